@@ -0,0 +1,343 @@
+package bannerprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	pkghttpprobe "github.com/internetworklab/cloudping/pkg/httpprobe"
+	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
+)
+
+const (
+	defaultTimeout  = 5 * time.Second
+	defaultMaxBytes = 1024
+	MaxMaxBytes     = 64 * 1024
+	MaxPayloadSize  = 4 * 1024
+
+	// Once the first bytes arrived, the banner is considered complete when nothing more arrives within this long,
+	// since most services send a line or two and then wait for the client.
+	bannerIdleTimeout = 500 * time.Millisecond
+
+	// Sent in EHLO when doing STARTTLS
+	smtpClientName = "cloudping.invalid"
+)
+
+// BannerProbe connects to a TCP port, optionally sends a payload, and reads what the service says first,
+// e.g. the greeting of an SMTP, SSH or FTP server.
+type BannerProbe struct {
+	// host:port, e.g. 'smtp.example.com:25'
+	Target string `json:"target"`
+
+	// Sent right after connecting, at most one of payload and payloadBase64 could be present,
+	// e.g. "HEAD / HTTP/1.0\r\n\r\n" for services that wait for the client to speak first
+	Payload       *string `json:"payload,omitempty"`
+	PayloadBase64 *string `json:"payloadBase64,omitempty"`
+
+	// When true, after reading the SMTP greeting, EHLO and STARTTLS are sent and the TLS handshake is done, can't be used with a payload
+	StartTLS bool `json:"startTLS,omitempty"`
+
+	// How many bytes of the banner to read at most, default is 1024
+	MaxBytes int `json:"maxBytes,omitempty"`
+
+	// Of the connect, and of the wait for the banner, each, default is 5000
+	TimeoutMs *int `json:"timeoutMs,omitempty"`
+
+	Resolver *string                            `json:"resolver,omitempty"`
+	IPPref   *pkghttpprobe.InetFamilyPreference `json:"inetFamilyPreference,omitempty"`
+
+	CorrelationID string `json:"correlationId,omitempty"`
+
+	// list of paths to additional CAs to trust in addition to the system's default CAs
+	AddCA []string
+}
+
+type StartTLSResult struct {
+	// Whether STARTTLS is in the response of EHLO
+	Advertised bool `json:"advertised"`
+	// The response of STARTTLS, e.g. '220 2.0.0 Ready to start TLS'
+	Response     string        `json:"response,omitempty"`
+	TLSHandshake time.Duration `json:"tls_handshake,omitempty"`
+	// The chain is verified against the name of the target, a failing one is reported here rather than aborting the probe
+	TLS   *pkghttpprobe.TLSInspection `json:"tls,omitempty"`
+	Error string                      `json:"error,omitempty"`
+}
+
+type BannerProbeResult struct {
+	CorrelationID string    `json:"correlationId"`
+	Target        string    `json:"target"`
+	RemoteAddr    string    `json:"remote_addr,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+
+	Connect time.Duration `json:"connect"`
+	// From the connection being established, to the first byte of the banner
+	TimeToBanner time.Duration `json:"time_to_banner,omitempty"`
+
+	// With the control characters and invalid UTF-8 sequences escaped
+	Banner      string `json:"banner"`
+	BannerBytes int    `json:"banner_bytes"`
+	Truncated   bool   `json:"truncated,omitempty"`
+
+	StartTLS *StartTLSResult `json:"starttls,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// GetPayload returns nil when the probe has no payload
+func (probe *BannerProbe) GetPayload() ([]byte, error) {
+	if probe.Payload != nil && probe.PayloadBase64 != nil {
+		return nil, fmt.Errorf("payload and payloadBase64 can't be both present")
+	}
+	var payload []byte
+	if probe.Payload != nil {
+		payload = []byte(*probe.Payload)
+	} else if probe.PayloadBase64 != nil {
+		decoded, err := base64.StdEncoding.DecodeString(*probe.PayloadBase64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64 payload: %w", err)
+		}
+		payload = decoded
+	} else {
+		return nil, nil
+	}
+	if len(payload) > MaxPayloadSize {
+		return nil, fmt.Errorf("payload of %d bytes exceeds the limit of %d bytes", len(payload), MaxPayloadSize)
+	}
+	return payload, nil
+}
+
+func (probe *BannerProbe) Validate() error {
+	if err := pkgutils.ValidateHostPort(probe.Target, ""); err != nil {
+		return err
+	}
+	if probe.MaxBytes < 0 || probe.MaxBytes > MaxMaxBytes {
+		return fmt.Errorf("max bytes must be within 0 and %d, got %d", MaxMaxBytes, probe.MaxBytes)
+	}
+	payload, err := probe.GetPayload()
+	if err != nil {
+		return err
+	}
+	if probe.StartTLS && payload != nil {
+		return fmt.Errorf("startTLS can't be used with a payload")
+	}
+	return nil
+}
+
+func (probe *BannerProbe) getTimeout() time.Duration {
+	if probe.TimeoutMs == nil || *probe.TimeoutMs <= 0 {
+		return defaultTimeout
+	}
+	return time.Duration(*probe.TimeoutMs) * time.Millisecond
+}
+
+// SanitizeBanner escapes what shouldn't be shown as is, CRLF line endings become LF, tabs and line feeds are kept.
+func SanitizeBanner(banner []byte) string {
+	sb := strings.Builder{}
+	for len(banner) > 0 {
+		r, size := utf8.DecodeRune(banner)
+		switch {
+		case r == utf8.RuneError && size <= 1:
+			fmt.Fprintf(&sb, "\\x%02x", banner[0])
+		case r == '\r' && len(banner) > 1 && banner[1] == '\n':
+			// dropped, the line feed follows
+		case r == '\n' || r == '\t':
+			sb.WriteRune(r)
+		case !unicode.IsPrint(r) && r != ' ':
+			if r < utf8.RuneSelf {
+				fmt.Fprintf(&sb, "\\x%02x", r)
+			} else {
+				fmt.Fprintf(&sb, "\\u%04x", r)
+			}
+		default:
+			sb.WriteRune(r)
+		}
+		banner = banner[size:]
+	}
+	return sb.String()
+}
+
+// isSMTPReplyComplete tells whether the last line of the reply is the final one, e.g. '220 mx.example.com ESMTP\r\n'
+func isSMTPReplyComplete(reply []byte) bool {
+	lines := strings.Split(strings.TrimRight(string(reply), "\r\n"), "\n")
+	last := lines[len(lines)-1]
+	return strings.HasSuffix(string(reply), "\n") && len(last) >= 4 && last[3] == ' '
+}
+
+// readBanner reads until maxBytes, EOF, the deadline, or the idle timeout after the first bytes, the time of the first byte is returned
+func readBanner(conn net.Conn, maxBytes int, deadline time.Time, isComplete func([]byte) bool) ([]byte, time.Time, error) {
+	banner := make([]byte, 0, maxBytes)
+	buf := make([]byte, maxBytes)
+	var firstByteAt time.Time
+	conn.SetReadDeadline(deadline)
+	for len(banner) < maxBytes {
+		n, err := conn.Read(buf[:maxBytes-len(banner)])
+		if n > 0 {
+			if firstByteAt.IsZero() {
+				firstByteAt = time.Now()
+			}
+			banner = append(banner, buf[:n]...)
+			if isComplete != nil && isComplete(banner) {
+				break
+			}
+			conn.SetReadDeadline(time.Now().Add(bannerIdleTimeout))
+		}
+		if err != nil {
+			// the idle timeout is how a banner normally ends
+			if len(banner) > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			return banner, firstByteAt, err
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	return banner, firstByteAt, nil
+}
+
+func (probe *BannerProbe) doStartTLS(conn net.Conn, host string) *StartTLSResult {
+	result := &StartTLSResult{}
+	conn.SetDeadline(time.Now().Add(probe.getTimeout()))
+	text := textproto.NewConn(conn)
+
+	if _, err := text.Cmd("EHLO %s", smtpClientName); err != nil {
+		result.Error = fmt.Sprintf("failed to send EHLO: %v", err)
+		return result
+	}
+	_, ehloResponse, err := text.ReadResponse(250)
+	if err != nil {
+		result.Error = fmt.Sprintf("EHLO failed: %v", err)
+		return result
+	}
+	for _, line := range strings.Split(ehloResponse, "\n") {
+		if strings.EqualFold(strings.TrimSpace(line), "STARTTLS") {
+			result.Advertised = true
+		}
+	}
+	if !result.Advertised {
+		result.Error = "STARTTLS is not advertised"
+		return result
+	}
+
+	if _, err := text.Cmd("STARTTLS"); err != nil {
+		result.Error = fmt.Sprintf("failed to send STARTTLS: %v", err)
+		return result
+	}
+	code, msg, err := text.ReadResponse(220)
+	result.Response = fmt.Sprintf("%d %s", code, msg)
+	if err != nil {
+		result.Error = fmt.Sprintf("STARTTLS is refused: %v", err)
+		return result
+	}
+
+	serverName := host
+	if net.ParseIP(host) != nil {
+		serverName = ""
+	}
+	rootCAs, err := pkgutils.LoadRootCAs(probe.AddCA)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	// the chain is verified by InspectTLS after the handshake
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	handshakeStartedAt := time.Now()
+	if err := tlsConn.Handshake(); err != nil {
+		result.Error = fmt.Sprintf("failed to handshake: %v", err)
+		return result
+	}
+	result.TLSHandshake = time.Since(handshakeStartedAt)
+	state := tlsConn.ConnectionState()
+	result.TLS = pkghttpprobe.InspectTLS(&state, host, rootCAs)
+	tlsConn.Write([]byte("QUIT\r\n"))
+	return result
+}
+
+func (probe *BannerProbe) Do(ctx context.Context) *BannerProbeResult {
+	result := &BannerProbeResult{
+		CorrelationID: probe.CorrelationID,
+		Target:        probe.Target,
+		StartedAt:     time.Now(),
+	}
+
+	payload, err := probe.GetPayload()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	host, port, err := net.SplitHostPort(probe.Target)
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid target %s, expected host:port: %v", probe.Target, err)
+		return result
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, probe.getTimeout())
+	defer cancel()
+	ip, err := pkgutils.LookupFirstIP(connectCtx, probe.Resolver, probe.IPPref, host)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	dialer := &net.Dialer{}
+	connectStartedAt := time.Now()
+	conn, err := dialer.DialContext(connectCtx, "tcp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to connect to %s: %v", probe.Target, err)
+		return result
+	}
+	defer conn.Close()
+	connectedAt := time.Now()
+	result.Connect = connectedAt.Sub(connectStartedAt)
+	result.RemoteAddr = conn.RemoteAddr().String()
+
+	// the connection outlives connectCtx, so the cancellation of ctx is forwarded by closing it
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if payload != nil {
+		conn.SetWriteDeadline(time.Now().Add(probe.getTimeout()))
+		if _, err := conn.Write(payload); err != nil {
+			result.Error = fmt.Sprintf("failed to send payload: %v", err)
+			return result
+		}
+	}
+
+	maxBytes := probe.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultMaxBytes
+	}
+	var isComplete func([]byte) bool
+	if probe.StartTLS {
+		isComplete = isSMTPReplyComplete
+	}
+	banner, firstByteAt, err := readBanner(conn, maxBytes, time.Now().Add(probe.getTimeout()), isComplete)
+	if !firstByteAt.IsZero() {
+		result.TimeToBanner = firstByteAt.Sub(connectedAt)
+	}
+	result.Banner = SanitizeBanner(banner)
+	result.BannerBytes = len(banner)
+	result.Truncated = len(banner) >= maxBytes
+	if err != nil {
+		if len(banner) == 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			result.Error = "no banner received within the timeout"
+		} else if !errors.Is(err, io.EOF) || len(banner) == 0 {
+			result.Error = fmt.Sprintf("failed to read banner: %v", err)
+		}
+		return result
+	}
+
+	if probe.StartTLS {
+		result.StartTLS = probe.doStartTLS(conn, host)
+	}
+	return result
+}
@@ -0,0 +1,104 @@
+package bannerprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSanitizeBanner(t *testing.T) {
+	cases := map[string]string{
+		"SSH-2.0-OpenSSH_9.6\r\n":            "SSH-2.0-OpenSSH_9.6\n",
+		"220 ready\r\n\x1b[31mred\x00\tok\r": "220 ready\n\\x1b[31mred\\x00\tok\\x0d",
+		"caf\xc3\xa9 \xff\xfe":               "café \\xff\\xfe",
+		"‮evil":                              "\\u202eevil",
+	}
+	for input, expected := range cases {
+		if got := SanitizeBanner([]byte(input)); got != expected {
+			t.Errorf("expected %q for %q, got %q", expected, input, got)
+		}
+	}
+}
+
+func TestIsSMTPReplyComplete(t *testing.T) {
+	cases := map[string]bool{
+		"220 mx.example.com ESMTP\r\n":              true,
+		"220-mx.example.com ESMTP\r\n":              false,
+		"220-mx.example.com\r\n220 ESMTP ready\r\n": true,
+		"220 mx.example.com ESM":                    false,
+	}
+	for input, expected := range cases {
+		if got := isSMTPReplyComplete([]byte(input)); got != expected {
+			t.Errorf("expected %v for %q, got %v", expected, input, got)
+		}
+	}
+}
+
+// serves an SMTP greeting and STARTTLS with the certificate of an httptest server, which is valid for 127.0.0.1
+func newTestSMTPServer(t *testing.T) (string, string) {
+	t.Helper()
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(tlsServer.Close)
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	if err := os.WriteFile(caPath, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				text := textproto.NewConn(conn)
+				text.PrintfLine("220 mx.example.com ESMTP")
+				text.ReadLine()
+				text.PrintfLine("250-mx.example.com\r\n250 STARTTLS")
+				text.ReadLine()
+				text.PrintfLine("220 2.0.0 Ready to start TLS")
+				tlsConn := tls.Server(conn, tlsServer.TLS)
+				tlsConn.Handshake()
+				io.Copy(io.Discard, tlsConn)
+			}()
+		}
+	}()
+	return ln.Addr().String(), caPath
+}
+
+func TestStartTLS(t *testing.T) {
+	target, caPath := newTestSMTPServer(t)
+
+	probe := &BannerProbe{Target: target, StartTLS: true}
+	result := probe.Do(context.Background())
+	if result.Error != "" || result.StartTLS == nil || result.StartTLS.Error != "" {
+		t.Fatalf("unexpected result %+v, starttls %+v", result, result.StartTLS)
+	}
+	if tlsInspection := result.StartTLS.TLS; tlsInspection == nil || tlsInspection.Verified || tlsInspection.VerifyError == "" {
+		t.Errorf("expected the chain to fail the verification, got %+v", tlsInspection)
+	}
+
+	probe.AddCA = []string{caPath}
+	result = probe.Do(context.Background())
+	if result.StartTLS == nil || result.StartTLS.TLS == nil || !result.StartTLS.TLS.Verified {
+		t.Fatalf("expected the chain to be verified, got %+v", result.StartTLS)
+	}
+	if result.StartTLS.TLS.DaysUntilExpiry <= 0 {
+		t.Errorf("expected the days until expiry to be reported, got %d", result.StartTLS.TLS.DaysUntilExpiry)
+	}
+}
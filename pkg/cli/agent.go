@@ -24,6 +24,8 @@ import (
 	pkgnodereg "github.com/internetworklab/cloudping/pkg/nodereg"
 	pkgratelimit "github.com/internetworklab/cloudping/pkg/ratelimit"
 	pkgrouting "github.com/internetworklab/cloudping/pkg/routing"
+	pkgstunprobe "github.com/internetworklab/cloudping/pkg/stunprobe"
+	pkgthroughput "github.com/internetworklab/cloudping/pkg/throughput"
 	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -111,7 +113,12 @@ type AgentCmd struct {
 	SupportTCP            bool     `help:"Declare supportness for TCP-flavored ping" default:"true"`
 	SupportDNS            bool     `help:"Declare supportness for DNS probing" default:"true"`
 	SupportHTTP           bool     `name:"support-http" help:"Declare supportness for HTTP probing" default:"true"`
+	SupportNTP            bool     `name:"support-ntp" help:"Declare supportness for NTP probing" default:"true"`
+	SupportBanner         bool     `name:"support-banner" help:"Declare supportness for TCP banner probing" default:"false"`
+	SupportThroughput     bool     `name:"support-throughput" help:"Declare supportness for throughput tests, the receiver is served on the HTTP endpoint, so the agent is only the sender when there is none" default:"true"`
+	STUNServer            string   `name:"stun-server" help:"STUN server to discover the NAT mapping and filtering behaviors with on startup, the result is announced as a node attribute, e.g. stun.example.com:3478, disabled when empty"`
 	HTTPProbeAdditionalCA []string `name:"http-probe-add-ca" help:"CAs to trust in addition to the systems' default CA store when doing DNS probe (DoT) or HTTP probe"`
+	Resolver              string   `help:"The resolver to use for resolving target names when the request doesn't specify one, e.g. 8.8.8.8:53, could also be a tls://, https:// or quic:// URI, e.g. tls://1.1.1.1, https://dns.google/dns-query, quic://dns.adguard-dns.com"`
 
 	// Some Debugging features
 	LogEchoReplies bool `help:"Log echo replies" default:"false"`
@@ -358,13 +365,33 @@ func (agentCmd *AgentCmd) Run(sharedCtx *pkgutils.GlobalSharedContext) error {
 		RespondRange:          respondRangeNet,
 		DomainRespondRange:    domaonRespondRange,
 		HTTPProbeAdditionalCA: agentCmd.HTTPProbeAdditionalCA,
+		Resolver:              agentCmd.Resolver,
+		ThroughputSender:      agentCmd.SupportThroughput,
 	}
 
+	// when sending to another agent's receiver, the agent is the client, so it presents its client cert
+	throughputClientTLSCfg := &tls.Config{}
+	if customCAs != nil {
+		throughputClientTLSCfg.RootCAs = customCAs
+	}
+	if agentCmd.ClientCert != "" && agentCmd.ClientCertKey != "" {
+		cert, err := tls.LoadX509KeyPair(agentCmd.ClientCert, agentCmd.ClientCertKey)
+		if err != nil {
+			log.Fatalf("failed to load client certificate: %v", err)
+		}
+		throughputClientTLSCfg.Certificates = []tls.Certificate{cert}
+	}
+	handler.ThroughputClientTLSConfig = throughputClientTLSCfg
+
 	muxer := http.NewServeMux()
 	muxer.Handle("/simpleping", handler)
 	muxer.Handle("/tcping", handler)
 	muxer.Handle("/dnsprobe", handler)
 	muxer.Handle("/version", pkghandler.NewVersionHandler(sharedCtx))
+	if agentCmd.SupportThroughput && agentCmd.HttpEndpoint != "" {
+		handler.ThroughputReceiver = pkgthroughput.NewReceiver()
+		muxer.Handle(pkgthroughput.ReceiverPath, handler.ThroughputReceiver)
+	}
 
 	var muxedHandler http.Handler = muxer
 	muxedHandler = pkgmyprom.WithCounterStoreHandler(muxedHandler, counterStore)
@@ -565,10 +592,45 @@ func (agentCmd *AgentCmd) Run(sharedCtx *pkgutils.GlobalSharedContext) error {
 				attributes[pkgnodereg.AttributeKeyHTTPProbeCapability] = "true"
 			}
 
+			if agentCmd.SupportNTP {
+				attributes[pkgnodereg.AttributeKeyNTPProbeCapability] = "true"
+			}
+
+			if agentCmd.SupportBanner {
+				attributes[pkgnodereg.AttributeKeyBannerProbeCapability] = "true"
+			}
+
 			if quicAddr := agentCmd.QUICServerAddress; quicAddr != "" {
 				attributes[pkgnodereg.AttributeKeySupportQUICTunnel] = "true"
 			}
 
+			if handler.ThroughputReceiver != nil {
+				attributes[pkgnodereg.AttributeKeyThroughputCapability] = "true"
+			}
+
+			if handler.ThroughputSender {
+				attributes[pkgnodereg.AttributeKeyThroughputSenderCapability] = "true"
+			}
+
+			if stunServer := agentCmd.STUNServer; stunServer != "" {
+				stunProbe := &pkgstunprobe.STUNProbe{Target: stunServer, DiscoverBehavior: true}
+				if agentCmd.Resolver != "" {
+					stunProbe.Resolver = &agentCmd.Resolver
+				}
+				if err := stunProbe.Validate(); err != nil {
+					log.Fatalf("invalid stun server %s: %v", stunServer, err)
+				}
+				stunCtx, stunCancel := context.WithTimeout(ctx, 15*time.Second)
+				stunResult := stunProbe.Do(stunCtx)
+				stunCancel()
+				if stunResult.Error != "" {
+					log.Printf("Failed to discover NAT behaviors with stun server %s: %s", stunServer, stunResult.Error)
+				}
+				stunResultJ, _ := json.Marshal(stunResult)
+				log.Printf("Advertising NAT discovery result: %s", string(stunResultJ))
+				attributes[pkgnodereg.AttributeKeyNATDiscovery] = string(stunResultJ)
+			}
+
 			versionJ, _ := json.Marshal(sharedCtx.BuildVersion)
 			attributes[pkgnodereg.AttributeKeyVersion] = string(versionJ)
 
@@ -45,12 +45,18 @@ type HubCmd struct {
 	ServerCert    string   `help:"The path to the server certificate" type:"path"`
 	ServerCertKey string   `help:"The path to the server certificate key" type:"path"`
 
-	ResolverAddress         string `help:"The address of the resolver to use for DNS resolution" default:"172.20.0.53:53"`
-	OutOfRespondRangePolicy string `help:"The policy to apply when a target is out of the respond range of a node" enum:"allow,deny" default:"allow"`
-	MinPktInterval          string `help:"The minimum interval between packets"`
-	MaxPktTimeout           string `help:"The maximum timeout for a packet"`
-	PktCountClamp           *int   `help:"The maximum number of packets to send for a single ping task"`
-	HTTPResponseBodyClamp   *int   `name:"http-response-body-clamp" help:"To restrict the maximum http body size to read in unit of bytes when such limit didn't appear in the requesting HTTP probe task"`
+	ResolverAddress         string   `aliases:"resolver" help:"The address of the resolver to use for DNS resolution, e.g. 172.20.0.53:53, could also be a tls://, https:// or quic:// URI, e.g. tls://1.1.1.1, https://dns.google/dns-query" default:"172.20.0.53:53"`
+	OutOfRespondRangePolicy string   `help:"The policy to apply when a target is out of the respond range of a node" enum:"allow,deny" default:"allow"`
+	MinPktInterval          string   `help:"The minimum interval between packets"`
+	MaxPktTimeout           string   `help:"The maximum timeout for a packet"`
+	PktCountClamp           *int     `help:"The maximum number of packets to send for a single ping task"`
+	HTTPResponseBodyClamp   *int     `name:"http-response-body-clamp" help:"To restrict the maximum http body size to read in unit of bytes when such limit didn't appear in the requesting HTTP probe task"`
+	HTTPRequestBodyClamp    *int     `name:"http-request-body-clamp" help:"To restrict the maximum size of the request body of HTTP probe tasks in unit of bytes, tasks with larger bodies are rejected"`
+	ThroughputBytesClamp    *int64   `name:"throughput-bytes-clamp" help:"The maximum number of bytes a throughput test could transfer, tests asking for more are lowered to it"`
+	ThroughputDurationClamp string   `name:"throughput-duration-clamp" help:"The maximum duration of a throughput test, e.g. 5s, tests asking for longer are lowered to it"`
+	HTTPAllowedMethods      []string `name:"http-allowed-methods" help:"HTTP methods allowed in HTTP probe tasks, tasks using other methods are rejected, the ones with side effects, e.g. POST, PUT, PATCH and DELETE, have to be opted in" default:"GET,HEAD,OPTIONS"`
+
+	DNSDivergenceIPInfoProvider string `name:"dns-divergence-ipinfo-provider" help:"Name of the ipinfo provider used to annotate the answers in the DNS divergence report, when the request doesn't specify one" default:"ip2location"`
 
 	JWTAuthSecretFromEnv  string        `name:"jwt-auth-secret-from-env" help:"Name of the environment variable that contains the JWT secret"`
 	JWTAuthSecretFromFile string        `name:"jwt-auth-secret-from-file" help:"Path to the file that contains the JWT secret"`
@@ -207,6 +213,16 @@ func (hubCmd HubCmd) Run(sharedCtx *pkgutils.GlobalSharedContext) error {
 		log.Printf("PktCountClamp is set to %d", *hubCmd.PktCountClamp)
 	}
 
+	var throughputDurationClamp *time.Duration
+	if hubCmd.ThroughputDurationClamp != "" {
+		d, err := time.ParseDuration(hubCmd.ThroughputDurationClamp)
+		if err != nil {
+			return fmt.Errorf("failed to parse throughput duration clamp: %v", err)
+		}
+		log.Printf("Parsed throughput duration clamp: %s", d.String())
+		throughputDurationClamp = &d
+	}
+
 	customCAs, err := pkgutils.NewCustomCAPool(hubCmd.PeerCA)
 	if err != nil {
 		log.Fatalf("Failed to create custom CA pool: %v", err)
@@ -290,7 +306,7 @@ func (hubCmd HubCmd) Run(sharedCtx *pkgutils.GlobalSharedContext) error {
 		return fmt.Errorf("failed to get JWT secret: %v", err)
 	}
 
-	var pingHandler http.Handler = &pkghandler.PingTaskHandler{
+	pingTaskHandler := &pkghandler.PingTaskHandler{
 		ConnRegistry:            cr,
 		ClientTLSConfig:         clientTLSConfig,
 		Resolver:                resolver,
@@ -299,7 +315,14 @@ func (hubCmd HubCmd) Run(sharedCtx *pkgutils.GlobalSharedContext) error {
 		MaxPktTimeout:           maxPktTimeout,
 		PktCountClamp:           hubCmd.PktCountClamp,
 		HTTPResponseBodyClamp:   hubCmd.HTTPResponseBodyClamp,
+		HTTPRequestBodyClamp:    hubCmd.HTTPRequestBodyClamp,
+		HTTPAllowedMethods:      hubCmd.HTTPAllowedMethods,
+		ThroughputBytesClamp:    hubCmd.ThroughputBytesClamp,
+		ThroughputDurationClamp: throughputDurationClamp,
+
+		DNSDivergenceIPInfoProvider: hubCmd.DNSDivergenceIPInfoProvider,
 	}
+	var pingHandler http.Handler = pingTaskHandler
 
 	ip2locProxyHandler := &pkgproxy.IP2LocationProxyHandler{
 		Requestor: &pkgipinfo.IP2LocationIPInfoAdapter{
@@ -337,6 +360,7 @@ func (hubCmd HubCmd) Run(sharedCtx *pkgutils.GlobalSharedContext) error {
 	if err != nil {
 		return err
 	}
+	pingTaskHandler.IPInfoReg = ipInfoProvidersRegistry
 	ipQueryDirectoryHandler := &pkgproxy.IPQueryDirectoryHandler{
 		IPInfoProvidersRegistry: ipInfoProvidersRegistry,
 	}
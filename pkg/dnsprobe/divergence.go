@@ -0,0 +1,348 @@
+package dnsprobe
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	pkgipinfo "github.com/internetworklab/cloudping/pkg/ipinfo"
+)
+
+type DivergenceFlag string
+
+const (
+	DivergenceFlagBogon        DivergenceFlag = "bogon"
+	DivergenceFlagPrivate      DivergenceFlag = "private"
+	DivergenceFlagDifferentASN DivergenceFlag = "different_asn"
+	DivergenceFlagNXDomain     DivergenceFlag = "nxdomain"
+	DivergenceFlagLowTTL       DivergenceFlag = "low_ttl"
+)
+
+const (
+	// an answer with TTL not greater than this is considered suspicious,
+	// if the other agents typically see TTLs of at least divergenceNormalTTL
+	divergenceLowTTL    = 10
+	divergenceNormalTTL = 60
+
+	// shared by the lookups of all the addresses seen, rather than per address
+	divergenceIPInfoTimeout = 5 * time.Second
+	// upper bound of the number of lookups in flight
+	divergenceIPInfoConcurrency = 8
+
+	// used as the rcode of a cluster, when there is no response at all
+	divergenceRcodeTimeout = "TIMEOUT"
+	divergenceRcodeError   = "ERROR"
+)
+
+var privatePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+}
+
+// Addresses that are never expected to be seen in a public DNS answer, see RFC6890
+var bogonPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type IPAnnotation struct {
+	IP      string `json:"ip"`
+	ASN     string `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"`
+	Bogon   bool   `json:"bogon,omitempty"`
+	Private bool   `json:"private,omitempty"`
+}
+
+type AnswerCluster struct {
+	Rcode   string   `json:"rcode"`
+	Answers []string `json:"answers"`
+	ASNs    []string `json:"asns,omitempty"`
+	Agents  []string `json:"agents"`
+}
+
+type DivergenceOutlier struct {
+	Agent   string           `json:"agent"`
+	Flags   []DivergenceFlag `json:"flags"`
+	Reasons []string         `json:"reasons"`
+}
+
+// DNSDivergenceReport compares the results of the same query (i.e. the same correlation id) seen by different agents
+type DNSDivergenceReport struct {
+	CorrelationID string              `json:"corrId,omitempty"`
+	Server        string              `json:"server"`
+	Target        string              `json:"target"`
+	QueryType     DNSQueryType        `json:"query_type"`
+	NumAgents     int                 `json:"num_agents"`
+	Divergent     bool                `json:"divergent"`
+	Clusters      []AnswerCluster     `json:"clusters"`
+	IPInfo        []IPAnnotation      `json:"ipinfo,omitempty"`
+	Outliers      []DivergenceOutlier `json:"outliers,omitempty"`
+}
+
+type DNSDivergenceSummary struct {
+	Reports []DNSDivergenceReport `json:"dnsDivergence"`
+}
+
+func getResultRcode(result *QueryResult) string {
+	if result.Rcode != "" {
+		return result.Rcode
+	}
+	if result.IOTimeout {
+		return divergenceRcodeTimeout
+	}
+	return divergenceRcodeError
+}
+
+func annotateIP(ctx context.Context, addr netip.Addr, ipinfoAdapter pkgipinfo.GeneralIPInfoAdapter) IPAnnotation {
+	annotation := IPAnnotation{
+		IP:      addr.String(),
+		Private: containsAddr(privatePrefixes, addr),
+		Bogon:   containsAddr(bogonPrefixes, addr),
+	}
+	if ipinfoAdapter == nil || annotation.Private || annotation.Bogon {
+		return annotation
+	}
+
+	info, err := ipinfoAdapter.GetIPInfo(ctx, addr.String())
+	if err != nil {
+		log.Printf("Failed to get ipinfo of %s: %v", addr.String(), err)
+		return annotation
+	}
+	if info != nil {
+		annotation.ASN = info.ASN
+		annotation.Org = info.ISP
+	}
+	return annotation
+}
+
+// annotateIPs annotates each of the distinct addresses, the lookups run concurrently and share the timeout,
+// the addresses whose lookups don't finish in time are annotated without ipinfo
+func annotateIPs(ctx context.Context, addrs []netip.Addr, ipinfoAdapter pkgipinfo.GeneralIPInfoAdapter, timeout time.Duration) map[string]IPAnnotation {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// buffered, so that the lookups finishing after the deadline don't block
+	annotationChan := make(chan IPAnnotation, len(addrs))
+	sem := make(chan struct{}, divergenceIPInfoConcurrency)
+	for _, addr := range addrs {
+		go func(addr netip.Addr) {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+				annotationChan <- annotateIP(ctx, addr, ipinfoAdapter)
+			case <-ctx.Done():
+				annotationChan <- annotateIP(ctx, addr, nil)
+			}
+		}(addr)
+	}
+
+	annotations := make(map[string]IPAnnotation, len(addrs))
+	for range addrs {
+		select {
+		case annotation := <-annotationChan:
+			annotations[annotation.IP] = annotation
+		case <-ctx.Done():
+			for _, addr := range addrs {
+				if _, ok := annotations[addr.String()]; !ok {
+					annotations[addr.String()] = annotateIP(ctx, addr, nil)
+				}
+			}
+			return annotations
+		}
+	}
+	return annotations
+}
+
+func getMedian(values []uint32) uint32 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	return sorted[len(sorted)/2]
+}
+
+// AnalyzeDNSDivergence clusters the results by answer set, and flags the agents that see something different from the others,
+// results is keyed by agent name, all results are expected to be of the same query. ipinfoAdapter is optional.
+func AnalyzeDNSDivergence(ctx context.Context, results map[string]*QueryResult, ipinfoAdapter pkgipinfo.GeneralIPInfoAdapter) DNSDivergenceReport {
+	report := DNSDivergenceReport{NumAgents: len(results)}
+
+	agents := make([]string, 0, len(results))
+	for agent := range results {
+		agents = append(agents, agent)
+	}
+	sort.Strings(agents)
+
+	addrs := make([]netip.Addr, 0)
+	for _, result := range results {
+		for _, ans := range result.AnswerStrings {
+			if addr, err := netip.ParseAddr(ans); err == nil && !slices.Contains(addrs, addr) {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	annotations := annotateIPs(ctx, addrs, ipinfoAdapter, divergenceIPInfoTimeout)
+
+	agentASNs := make(map[string][]string)
+	clusters := make(map[string]*AnswerCluster)
+	clusterKeys := make([]string, 0)
+	numSucceeded := 0
+	ttls := make([]uint32, 0)
+	for _, agent := range agents {
+		result := results[agent]
+		if report.Target == "" {
+			report.CorrelationID = result.CorrelationID
+			report.Server = result.Server
+			report.Target = result.Target
+			report.QueryType = result.QueryType
+		}
+
+		rcode := getResultRcode(result)
+		answers := slices.Clone(result.AnswerStrings)
+		slices.Sort(answers)
+		if rcode == "NOERROR" && len(answers) > 0 {
+			numSucceeded++
+		}
+		if result.MinTTL != nil {
+			ttls = append(ttls, *result.MinTTL)
+		}
+
+		asns := make([]string, 0)
+		for _, ans := range answers {
+			addr, err := netip.ParseAddr(ans)
+			if err != nil {
+				continue
+			}
+			annotation := annotations[addr.String()]
+			if annotation.ASN != "" && !slices.Contains(asns, annotation.ASN) {
+				asns = append(asns, annotation.ASN)
+			}
+		}
+		slices.Sort(asns)
+		agentASNs[agent] = asns
+
+		key := rcode + "|" + strings.Join(answers, ",")
+		cluster, ok := clusters[key]
+		if !ok {
+			cluster = &AnswerCluster{Rcode: rcode, Answers: answers, ASNs: asns}
+			clusters[key] = cluster
+			clusterKeys = append(clusterKeys, key)
+		}
+		cluster.Agents = append(cluster.Agents, agent)
+	}
+
+	for _, key := range clusterKeys {
+		report.Clusters = append(report.Clusters, *clusters[key])
+	}
+	sort.SliceStable(report.Clusters, func(i, j int) bool {
+		return len(report.Clusters[i].Agents) > len(report.Clusters[j].Agents)
+	})
+	report.Divergent = len(report.Clusters) > 1
+
+	for _, annotation := range annotations {
+		report.IPInfo = append(report.IPInfo, annotation)
+	}
+	sort.Slice(report.IPInfo, func(i, j int) bool { return report.IPInfo[i].IP < report.IPInfo[j].IP })
+
+	// ASNs seen by at least half of the agents which got any ASN at all
+	numAgentsWithASN := 0
+	asnCount := make(map[string]int)
+	for _, asns := range agentASNs {
+		if len(asns) > 0 {
+			numAgentsWithASN++
+		}
+		for _, asn := range asns {
+			asnCount[asn]++
+		}
+	}
+	commonASNs := make([]string, 0)
+	for asn, count := range asnCount {
+		if numAgentsWithASN >= 2 && count*2 >= numAgentsWithASN {
+			commonASNs = append(commonASNs, asn)
+		}
+	}
+	slices.Sort(commonASNs)
+
+	medianTTL := getMedian(ttls)
+	for _, agent := range agents {
+		result := results[agent]
+		outlier := DivergenceOutlier{Agent: agent}
+		flag := func(f DivergenceFlag, reason string) {
+			outlier.Flags = append(outlier.Flags, f)
+			outlier.Reasons = append(outlier.Reasons, reason)
+		}
+
+		for _, ans := range result.AnswerStrings {
+			addr, err := netip.ParseAddr(ans)
+			if err != nil {
+				continue
+			}
+			annotation := annotations[addr.String()]
+			if annotation.Bogon {
+				flag(DivergenceFlagBogon, fmt.Sprintf("answer %s is a bogon address", ans))
+			}
+			if annotation.Private {
+				flag(DivergenceFlagPrivate, fmt.Sprintf("answer %s is a private address", ans))
+			}
+		}
+
+		if asns := agentASNs[agent]; len(asns) > 0 && len(commonASNs) > 0 {
+			overlapped := false
+			for _, asn := range asns {
+				if slices.Contains(commonASNs, asn) {
+					overlapped = true
+					break
+				}
+			}
+			if !overlapped {
+				flag(DivergenceFlagDifferentASN, fmt.Sprintf("answers are in %s, while most agents see %s", strings.Join(asns, ","), strings.Join(commonASNs, ",")))
+			}
+		}
+
+		if result.NoSuchHost && numSucceeded > 0 {
+			flag(DivergenceFlagNXDomain, fmt.Sprintf("got NXDOMAIN, while %d agent(s) got answers", numSucceeded))
+		}
+
+		if result.MinTTL != nil && *result.MinTTL <= divergenceLowTTL && medianTTL >= divergenceNormalTTL {
+			flag(DivergenceFlagLowTTL, fmt.Sprintf("TTL is %ds, while the median is %ds", *result.MinTTL, medianTTL))
+		}
+
+		if len(outlier.Flags) > 0 {
+			report.Outliers = append(report.Outliers, outlier)
+		}
+	}
+
+	return report
+}
@@ -0,0 +1,147 @@
+package dnsprobe
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	pkgipinfo "github.com/internetworklab/cloudping/pkg/ipinfo"
+)
+
+type testIPInfoAdapter map[string]string
+
+func (a testIPInfoAdapter) GetIPInfo(ctx context.Context, ip string) (*pkgipinfo.BasicIPInfo, error) {
+	return &pkgipinfo.BasicIPInfo{ASN: a[ip]}, nil
+}
+
+func (a testIPInfoAdapter) GetName() string {
+	return "test"
+}
+
+func newTestQueryResult(rcode string, ttl uint32, answers ...string) *QueryResult {
+	return &QueryResult{
+		Target:        "www.example.com",
+		QueryType:     DNSQueryTypeA,
+		Rcode:         rcode,
+		NoSuchHost:    rcode == "NXDOMAIN",
+		AnswerStrings: answers,
+		MinTTL:        &ttl,
+	}
+}
+
+func TestAnalyzeDNSDivergence(t *testing.T) {
+	results := map[string]*QueryResult{
+		"agent1": newTestQueryResult("NOERROR", 300, "203.0.114.1", "203.0.114.2"),
+		"agent2": newTestQueryResult("NOERROR", 120, "203.0.114.2", "203.0.114.1"),
+		"agent3": newTestQueryResult("NOERROR", 200, "203.0.114.1", "203.0.114.2"),
+		"agent4": newTestQueryResult("NOERROR", 1, "198.51.99.1"),
+		"agent5": newTestQueryResult("NOERROR", 300, "10.0.0.1"),
+		"agent6": newTestQueryResult("NXDOMAIN", 0),
+	}
+	results["agent6"].MinTTL = nil
+	adapter := testIPInfoAdapter{
+		"203.0.114.1": "AS65001",
+		"203.0.114.2": "AS65001",
+		"198.51.99.1": "AS65002",
+	}
+
+	report := AnalyzeDNSDivergence(context.Background(), results, adapter)
+	if !report.Divergent || len(report.Clusters) != 4 {
+		t.Fatalf("expected 4 clusters, got %+v", report.Clusters)
+	}
+	if got := report.Clusters[0].Agents; !slices.Equal(got, []string{"agent1", "agent2", "agent3"}) {
+		t.Fatalf("unexpected majority cluster: %v", got)
+	}
+
+	expected := map[string][]DivergenceFlag{
+		"agent4": {DivergenceFlagDifferentASN, DivergenceFlagLowTTL},
+		"agent5": {DivergenceFlagPrivate},
+		"agent6": {DivergenceFlagNXDomain},
+	}
+	if len(report.Outliers) != len(expected) {
+		t.Fatalf("unexpected outliers: %+v", report.Outliers)
+	}
+	for _, outlier := range report.Outliers {
+		if !slices.Equal(outlier.Flags, expected[outlier.Agent]) {
+			t.Fatalf("unexpected flags of %s: %v", outlier.Agent, outlier.Flags)
+		}
+	}
+}
+
+// counts the lookups of each ip, and never answers the lookups of the ips in hang until the context is done
+type testSlowIPInfoAdapter struct {
+	lock        sync.Mutex
+	lookups     map[string]int
+	inFlight    int
+	maxInFlight int
+	hang        []string
+}
+
+func (a *testSlowIPInfoAdapter) GetIPInfo(ctx context.Context, ip string) (*pkgipinfo.BasicIPInfo, error) {
+	a.lock.Lock()
+	a.lookups[ip]++
+	a.inFlight++
+	a.maxInFlight = max(a.maxInFlight, a.inFlight)
+	a.lock.Unlock()
+	defer func() {
+		a.lock.Lock()
+		a.inFlight--
+		a.lock.Unlock()
+	}()
+
+	if slices.Contains(a.hang, ip) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	time.Sleep(20 * time.Millisecond)
+	return &pkgipinfo.BasicIPInfo{ASN: "AS64500"}, nil
+}
+
+func (a *testSlowIPInfoAdapter) GetName() string {
+	return "slow"
+}
+
+func TestAnnotateIPs(t *testing.T) {
+	adapter := &testSlowIPInfoAdapter{lookups: make(map[string]int), hang: []string{"203.0.114.99"}}
+	addrs := make([]netip.Addr, 0)
+	for i := 1; i <= 3*divergenceIPInfoConcurrency; i++ {
+		addrs = append(addrs, netip.AddrFrom4([4]byte{203, 0, 114, byte(i)}))
+	}
+	addrs = append(addrs, netip.MustParseAddr("203.0.114.99"), netip.MustParseAddr("10.0.0.1"))
+
+	startedAt := time.Now()
+	annotations := annotateIPs(context.Background(), addrs, adapter, time.Second)
+	// the lookups run concurrently, one hanging lookup holds up the rest no longer than the timeout
+	if elapsed := time.Since(startedAt); elapsed > 2*time.Second {
+		t.Fatalf("expected the lookups to be bounded by the timeout, took %v", elapsed)
+	}
+
+	adapter.lock.Lock()
+	defer adapter.lock.Unlock()
+	if adapter.maxInFlight < 2 || adapter.maxInFlight > divergenceIPInfoConcurrency {
+		t.Fatalf("expected concurrent lookups of at most %d, got %d", divergenceIPInfoConcurrency, adapter.maxInFlight)
+	}
+	if len(annotations) != len(addrs) {
+		t.Fatalf("expected an annotation of each address, got %v", annotations)
+	}
+	for _, addr := range addrs {
+		annotation := annotations[addr.String()]
+		switch addr.String() {
+		case "10.0.0.1":
+			if !annotation.Private || adapter.lookups[addr.String()] != 0 {
+				t.Fatalf("expected the private address to be annotated without lookup, got %+v", annotation)
+			}
+		case "203.0.114.99":
+			if annotation.ASN != "" {
+				t.Fatalf("expected no ASN of the hanging lookup, got %+v", annotation)
+			}
+		default:
+			if annotation.ASN != "AS64500" || adapter.lookups[addr.String()] != 1 {
+				t.Fatalf("expected %s to be looked up once, got %+v after %d lookups", addr, annotation, adapter.lookups[addr.String()])
+			}
+		}
+	}
+}
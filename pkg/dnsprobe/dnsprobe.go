@@ -4,19 +4,19 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
 	"net"
-	"net/http"
 	"net/netip"
+	"net/url"
 	"os"
 	"strings"
 	"time"
+	"unicode"
 
 	"codeberg.org/miekg/dns"
 	"codeberg.org/miekg/dns/dnsutil"
-	quicHTTP3 "github.com/quic-go/quic-go/http3"
 )
 
 type Transport string
@@ -25,8 +25,9 @@ const (
 	TransportUDP   Transport = "udp"
 	TransportTCP   Transport = "tcp"
 	TransportTLS   Transport = "tls"    // DNS over TLS, defined by RFC7858
-	TransportHTTP2 Transport = "http/2" // RFC8484, HTTP/2, POST method, application/dns-message wire format
-	TransportHTTP3 Transport = "http/3" // RFC8484, HTTP/3, POST method, application/dns-message wire format
+	TransportHTTP2 Transport = "http/2" // RFC8484 over HTTP/2, see DoHMethod for how the query is sent
+	TransportHTTP3 Transport = "http/3" // RFC8484 over HTTP/3, see DoHMethod for how the query is sent
+	TransportQUIC  Transport = "quic"   // DNS over dedicated QUIC connections, defined by RFC9250
 )
 
 type DNSQueryType string
@@ -39,8 +40,53 @@ const (
 	DNSQueryTypeNS    DNSQueryType = "ns"
 	DNSQueryTypePTR   DNSQueryType = "ptr"
 	DNSQueryTypeTXT   DNSQueryType = "txt"
+
+	DNSQueryTypeSOA    DNSQueryType = "soa"
+	DNSQueryTypeSRV    DNSQueryType = "srv"
+	DNSQueryTypeCAA    DNSQueryType = "caa"
+	DNSQueryTypeDS     DNSQueryType = "ds"
+	DNSQueryTypeDNSKEY DNSQueryType = "dnskey"
+	DNSQueryTypeRRSIG  DNSQueryType = "rrsig"
+	DNSQueryTypeHTTPS  DNSQueryType = "https"
+	DNSQueryTypeSVCB   DNSQueryType = "svcb"
+	DNSQueryTypeNAPTR  DNSQueryType = "naptr"
+	DNSQueryTypeSSHFP  DNSQueryType = "sshfp"
+	DNSQueryTypeTLSA   DNSQueryType = "tlsa"
+
+	// Shortcuts for identifying the anycast instance of the server, the target is ignored,
+	// the query is sent as CHAOS TXT of the name itself.
+	DNSQueryTypeIDServer     DNSQueryType = "id.server"
+	DNSQueryTypeHostnameBind DNSQueryType = "hostname.bind"
 )
 
+var dnsQueryTypeToRRType = map[DNSQueryType]uint16{
+	DNSQueryTypeA:      dns.TypeA,
+	DNSQueryTypeAAAA:   dns.TypeAAAA,
+	DNSQueryTypeCNAME:  dns.TypeCNAME,
+	DNSQueryTypeMX:     dns.TypeMX,
+	DNSQueryTypeNS:     dns.TypeNS,
+	DNSQueryTypePTR:    dns.TypePTR,
+	DNSQueryTypeTXT:    dns.TypeTXT,
+	DNSQueryTypeSOA:    dns.TypeSOA,
+	DNSQueryTypeSRV:    dns.TypeSRV,
+	DNSQueryTypeCAA:    dns.TypeCAA,
+	DNSQueryTypeDS:     dns.TypeDS,
+	DNSQueryTypeDNSKEY: dns.TypeDNSKEY,
+	DNSQueryTypeRRSIG:  dns.TypeRRSIG,
+	DNSQueryTypeHTTPS:  dns.TypeHTTPS,
+	DNSQueryTypeSVCB:   dns.TypeSVCB,
+	DNSQueryTypeNAPTR:  dns.TypeNAPTR,
+	DNSQueryTypeSSHFP:  dns.TypeSSHFP,
+	DNSQueryTypeTLSA:   dns.TypeTLSA,
+
+	DNSQueryTypeIDServer:     dns.TypeTXT,
+	DNSQueryTypeHostnameBind: dns.TypeTXT,
+}
+
+func isChaosQueryType(queryType DNSQueryType) bool {
+	return queryType == DNSQueryTypeIDServer || queryType == DNSQueryTypeHostnameBind
+}
+
 const defaultDNSProbeTransport = TransportUDP
 
 type LookupParameter struct {
@@ -50,14 +96,66 @@ type LookupParameter struct {
 	// e.g. 1.1.1.1, 1.1.1.1:53, 2606:4700:4700::1111, [2606:4700:4700::1111]:53
 	// For DoT, valid addrPort including valid addrPort for UDP, TCP transport plus a `tls://` prefix,
 	// e.g. tls://1.1.1.1, 1.1.1.1, 1.1.1.1:53, 2606:4700:4700::1111, [2606:4700:4700::1111]:53
-	// For DoH, valid addrPort should be an HTTPS URL, but the host part must be ip or ipv6 address literal
-	// e.g. https://8.8.8.8/dns-query, or https://[2001:4860:4860::8888]/dns-query, ipv6 address literal must be wrapped within a bracket pair.
+	// For DoH, valid addrPort should be an HTTPS URL, e.g. https://8.8.8.8/dns-query, https://dns.google/dns-query,
+	// or https://[2001:4860:4860::8888]/dns-query, ipv6 address literal must be wrapped within a bracket pair.
+	// For DoQ, valid addrPort are the same as DoT, but with an optional `quic://` prefix, e.g. quic://94.140.14.140
+	// The host could also be a hostname, e.g. tls://dns.google, which is resolved by the bootstrap resolver,
+	// and used as the TLS server name when DoTServerName is not specified.
 	AddrPort      string       `json:"addrport"`
 	Target        string       `json:"target"`
 	TimeoutMs     *int64       `json:"timeoutMs,omitempty"`
 	Transport     *Transport   `json:"transport,omitempty"`
 	QueryType     DNSQueryType `json:"queryType"`
 	DoTServerName string       `json:"dotServerName"`
+
+	// Take effect only when the transport is DoH, i.e. http/2 or http/3
+	DoHMethod DoHMethod `json:"dohMethod,omitempty"`
+
+	// Set the DO bit (RFC3225), so that the resolver includes the DNSSEC records in the response
+	DNSSECOk bool `json:"dnssecOk,omitempty"`
+
+	// Validate the response up to the trust anchors, implies DNSSECOk
+	ValidateDNSSEC bool `json:"validateDnssec,omitempty"`
+
+	// DS records in presentation format, e.g. ". IN DS 20326 8 2 E06D44B8...",
+	// the root zone KSKs are used when left empty.
+	TrustAnchors []string `json:"trustAnchors,omitempty"`
+
+	// Resolve iteratively from the root hints instead of asking the resolver at AddrPort,
+	// which is ignored then, see TraceDNS
+	Trace bool `json:"trace,omitempty"`
+
+	// The EDNS Client Subnet (RFC7871) to send, in CIDR notation, e.g. 192.0.2.0/24,
+	// 0.0.0.0/0 asks the resolver not to send any ECS upstream.
+	ClientSubnet string `json:"clientSubnet,omitempty"`
+
+	// Ask the server to identify itself with the NSID option (RFC5001)
+	RequestNSID bool `json:"requestNsid,omitempty"`
+
+	// Check the consistency among all authoritative servers of the zone, i.e. Target,
+	// AddrPort and Transport are ignored then, see CheckZone
+	ZoneCheck bool `json:"zoneCheck,omitempty"`
+
+	// Take effect only in zone check mode, the name of the record of QueryType to be compared
+	// among the servers, defaults to the zone apex
+	RecordName string `json:"recordName,omitempty"`
+
+	// Tells if the agent is allowed to send to the address a server given by hostname is bootstrapped to, nil allows any,
+	// it's the very address the query is sent to that's checked, rather than what another lookup of the name returns.
+	CheckServerAddr func(addr netip.Addr) error `json:"-"`
+}
+
+type ECSResult struct {
+	Subnet string `json:"subnet"`
+	// the prefix length the answer is valid for, as returned by the server
+	ScopePrefixLength uint8 `json:"scope_prefix_length"`
+}
+
+type MsgFlags struct {
+	Authoritative      bool `json:"aa"`
+	Truncated          bool `json:"tc"`
+	AuthenticatedData  bool `json:"ad"`
+	RecursionAvailable bool `json:"ra"`
 }
 
 type QueryResult struct {
@@ -75,6 +173,26 @@ type QueryResult struct {
 	StartedAt        time.Time     `json:"started_at"`
 	TimeoutSpecified time.Duration `json:"timeout_specified"`
 	TransportUsed    Transport     `json:"transport_used"`
+
+	Rcode       string            `json:"rcode,omitempty"`
+	Flags       *MsgFlags         `json:"flags,omitempty"`
+	EDNSBufSize uint16            `json:"edns_bufsize,omitempty"`
+	DNSSEC      *DNSSECValidation `json:"dnssec,omitempty"`
+
+	// only available when the transport is quic
+	QUIC *QUICStats `json:"quic,omitempty"`
+
+	// the ECS option echoed by the server, if any
+	ECS *ECSResult `json:"ecs,omitempty"`
+	// decoded when printable, otherwise in hex
+	NSID string `json:"nsid,omitempty"`
+
+	// the lowest TTL among the answers, in seconds
+	MinTTL *uint32 `json:"min_ttl,omitempty"`
+
+	// only available when the server is specified by hostname, the time spent on resolving it is not included in Elapsed
+	BootstrapTime time.Duration `json:"bootstrap_time,omitempty"`
+	BootstrapAddr string        `json:"bootstrap_addr,omitempty"`
 }
 
 // make it suitable for transmitting over the wire
@@ -86,16 +204,8 @@ func (qr *QueryResult) PreStringify() (*QueryResult, error) {
 		clone.Error = nil
 	}
 
-	if clone.Answers != nil && qr.TransportUsed != TransportHTTP2 && qr.TransportUsed != TransportHTTP3 {
-		answerStrings := make([]string, 0)
-		for _, ans := range clone.Answers {
-			ansStr, err := wrappedAnsToString(ans, clone.QueryType)
-			if err != nil {
-				return nil, fmt.Errorf("failed to convert answer to string: %v", err)
-			}
-			answerStrings = append(answerStrings, ansStr)
-		}
-		clone.AnswerStrings = answerStrings
+	if !isDoHTransport(qr.TransportUsed) {
+		// the answer strings already carry everything
 		clone.Answers = nil
 	}
 	return clone, nil
@@ -126,8 +236,9 @@ func stripTLSURLPrefix(s string) string {
 
 func appendDNSPort(s string, transport Transport) string {
 	port := "53"
-	if transport == TransportTLS {
+	if transport == TransportTLS || transport == TransportQUIC {
 		// As per RFC7853, https://datatracker.ietf.org/doc/html/rfc7858#section-3.1
+		// and RFC9250, https://datatracker.ietf.org/doc/html/rfc9250#section-4.1.1
 		port = "853"
 	}
 	_, _, err := net.SplitHostPort(s)
@@ -137,35 +248,185 @@ func appendDNSPort(s string, transport Transport) string {
 	return s
 }
 
+func isDoHTransport(transport Transport) bool {
+	return transport == TransportHTTP2 || transport == TransportHTTP3
+}
+
+func getServerHost(addrPort string, transport Transport) (string, error) {
+	if isDoHTransport(transport) {
+		urlObj, err := url.Parse(addrPort)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse DoH url %s: %w", addrPort, err)
+		}
+		if urlObj.Hostname() == "" {
+			return "", fmt.Errorf("no host in DoH url %s", addrPort)
+		}
+		return urlObj.Hostname(), nil
+	}
+
+	addrPort = stripQUICURLPrefix(stripTLSURLPrefix(addrPort))
+	if host, _, err := net.SplitHostPort(addrPort); err == nil {
+		return host, nil
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addrPort, "["), "]"), nil
+}
+
+// GetServerHost returns the host part of AddrPort, it's either an ip address literal,
+// or a hostname to be resolved by the bootstrap resolver.
+func (parameter *LookupParameter) GetServerHost() (string, error) {
+	var transport Transport = defaultDNSProbeTransport
+	if parameter.Transport != nil {
+		transport = *parameter.Transport
+	}
+	return getServerHost(parameter.AddrPort, transport)
+}
+
+func bootstrapServer(ctx context.Context, resolver *net.Resolver, host string) (netip.Addr, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if len(addrs) == 0 {
+		return netip.Addr{}, fmt.Errorf("no address found for %s", host)
+	}
+	return addrs[0].Unmap(), nil
+}
+
+// replaces the host part of addrPort with the bootstrapped address, DoH urls are kept as is, see getDoHExchangeFunc
+func getBootstrappedAddrPort(addrPort string, transport Transport, bootstrapped netip.Addr) string {
+	if isDoHTransport(transport) {
+		return addrPort
+	}
+	_, port, _ := net.SplitHostPort(appendDNSPort(stripQUICURLPrefix(stripTLSURLPrefix(addrPort)), transport))
+	return net.JoinHostPort(bootstrapped.String(), port)
+}
+
 const minTimeoutMs = 10
 const maxTimeoutMs = 10 * 1000
 const defaultDNSProbeTimeoutMs = 3000
 
-func getDoHRequest(ctx context.Context, urlStr string, m *dns.Msg, serverName string) (*http.Request, error) {
+// Same as what the go resolver advertises, as recommended by the DNS flag day 2020
+const ednsUDPSize = 1232
 
-	mime := "application/dns-message"
+type exchangeFunc func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
 
-	if err := m.Pack(); err != nil {
-		return nil, err
+// for udp, tcp and tls transports, addrPort is what specified by the user, see LookupParameter.AddrPort
+func getExchangeFunc(transport Transport, addrPort string, tlsConfig *tls.Config, timeout time.Duration) (exchangeFunc, error) {
+	addrPort = stripTLSURLPrefix(addrPort)
+	addrPort = appendDNSPort(addrPort, transport)
+	addrportObj, err := netip.ParseAddrPort(addrPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse addrport %s as netip.AddrPort: %v", addrPort, err)
+	}
+
+	client := &dns.Client{
+		Transport: &dns.Transport{
+			Dialer:       &net.Dialer{Timeout: timeout},
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+		},
+	}
+
+	network := ""
+	switch transport {
+	case TransportUDP:
+		network = "udp"
+	case TransportTCP:
+		network = "tcp"
+	case TransportTLS:
+		network = "tcp"
+		client.Transport.TLSConfig = tlsConfig
+	default:
+		return nil, fmt.Errorf("transport is not specified or invalid transport: %s", transport)
+	}
+
+	return func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		resp, _, err := client.Exchange(ctx, m, network, addrportObj.String())
+		if err == nil && resp.Truncated && transport == TransportUDP {
+			// the buffer of m is reused for the response, so it has to be packed again
+			m.Data = nil
+			resp, _, err = client.Exchange(ctx, m, "tcp", addrportObj.String())
+		}
+		return resp, err
+	}, nil
+}
+
+func buildQueryMsg(target string, queryType DNSQueryType) (*dns.Msg, error) {
+	rrType, ok := dnsQueryTypeToRRType[queryType]
+	if !ok {
+		return nil, fmt.Errorf("invalid query type: %s", queryType)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", urlStr, m)
+	queryingTarget := target
+	if isChaosQueryType(queryType) {
+		queryingTarget = string(queryType)
+	}
+	// test if the querying name has .in-addr.arpa. suffix or .ip6.arpa. suffix
+	if queryType == DNSQueryTypePTR && dnsutil.IsReverse(queryingTarget) == 0 {
+		ipaddr, err := netip.ParseAddr(queryingTarget)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip: %w", err)
+		}
+		queryingTarget = dnsutil.ReverseAddr(ipaddr)
+	}
+
+	m := dns.NewMsg(queryingTarget, rrType)
+	if m == nil {
+		return nil, fmt.Errorf("failed to build query of type %s for %s", queryType, target)
+	}
+	m.UDPSize = ednsUDPSize
+	if isChaosQueryType(queryType) {
+		m.Question[0].Header().Class = dns.ClassCHAOS
+	}
+	return m, nil
+}
+
+func getClientSubnetOption(clientSubnet string) (*dns.SUBNET, error) {
+	prefix, err := netip.ParsePrefix(clientSubnet)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid client subnet %s: %w", clientSubnet, err)
 	}
+	prefix = prefix.Masked()
 
-	if serverName != "" {
-		// Note, such serverName is actually the Host (or :authority) header field
-		req.Host = serverName
+	// As per RFC7871, 1 for IPv4, 2 for IPv6
+	var family uint16 = 1
+	if prefix.Addr().Is6() {
+		family = 2
 	}
+	return &dns.SUBNET{
+		Family:  family,
+		Netmask: uint8(prefix.Bits()),
+		Address: prefix.Addr(),
+	}, nil
+}
 
-	req.Header.Set("Accept", mime)
-	req.Header.Set("Content-Type", mime)
-	return req, nil
+// the subnet echoed by the server is not necessarily a valid prefix, e.g. the mask might be longer than the address,
+// such subnet is reported as it is
+func formatClientSubnet(opt *dns.SUBNET) string {
+	if prefix := netip.PrefixFrom(opt.Address, int(opt.Netmask)); prefix.IsValid() {
+		return prefix.String()
+	}
+	return fmt.Sprintf("%s/%d", opt.Address.String(), opt.Netmask)
+}
+
+func formatNSID(nsidHex string) string {
+	raw, err := hex.DecodeString(nsidHex)
+	if err != nil {
+		return nsidHex
+	}
+	for _, r := range string(raw) {
+		if !unicode.IsPrint(r) {
+			return nsidHex
+		}
+	}
+	return string(raw)
 }
 
-// returns: answers, error
-func LookupDNS(ctx context.Context, parameter LookupParameter, certPool *x509.CertPool) (*QueryResult, error) {
+// resolver is the bootstrap resolver for servers specified by hostname, the default resolver is used when it's nil.
+func LookupDNS(ctx context.Context, parameter LookupParameter, certPool *x509.CertPool, resolver *net.Resolver) (*QueryResult, error) {
 
 	var transport Transport = defaultDNSProbeTransport
 	if parameter.Transport != nil {
@@ -180,10 +441,10 @@ func LookupDNS(ctx context.Context, parameter LookupParameter, certPool *x509.Ce
 	}
 
 	if timeoutMs < minTimeoutMs {
-		return nil, fmt.Errorf("timeout is too short: at least %dms is required, got %dms", minTimeoutMs, parameter.TimeoutMs)
+		return nil, fmt.Errorf("timeout is too short: at least %dms is required, got %dms", minTimeoutMs, timeoutMs)
 	}
 	if timeoutMs > maxTimeoutMs {
-		return nil, fmt.Errorf("timeout is too long: at most %dms is allowed, got %dms", maxTimeoutMs, parameter.TimeoutMs)
+		return nil, fmt.Errorf("timeout is too long: at most %dms is allowed, got %dms", maxTimeoutMs, timeoutMs)
 	}
 	timeout := time.Duration(timeoutMs) * time.Millisecond
 
@@ -197,6 +458,31 @@ func LookupDNS(ctx context.Context, parameter LookupParameter, certPool *x509.Ce
 	queryResult.TransportUsed = transport
 	queryResult.CorrelationID = parameter.CorrelationID
 
+	m, err := buildQueryMsg(target, queryType)
+	if err != nil {
+		return nil, err
+	}
+	m.Security = parameter.DNSSECOk || parameter.ValidateDNSSEC
+	if parameter.ClientSubnet != "" {
+		subnetOpt, err := getClientSubnetOption(parameter.ClientSubnet)
+		if err != nil {
+			return nil, err
+		}
+		m.Pseudo = append(m.Pseudo, subnetOpt)
+	}
+	if parameter.RequestNSID {
+		m.Pseudo = append(m.Pseudo, &dns.NSID{})
+	}
+
+	var validator *dnssecValidator
+	if parameter.ValidateDNSSEC {
+		anchors, err := parseTrustAnchors(parameter.TrustAnchors)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trust anchors: %w", err)
+		}
+		validator = newDNSSECValidator(anchors)
+	}
+
 	tlsConfig := &tls.Config{
 		MinVersion: tls.VersionTLS12,
 		ServerName: parameter.DoTServerName,
@@ -205,261 +491,162 @@ func LookupDNS(ctx context.Context, parameter LookupParameter, certPool *x509.Ce
 		tlsConfig.RootCAs = certPool
 	}
 
-	queryResult.StartedAt = time.Now()
-	defer func() {
-		queryResult.Elapsed = time.Since(queryResult.StartedAt)
-	}()
-
-	ctx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-
-	if transport == TransportHTTP2 || transport == TransportHTTP3 {
-		var m *dns.Msg = nil
-		switch queryType {
-		case DNSQueryTypeA:
-			m = dns.NewMsg(target, dns.TypeA)
-		case DNSQueryTypeAAAA:
-			m = dns.NewMsg(target, dns.TypeAAAA)
-		case DNSQueryTypeCNAME:
-			m = dns.NewMsg(target, dns.TypeCNAME)
-		case DNSQueryTypeMX:
-			m = dns.NewMsg(target, dns.TypeMX)
-		case DNSQueryTypeNS:
-			m = dns.NewMsg(target, dns.TypeNS)
-		case DNSQueryTypePTR:
-			queryingTarget := target
-			if dnsutil.IsReverse(queryingTarget) > 0 {
-				m = dns.NewMsg(queryingTarget, dns.TypePTR)
-			} else {
-				ipaddr, err := netip.ParseAddr(queryingTarget)
-				if err != nil {
-					return nil, fmt.Errorf("invalid ip: %w", err)
-				}
-				queryingTarget = dnsutil.ReverseAddr(ipaddr)
-				m = dns.NewMsg(queryingTarget, dns.TypePTR)
-			}
-		case DNSQueryTypeTXT:
-			m = dns.NewMsg(target, dns.TypeTXT)
-		default:
-			return nil, fmt.Errorf("invalid query type: %s", queryType)
-		}
-
-		m.ID = dns.ID()
-		m.RecursionDesired = true
-
-		req, err := getDoHRequest(ctx, parameter.AddrPort, m, parameter.DoTServerName)
+	serverHost, err := getServerHost(parameter.AddrPort, transport)
+	if err != nil {
+		return nil, err
+	}
+	serverAddrPort := parameter.AddrPort
+	var bootstrapped netip.Addr
+	if _, err := netip.ParseAddr(serverHost); err != nil {
+		bootstrapStartedAt := time.Now()
+		bootstrapCtx, cancel := context.WithTimeout(ctx, timeout)
+		bootstrapped, err = bootstrapServer(bootstrapCtx, resolver, serverHost)
+		cancel()
+		queryResult.BootstrapTime = time.Since(bootstrapStartedAt)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create DoH request: %w", err)
+			return nil, fmt.Errorf("failed to bootstrap dns server %s: %w", serverHost, err)
 		}
-
-		ansM := new(dns.Msg)
-		if transport == TransportHTTP2 {
-			cli := http.DefaultClient
-			resp, err := cli.Do(req)
-			if err != nil {
-				return nil, fmt.Errorf("failed to send DoH request via http client: %w", err)
-			}
-			if resp.StatusCode >= 400 {
-				return nil, fmt.Errorf("DoH request failed with status code: %s", resp.Status)
-			}
-			defer resp.Body.Close()
-			ansM.Data, err = io.ReadAll(resp.Body)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read DoH response: %w", err)
-			}
-		} else {
-			tr := &quicHTTP3.Transport{
-				TLSClientConfig: tlsConfig,
-			}
-			var err error
-			resp, err := tr.RoundTrip(req)
-			if err != nil {
-				return nil, fmt.Errorf("failed to send DoH request via quic client: %w", err)
-			}
-			if resp.StatusCode >= 400 {
-				return nil, fmt.Errorf("DoH3 request failed with status code: %s", resp.Status)
-			}
-			defer resp.Body.Close()
-			ansM.Data, err = io.ReadAll(resp.Body)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read DoH response: %w", err)
+		queryResult.BootstrapAddr = bootstrapped.String()
+		if parameter.CheckServerAddr != nil {
+			if err := parameter.CheckServerAddr(bootstrapped); err != nil {
+				return nil, fmt.Errorf("bootstrapped address %s of dns server %s is not allowed: %w", bootstrapped.String(), serverHost, err)
 			}
 		}
 
-		if err := ansM.Unpack(); err != nil {
-			return nil, fmt.Errorf("failed to unpack DoH response: %w", err)
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = serverHost
 		}
+		serverAddrPort = getBootstrappedAddrPort(serverAddrPort, transport, bootstrapped)
+	}
 
-		for _, rr := range ansM.Answer {
-			rrData := rr.Data()
-			ansDataStr := rrData.String()
-			queryResult.Answers = append(queryResult.Answers, rrData)
-			queryResult.AnswerStrings = append(queryResult.AnswerStrings, ansDataStr)
+	var exchange exchangeFunc
+	if isDoHTransport(transport) {
+		exchange = getDoHExchangeFunc(transport, parameter.DoHMethod, parameter.AddrPort, parameter.DoTServerName, tlsConfig, bootstrapped)
+	} else if transport == TransportQUIC {
+		exchange, err = getDoQExchangeFunc(serverAddrPort, tlsConfig, func(stats *QUICStats) {
+			// the validator reuses the exchange, only the stats of the first one is of interest
+			if queryResult.QUIC == nil {
+				queryResult.QUIC = stats
+			}
+		})
+		if err != nil {
+			return nil, err
 		}
-
-		return queryResult, nil
 	} else {
-		addrPort := parameter.AddrPort
-		addrPort = stripTLSURLPrefix(addrPort)
-		addrPort = appendDNSPort(addrPort, transport)
-		addrportObj, err := netip.ParseAddrPort(addrPort)
+		exchange, err = getExchangeFunc(transport, serverAddrPort, tlsConfig, timeout)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse addrport %s as netip.AddrPort: %v", parameter.AddrPort, err)
-		}
-		resolver := net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				if transport == TransportUDP {
-					udpaddr := net.UDPAddrFromAddrPort(addrportObj)
-					if udpaddr == nil {
-						return nil, fmt.Errorf("failed to get udpaddr from %s", addrportObj.String())
-					}
-					return net.DialUDP("udp", nil, udpaddr)
-				} else if transport == TransportTCP {
-					tcpaddr := net.TCPAddrFromAddrPort(addrportObj)
-					if tcpaddr == nil {
-						return nil, fmt.Errorf("failed to get tcpaddr from %s", addrportObj.String())
-					}
-					return net.DialTCP("tcp", nil, tcpaddr)
-				} else if transport == TransportTLS {
-					tcpaddr := net.TCPAddrFromAddrPort(addrportObj)
-					dialer := &tls.Dialer{
-						Config: tlsConfig,
-					}
-					return dialer.DialContext(ctx, "tcp", tcpaddr.String())
-				} else {
-					return nil, fmt.Errorf("transport is not specified or invalid transport: %s", transport)
-				}
-			},
+			return nil, err
 		}
+	}
 
-		switch queryType {
-		case DNSQueryTypeA, DNSQueryTypeAAAA:
-			ipPref := "ip"
-			if queryType == DNSQueryTypeA {
-				ipPref = "ip4"
-			} else if queryType == DNSQueryTypeAAAA {
-				ipPref = "ip6"
-			}
-			answers, err := resolver.LookupIP(ctx, ipPref, target)
-			if err != nil && !analyzeError(err, queryResult) {
-				return nil, fmt.Errorf("failed to lookup ip (type %s) for %s: %v", queryType, target, err)
-			}
+	queryResult.StartedAt = time.Now()
+	defer func() {
+		queryResult.Elapsed = time.Since(queryResult.StartedAt)
+	}()
 
-			for _, ans := range answers {
-				queryResult.Answers = append(queryResult.Answers, ans)
-			}
-			return queryResult, nil
-		case DNSQueryTypeCNAME:
-			answer, err := resolver.LookupCNAME(ctx, target)
-			if err != nil && !analyzeError(err, queryResult) {
-				return nil, fmt.Errorf("failed to lookup ip (type %s) for %s: %v", queryType, target, err)
-			}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-			if answer != "" {
-				queryResult.Answers = append(queryResult.Answers, answer)
-			}
-			return queryResult, nil
-		case DNSQueryTypeMX:
-			answers, err := resolver.LookupMX(ctx, target)
-			if err != nil && !analyzeError(err, queryResult) {
-				return nil, fmt.Errorf("failed to lookup mx for %s: %v", target, err)
-			}
-			for _, ans := range answers {
-				if ans == nil {
-					continue
-				}
-				queryResult.Answers = append(queryResult.Answers, ans)
-			}
-			return queryResult, nil
-		case DNSQueryTypeNS:
-			answers, err := resolver.LookupNS(ctx, target)
-			if err != nil && !analyzeError(err, queryResult) {
-				return nil, fmt.Errorf("failed to lookup ns for %s: %v", target, err)
-			}
-			for _, ans := range answers {
-				if ans == nil {
-					continue
-				}
-				queryResult.Answers = append(queryResult.Answers, ans)
-			}
-			return queryResult, nil
-		case DNSQueryTypePTR:
-			queryingTarget := target
-			// test if the querying name has .in-addr.arpa. suffix or .ip6.arpa. suffix
-			if dnsutil.IsReverse(queryingTarget) > 0 {
-				targetObj := dnsutil.AddrReverse(queryingTarget)
-				if !targetObj.IsValid() {
-					return nil, fmt.Errorf("invalid address: %s", queryingTarget)
-				}
-				queryingTarget = targetObj.String()
-			}
-			answer, err := resolver.LookupAddr(ctx, queryingTarget)
-			if err != nil && !analyzeError(err, queryResult) {
-				return nil, fmt.Errorf("failed to lookup ptr for %s: %v", target, err)
-			}
-			for _, ans := range answer {
-				if ans == "" {
-					continue
-				}
-				queryResult.Answers = append(queryResult.Answers, ans)
-			}
-			return queryResult, nil
-		case DNSQueryTypeTXT:
-			answer, err := resolver.LookupTXT(ctx, target)
-			if err != nil && !analyzeError(err, queryResult) {
-				return nil, fmt.Errorf("failed to lookup txt for %s: %v", target, err)
-			}
-			for _, ans := range answer {
-				queryResult.Answers = append(queryResult.Answers, ans)
-			}
+	resp, err := exchange(ctx, m)
+	if err != nil {
+		if analyzeError(err, queryResult) {
 			return queryResult, nil
-		default:
-			return nil, fmt.Errorf("invalid query type: %s", queryType)
 		}
+		return nil, fmt.Errorf("failed to lookup %s (type %s): %w", target, queryType, err)
+	}
+	fillQueryResult(queryResult, resp, dnsQueryTypeToRRType[queryType])
+
+	if validator != nil {
+		validator.exchange = exchange
+		queryResult.DNSSEC = validator.Validate(ctx, resp)
 	}
 
+	return queryResult, nil
 }
 
-func wrappedAnsToString(ans interface{}, qtype DNSQueryType) (string, error) {
-	switch qtype {
-	case DNSQueryTypeA:
-		ip, ok := ans.(net.IP)
-		if !ok {
-			return "", fmt.Errorf("answer is not a net.IP: %v", ans)
-		}
-		return ip.String(), nil
-	case DNSQueryTypeAAAA:
-		ip, ok := ans.(net.IP)
-		if !ok {
-			return "", fmt.Errorf("answer is not a net.IP: %v", ans)
-		}
-		return ip.String(), nil
-	case DNSQueryTypeCNAME:
-		cname, ok := ans.(string)
-		if !ok {
-			return "", fmt.Errorf("answer is not a string: %v", ans)
+func fillQueryResult(queryResult *QueryResult, resp *dns.Msg, rrType uint16) {
+	queryResult.Rcode = dnsutil.RcodeToString(resp.Rcode)
+	queryResult.NoSuchHost = resp.Rcode == dns.RcodeNameError
+	queryResult.EDNSBufSize = resp.UDPSize
+	queryResult.Flags = &MsgFlags{
+		Authoritative:      resp.Authoritative,
+		Truncated:          resp.Truncated,
+		AuthenticatedData:  resp.AuthenticatedData,
+		RecursionAvailable: resp.RecursionAvailable,
+	}
+
+	for _, rr := range resp.Pseudo {
+		switch opt := rr.(type) {
+		case *dns.SUBNET:
+			queryResult.ECS = &ECSResult{
+				Subnet:            formatClientSubnet(opt),
+				ScopePrefixLength: opt.Scope,
+			}
+		case *dns.NSID:
+			queryResult.NSID = formatNSID(opt.Nsid)
 		}
-		return cname, nil
-	case DNSQueryTypeMX:
-		mx, ok := ans.(*net.MX)
-		if !ok {
-			return "", fmt.Errorf("answer is not a *net.MX: %v", ans)
+	}
+
+	for _, rr := range resp.Answer {
+		// skip the CNAME chain, and the signatures when not asked for
+		if dns.RRToType(rr) != rrType {
+			continue
 		}
-		return fmt.Sprintf("%s (pref=%d)", mx.Host, mx.Pref), nil
-	case DNSQueryTypeNS:
-		ns, ok := ans.(*net.NS)
-		if !ok {
-			return "", fmt.Errorf("answer is not a *net.NS: %v", ans)
+		if ttl := rr.Header().TTL; queryResult.MinTTL == nil || ttl < *queryResult.MinTTL {
+			queryResult.MinTTL = &ttl
 		}
-		return ns.Host, nil
-	case DNSQueryTypePTR:
-		ptr, ok := ans.(string)
-		if !ok {
-			return "", fmt.Errorf("answer is not a string: %v", ans)
+		if isDoHTransport(queryResult.TransportUsed) {
+			queryResult.Answers = append(queryResult.Answers, rr.Data())
+			queryResult.AnswerStrings = append(queryResult.AnswerStrings, rr.Data().String())
+		} else {
+			queryResult.Answers = append(queryResult.Answers, getPlainAnswer(rr))
+			queryResult.AnswerStrings = append(queryResult.AnswerStrings, answerToString(rr))
 		}
-		return ptr, nil
+	}
+}
+
+// getPlainAnswer returns the answer the way the lookups of net.Resolver do, which is what the answers of the
+// UDP, TCP and DoT transports have always been, e.g. net.IP of A and AAAA, *net.MX of MX, the records of the
+// other types are kept as their RR data. Whereas the answers of DoH are the RR data, and their strings are
+// the presentation format, e.g. '10 mx.example.' rather than 'mx.example. (pref=10)'.
+func getPlainAnswer(rr dns.RR) interface{} {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return net.IP(rr.Addr.AsSlice())
+	case *dns.AAAA:
+		return net.IP(rr.Addr.AsSlice())
+	case *dns.CNAME:
+		return rr.Target
+	case *dns.MX:
+		return &net.MX{Host: rr.Mx, Pref: rr.Preference}
+	case *dns.NS:
+		return &net.NS{Host: rr.Ns}
+	case *dns.PTR:
+		return rr.Ptr
+	case *dns.TXT:
+		return strings.Join(rr.Txt, "")
+	default:
+		return rr.Data()
+	}
+}
+
+func answerToString(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.Addr.String()
+	case *dns.AAAA:
+		return rr.Addr.String()
+	case *dns.CNAME:
+		return rr.Target
+	case *dns.MX:
+		return fmt.Sprintf("%s (pref=%d)", rr.Mx, rr.Preference)
+	case *dns.NS:
+		return rr.Ns
+	case *dns.PTR:
+		return rr.Ptr
+	case *dns.TXT:
+		return strings.Join(rr.Txt, "")
 	default:
-		return "", fmt.Errorf("unknown query type: %s", qtype)
+		return rr.Data().String()
 	}
 }
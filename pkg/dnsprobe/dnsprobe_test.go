@@ -0,0 +1,312 @@
+package dnsprobe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+// serves handler over both udp and tcp on addr, returns the address listened on once both servers have started
+func startTestDNSServer(t *testing.T, addr string, handler dns.Handler) string {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skipf("failed to listen tcp on the port of udp: %v", err)
+	}
+
+	started := make(chan struct{}, 2)
+	for _, server := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: ln, Handler: handler}} {
+		server.NotifyStartedFunc = func(context.Context) { started <- struct{}{} }
+		go server.ListenAndServe()
+		t.Cleanup(func() { server.Shutdown(context.Background()) })
+	}
+	<-started
+	<-started
+	return pc.LocalAddr().String()
+}
+
+func TestExchangeFunc_TruncatedRetriesOverTCP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skipf("failed to listen tcp on the port of udp: %v", err)
+	}
+
+	// also what orders the start of the servers before their shutdown
+	var udpServed, tcpServed atomic.Bool
+	handler := dns.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		dnsutil.SetReply(m, req)
+		if dnsutil.Network(w) == "udp" {
+			udpServed.Store(true)
+			m.Truncated = true
+		} else {
+			tcpServed.Store(true)
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.Header{Name: req.Question[0].Header().Name, Class: dns.ClassINET, TTL: 300},
+				A:   rdata.A{Addr: netip.MustParseAddr("192.0.2.1")},
+			}}
+		}
+		io.Copy(w, m)
+	})
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &dns.Server{Listener: ln, Handler: handler}
+	go udpServer.ListenAndServe()
+	go tcpServer.ListenAndServe()
+	defer udpServer.Shutdown(context.Background())
+	defer tcpServer.Shutdown(context.Background())
+
+	exchange, err := getExchangeFunc(TransportUDP, pc.LocalAddr().String(), nil, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := dns.NewMsg("www.example.", dns.TypeA)
+	m.UDPSize = ednsUDPSize
+	resp, err := exchange(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Truncated || len(resp.Answer) != 1 {
+		t.Fatalf("expected the full answer over tcp, got truncated=%v answer=%v", resp.Truncated, resp.Answer)
+	}
+	if !udpServed.Load() || !tcpServed.Load() {
+		t.Fatalf("expected the query over udp then tcp, got udp=%v tcp=%v", udpServed.Load(), tcpServed.Load())
+	}
+}
+
+func TestGetClientSubnetOption(t *testing.T) {
+	tests := []struct {
+		clientSubnet string
+		family       uint16
+		netmask      uint8
+		address      string
+		wantErr      bool
+	}{
+		{clientSubnet: "192.0.2.1/24", family: 1, netmask: 24, address: "192.0.2.0"},
+		{clientSubnet: "2001:db8::1/56", family: 2, netmask: 56, address: "2001:db8::"},
+		{clientSubnet: "0.0.0.0/0", family: 1, netmask: 0, address: "0.0.0.0"},
+		{clientSubnet: "192.0.2.1", wantErr: true},
+		{clientSubnet: "192.0.2.0/33", wantErr: true},
+	}
+	for _, tt := range tests {
+		opt, err := getClientSubnetOption(tt.clientSubnet)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", tt.clientSubnet, opt)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.clientSubnet, err)
+			continue
+		}
+		if opt.Family != tt.family || opt.Netmask != tt.netmask || opt.Address.String() != tt.address {
+			t.Errorf("%s: unexpected option %+v", tt.clientSubnet, opt)
+		}
+	}
+}
+
+func TestFormatNSID(t *testing.T) {
+	tests := []struct {
+		nsidHex string
+		want    string
+	}{
+		{nsidHex: "6e73312e6578616d706c65", want: "ns1.example"},
+		// not printable, so left as hex
+		{nsidHex: "00ff10", want: "00ff10"},
+		{nsidHex: "not hex", want: "not hex"},
+		{nsidHex: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := formatNSID(tt.nsidHex); got != tt.want {
+			t.Errorf("formatNSID(%q) = %q, want %q", tt.nsidHex, got, tt.want)
+		}
+	}
+}
+
+func TestBuildQueryMsg_Chaos(t *testing.T) {
+	tests := []struct {
+		target    string
+		queryType DNSQueryType
+		name      string
+		class     uint16
+		rrType    uint16
+	}{
+		{target: "example.com", queryType: DNSQueryTypeIDServer, name: "id.server.", class: dns.ClassCHAOS, rrType: dns.TypeTXT},
+		{target: "example.com", queryType: DNSQueryTypeHostnameBind, name: "hostname.bind.", class: dns.ClassCHAOS, rrType: dns.TypeTXT},
+		{target: "example.com", queryType: DNSQueryTypeTXT, name: "example.com.", class: dns.ClassINET, rrType: dns.TypeTXT},
+	}
+	for _, tt := range tests {
+		m, err := buildQueryMsg(tt.target, tt.queryType)
+		if err != nil {
+			t.Errorf("%s: %v", tt.queryType, err)
+			continue
+		}
+		question := m.Question[0]
+		if question.Header().Name != tt.name || question.Header().Class != tt.class || dns.RRToType(question) != tt.rrType {
+			t.Errorf("%s: unexpected question %s", tt.queryType, question.String())
+		}
+	}
+}
+
+func TestFillQueryResult_Echo(t *testing.T) {
+	tests := []struct {
+		name   string
+		pseudo []dns.RR
+		subnet string
+		scope  uint8
+		nsid   string
+	}{
+		{
+			name:   "ecs and nsid",
+			pseudo: []dns.RR{&dns.SUBNET{Family: 1, Netmask: 24, Scope: 16, Address: netip.MustParseAddr("192.0.2.0")}, &dns.NSID{Nsid: "6e7331"}},
+			subnet: "192.0.2.0/24",
+			scope:  16,
+			nsid:   "ns1",
+		},
+		{
+			name:   "mask longer than the address",
+			pseudo: []dns.RR{&dns.SUBNET{Family: 1, Netmask: 40, Address: netip.MustParseAddr("192.0.2.0")}},
+			subnet: "192.0.2.0/40",
+		},
+		{
+			name: "nothing echoed",
+		},
+	}
+	for _, tt := range tests {
+		queryResult := new(QueryResult)
+		fillQueryResult(queryResult, &dns.Msg{Pseudo: tt.pseudo}, dns.TypeA)
+		if tt.subnet == "" {
+			if queryResult.ECS != nil {
+				t.Errorf("%s: unexpected ecs %+v", tt.name, queryResult.ECS)
+			}
+		} else if queryResult.ECS == nil || queryResult.ECS.Subnet != tt.subnet || queryResult.ECS.ScopePrefixLength != tt.scope {
+			t.Errorf("%s: unexpected ecs %+v", tt.name, queryResult.ECS)
+		}
+		if queryResult.NSID != tt.nsid {
+			t.Errorf("%s: unexpected nsid %q", tt.name, queryResult.NSID)
+		}
+	}
+}
+
+func TestFillQueryResult_AnswerFormat(t *testing.T) {
+	resp := &dns.Msg{Answer: []dns.RR{&dns.MX{
+		Hdr: dns.Header{Name: "example.", Class: dns.ClassINET, TTL: 300},
+		MX:  rdata.MX{Preference: 10, Mx: "mx.example."},
+	}}}
+
+	// the answers of the plain transports are what net.Resolver returns, none but the strings are sent over the wire
+	queryResult := &QueryResult{TransportUsed: TransportUDP}
+	fillQueryResult(queryResult, resp, dns.TypeMX)
+	if mx, ok := queryResult.Answers[0].(*net.MX); !ok || mx.Host != "mx.example." || mx.Pref != 10 {
+		t.Errorf("expected a *net.MX answer, got %#v", queryResult.Answers[0])
+	}
+	stringified, err := queryResult.PreStringify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stringified.Answers != nil || len(stringified.AnswerStrings) != 1 || stringified.AnswerStrings[0] != "mx.example. (pref=10)" {
+		t.Errorf("unexpected answers %v and strings %v", stringified.Answers, stringified.AnswerStrings)
+	}
+
+	// the answers of DoH are the RR data in the presentation format
+	queryResult = &QueryResult{TransportUsed: TransportHTTP2}
+	fillQueryResult(queryResult, resp, dns.TypeMX)
+	stringified, err = queryResult.PreStringify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stringified.Answers) != 1 || len(stringified.AnswerStrings) != 1 || stringified.AnswerStrings[0] != "10 mx.example." {
+		t.Errorf("unexpected answers %v and strings %v", stringified.Answers, stringified.AnswerStrings)
+	}
+
+	queryResult = &QueryResult{TransportUsed: TransportTCP}
+	fillQueryResult(queryResult, &dns.Msg{Answer: []dns.RR{&dns.A{
+		Hdr: dns.Header{Name: "www.example.", Class: dns.ClassINET, TTL: 300},
+		A:   rdata.A{Addr: netip.MustParseAddr("192.0.2.1")},
+	}}}, dns.TypeA)
+	if ip, ok := queryResult.Answers[0].(net.IP); !ok || !ip.Equal(net.IPv4(192, 0, 2, 1)) || queryResult.AnswerStrings[0] != "192.0.2.1" {
+		t.Errorf("expected a net.IP answer, got %#v and %v", queryResult.Answers[0], queryResult.AnswerStrings)
+	}
+}
+
+func TestLookupDNS_CheckServerAddr(t *testing.T) {
+	// serves as both the bootstrap resolver and the server bootstrapped to
+	var targetQueries atomic.Int32
+	serverAddr := startTestDNSServer(t, "127.0.0.1:0", dns.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		dnsutil.SetReply(m, req)
+		name := req.Question[0].Header().Name
+		addr := "192.0.2.1"
+		if dnsutil.Canonical(name) == "dns.example." {
+			addr = "127.0.0.1"
+		} else {
+			targetQueries.Add(1)
+		}
+		if dns.RRToType(req.Question[0]) == dns.TypeA {
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.Header{Name: name, Class: dns.ClassINET, TTL: 300},
+				A:   rdata.A{Addr: netip.MustParseAddr(addr)},
+			}}
+		}
+		io.Copy(w, m)
+	}))
+	_, port, _ := net.SplitHostPort(serverAddr)
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, serverAddr)
+		},
+	}
+
+	checked := make([]netip.Addr, 0)
+	parameter := LookupParameter{
+		AddrPort:  net.JoinHostPort("dns.example", port),
+		Target:    "www.example.",
+		QueryType: DNSQueryTypeA,
+		CheckServerAddr: func(addr netip.Addr) error {
+			checked = append(checked, addr)
+			if !netip.MustParsePrefix("127.0.0.0/8").Contains(addr) {
+				return fmt.Errorf("ip %s is not in the respond range", addr.String())
+			}
+			return nil
+		},
+	}
+	queryResult, err := LookupDNS(context.Background(), parameter, nil, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queryResult.BootstrapAddr != "127.0.0.1" || len(checked) != 1 || checked[0] != netip.MustParseAddr("127.0.0.1") {
+		t.Fatalf("expected the bootstrapped address to be checked, got %s and %v", queryResult.BootstrapAddr, checked)
+	}
+	if n := targetQueries.Load(); n != 1 {
+		t.Fatalf("expected the query to be sent once, got %d", n)
+	}
+
+	parameter.CheckServerAddr = func(addr netip.Addr) error {
+		return fmt.Errorf("ip %s is not in the respond range", addr.String())
+	}
+	if _, err := LookupDNS(context.Background(), parameter, nil, resolver); err == nil {
+		t.Fatal("expected a server bootstrapped out of range to be refused")
+	}
+	if n := targetQueries.Load(); n != 1 {
+		t.Fatalf("expected no query to be sent to a refused server, got %d in total", n)
+	}
+}
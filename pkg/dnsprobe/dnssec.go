@@ -0,0 +1,745 @@
+package dnsprobe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+)
+
+type DNSSECStatus string
+
+const (
+	// the whole chain, from the trust anchor down to the answer, has been authenticated
+	DNSSECStatusSecure DNSSECStatus = "secure"
+	// the chain of trust ends at a delegation whose DS is proven absent by the parent zone
+	DNSSECStatusInsecure DNSSECStatus = "insecure"
+	// some signature or key in the chain failed to verify
+	DNSSECStatusBogus DNSSECStatus = "bogus"
+	// the chain could not be fetched, e.g. the resolver timed out
+	DNSSECStatusIndeterminate DNSSECStatus = "indeterminate"
+)
+
+type DNSSECValidation struct {
+	Status DNSSECStatus `json:"status"`
+	Reason string       `json:"reason,omitempty"`
+
+	// zones whose DNSKEY sets were authenticated, in the order of being authenticated
+	Chain []string `json:"chain,omitempty"`
+}
+
+// Root zone KSK-2017 and KSK-2024, see https://data.iana.org/root-anchors/root-anchors.xml
+var defaultTrustAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// guards against signer names that never lead to a trust anchor
+const maxDNSSECChainDepth = 32
+
+var errDNSSECBogus = errors.New("bogus")
+var errDNSSECInsecure = errors.New("insecure")
+
+// the Opt-Out flag of NSEC3, RFC 5155 section 3.1.2.1
+const nsec3FlagOptOut = 0x01
+
+func parseTrustAnchors(anchors []string) ([]*dns.DS, error) {
+	if len(anchors) == 0 {
+		anchors = defaultTrustAnchors
+	}
+
+	result := make([]*dns.DS, 0, len(anchors))
+	for _, anchor := range anchors {
+		rr, err := dns.New(anchor)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trust anchor %q: %w", anchor, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, fmt.Errorf("trust anchor %q is not a DS record", anchor)
+		}
+		result = append(result, ds)
+	}
+	return result, nil
+}
+
+type rrsetKey struct {
+	name   string
+	rrType uint16
+}
+
+// groups the records by owner name and type, the signatures are grouped by the type they cover
+func groupRRsets(records []dns.RR) ([]rrsetKey, map[rrsetKey][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	keys := make([]rrsetKey, 0)
+	rrsets := make(map[rrsetKey][]dns.RR)
+	sigs := make(map[rrsetKey][]*dns.RRSIG)
+	for _, rr := range records {
+		name := dnsutil.Canonical(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey{name: name, rrType: sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		key := rrsetKey{name: name, rrType: dns.RRToType(rr)}
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+	return keys, rrsets, sigs
+}
+
+// dnssecValidator authenticates a response by walking from the signer of the answer up to the trust anchors,
+// fetching the DNSKEY and DS records through the same resolver which served the response.
+type dnssecValidator struct {
+	anchors []*dns.DS
+
+	exchange exchangeFunc
+
+	now   time.Time
+	keys  map[string][]*dns.DNSKEY
+	chain []string
+}
+
+func newDNSSECValidator(anchors []*dns.DS) *dnssecValidator {
+	return &dnssecValidator{
+		anchors: anchors,
+		now:     time.Now(),
+		keys:    make(map[string][]*dns.DNSKEY),
+	}
+}
+
+func (v *dnssecValidator) query(ctx context.Context, name string, rrType uint16) (*dns.Msg, error) {
+	m := dns.NewMsg(name, rrType)
+	m.UDPSize = ednsUDPSize
+	m.Security = true
+	// we'd like to see the records even if the resolver considers them bogus
+	m.CheckingDisabled = true
+
+	resp, err := v.exchange(ctx, m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s %s: %w", name, dnsutil.TypeToString(rrType), err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("failed to query %s %s: got rcode %s", name, dnsutil.TypeToString(rrType), dnsutil.RcodeToString(resp.Rcode))
+	}
+	return resp, nil
+}
+
+// returns the records of type rrType owned by name found in the answer section, and the signatures covering them
+func (v *dnssecValidator) queryRRset(ctx context.Context, name string, rrType uint16) ([]dns.RR, []*dns.RRSIG, error) {
+	resp, err := v.query(ctx, name, rrType)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, rrsets, sigs := groupRRsets(resp.Answer)
+	key := rrsetKey{name: dnsutil.Canonical(name), rrType: rrType}
+	return rrsets[key], sigs[key], nil
+}
+
+// returns the signature which verifies
+func (v *dnssecValidator) verifyRRset(key rrsetKey, rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) (*dns.RRSIG, error) {
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("%w: %s %s is not signed", errDNSSECBogus, key.name, dnsutil.TypeToString(key.rrType))
+	}
+
+	var lastErr error = errors.New("no key matches any of the signatures")
+	for _, sig := range sigs {
+		if !sig.ValidPeriod(v.now) {
+			lastErr = fmt.Errorf("signature by key %d of %s is expired or not yet valid", sig.KeyTag, sig.SignerName)
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(k, rrset, &dns.SignOption{}); err != nil {
+				lastErr = fmt.Errorf("signature by key %d of %s does not verify: %v", sig.KeyTag, sig.SignerName, err)
+				continue
+			}
+			return sig, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s %s: %v", errDNSSECBogus, key.name, dnsutil.TypeToString(key.rrType), lastErr)
+}
+
+// verifySigned authenticates rrset with the keys of each signer of sigs which checkSigner accepts, until one verifies,
+// so that a signature of another signer, e.g. one added on the path, neither fails the RRset nor stands in for the
+// rest. The keys of the signers are fetched at depth, and the signature which verifies is returned.
+func (v *dnssecValidator) verifySigned(ctx context.Context, key rrsetKey, rrset []dns.RR, sigs []*dns.RRSIG, depth int, checkSigner func(signer string) error) (*dns.RRSIG, error) {
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("%w: %s %s is not signed", errDNSSECBogus, key.name, dnsutil.TypeToString(key.rrType))
+	}
+
+	signers := make([]string, 0)
+	signerSigs := make(map[string][]*dns.RRSIG)
+	for _, sig := range sigs {
+		signer := dnsutil.Canonical(sig.SignerName)
+		if _, ok := signerSigs[signer]; !ok {
+			signers = append(signers, signer)
+		}
+		signerSigs[signer] = append(signerSigs[signer], sig)
+	}
+
+	var lastErr error
+	for _, signer := range signers {
+		if err := checkSigner(signer); err != nil {
+			lastErr = err
+			continue
+		}
+		signerKeys, err := v.getZoneKeys(ctx, signer, depth)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		sig, err := v.verifyRRset(key, rrset, signerSigs[signer], signerKeys)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return sig, nil
+	}
+	return nil, lastErr
+}
+
+// returns the keys of dnskeys which are referred by any of the DS records
+func matchDS(dnskeys []dns.RR, dsSet []dns.RR) []*dns.DNSKEY {
+	matched := make([]*dns.DNSKEY, 0)
+	for _, rr := range dnskeys {
+		k, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			continue
+		}
+		for _, dsRR := range dsSet {
+			ds, ok := dsRR.(*dns.DS)
+			if !ok || ds.KeyTag != k.KeyTag() || ds.Algorithm != k.Algorithm {
+				continue
+			}
+			if digest := k.ToDS(ds.DigestType); digest != nil && strings.EqualFold(digest.Digest, ds.Digest) {
+				matched = append(matched, k)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+func (v *dnssecValidator) getAnchors(zone string) []dns.RR {
+	result := make([]dns.RR, 0)
+	for _, ds := range v.anchors {
+		if dnsutil.Canonical(ds.Hdr.Name) == zone {
+			result = append(result, ds)
+		}
+	}
+	return result
+}
+
+// returns the authenticated DNSKEY set of zone
+func (v *dnssecValidator) getZoneKeys(ctx context.Context, zone string, depth int) ([]*dns.DNSKEY, error) {
+	zone = dnsutil.Canonical(zone)
+	if keys, ok := v.keys[zone]; ok {
+		return keys, nil
+	}
+	if depth > maxDNSSECChainDepth {
+		return nil, fmt.Errorf("%w: chain of trust is too long at %s", errDNSSECBogus, zone)
+	}
+
+	dnskeys, dnskeySigs, err := v.queryRRset(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	if len(dnskeys) == 0 {
+		return nil, fmt.Errorf("%w: zone %s has no DNSKEY", errDNSSECBogus, zone)
+	}
+
+	dsSet := v.getAnchors(zone)
+	if len(dsSet) == 0 {
+		if zone == "." {
+			return nil, fmt.Errorf("%w: no trust anchor for the root zone", errDNSSECBogus)
+		}
+
+		dsResp, err := v.query(ctx, zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		_, dsRRsets, dsSigSets := groupRRsets(dsResp.Answer)
+		dsSet = dsRRsets[rrsetKey{name: zone, rrType: dns.TypeDS}]
+		dsSigs := dsSigSets[rrsetKey{name: zone, rrType: dns.TypeDS}]
+		if len(dsSet) == 0 {
+			delegation, err := v.verifyDSDenial(ctx, zone, dsResp.Ns, depth)
+			if err != nil {
+				return nil, err
+			}
+			if !delegation {
+				return nil, fmt.Errorf("%w: %s has DNSKEY, but its parent zone denies the delegation", errDNSSECBogus, zone)
+			}
+			return nil, fmt.Errorf("%w: %s is delegated without DS", errDNSSECInsecure, zone)
+		}
+		_, err = v.verifySigned(ctx, rrsetKey{name: zone, rrType: dns.TypeDS}, dsSet, dsSigs, depth+1, func(parent string) error {
+			if parent == zone || !dnsutil.IsBelow(parent, zone) {
+				return fmt.Errorf("%w: DS of %s is signed by %s, which is not a parent zone", errDNSSECBogus, zone, parent)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sepKeys := matchDS(dnskeys, dsSet)
+	if len(sepKeys) == 0 {
+		return nil, fmt.Errorf("%w: none of the DNSKEY of %s matches its DS", errDNSSECBogus, zone)
+	}
+	if _, err := v.verifyRRset(rrsetKey{name: zone, rrType: dns.TypeDNSKEY}, dnskeys, dnskeySigs, sepKeys); err != nil {
+		return nil, err
+	}
+
+	keys := make([]*dns.DNSKEY, 0, len(dnskeys))
+	for _, rr := range dnskeys {
+		if k, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, k)
+		}
+	}
+	v.keys[zone] = keys
+	v.chain = append(v.chain, zone)
+	return keys, nil
+}
+
+func hasType(bitmap []uint16, rrType uint16) bool {
+	return slices.Contains(bitmap, rrType)
+}
+
+// tells if name falls between owner and next in the canonical order, the last NSEC of a zone wraps around
+func nsecCovers(owner, next, name string) bool {
+	if dns.CompareName(owner, next) >= 0 {
+		return dns.CompareName(owner, name) < 0
+	}
+	return dns.CompareName(owner, name) < 0 && dns.CompareName(name, next) < 0
+}
+
+// same as nsecCovers, but for the base32hex hashes of NSEC3, which sort as plain strings
+func nsec3Covers(owner, next, hash string) bool {
+	if owner >= next {
+		return owner < hash
+	}
+	return owner < hash && hash < next
+}
+
+// the authenticated NSEC and NSEC3 records of a response, which deny the existence of names or of types
+type nsecProof struct {
+	nsecs  []*dns.NSEC
+	nsec3s []*dns.NSEC3
+}
+
+func (p *nsecProof) add(rrset []dns.RR) {
+	for _, rr := range rrset {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			p.nsecs = append(p.nsecs, rr)
+		case *dns.NSEC3:
+			p.nsec3s = append(p.nsec3s, rr)
+		}
+	}
+}
+
+// returns the NSEC owned by name, or the one covering name if covering is true
+func (p *nsecProof) findNSEC(name string, covering bool) *dns.NSEC {
+	for _, nsec := range p.nsecs {
+		owner := dnsutil.Canonical(nsec.Hdr.Name)
+		if !covering && owner == name {
+			return nsec
+		}
+		if covering && nsecCovers(owner, dnsutil.Canonical(nsec.NextDomain), name) {
+			return nsec
+		}
+	}
+	return nil
+}
+
+// same as findNSEC, but compares the hash of name
+func (p *nsecProof) findNSEC3(name string, covering bool) *dns.NSEC3 {
+	for _, nsec3 := range p.nsec3s {
+		ownerHash, _, _ := strings.Cut(dnsutil.Canonical(nsec3.Hdr.Name), ".")
+		ownerHash = strings.ToUpper(ownerHash)
+		hash := dnsutil.NSEC3Name(name, nsec3.Salt, nsec3.Iterations)
+		if !covering && ownerHash == hash {
+			return nsec3
+		}
+		if covering && nsec3Covers(ownerHash, strings.ToUpper(nsec3.NextDomain), hash) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// returns the closest encloser of name proven by the NSEC3 records (RFC 5155 section 8.3), i.e. the deepest
+// existing ancestor, along with the NSEC3 covering the next closer name, nil if there is no such proof
+func (p *nsecProof) findClosestEncloser(name string) (string, *dns.NSEC3) {
+	ancestors := getAncestors(name)
+	for i := len(ancestors) - 1; i > 0; i-- {
+		if p.findNSEC3(ancestors[i-1], false) == nil {
+			continue
+		}
+		return ancestors[i-1], p.findNSEC3(ancestors[i], true)
+	}
+	return "", nil
+}
+
+// returns the closest encloser of name implied by the NSEC covering it, i.e. the deepest ancestor of name
+// which either end of the NSEC is below of
+func getNSECClosestEncloser(cover *dns.NSEC, name string) string {
+	closestEncloser := "."
+	for _, ancestor := range getAncestors(name) {
+		if ancestor != name && (dnsutil.IsBelow(ancestor, dnsutil.Canonical(cover.Hdr.Name)) || dnsutil.IsBelow(ancestor, dnsutil.Canonical(cover.NextDomain))) {
+			closestEncloser = ancestor
+		}
+	}
+	return closestEncloser
+}
+
+func getWildcard(closestEncloser string) string {
+	if closestEncloser == "." {
+		return "*."
+	}
+	return "*." + closestEncloser
+}
+
+// proveDenial tells if the records prove that name doesn't exist if nxdomain is true, or that it has no records of
+// rrType otherwise, see RFC 4035 section 5.4 and RFC 5155 section 8. It fails with errDNSSECInsecure if name falls
+// in an opt-out span, where unsigned delegations may hide.
+func (p *nsecProof) proveDenial(name string, rrType uint16, nxdomain bool) error {
+	name = dnsutil.Canonical(name)
+	typeName := dnsutil.TypeToString(rrType)
+	denies := func(bitmap []uint16) bool {
+		return !hasType(bitmap, rrType) && !hasType(bitmap, dns.TypeCNAME)
+	}
+
+	if len(p.nsecs) > 0 {
+		if !nxdomain {
+			if nsec := p.findNSEC(name, false); nsec != nil {
+				if !denies(nsec.TypeBitMap) {
+					return fmt.Errorf("%w: NSEC of %s says it has %s", errDNSSECBogus, name, typeName)
+				}
+				return nil
+			}
+		}
+		cover := p.findNSEC(name, true)
+		if cover == nil {
+			return fmt.Errorf("%w: no NSEC proves %s absent", errDNSSECBogus, name)
+		}
+
+		wildcard := getWildcard(getNSECClosestEncloser(cover, name))
+		if nsec := p.findNSEC(wildcard, false); nsec != nil {
+			if nxdomain {
+				return fmt.Errorf("%w: wildcard %s exists, %s should have been synthesized from it", errDNSSECBogus, wildcard, name)
+			}
+			if !denies(nsec.TypeBitMap) {
+				return fmt.Errorf("%w: NSEC of %s says it has %s", errDNSSECBogus, wildcard, typeName)
+			}
+			return nil
+		}
+		if nxdomain && p.findNSEC(wildcard, true) != nil {
+			return nil
+		}
+		return fmt.Errorf("%w: no NSEC proves wildcard %s absent", errDNSSECBogus, wildcard)
+	}
+
+	if len(p.nsec3s) > 0 {
+		if !nxdomain {
+			if nsec3 := p.findNSEC3(name, false); nsec3 != nil {
+				if !denies(nsec3.TypeBitMap) {
+					return fmt.Errorf("%w: NSEC3 of %s says it has %s", errDNSSECBogus, name, typeName)
+				}
+				return nil
+			}
+		}
+		closestEncloser, nextCloser := p.findClosestEncloser(name)
+		if nextCloser == nil {
+			return fmt.Errorf("%w: no NSEC3 proves the closest encloser of %s", errDNSSECBogus, name)
+		}
+		if nextCloser.Flags&nsec3FlagOptOut != 0 {
+			return fmt.Errorf("%w: %s falls in an opt-out span of NSEC3", errDNSSECInsecure, name)
+		}
+		wildcard := getWildcard(closestEncloser)
+		if nsec3 := p.findNSEC3(wildcard, false); nsec3 != nil {
+			if nxdomain {
+				return fmt.Errorf("%w: wildcard %s exists, %s should have been synthesized from it", errDNSSECBogus, wildcard, name)
+			}
+			if !denies(nsec3.TypeBitMap) {
+				return fmt.Errorf("%w: NSEC3 of %s says it has %s", errDNSSECBogus, wildcard, typeName)
+			}
+			return nil
+		}
+		if nxdomain && p.findNSEC3(wildcard, true) != nil {
+			return nil
+		}
+		return fmt.Errorf("%w: no NSEC3 proves wildcard %s absent", errDNSSECBogus, wildcard)
+	}
+
+	return fmt.Errorf("%w: no NSEC/NSEC3 proves %s %s absent", errDNSSECBogus, name, typeName)
+}
+
+// tells if the RRset of name signed with sig is synthesized from a wildcard, i.e. sig covers fewer labels than name
+// has, not counting the asterisk of a wildcard owner name (RFC 4035 section 5.3.4)
+func isWildcardExpansion(name string, sig *dns.RRSIG) bool {
+	labels := dnsutil.Labels(name)
+	if strings.HasPrefix(name, "*.") {
+		labels--
+	}
+	return int(sig.Labels) < labels
+}
+
+// proveWildcardExpansion tells if the records prove that name, which an RRset signed over labels labels is synthesized
+// for, doesn't exist, so that the wildcard isn't used in place of a closer match, see RFC 4035 section 5.3.4 and
+// RFC 5155 section 8.8.
+func (p *nsecProof) proveWildcardExpansion(name string, labels uint8) error {
+	name = dnsutil.Canonical(name)
+	closestEncloser, nextCloser := ".", ""
+	for _, ancestor := range getAncestors(name) {
+		switch dnsutil.Labels(ancestor) {
+		case int(labels):
+			closestEncloser = ancestor
+		case int(labels) + 1:
+			nextCloser = ancestor
+		}
+	}
+	wildcard := getWildcard(closestEncloser)
+
+	if len(p.nsecs) > 0 {
+		cover := p.findNSEC(name, true)
+		if cover == nil {
+			return fmt.Errorf("%w: no NSEC proves %s absent, which is synthesized from wildcard %s", errDNSSECBogus, name, wildcard)
+		}
+		if ce := getNSECClosestEncloser(cover, name); ce != closestEncloser {
+			return fmt.Errorf("%w: NSEC proves %s to exist, which is closer to %s than wildcard %s", errDNSSECBogus, ce, name, wildcard)
+		}
+		return nil
+	}
+	if len(p.nsec3s) > 0 {
+		if p.findNSEC3(nextCloser, true) == nil {
+			return fmt.Errorf("%w: no NSEC3 proves the next closer name %s absent, %s is synthesized from wildcard %s", errDNSSECBogus, nextCloser, name, wildcard)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: no NSEC/NSEC3 proves %s absent, which is synthesized from wildcard %s", errDNSSECBogus, name, wildcard)
+}
+
+// authenticateDenials authenticates the NSEC and NSEC3 RRsets in authority with the keys of the signers which
+// checkSigner accepts, fetched at depth, and returns them as a proof
+func (v *dnssecValidator) authenticateDenials(ctx context.Context, authority []dns.RR, depth int, checkSigner func(key rrsetKey, signer string) error) (*nsecProof, error) {
+	keys, rrsets, sigs := groupRRsets(authority)
+	proof := new(nsecProof)
+	for _, key := range keys {
+		if key.rrType != dns.TypeNSEC && key.rrType != dns.TypeNSEC3 {
+			continue
+		}
+		_, err := v.verifySigned(ctx, key, rrsets[key], sigs[key], depth, func(signer string) error {
+			return checkSigner(key, signer)
+		})
+		if err != nil {
+			return nil, err
+		}
+		proof.add(rrsets[key])
+	}
+	return proof, nil
+}
+
+// verifyDSDenial authenticates the NSEC/NSEC3 records in authority, which the parent zone answered a DS query
+// for name with, and tells if they prove name to be a delegation without DS. It fails if the DS is not
+// proven absent, e.g. the denial was stripped, or it's not signed by a zone above name.
+func (v *dnssecValidator) verifyDSDenial(ctx context.Context, name string, authority []dns.RR, depth int) (bool, error) {
+	name = dnsutil.Canonical(name)
+	proof, err := v.authenticateDenials(ctx, authority, depth+1, func(key rrsetKey, signer string) error {
+		if signer == name || !dnsutil.IsBelow(signer, name) || !dnsutil.IsBelow(signer, key.name) {
+			return fmt.Errorf("%w: denial of DS of %s is signed by %s, which is not a parent zone", errDNSSECBogus, name, signer)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if nsec := proof.findNSEC(name, false); nsec != nil {
+		if hasType(nsec.TypeBitMap, dns.TypeDS) {
+			return false, fmt.Errorf("%w: NSEC of %s says it has DS", errDNSSECBogus, name)
+		}
+		return hasType(nsec.TypeBitMap, dns.TypeNS), nil
+	}
+	if proof.findNSEC(name, true) != nil {
+		// name doesn't exist, so it's no delegation
+		return false, nil
+	}
+	if nsec3 := proof.findNSEC3(name, false); nsec3 != nil {
+		if hasType(nsec3.TypeBitMap, dns.TypeDS) {
+			return false, fmt.Errorf("%w: NSEC3 of %s says it has DS", errDNSSECBogus, name)
+		}
+		return hasType(nsec3.TypeBitMap, dns.TypeNS), nil
+	}
+	if nsec3 := proof.findNSEC3(name, true); nsec3 != nil {
+		// an opt-out span may hide unsigned delegations (RFC 5155 section 6), otherwise name doesn't exist
+		return nsec3.Flags&nsec3FlagOptOut != 0, nil
+	}
+	return false, fmt.Errorf("%w: no DS for %s, and no signed NSEC/NSEC3 proving it absent", errDNSSECBogus, name)
+}
+
+// returns name and its ancestors below the root, the closest to the root first
+func getAncestors(name string) []string {
+	result := make([]string, 0)
+	for off, end := 0, false; !end; off, end = dnsutil.Next(name, off) {
+		result = append(result, name[off:])
+	}
+	slices.Reverse(result)
+	return result
+}
+
+// proveInsecure walks from the root down to name, and succeeds (with errDNSSECInsecure) only if a
+// delegation on the way is proven to have no DS, so that unsigned records of name are expected.
+func (v *dnssecValidator) proveInsecure(ctx context.Context, name string) error {
+	name = dnsutil.Canonical(name)
+	zone := "."
+	for _, candidate := range getAncestors(name) {
+		if candidate == "." {
+			continue
+		}
+		resp, err := v.query(ctx, candidate, dns.TypeDS)
+		if err != nil {
+			return err
+		}
+		_, rrsets, _ := groupRRsets(resp.Answer)
+		if len(rrsets[rrsetKey{name: candidate, rrType: dns.TypeDS}]) > 0 {
+			if _, err := v.getZoneKeys(ctx, candidate, 0); err != nil {
+				return err
+			}
+			zone = candidate
+			continue
+		}
+
+		delegation, err := v.verifyDSDenial(ctx, candidate, resp.Ns, 0)
+		if err != nil {
+			return err
+		}
+		if delegation {
+			return fmt.Errorf("%w: %s is delegated without DS", errDNSSECInsecure, candidate)
+		}
+	}
+	return fmt.Errorf("%w: %s is in the signed zone %s, but not signed", errDNSSECBogus, name, zone)
+}
+
+// Validate authenticates every RRset in the answer section of resp, or in the authority section
+// if the answer is empty (NXDOMAIN or NODATA), in which case the NSEC/NSEC3 records also have
+// to prove that the name, or the type of the question doesn't exist. Likewise, the NSEC/NSEC3 records
+// in the authority section have to prove that no closer match exists for an answer synthesized from a wildcard.
+func (v *dnssecValidator) Validate(ctx context.Context, resp *dns.Msg) *DNSSECValidation {
+	result := &DNSSECValidation{Status: DNSSECStatusSecure}
+	defer func() {
+		result.Chain = v.chain
+	}()
+
+	records := resp.Answer
+	if len(records) == 0 {
+		records = resp.Ns
+	}
+	keys, rrsets, sigs := groupRRsets(records)
+	if len(keys) == 0 {
+		result.Status = DNSSECStatusIndeterminate
+		result.Reason = "nothing to validate in the response"
+		return result
+	}
+
+	checkInZone := func(key rrsetKey, signer string) error {
+		if !dnsutil.IsBelow(signer, key.name) {
+			return fmt.Errorf("%w: %s %s is signed by %s, which is out of zone", errDNSSECBogus, key.name, dnsutil.TypeToString(key.rrType), signer)
+		}
+		return nil
+	}
+
+	// unsigned records are fine only if they are proven to be in an unsigned zone
+	insecureReason := ""
+	// the names of the RRsets synthesized from wildcards, along with the labels their signatures cover
+	wildcardLabels := make(map[string]uint8)
+	for _, key := range keys {
+		keySigs := sigs[key]
+		var err error
+		if len(keySigs) == 0 {
+			err = v.proveInsecure(ctx, key.name)
+		} else {
+			var sig *dns.RRSIG
+			sig, err = v.verifySigned(ctx, key, rrsets[key], keySigs, 0, func(signer string) error {
+				return checkInZone(key, signer)
+			})
+			if err == nil && isWildcardExpansion(key.name, sig) {
+				wildcardLabels[key.name] = sig.Labels
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, errDNSSECInsecure) {
+			insecureReason = err.Error()
+			continue
+		}
+
+		if errors.Is(err, errDNSSECBogus) {
+			result.Status = DNSSECStatusBogus
+		} else {
+			result.Status = DNSSECStatusIndeterminate
+		}
+		result.Reason = err.Error()
+		return result
+	}
+	if insecureReason != "" {
+		result.Status = DNSSECStatusInsecure
+		result.Reason = insecureReason
+		return result
+	}
+
+	if len(resp.Answer) > 0 && len(wildcardLabels) > 0 {
+		// what proves that no closer match exists is in the authority section
+		proof, err := v.authenticateDenials(ctx, resp.Ns, 0, checkInZone)
+		if err == nil {
+			for _, key := range keys {
+				if labels, ok := wildcardLabels[key.name]; ok {
+					if err = proof.proveWildcardExpansion(key.name, labels); err != nil {
+						break
+					}
+				}
+			}
+		}
+		if err != nil {
+			if errors.Is(err, errDNSSECBogus) {
+				result.Status = DNSSECStatusBogus
+			} else {
+				result.Status = DNSSECStatusIndeterminate
+			}
+			result.Reason = err.Error()
+			return result
+		}
+	}
+
+	if len(resp.Answer) == 0 {
+		if len(resp.Question) == 0 {
+			result.Status = DNSSECStatusIndeterminate
+			result.Reason = "no question to prove the denial of"
+			return result
+		}
+		proof := new(nsecProof)
+		for _, key := range keys {
+			proof.add(rrsets[key])
+		}
+		question := resp.Question[0]
+		err := proof.proveDenial(question.Header().Name, dns.RRToType(question), resp.Rcode == dns.RcodeNameError)
+		if errors.Is(err, errDNSSECInsecure) {
+			result.Status = DNSSECStatusInsecure
+			result.Reason = err.Error()
+		} else if err != nil {
+			result.Status = DNSSECStatusBogus
+			result.Reason = err.Error()
+		}
+	}
+	return result
+}
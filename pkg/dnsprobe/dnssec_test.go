@@ -0,0 +1,436 @@
+package dnsprobe
+
+import (
+	"context"
+	"crypto"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+type testZone struct {
+	name   string
+	key    *dns.DNSKEY
+	signer crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:    dns.Header{Name: name, Class: dns.ClassINET, TTL: 3600},
+		DNSKEY: rdata.DNSKEY{Flags: dns.FlagZONE | dns.FlagSEP, Protocol: 3, Algorithm: dns.ED25519},
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("failed to generate key for %s: %v", name, err)
+	}
+	return &testZone{name: name, key: key, signer: priv.(crypto.Signer)}
+}
+
+func (z *testZone) sign(t *testing.T, rrset ...dns.RR) []dns.RR {
+	t.Helper()
+	now := time.Now()
+	// the asterisk of a wildcard owner name isn't counted
+	labels := dnsutil.Labels(rrset[0].Header().Name)
+	if strings.HasPrefix(rrset[0].Header().Name, "*.") {
+		labels--
+	}
+	sig := &dns.RRSIG{
+		Hdr: dns.Header{Name: rrset[0].Header().Name, Class: dns.ClassINET, TTL: 3600},
+		RRSIG: rdata.RRSIG{
+			TypeCovered: dns.RRToType(rrset[0]),
+			Algorithm:   z.key.Algorithm,
+			Labels:      uint8(labels),
+			OrigTTL:     rrset[0].Header().TTL,
+			Inception:   uint32(now.Add(-time.Hour).Unix()),
+			Expiration:  uint32(now.Add(time.Hour).Unix()),
+			KeyTag:      z.key.KeyTag(),
+			SignerName:  z.name,
+		},
+	}
+	if err := sig.Sign(z.signer, rrset, &dns.SignOption{}); err != nil {
+		t.Fatalf("failed to sign %s: %v", rrset[0].Header().Name, err)
+	}
+	return append(append([]dns.RR{}, rrset...), sig)
+}
+
+// a resolver serving a signed root and a signed example. zone
+type testResolver map[rrsetKey][]dns.RR
+
+func (r testResolver) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	q := m.Question[0]
+	resp := new(dns.Msg)
+	resp.Response = true
+	for _, rr := range r[rrsetKey{name: dnsutil.Canonical(q.Header().Name), rrType: dns.RRToType(q)}] {
+		rrType := dns.RRToType(rr)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			rrType = sig.TypeCovered
+		}
+		// denials go to the authority section
+		if rrType == dns.TypeNSEC || rrType == dns.TypeNSEC3 {
+			resp.Ns = append(resp.Ns, rr)
+		} else {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	return resp, nil
+}
+
+func newTestNSEC(name, next string, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr:  dns.Header{Name: name, Class: dns.ClassINET, TTL: 3600},
+		NSEC: rdata.NSEC{NextDomain: next, TypeBitMap: types},
+	}
+}
+
+func newTestChain(t *testing.T, withDS bool) (testResolver, []*dns.DS, *testZone, *testZone) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+
+	resolver := testResolver{
+		{name: ".", rrType: dns.TypeDNSKEY}:        root.sign(t, root.key),
+		{name: "example.", rrType: dns.TypeDNSKEY}: example.sign(t, example.key),
+	}
+	if withDS {
+		resolver[rrsetKey{name: "example.", rrType: dns.TypeDS}] = root.sign(t, example.key.ToDS(dns.SHA256))
+	}
+	return resolver, []*dns.DS{root.key.ToDS(dns.SHA256)}, root, example
+}
+
+func newTestAnswer(t *testing.T, zone *testZone, addr string) []dns.RR {
+	a := &dns.A{
+		Hdr: dns.Header{Name: "www.example.", Class: dns.ClassINET, TTL: 300},
+		A:   rdata.A{Addr: netip.MustParseAddr(addr)},
+	}
+	return zone.sign(t, a)
+}
+
+func TestDNSSECValidator_Secure(t *testing.T) {
+	resolver, anchors, _, example := newTestChain(t, true)
+	validator := newDNSSECValidator(anchors)
+	validator.exchange = resolver.exchange
+
+	result := validator.Validate(context.Background(), &dns.Msg{Answer: newTestAnswer(t, example, "192.0.2.1")})
+	if result.Status != DNSSECStatusSecure {
+		t.Fatalf("expected secure, got %s: %s", result.Status, result.Reason)
+	}
+	if len(result.Chain) != 2 || result.Chain[0] != "." || result.Chain[1] != "example." {
+		t.Fatalf("unexpected chain: %v", result.Chain)
+	}
+}
+
+func TestDNSSECValidator_Bogus(t *testing.T) {
+	resolver, anchors, _, example := newTestChain(t, true)
+	validator := newDNSSECValidator(anchors)
+	validator.exchange = resolver.exchange
+
+	answer := newTestAnswer(t, example, "192.0.2.1")
+	// spoofed after being signed
+	answer[0].(*dns.A).Addr = netip.MustParseAddr("198.51.100.1")
+
+	result := validator.Validate(context.Background(), &dns.Msg{Answer: answer})
+	if result.Status != DNSSECStatusBogus {
+		t.Fatalf("expected bogus, got %s: %s", result.Status, result.Reason)
+	}
+}
+
+func TestDNSSECValidator_Insecure(t *testing.T) {
+	resolver, anchors, root, example := newTestChain(t, false)
+	// the root proves example. to be delegated without DS
+	resolver[rrsetKey{name: "example.", rrType: dns.TypeDS}] = root.sign(t, newTestNSEC("example.", "next.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC))
+
+	for _, answer := range [][]dns.RR{newTestAnswer(t, example, "192.0.2.1"), newTestAnswer(t, example, "192.0.2.1")[:1]} {
+		validator := newDNSSECValidator(anchors)
+		validator.exchange = resolver.exchange
+
+		result := validator.Validate(context.Background(), &dns.Msg{Answer: answer})
+		if result.Status != DNSSECStatusInsecure {
+			t.Fatalf("expected insecure, got %s: %s", result.Status, result.Reason)
+		}
+	}
+}
+
+func TestDNSSECValidator_StrippedDS(t *testing.T) {
+	// the DS of example. is gone, and nothing proves it absent
+	resolver, anchors, _, example := newTestChain(t, false)
+	validator := newDNSSECValidator(anchors)
+	validator.exchange = resolver.exchange
+
+	result := validator.Validate(context.Background(), &dns.Msg{Answer: newTestAnswer(t, example, "192.0.2.1")})
+	if result.Status != DNSSECStatusBogus {
+		t.Fatalf("expected bogus, got %s: %s", result.Status, result.Reason)
+	}
+
+	// a denial, which is not signed by the parent
+	resolver[rrsetKey{name: "example.", rrType: dns.TypeDS}] = example.sign(t, newTestNSEC("example.", "next.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC))
+	validator = newDNSSECValidator(anchors)
+	validator.exchange = resolver.exchange
+	result = validator.Validate(context.Background(), &dns.Msg{Answer: newTestAnswer(t, example, "192.0.2.1")})
+	if result.Status != DNSSECStatusBogus {
+		t.Fatalf("expected bogus, got %s: %s", result.Status, result.Reason)
+	}
+}
+
+func TestDNSSECValidator_StrippedRRSIG(t *testing.T) {
+	resolver, anchors, _, example := newTestChain(t, true)
+	resolver[rrsetKey{name: "www.example.", rrType: dns.TypeDS}] = example.sign(t, newTestNSEC("www.example.", "zzz.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))
+	validator := newDNSSECValidator(anchors)
+	validator.exchange = resolver.exchange
+
+	answer := newTestAnswer(t, example, "192.0.2.1")[:1]
+	result := validator.Validate(context.Background(), &dns.Msg{Answer: answer})
+	if result.Status != DNSSECStatusBogus {
+		t.Fatalf("expected bogus, got %s: %s", result.Status, result.Reason)
+	}
+}
+
+func newTestNSEC3(name, next string, optOut bool, types ...uint16) *dns.NSEC3 {
+	var flags uint8
+	if optOut {
+		flags = nsec3FlagOptOut
+	}
+	return &dns.NSEC3{
+		Hdr:   dns.Header{Name: strings.ToLower(name) + ".example.", Class: dns.ClassINET, TTL: 3600},
+		NSEC3: rdata.NSEC3{Hash: dns.SHA1, Flags: flags, NextDomain: next, TypeBitMap: types},
+	}
+}
+
+// a negative response of the example. zone, each of the denials is signed as an RRset of its own
+func newTestDenial(t *testing.T, zone *testZone, qname string, qtype uint16, rcode uint16, denials ...dns.RR) *dns.Msg {
+	soa := &dns.SOA{
+		Hdr: dns.Header{Name: "example.", Class: dns.ClassINET, TTL: 300},
+		SOA: rdata.SOA{Ns: "ns.example.", Mbox: "hostmaster.example.", Serial: 1},
+	}
+	resp := dns.NewMsg(qname, qtype)
+	resp.Response = true
+	resp.Rcode = rcode
+	resp.Ns = zone.sign(t, soa)
+	for _, rr := range denials {
+		resp.Ns = append(resp.Ns, zone.sign(t, rr)...)
+	}
+	return resp
+}
+
+func TestDNSSECValidator_Denial(t *testing.T) {
+	resolver, anchors, _, example := newTestChain(t, true)
+
+	// the NSEC3 of the closest encloser covers no other hash, what covers the rest spans the whole hash space
+	const base32hex = "0123456789ABCDEFGHIJKLMNOPQRSTUV"
+	ceHash := dnsutil.NSEC3Name("example.", "", 0)
+	ceNext := ceHash[:len(ceHash)-1] + string(base32hex[strings.IndexByte(base32hex, ceHash[len(ceHash)-1])+1])
+	firstHash, lastHash := strings.Repeat("0", len(ceHash)), strings.Repeat("V", len(ceHash))
+	for _, name := range []string{"nope.example.", "*.example."} {
+		if hash := dnsutil.NSEC3Name(name, "", 0); hash == firstHash || hash == lastHash {
+			t.Fatalf("hash of %s is at the edge of the hash space", name)
+		}
+	}
+
+	tests := []struct {
+		name string
+		resp *dns.Msg
+		want DNSSECStatus
+	}{
+		{
+			name: "nsec nxdomain",
+			resp: newTestDenial(t, example, "nope.example.", dns.TypeA, dns.RcodeNameError,
+				newTestNSEC("mail.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC),
+				newTestNSEC("example.", "mail.example.", dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY)),
+			want: DNSSECStatusSecure,
+		},
+		{
+			name: "nsec nxdomain not covering the name",
+			resp: newTestDenial(t, example, "nope.example.", dns.TypeA, dns.RcodeNameError,
+				newTestNSEC("example.", "mail.example.", dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY)),
+			want: DNSSECStatusBogus,
+		},
+		{
+			name: "nsec nxdomain with the wildcard existing",
+			resp: newTestDenial(t, example, "nope.example.", dns.TypeA, dns.RcodeNameError,
+				newTestNSEC("mail.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC),
+				newTestNSEC("*.example.", "mail.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)),
+			want: DNSSECStatusBogus,
+		},
+		{
+			name: "nsec nodata",
+			resp: newTestDenial(t, example, "www.example.", dns.TypeAAAA, dns.RcodeSuccess,
+				newTestNSEC("www.example.", "zzz.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)),
+			want: DNSSECStatusSecure,
+		},
+		{
+			name: "nsec nodata of a type the name has",
+			resp: newTestDenial(t, example, "www.example.", dns.TypeA, dns.RcodeSuccess,
+				newTestNSEC("www.example.", "zzz.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)),
+			want: DNSSECStatusBogus,
+		},
+		{
+			name: "nsec3 nxdomain",
+			resp: newTestDenial(t, example, "nope.example.", dns.TypeA, dns.RcodeNameError,
+				newTestNSEC3(ceHash, ceNext, false, dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeDNSKEY),
+				newTestNSEC3(firstHash, lastHash, false, dns.TypeA, dns.TypeRRSIG)),
+			want: DNSSECStatusSecure,
+		},
+		{
+			name: "nsec3 nxdomain without the closest encloser",
+			resp: newTestDenial(t, example, "nope.example.", dns.TypeA, dns.RcodeNameError,
+				newTestNSEC3(firstHash, lastHash, false, dns.TypeA, dns.TypeRRSIG)),
+			want: DNSSECStatusBogus,
+		},
+		{
+			name: "nsec3 nxdomain in an opt-out span",
+			resp: newTestDenial(t, example, "nope.example.", dns.TypeA, dns.RcodeNameError,
+				newTestNSEC3(ceHash, ceNext, false, dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeDNSKEY),
+				newTestNSEC3(firstHash, lastHash, true, dns.TypeA, dns.TypeRRSIG)),
+			want: DNSSECStatusInsecure,
+		},
+		{
+			name: "nsec3 nodata",
+			resp: newTestDenial(t, example, "example.", dns.TypeA, dns.RcodeSuccess,
+				newTestNSEC3(ceHash, ceNext, false, dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeDNSKEY)),
+			want: DNSSECStatusSecure,
+		},
+		{
+			name: "nsec3 nodata of a type the name has",
+			resp: newTestDenial(t, example, "example.", dns.TypeSOA, dns.RcodeSuccess,
+				newTestNSEC3(ceHash, ceNext, false, dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeDNSKEY)),
+			want: DNSSECStatusBogus,
+		},
+	}
+	for _, tt := range tests {
+		validator := newDNSSECValidator(anchors)
+		validator.exchange = resolver.exchange
+		if result := validator.Validate(context.Background(), tt.resp); result.Status != tt.want {
+			t.Errorf("%s: expected %s, got %s: %s", tt.name, tt.want, result.Status, result.Reason)
+		}
+	}
+}
+
+// an answer of name synthesized from the wildcard *.example., signed by zone, along with the denials in the authority section
+func newTestWildcardAnswer(t *testing.T, zone *testZone, name string, denials ...dns.RR) *dns.Msg {
+	a := &dns.A{
+		Hdr: dns.Header{Name: "*.example.", Class: dns.ClassINET, TTL: 300},
+		A:   rdata.A{Addr: netip.MustParseAddr("192.0.2.1")},
+	}
+	resp := dns.NewMsg(name, dns.TypeA)
+	resp.Response = true
+	for _, rr := range zone.sign(t, a) {
+		rr.Header().Name = name
+		resp.Answer = append(resp.Answer, rr)
+	}
+	for _, rr := range denials {
+		resp.Ns = append(resp.Ns, zone.sign(t, rr)...)
+	}
+	return resp
+}
+
+func TestDNSSECValidator_Wildcard(t *testing.T) {
+	resolver, anchors, _, example := newTestChain(t, true)
+
+	// the NSEC3 covering the next closer name spans the whole hash space
+	const base32hex = "0123456789ABCDEFGHIJKLMNOPQRSTUV"
+	ceHash := dnsutil.NSEC3Name("example.", "", 0)
+	ceNext := ceHash[:len(ceHash)-1] + string(base32hex[strings.IndexByte(base32hex, ceHash[len(ceHash)-1])+1])
+	firstHash, lastHash := strings.Repeat("0", len(ceHash)), strings.Repeat("V", len(ceHash))
+	if hash := dnsutil.NSEC3Name("nope.example.", "", 0); hash == firstHash || hash == lastHash {
+		t.Fatalf("hash of nope.example. is at the edge of the hash space")
+	}
+
+	tests := []struct {
+		name string
+		resp *dns.Msg
+		want DNSSECStatus
+	}{
+		{
+			name: "nsec proving no closer match",
+			resp: newTestWildcardAnswer(t, example, "nope.example.",
+				newTestNSEC("mail.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)),
+			want: DNSSECStatusSecure,
+		},
+		{
+			name: "no denial",
+			resp: newTestWildcardAnswer(t, example, "nope.example."),
+			want: DNSSECStatusBogus,
+		},
+		{
+			name: "nsec not covering the name",
+			resp: newTestWildcardAnswer(t, example, "nope.example.",
+				newTestNSEC("example.", "mail.example.", dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY)),
+			want: DNSSECStatusBogus,
+		},
+		{
+			name: "nsec proving a closer encloser",
+			resp: newTestWildcardAnswer(t, example, "x.nope.example.",
+				newTestNSEC("nope.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)),
+			want: DNSSECStatusBogus,
+		},
+		{
+			name: "nsec3 covering the next closer name",
+			resp: newTestWildcardAnswer(t, example, "nope.example.",
+				newTestNSEC3(firstHash, lastHash, false, dns.TypeA, dns.TypeRRSIG)),
+			want: DNSSECStatusSecure,
+		},
+		{
+			name: "nsec3 not covering the next closer name",
+			resp: newTestWildcardAnswer(t, example, "nope.example.",
+				newTestNSEC3(ceHash, ceNext, false, dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeDNSKEY)),
+			want: DNSSECStatusBogus,
+		},
+	}
+	for _, tt := range tests {
+		validator := newDNSSECValidator(anchors)
+		validator.exchange = resolver.exchange
+		if result := validator.Validate(context.Background(), tt.resp); result.Status != tt.want {
+			t.Errorf("%s: expected %s, got %s: %s", tt.name, tt.want, result.Status, result.Reason)
+		}
+	}
+
+	// a wildcard answer spoofed for another name, the signature covers the owner name of the wildcard only
+	resp := newTestWildcardAnswer(t, example, "nope.example.",
+		newTestNSEC("mail.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))
+	resp.Answer[0].(*dns.A).Addr = netip.MustParseAddr("198.51.100.1")
+	validator := newDNSSECValidator(anchors)
+	validator.exchange = resolver.exchange
+	if result := validator.Validate(context.Background(), resp); result.Status != DNSSECStatusBogus {
+		t.Errorf("spoofed: expected bogus, got %s: %s", result.Status, result.Reason)
+	}
+}
+
+func TestDNSSECValidator_SignerOfAnySignature(t *testing.T) {
+	resolver, anchors, _, example := newTestChain(t, true)
+	other := newTestZone(t, "other.")
+
+	// a signature out of zone ahead of the one which verifies
+	answer := newTestAnswer(t, example, "192.0.2.1")
+	stray := other.sign(t, answer[0])[1]
+	answer = []dns.RR{answer[0], stray, answer[1]}
+
+	validator := newDNSSECValidator(anchors)
+	validator.exchange = resolver.exchange
+	if result := validator.Validate(context.Background(), &dns.Msg{Answer: answer}); result.Status != DNSSECStatusSecure {
+		t.Fatalf("expected secure, got %s: %s", result.Status, result.Reason)
+	}
+
+	// only the stray signature is left
+	validator = newDNSSECValidator(anchors)
+	validator.exchange = resolver.exchange
+	if result := validator.Validate(context.Background(), &dns.Msg{Answer: answer[:2]}); result.Status != DNSSECStatusBogus {
+		t.Fatalf("expected bogus, got %s: %s", result.Status, result.Reason)
+	}
+}
+
+func TestParseTrustAnchors_Default(t *testing.T) {
+	anchors, err := parseTrustAnchors(nil)
+	if err != nil {
+		t.Fatalf("failed to parse default trust anchors: %v", err)
+	}
+	if len(anchors) != len(defaultTrustAnchors) || anchors[0].KeyTag != 20326 {
+		t.Fatalf("unexpected default trust anchors: %v", anchors)
+	}
+	if _, err := parseTrustAnchors([]string{". IN A 192.0.2.1"}); err == nil {
+		t.Fatalf("expected error on non-DS trust anchor")
+	}
+}
@@ -0,0 +1,233 @@
+package dnsprobe
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"github.com/quic-go/quic-go"
+	quicHTTP3 "github.com/quic-go/quic-go/http3"
+)
+
+type DoHMethod string
+
+const (
+	DoHMethodPOST DoHMethod = "post" // RFC8484, application/dns-message in the request body, the default
+	DoHMethodGET  DoHMethod = "get"  // RFC8484, base64url encoded application/dns-message in the `dns` query parameter
+	DoHMethodJSON DoHMethod = "json" // The JSON API served by Google and Cloudflare, application/dns-json
+)
+
+const (
+	dohMIMEMessage = "application/dns-message"
+	dohMIMEJSON    = "application/dns-json"
+)
+
+// The answer format of the JSON API, see https://developers.google.com/speed/public-dns/docs/doh/json
+type dohJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type dohJSONResponse struct {
+	Status    uint16          `json:"Status"`
+	TC        bool            `json:"TC"`
+	RD        bool            `json:"RD"`
+	RA        bool            `json:"RA"`
+	AD        bool            `json:"AD"`
+	CD        bool            `json:"CD"`
+	Answer    []dohJSONRecord `json:"Answer"`
+	Authority []dohJSONRecord `json:"Authority"`
+}
+
+func getDoHRequest(ctx context.Context, method DoHMethod, urlStr string, m *dns.Msg, serverName string) (*http.Request, error) {
+	urlObj, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DoH url %s: %w", urlStr, err)
+	}
+
+	var req *http.Request
+	switch method {
+	case "", DoHMethodPOST:
+		if err := m.Pack(); err != nil {
+			return nil, err
+		}
+		// m itself is an io.WriterTo which only writes to a dns.ResponseWriter, so the packed bytes are sent instead
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, urlObj.String(), bytes.NewReader(m.Data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", dohMIMEMessage)
+		req.Header.Set("Content-Type", dohMIMEMessage)
+	case DoHMethodGET:
+		// As per RFC8484, the ID should be 0 so that the responses are cache friendly,
+		// https://datatracker.ietf.org/doc/html/rfc8484#section-4.1
+		m.ID = 0
+		if err := m.Pack(); err != nil {
+			return nil, err
+		}
+		query := urlObj.Query()
+		query.Set("dns", base64.RawURLEncoding.EncodeToString(m.Data))
+		urlObj.RawQuery = query.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, urlObj.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", dohMIMEMessage)
+	case DoHMethodJSON:
+		if len(m.Question) == 0 {
+			return nil, fmt.Errorf("no question in the query")
+		}
+		q := m.Question[0]
+		query := urlObj.Query()
+		query.Set("name", q.Header().Name)
+		query.Set("type", dnsutil.TypeToString(dns.RRToType(q)))
+		if m.Security {
+			query.Set("do", "1")
+		}
+		if m.CheckingDisabled {
+			query.Set("cd", "1")
+		}
+		for _, rr := range m.Pseudo {
+			if subnet, ok := rr.(*dns.SUBNET); ok {
+				query.Set("edns_client_subnet", netip.PrefixFrom(subnet.Address, int(subnet.Netmask)).String())
+			}
+		}
+		urlObj.RawQuery = query.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, urlObj.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", dohMIMEJSON)
+	default:
+		return nil, fmt.Errorf("invalid DoH method: %s", method)
+	}
+
+	if serverName != "" {
+		// Note, such serverName is actually the Host (or :authority) header field
+		req.Host = serverName
+	}
+	return req, nil
+}
+
+func toDoHJSONRRs(records []dohJSONRecord) []dns.RR {
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		rr, err := dns.New(fmt.Sprintf("%s %d IN %s %s", dnsutil.Fqdn(record.Name), record.TTL, dnsutil.TypeToString(record.Type), record.Data))
+		if err != nil {
+			// e.g. types unknown to us, there is nothing we could do about it
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func parseDoHJSONResponse(m *dns.Msg, body []byte) (*dns.Msg, error) {
+	jsonResp := new(dohJSONResponse)
+	if err := json.Unmarshal(body, jsonResp); err != nil {
+		return nil, fmt.Errorf("failed to decode DoH JSON response: %w", err)
+	}
+
+	ansM := new(dns.Msg)
+	ansM.ID = m.ID
+	ansM.Response = true
+	ansM.Rcode = jsonResp.Status
+	ansM.Truncated = jsonResp.TC
+	ansM.RecursionDesired = jsonResp.RD
+	ansM.RecursionAvailable = jsonResp.RA
+	ansM.AuthenticatedData = jsonResp.AD
+	ansM.CheckingDisabled = jsonResp.CD
+	ansM.Question = m.Question
+	ansM.Answer = toDoHJSONRRs(jsonResp.Answer)
+	ansM.Ns = toDoHJSONRRs(jsonResp.Authority)
+	return ansM, nil
+}
+
+// replaces the host part of addr, i.e. what the http transport is about to dial, with the bootstrapped one
+func getBootstrappedDialAddr(addr string, bootstrapped netip.Addr) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		port = "443"
+	}
+	return net.JoinHostPort(bootstrapped.String(), port)
+}
+
+// when bootstrapped is valid, connections are made to it instead of the host in urlStr, which is still used for SNI and the Host header
+func getDoHClient(transport Transport, tlsConfig *tls.Config, bootstrapped netip.Addr) *http.Client {
+	if transport == TransportHTTP2 {
+		tr := &http.Transport{
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: true,
+		}
+		if bootstrapped.IsValid() {
+			dialer := &net.Dialer{}
+			tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, getBootstrappedDialAddr(addr, bootstrapped))
+			}
+		}
+		return &http.Client{Transport: tr}
+	}
+
+	tr := &quicHTTP3.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	if bootstrapped.IsValid() {
+		tr.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+			return quic.DialAddrEarly(ctx, getBootstrappedDialAddr(addr, bootstrapped), tlsCfg, cfg)
+		}
+	}
+	return &http.Client{Transport: tr}
+}
+
+// connections of cli are reused by subsequent exchanges, it's up to the caller to close them
+func exchangeDoH(ctx context.Context, cli *http.Client, method DoHMethod, urlStr string, serverName string, m *dns.Msg) (*dns.Msg, error) {
+	req, err := getDoHRequest(ctx, method, urlStr, m, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DoH request: %w", err)
+	}
+
+	resp, err := cli.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send DoH request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("DoH request failed with status code: %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DoH response: %w", err)
+	}
+
+	if method == DoHMethodJSON {
+		return parseDoHJSONResponse(m, body)
+	}
+
+	ansM := new(dns.Msg)
+	ansM.Data = body
+	if err := ansM.Unpack(); err != nil {
+		return nil, fmt.Errorf("failed to unpack DoH response: %w", err)
+	}
+	return ansM, nil
+}
+
+// every exchange is made over a new connection, so that the timings of the probe are those of a cold start
+func getDoHExchangeFunc(transport Transport, method DoHMethod, urlStr string, serverName string, tlsConfig *tls.Config, bootstrapped netip.Addr) exchangeFunc {
+	return func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		cli := getDoHClient(transport, tlsConfig, bootstrapped)
+		defer cli.CloseIdleConnections()
+		return exchangeDoH(ctx, cli, method, urlStr, serverName, m)
+	}
+}
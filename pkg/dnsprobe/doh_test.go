@@ -0,0 +1,154 @@
+package dnsprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+// serves the three flavors of DoH over h2, reports whatever is wrong about a request as a 400 with the reason
+func startTestDoHServer(t *testing.T) (*httptest.Server, *x509.CertPool) {
+	answer := func(w http.ResponseWriter, wire []byte) {
+		req := new(dns.Msg)
+		req.Data = wire
+		if err := req.Unpack(); err != nil || len(req.Question) == 0 {
+			http.Error(w, fmt.Sprintf("failed to unpack the query: %v", err), http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		dnsutil.SetReply(m, req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.Header{Name: req.Question[0].Header().Name, Class: dns.ClassINET, TTL: 300},
+			A:   rdata.A{Addr: netip.MustParseAddr("192.0.2.1")},
+		}}
+		if err := m.Pack(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohMIMEMessage)
+		w.Write(m.Data)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "expected h2, got "+r.Proto, http.StatusBadRequest)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMIMEMessage || r.Header.Get("Accept") != dohMIMEMessage {
+				http.Error(w, "unexpected content type or accept", http.StatusBadRequest)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			answer(w, body)
+		case r.Header.Get("Accept") == dohMIMEMessage:
+			encoded := r.URL.Query().Get("dns")
+			if encoded == "" || strings.Contains(encoded, "=") {
+				http.Error(w, "expected unpadded base64url in dns, got "+encoded, http.StatusBadRequest)
+				return
+			}
+			wire, err := base64.RawURLEncoding.DecodeString(encoded)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if wire[0] != 0 || wire[1] != 0 {
+				http.Error(w, "expected the id of the query to be 0", http.StatusBadRequest)
+				return
+			}
+			answer(w, wire)
+		case r.Header.Get("Accept") == dohMIMEJSON:
+			query := r.URL.Query()
+			w.Header().Set("Content-Type", dohMIMEJSON)
+			switch query.Get("name") {
+			case "www.example.":
+				if query.Get("type") != "A" || query.Get("do") != "1" {
+					http.Error(w, "unexpected query "+r.URL.RawQuery, http.StatusBadRequest)
+					return
+				}
+				io.WriteString(w, `{"Status":0,"TC":true,"RD":true,"RA":true,"AD":true,"Answer":[`+
+					`{"name":"www.example.","type":5,"TTL":300,"data":"cdn.example."},`+
+					`{"name":"cdn.example","type":1,"TTL":60,"data":"192.0.2.1"},`+
+					`{"name":"cdn.example.","type":65280,"TTL":60,"data":"unknown"}]}`)
+			default:
+				io.WriteString(w, `{"Status":3,"Authority":[{"name":"example.","type":6,"TTL":300,"data":"ns.example. hostmaster.example. 1 7200 3600 1209600 300"}]}`)
+			}
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	return server, roots
+}
+
+func TestDoHExchangeFunc(t *testing.T) {
+	server, roots := startTestDoHServer(t)
+	// the certificate of httptest is for example.com, the server is dialed by the bootstrapped address
+	urlStr := strings.Replace(server.URL, "127.0.0.1", "example.com", 1) + "/dns-query"
+	tlsConfig := &tls.Config{RootCAs: roots}
+
+	for _, method := range []DoHMethod{DoHMethodPOST, DoHMethodGET} {
+		exchange := getDoHExchangeFunc(TransportHTTP2, method, urlStr, "", tlsConfig, netip.MustParseAddr("127.0.0.1"))
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		m := dns.NewMsg("www.example.", dns.TypeA)
+		m.ID = 1234
+		resp, err := exchange(ctx, m)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if len(resp.Answer) != 1 || answerToString(resp.Answer[0]) != "192.0.2.1" {
+			t.Fatalf("%s: unexpected answer %v", method, resp.Answer)
+		}
+	}
+}
+
+func TestDoHExchangeFunc_JSON(t *testing.T) {
+	server, roots := startTestDoHServer(t)
+	urlStr := strings.Replace(server.URL, "127.0.0.1", "example.com", 1) + "/resolve"
+	exchange := getDoHExchangeFunc(TransportHTTP2, DoHMethodJSON, urlStr, "", &tls.Config{RootCAs: roots}, netip.MustParseAddr("127.0.0.1"))
+
+	m := dns.NewMsg("www.example.", dns.TypeA)
+	m.Security = true
+	resp, err := exchange(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || !resp.Truncated || !resp.AuthenticatedData || !resp.RecursionAvailable {
+		t.Fatalf("unexpected header of the response: %+v", resp.MsgHeader)
+	}
+	// the record of the unknown type is dropped
+	if len(resp.Answer) != 2 || answerToString(resp.Answer[0]) != "cdn.example." || answerToString(resp.Answer[1]) != "192.0.2.1" {
+		t.Fatalf("unexpected answer: %v", resp.Answer)
+	}
+	if resp.Answer[1].Header().Name != "cdn.example." || resp.Answer[1].Header().TTL != 60 {
+		t.Fatalf("unexpected header of the answer: %v", resp.Answer[1])
+	}
+
+	resp, err = exchange(context.Background(), dns.NewMsg("nope.example.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Fatalf("expected NXDOMAIN with the SOA, got %s %v %v", dnsutil.RcodeToString(resp.Rcode), resp.Answer, resp.Ns)
+	}
+}
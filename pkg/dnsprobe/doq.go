@@ -0,0 +1,144 @@
+package dnsprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// As per RFC9250, https://datatracker.ietf.org/doc/html/rfc9250#section-4.1.1
+const doqALPN = "doq"
+
+// DoQ error code, https://datatracker.ietf.org/doc/html/rfc9250#section-8.4
+const doqNoError quic.ApplicationErrorCode = 0x0
+
+// Session tickets are kept across lookups, so that subsequent queries to the same server could use 0-RTT.
+var doqSessionCache = tls.NewLRUClientSessionCache(256)
+
+type QUICStats struct {
+	// Time from dialing till the QUIC handshake is completed
+	HandshakeTime time.Duration `json:"handshake_time"`
+	Used0RTT      bool          `json:"used_0rtt"`
+}
+
+func stripQUICURLPrefix(s string) string {
+	if after, ok := strings.CutPrefix(s, "quic://"); ok {
+		return after
+	}
+	return s
+}
+
+func getDoQTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	doqTLSConfig := tlsConfig.Clone()
+	doqTLSConfig.MinVersion = tls.VersionTLS13
+	doqTLSConfig.NextProtos = []string{doqALPN}
+	doqTLSConfig.ClientSessionCache = doqSessionCache
+	return doqTLSConfig
+}
+
+// each query is sent over a stream of its own, hence conn could be shared by concurrent exchanges
+func exchangeOnQUICConn(ctx context.Context, conn *quic.Conn, m *dns.Msg) (*dns.Msg, error) {
+	// When sending queries over a QUIC connection, the DNS Message ID MUST be set to 0.
+	m.ID = 0
+	if err := m.Pack(); err != nil {
+		return nil, fmt.Errorf("failed to pack query: %w", err)
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open quic stream: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	// Each message is prefixed with a 2-octet length field, the same as DNS over TCP
+	buf := make([]byte, 2+len(m.Data))
+	binary.BigEndian.PutUint16(buf, uint16(len(m.Data)))
+	copy(buf[2:], m.Data)
+	if _, err := stream.Write(buf); err != nil {
+		return nil, fmt.Errorf("failed to write query to quic stream: %w", err)
+	}
+	// The client MUST send the DNS query over the selected stream, and MUST indicate through the STREAM FIN mechanism that no further data will be sent on that stream.
+	if err := stream.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close the write side of quic stream: %w", err)
+	}
+
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(stream, lenBuf); err != nil {
+		return nil, fmt.Errorf("failed to read response length from quic stream: %w", err)
+	}
+	resp := new(dns.Msg)
+	resp.Data = make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(stream, resp.Data); err != nil {
+		return nil, fmt.Errorf("failed to read response from quic stream: %w", err)
+	}
+	if err := resp.Unpack(); err != nil {
+		return nil, fmt.Errorf("failed to unpack DoQ response: %w", err)
+	}
+	return resp, nil
+}
+
+// onConnected is invoked for each successful exchange with the stats of the underlying QUIC connection.
+func getDoQExchangeFunc(addrPort string, tlsConfig *tls.Config, onConnected func(stats *QUICStats)) (exchangeFunc, error) {
+	addrPort = stripQUICURLPrefix(addrPort)
+	addrPort = appendDNSPort(addrPort, TransportQUIC)
+	addrportObj, err := netip.ParseAddrPort(addrPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse addrport %s as netip.AddrPort: %v", addrPort, err)
+	}
+
+	doqTLSConfig := getDoQTLSConfig(tlsConfig)
+
+	return func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		startedAt := time.Now()
+		conn, err := quic.DialAddrEarly(ctx, addrportObj.String(), doqTLSConfig, &quic.Config{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial quic: %w", err)
+		}
+		defer conn.CloseWithError(doqNoError, "")
+
+		handshakeTimeCh := make(chan time.Duration, 1)
+		go func() {
+			select {
+			case <-conn.HandshakeComplete():
+				handshakeTimeCh <- time.Since(startedAt)
+			case <-ctx.Done():
+			}
+		}()
+
+		resp, err := exchangeOnQUICConn(ctx, conn, m)
+		if errors.Is(err, quic.Err0RTTRejected) {
+			// e.g. the ticket is of a server restarted since, whatever sent in 0-RTT is discarded, so the query is sent again after the handshake
+			var nextConn *quic.Conn
+			if nextConn, err = conn.NextConnection(ctx); err == nil {
+				resp, err = exchangeOnQUICConn(ctx, nextConn, m)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if onConnected != nil {
+			select {
+			case handshakeTime := <-handshakeTimeCh:
+				onConnected(&QUICStats{
+					HandshakeTime: handshakeTime,
+					Used0RTT:      conn.ConnectionState().Used0RTT,
+				})
+			case <-ctx.Done():
+			}
+		}
+
+		return resp, nil
+	}, nil
+}
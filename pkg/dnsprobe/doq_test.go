@@ -0,0 +1,133 @@
+package dnsprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+	"github.com/quic-go/quic-go"
+)
+
+// answers each query on its own stream, the same way as RFC9250 describes, with the certificate of an httptest server
+func startTestDoQServer(t *testing.T) (*quic.EarlyListener, *x509.CertPool, *atomic.Int32) {
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(tlsServer.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+
+	tlsConfig := tlsServer.TLS.Clone()
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{doqALPN}
+	ln, err := quic.ListenAddrEarly("127.0.0.1:0", tlsConfig, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	// counts the queries whose ID isn't 0, or which aren't terminated by a FIN
+	var violations atomic.Int32
+	serveStream := func(stream *quic.Stream) {
+		defer stream.Close()
+		lenBuf := make([]byte, 2)
+		if _, err := io.ReadFull(stream, lenBuf); err != nil {
+			violations.Add(1)
+			return
+		}
+		req := new(dns.Msg)
+		req.Data = make([]byte, binary.BigEndian.Uint16(lenBuf))
+		if _, err := io.ReadFull(stream, req.Data); err != nil {
+			violations.Add(1)
+			return
+		}
+		if n, err := stream.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			violations.Add(1)
+		}
+		if err := req.Unpack(); err != nil || req.ID != 0 || len(req.Question) == 0 {
+			violations.Add(1)
+			return
+		}
+
+		m := new(dns.Msg)
+		dnsutil.SetReply(m, req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.Header{Name: req.Question[0].Header().Name, Class: dns.ClassINET, TTL: 300},
+			A:   rdata.A{Addr: netip.MustParseAddr("192.0.2.1")},
+		}}
+		if err := m.Pack(); err != nil {
+			return
+		}
+		buf := make([]byte, 2+len(m.Data))
+		binary.BigEndian.PutUint16(buf, uint16(len(m.Data)))
+		copy(buf[2:], m.Data)
+		stream.Write(buf)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go serveStream(stream)
+				}
+			}()
+		}
+	}()
+	return ln, roots, &violations
+}
+
+func TestDoQExchangeFunc(t *testing.T) {
+	ln, roots, violations := startTestDoQServer(t)
+
+	var stats []*QUICStats
+	exchange, err := getDoQExchangeFunc("quic://"+ln.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}, func(s *QUICStats) {
+		stats = append(stats, s)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		m := dns.NewMsg("www.example.", dns.TypeA)
+		m.ID = 1234
+		resp, err := exchange(ctx, m)
+		cancel()
+		if err != nil {
+			t.Fatalf("exchange %d failed: %v", i, err)
+		}
+		if len(resp.Answer) != 1 || resp.ID != 0 {
+			t.Fatalf("unexpected response of exchange %d: id=%d answer=%v", i, resp.ID, resp.Answer)
+		}
+	}
+	if n := violations.Load(); n != 0 {
+		t.Fatalf("expected the queries to be sent with ID 0 and a FIN, got %d violations", n)
+	}
+
+	if len(stats) != 2 {
+		t.Fatalf("expected stats of 2 exchanges, got %d", len(stats))
+	}
+	if stats[0].HandshakeTime <= 0 || stats[0].Used0RTT {
+		t.Fatalf("unexpected stats of the first exchange: %+v", stats[0])
+	}
+	// the session ticket of the first connection is what the second one resumes with
+	if stats[1].HandshakeTime <= 0 || !stats[1].Used0RTT {
+		t.Fatalf("expected the second exchange to use 0-RTT, got %+v", stats[1])
+	}
+}
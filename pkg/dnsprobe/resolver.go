@@ -0,0 +1,513 @@
+package dnsprobe
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"github.com/quic-go/quic-go"
+)
+
+var encryptedResolverSchemes = map[string]Transport{
+	"tls://":   TransportTLS,
+	"https://": TransportHTTP2,
+	"quic://":  TransportQUIC,
+}
+
+// IsEncryptedResolverURI tells whether the resolver is a tls://, https:// or quic:// URI
+func IsEncryptedResolverURI(uri string) bool {
+	_, err := getEncryptedResolverTransport(uri)
+	return err == nil
+}
+
+func getEncryptedResolverTransport(uri string) (Transport, error) {
+	for scheme, transport := range encryptedResolverSchemes {
+		if strings.HasPrefix(strings.ToLower(uri), scheme) {
+			return transport, nil
+		}
+	}
+	return "", fmt.Errorf("resolver %s is not a tls://, https:// or quic:// URI", uri)
+}
+
+const (
+	resolverCacheMaxEntries = 4096
+	resolverCacheMaxTTL     = time.Hour
+)
+
+type resolverCacheEntry struct {
+	data      []byte
+	storedAt  time.Time
+	expiresAt time.Time
+}
+
+// The responses are shared among all encrypted resolvers, keyed by the upstream and the question
+type resolverCache struct {
+	lock    sync.Mutex
+	entries map[string]*resolverCacheEntry
+}
+
+var sharedResolverCache = &resolverCache{entries: make(map[string]*resolverCacheEntry)}
+
+func getResolverCacheKey(upstream string, m *dns.Msg) string {
+	q := m.Question[0]
+	return fmt.Sprintf("%s|%s|%d|%d", upstream, dnsutil.Canonical(q.Header().Name), dns.RRToType(q), q.Header().Class)
+}
+
+// The lowest TTL among the records, for negative answers, it's also bound by the SOA minimum, see RFC2308
+func getResponseTTL(resp *dns.Msg) time.Duration {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return 0
+	}
+
+	var ttl uint32
+	found := false
+	for _, rr := range slices.Concat(resp.Answer, resp.Ns) {
+		rrTTL := rr.Header().TTL
+		if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < rrTTL {
+			rrTTL = soa.Minttl
+		}
+		if !found || rrTTL < ttl {
+			ttl = rrTTL
+			found = true
+		}
+	}
+	return min(time.Duration(ttl)*time.Second, resolverCacheMaxTTL)
+}
+
+func (c *resolverCache) get(key string) (*dns.Msg, error) {
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	c.lock.Unlock()
+	now := time.Now()
+	if !ok || !now.Before(entry.expiresAt) {
+		return nil, nil
+	}
+
+	resp := new(dns.Msg)
+	resp.Data = slices.Clone(entry.data)
+	if err := resp.Unpack(); err != nil {
+		return nil, fmt.Errorf("failed to unpack cached response: %w", err)
+	}
+	age := uint32(now.Sub(entry.storedAt).Seconds())
+	for _, rr := range slices.Concat(resp.Answer, resp.Ns, resp.Extra) {
+		rr.Header().TTL -= min(age, rr.Header().TTL)
+	}
+	return resp, nil
+}
+
+func (c *resolverCache) put(key string, resp *dns.Msg, data []byte) {
+	ttl := getResponseTTL(resp)
+	if ttl <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if len(c.entries) >= resolverCacheMaxEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= resolverCacheMaxEntries {
+			return
+		}
+	}
+	c.entries[key] = &resolverCacheEntry{
+		data:      slices.Clone(data),
+		storedAt:  now,
+		expiresAt: now.Add(ttl),
+	}
+}
+
+// the address of a resolver given by name is bootstrapped again after this long
+const resolverBootstrapTTL = 5 * time.Minute
+
+// upstreamSession holds the connections to an upstream, which are reused across queries
+type upstreamSession interface {
+	exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	close()
+}
+
+// the http transport keeps the connections alive and multiplexes the queries over them
+type dohSession struct {
+	uri    string
+	client *http.Client
+}
+
+func (s *dohSession) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	return exchangeDoH(ctx, s.client, DoHMethodPOST, s.uri, "", m)
+}
+
+func (s *dohSession) close() { s.client.CloseIdleConnections() }
+
+// a single connection over which the queries are sent one at a time
+type dotSession struct {
+	addrPort  string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	lock      sync.Mutex
+	conn      net.Conn
+}
+
+func (s *dotSession) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	client := &dns.Client{
+		Transport: &dns.Transport{
+			ReadTimeout:  s.timeout,
+			WriteTimeout: s.timeout,
+		},
+	}
+	for {
+		reused := s.conn != nil
+		if !reused {
+			dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: s.timeout}, Config: s.tlsConfig}
+			conn, err := dialer.DialContext(ctx, "tcp", s.addrPort)
+			if err != nil {
+				return nil, fmt.Errorf("failed to dial %s: %w", s.addrPort, err)
+			}
+			s.conn = conn
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			s.conn.SetWriteDeadline(deadline)
+		}
+		resp, _, err := client.ExchangeWithConn(ctx, m, s.conn)
+		if err == nil {
+			return resp, nil
+		}
+		s.conn.Close()
+		s.conn = nil
+		// the server might have closed the idle connection in the meantime, which is retried once with a new one
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+		// the buffer of m is reused for the response, so it has to be packed again
+		m.Data = nil
+	}
+}
+
+func (s *dotSession) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// a single connection shared by the queries, each of which is sent over a stream of its own
+type doqSession struct {
+	addrPort  string
+	tlsConfig *tls.Config
+	lock      sync.Mutex
+	conn      *quic.Conn
+}
+
+func (s *doqSession) getConn(ctx context.Context) (*quic.Conn, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn != nil && s.conn.Context().Err() == nil {
+		return s.conn, true, nil
+	}
+	// unlike the probe, there is no 0-RTT, whose rejection would disrupt the other queries sharing the connection
+	conn, err := quic.DialAddr(ctx, s.addrPort, s.tlsConfig, &quic.Config{})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to dial quic: %w", err)
+	}
+	s.conn = conn
+	return conn, false, nil
+}
+
+func (s *doqSession) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	for {
+		conn, reused, err := s.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := exchangeOnQUICConn(ctx, conn, m)
+		// a connection closed by the server, e.g. on idle timeout, is dialed again once
+		if err != nil && reused && conn.Context().Err() != nil && ctx.Err() == nil {
+			continue
+		}
+		return resp, err
+	}
+}
+
+func (s *doqSession) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn != nil {
+		s.conn.CloseWithError(doqNoError, "")
+		s.conn = nil
+	}
+}
+
+type encryptedUpstream struct {
+	uri       string
+	transport Transport
+	timeout   time.Duration
+	cache     *resolverCache
+	// nil means the system's roots
+	rootCAs *x509.CertPool
+
+	lock         sync.Mutex
+	session      upstreamSession
+	bootstrapped netip.Addr
+	// zero when the upstream is given by address, which is never bootstrapped
+	bootstrapExpiresAt time.Time
+}
+
+func (u *encryptedUpstream) newSession(host string, bootstrapped netip.Addr) (upstreamSession, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: host,
+		RootCAs:    u.rootCAs,
+	}
+	if u.transport == TransportHTTP2 {
+		return &dohSession{uri: u.uri, client: getDoHClient(TransportHTTP2, tlsConfig, bootstrapped)}, nil
+	}
+
+	addrPort := u.uri
+	if bootstrapped.IsValid() {
+		addrPort = getBootstrappedAddrPort(addrPort, u.transport, bootstrapped)
+	}
+	addrPort = appendDNSPort(stripQUICURLPrefix(stripTLSURLPrefix(addrPort)), u.transport)
+	if _, err := netip.ParseAddrPort(addrPort); err != nil {
+		return nil, fmt.Errorf("failed to parse addrport %s as netip.AddrPort: %v", addrPort, err)
+	}
+	if u.transport == TransportQUIC {
+		return &doqSession{addrPort: addrPort, tlsConfig: getDoQTLSConfig(tlsConfig)}, nil
+	}
+	return &dotSession{addrPort: addrPort, tlsConfig: tlsConfig, timeout: u.timeout}, nil
+}
+
+// the session is kept until the bootstrapped address expires, and only replaced when the address changes
+func (u *encryptedUpstream) getSession(ctx context.Context) (upstreamSession, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.session != nil && (u.bootstrapExpiresAt.IsZero() || time.Now().Before(u.bootstrapExpiresAt)) {
+		return u.session, nil
+	}
+
+	host, err := getServerHost(u.uri, u.transport)
+	if err != nil {
+		return nil, err
+	}
+	var bootstrapped netip.Addr
+	if _, err := netip.ParseAddr(host); err != nil {
+		// the name of the resolver itself could only be resolved in plain text
+		bootstrapped, err = bootstrapServer(ctx, nil, host)
+		if err != nil {
+			if u.session != nil {
+				// a stale address is better than none, it's bootstrapped again by the next query
+				return u.session, nil
+			}
+			return nil, fmt.Errorf("failed to bootstrap resolver %s: %w", host, err)
+		}
+		u.bootstrapExpiresAt = time.Now().Add(resolverBootstrapTTL)
+		if u.session != nil && bootstrapped == u.bootstrapped {
+			return u.session, nil
+		}
+	}
+
+	session, err := u.newSession(host, bootstrapped)
+	if err != nil {
+		return nil, err
+	}
+	if u.session != nil {
+		u.session.close()
+	}
+	u.session = session
+	u.bootstrapped = bootstrapped
+	return session, nil
+}
+
+func (u *encryptedUpstream) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	session, err := u.getSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return session.exchange(ctx, m)
+}
+
+// handles a query in wire format, returns the response in wire format
+func (u *encryptedUpstream) handle(ctx context.Context, query []byte) ([]byte, error) {
+	m := new(dns.Msg)
+	m.Data = query
+	if err := m.Unpack(); err != nil {
+		return nil, fmt.Errorf("failed to unpack query: %w", err)
+	}
+	if len(m.Question) == 0 {
+		return nil, fmt.Errorf("no question in the query")
+	}
+	id := m.ID
+	key := getResolverCacheKey(u.uri, m)
+
+	resp, err := u.cache.get(key)
+	if err != nil {
+		return nil, err
+	}
+	fromCache := resp != nil
+	if !fromCache {
+		resp, err = u.exchange(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the response might share the buffer with the query, so always pack it into a new one
+	resp.ID = id
+	resp.Data = nil
+	if err := resp.Pack(); err != nil {
+		return nil, fmt.Errorf("failed to pack response: %w", err)
+	}
+	if !fromCache {
+		u.cache.put(key, resp, resp.Data)
+	}
+	return resp.Data, nil
+}
+
+type resolverAddr string
+
+func (addr resolverAddr) Network() string { return "tcp" }
+func (addr resolverAddr) String() string  { return string(addr) }
+
+// resolverConn is what the go resolver sees as a stream connection to a plain DNS server,
+// the queries written to it are forwarded to the upstream over an encrypted transport.
+type resolverConn struct {
+	upstream *encryptedUpstream
+	lock     sync.Mutex
+	wbuf     bytes.Buffer
+	rbuf     bytes.Buffer
+	deadline time.Time
+}
+
+func (c *resolverConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.wbuf.Write(b)
+	for c.wbuf.Len() >= 2 {
+		msgLen := int(binary.BigEndian.Uint16(c.wbuf.Bytes()[:2]))
+		if c.wbuf.Len() < 2+msgLen {
+			break
+		}
+		query := slices.Clone(c.wbuf.Next(2 + msgLen)[2:])
+
+		deadline := c.deadline
+		if deadline.IsZero() {
+			deadline = time.Now().Add(c.upstream.timeout)
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		resp, err := c.upstream.handle(ctx, query)
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+
+		lenBuf := make([]byte, 2)
+		binary.BigEndian.PutUint16(lenBuf, uint16(len(resp)))
+		c.rbuf.Write(lenBuf)
+		c.rbuf.Write(resp)
+	}
+	return len(b), nil
+}
+
+func (c *resolverConn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.rbuf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.rbuf.Read(b)
+}
+
+func (c *resolverConn) Close() error                       { return nil }
+func (c *resolverConn) LocalAddr() net.Addr                { return resolverAddr("") }
+func (c *resolverConn) RemoteAddr() net.Addr               { return resolverAddr(c.upstream.uri) }
+func (c *resolverConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *resolverConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+func (c *resolverConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deadline = t
+	return nil
+}
+
+const maxSharedEncryptedUpstreams = 256
+
+// The upstreams, hence their connections, are shared among all encrypted resolvers, keyed by the uri and the timeout
+type encryptedUpstreams struct {
+	lock      sync.Mutex
+	upstreams map[string]*encryptedUpstream
+}
+
+var sharedEncryptedUpstreams = &encryptedUpstreams{upstreams: make(map[string]*encryptedUpstream)}
+
+func (us *encryptedUpstreams) get(uri string, timeout time.Duration) (*encryptedUpstream, error) {
+	transport, err := getEncryptedResolverTransport(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	us.lock.Lock()
+	defer us.lock.Unlock()
+	key := fmt.Sprintf("%s|%s", uri, timeout)
+	if upstream, ok := us.upstreams[key]; ok {
+		return upstream, nil
+	}
+	upstream := &encryptedUpstream{
+		uri:       uri,
+		transport: transport,
+		timeout:   timeout,
+		cache:     sharedResolverCache,
+	}
+	// beyond the limit, the upstream still works, only its connections aren't reused by other resolvers
+	if len(us.upstreams) < maxSharedEncryptedUpstreams {
+		us.upstreams[key] = upstream
+	}
+	return upstream, nil
+}
+
+func (u *encryptedUpstream) newResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		// the address of the name servers in resolv.conf is ignored, all queries go to the upstream
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &resolverConn{upstream: u}, nil
+		},
+	}
+}
+
+// NewEncryptedResolver returns a resolver which sends all queries to the resolver at uri, which is a
+// tls://, https:// or quic:// URI, e.g. tls://1.1.1.1, https://dns.google/dns-query, quic://dns.adguard-dns.com,
+// the responses are cached according to their TTLs, and the connections to the resolver are reused.
+func NewEncryptedResolver(uri string, timeout time.Duration) *net.Resolver {
+	upstream, err := sharedEncryptedUpstreams.get(uri, timeout)
+	if err != nil {
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, err
+			},
+		}
+	}
+	return upstream.newResolver()
+}
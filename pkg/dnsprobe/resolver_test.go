@@ -0,0 +1,128 @@
+package dnsprobe
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+func newTestRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.New(s)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", s, err)
+	}
+	return rr
+}
+
+func TestGetResponseTTL(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.Answer = []dns.RR{
+		newTestRR(t, "www.example.com. 300 IN CNAME example.com."),
+		newTestRR(t, "example.com. 60 IN A 192.0.2.1"),
+	}
+	if ttl := getResponseTTL(resp); ttl != 60*time.Second {
+		t.Fatalf("expected 60s, got %v", ttl)
+	}
+
+	// negative answers are bound by the SOA minimum
+	resp = new(dns.Msg)
+	resp.Rcode = dns.RcodeNameError
+	resp.Ns = []dns.RR{newTestRR(t, "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 30")}
+	if ttl := getResponseTTL(resp); ttl != 30*time.Second {
+		t.Fatalf("expected 30s, got %v", ttl)
+	}
+
+	resp.Rcode = dns.RcodeServerFailure
+	if ttl := getResponseTTL(resp); ttl != 0 {
+		t.Fatalf("expected SERVFAIL not to be cached, got %v", ttl)
+	}
+}
+
+func TestEncryptedResolver_CachesAndReusesConnections(t *testing.T) {
+	var queries, conns atomic.Int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		req.Data = body
+		if err := req.Unpack(); err != nil || len(req.Question) == 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		queries.Add(1)
+
+		m := new(dns.Msg)
+		dnsutil.SetReply(m, req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.Header{Name: req.Question[0].Header().Name, Class: dns.ClassINET, TTL: 300},
+			A:   rdata.A{Addr: netip.MustParseAddr("192.0.2.1")},
+		}}
+		if err := m.Pack(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohMIMEMessage)
+		w.Write(m.Data)
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	upstream := &encryptedUpstream{
+		uri:       ts.URL + "/dns-query",
+		transport: TransportHTTP2,
+		timeout:   2 * time.Second,
+		cache:     &resolverCache{entries: make(map[string]*resolverCacheEntry)},
+		rootCAs:   roots,
+	}
+	resolver := upstream.newResolver()
+
+	lookup := func(name string) {
+		t.Helper()
+		addrs, err := resolver.LookupNetIP(context.Background(), "ip4", name)
+		if err != nil {
+			t.Fatalf("failed to lookup %s: %v", name, err)
+		}
+		if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.1") {
+			t.Fatalf("unexpected addrs of %s: %v", name, addrs)
+		}
+	}
+
+	lookup("www.example.com.")
+	defer upstream.session.close()
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("expected 1 query to the upstream, got %d", n)
+	}
+	lookup("www.example.com.")
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("expected the second lookup to hit the cache, got %d queries", n)
+	}
+
+	lookup("other.example.com.")
+	if n := queries.Load(); n != 2 {
+		t.Fatalf("expected 2 queries to the upstream, got %d", n)
+	}
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("expected the connection to be reused, got %d connections", n)
+	}
+}
@@ -0,0 +1,455 @@
+package dnsprobe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+)
+
+type TraceOutcome string
+
+const (
+	// the server delegated the query to the servers of a child zone
+	TraceOutcomeReferral TraceOutcome = "referral"
+	// the server answered with the records asked for, this is the last step
+	TraceOutcomeAnswer TraceOutcome = "answer"
+	// the server answered with a CNAME, the trace restarts from the root for the canonical name
+	TraceOutcomeCNAME TraceOutcome = "cname"
+	// the name does not exist, this is the last step
+	TraceOutcomeNXDomain TraceOutcome = "nxdomain"
+	// the name exists but has no records of the type asked for, this is the last step
+	TraceOutcomeNoData TraceOutcome = "nodata"
+	// the server is supposed to be authoritative for the zone, but it's not, e.g. REFUSED, or an upward referral
+	TraceOutcomeLame TraceOutcome = "lame"
+	// the query failed at the transport level, e.g. timed out
+	TraceOutcomeError TraceOutcome = "error"
+	// none of the servers of a zone gave an usable response, the delegation is broken here, this is the last step
+	TraceOutcomeFailed TraceOutcome = "failed"
+)
+
+type TraceReferral struct {
+	Zone        string   `json:"zone"`
+	NameServers []string `json:"name_servers"`
+	// in the form of "<ns name> <address>"
+	Glue []string `json:"glue,omitempty"`
+}
+
+type TraceStep struct {
+	CorrelationID string       `json:"corrId,omitempty"`
+	Step          int          `json:"step"`
+	Target        string       `json:"target"`
+	QueryType     DNSQueryType `json:"query_type"`
+
+	// the zone whose servers are being queried
+	Zone       string `json:"zone"`
+	ServerName string `json:"server_name,omitempty"`
+	Server     string `json:"server,omitempty"`
+	// whether the address of the server was taken from the glue records of the previous referral
+	GlueUsed bool `json:"glue_used"`
+
+	Outcome       TraceOutcome   `json:"outcome"`
+	Rcode         string         `json:"rcode,omitempty"`
+	Flags         *MsgFlags      `json:"flags,omitempty"`
+	RTT           time.Duration  `json:"rtt,omitempty"`
+	Referral      *TraceReferral `json:"referral,omitempty"`
+	AnswerStrings []string       `json:"answer_strings,omitempty"`
+	Reason        string         `json:"reason,omitempty"`
+	ErrString     string         `json:"err_string,omitempty"`
+	IOTimeout     bool           `json:"io_timeout,omitempty"`
+	StartedAt     time.Time      `json:"started_at"`
+}
+
+type traceNameServer struct {
+	name  string
+	addrs []netip.Addr
+	glue  bool
+}
+
+// https://www.iana.org/domains/root/files
+var rootHints = []traceNameServer{
+	{name: "a.root-servers.net.", addrs: []netip.Addr{netip.MustParseAddr("198.41.0.4"), netip.MustParseAddr("2001:503:ba3e::2:30")}},
+	{name: "b.root-servers.net.", addrs: []netip.Addr{netip.MustParseAddr("170.247.170.2"), netip.MustParseAddr("2801:1b8:10::b")}},
+	{name: "c.root-servers.net.", addrs: []netip.Addr{netip.MustParseAddr("192.33.4.12"), netip.MustParseAddr("2001:500:2::c")}},
+	{name: "d.root-servers.net.", addrs: []netip.Addr{netip.MustParseAddr("199.7.91.13"), netip.MustParseAddr("2001:500:2d::d")}},
+	{name: "e.root-servers.net.", addrs: []netip.Addr{netip.MustParseAddr("192.203.230.10"), netip.MustParseAddr("2001:500:a8::e")}},
+	{name: "f.root-servers.net.", addrs: []netip.Addr{netip.MustParseAddr("192.5.5.241"), netip.MustParseAddr("2001:500:2f::f")}},
+	{name: "g.root-servers.net.", addrs: []netip.Addr{netip.MustParseAddr("192.112.36.4"), netip.MustParseAddr("2001:500:12::d0d")}},
+	{name: "h.root-servers.net.", addrs: []netip.Addr{netip.MustParseAddr("198.97.190.53"), netip.MustParseAddr("2001:500:1::53")}},
+	{name: "i.root-servers.net.", addrs: []netip.Addr{netip.MustParseAddr("192.36.148.17"), netip.MustParseAddr("2001:7fe::53")}},
+	{name: "j.root-servers.net.", addrs: []netip.Addr{netip.MustParseAddr("192.58.128.30"), netip.MustParseAddr("2001:503:c27::2:30")}},
+	{name: "k.root-servers.net.", addrs: []netip.Addr{netip.MustParseAddr("193.0.14.129"), netip.MustParseAddr("2001:7fd::1")}},
+	{name: "l.root-servers.net.", addrs: []netip.Addr{netip.MustParseAddr("199.7.83.42"), netip.MustParseAddr("2001:500:9f::42")}},
+	{name: "m.root-servers.net.", addrs: []netip.Addr{netip.MustParseAddr("202.12.27.33"), netip.MustParseAddr("2001:dc3::35")}},
+}
+
+const (
+	// upper bound of the number of referrals followed for one name
+	maxTraceReferrals = 16
+	// upper bound of the number of CNAMEs followed
+	maxTraceCNAMEs = 8
+	// upper bound of the nesting of glueless delegations
+	maxTraceDepth = 4
+	// upper bound of the number of servers tried for one zone, before giving up
+	maxTraceServersPerZone = 4
+	// upper bound of the time a trace could take
+	maxTraceDuration = 60 * time.Second
+)
+
+var errTraceFailed = errors.New("trace failed")
+
+type dnsTracer struct {
+	parameter LookupParameter
+	transport Transport
+	timeout   time.Duration
+	dnssecOk  bool
+	// of the top-level resolution, CHAOS queries are also sent to the servers the referrals lead to
+	qclass uint16
+
+	// where the iteration starts from, and the port the servers listen on, other than in tests, the root hints and 53
+	roots []traceNameServer
+	port  uint16
+
+	// events of the top-level resolution only, the resolutions of glueless name servers are silent
+	emit func(step TraceStep)
+	step int
+
+	// the zone where the delegation is found broken
+	brokenZone string
+}
+
+// prefers v4 addresses, since v6 connectivity of agents is less common
+func pickTraceAddr(addrs []netip.Addr) (netip.Addr, bool) {
+	for _, addr := range addrs {
+		if addr.Is4() {
+			return addr, true
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0], true
+	}
+	return netip.Addr{}, false
+}
+
+func (t *dnsTracer) exchange(ctx context.Context, server netip.Addr, qname string, qtype uint16) (*dns.Msg, error) {
+	m := dns.NewMsg(qname, qtype)
+	m.Question[0].Header().Class = t.qclass
+	m.RecursionDesired = false
+	m.UDPSize = ednsUDPSize
+	m.Security = t.dnssecOk
+
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	addrPort := netip.AddrPortFrom(server, t.port).String()
+	exchange, err := getExchangeFunc(t.transport, addrPort, nil, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return exchange(ctx, m)
+}
+
+// returns the outcome, plus the name servers of the child zone if it's a referral
+func classifyTraceResponse(resp *dns.Msg, zone string, qname string, qtype uint16, step *TraceStep) (TraceOutcome, string, []traceNameServer) {
+	if resp.Rcode == dns.RcodeNameError {
+		return TraceOutcomeNXDomain, "", nil
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		step.Reason = fmt.Sprintf("server responded with %s", dnsutil.RcodeToString(resp.Rcode))
+		return TraceOutcomeLame, "", nil
+	}
+
+	hasAnswer := false
+	for _, rr := range resp.Answer {
+		if rrType := dns.RRToType(rr); rrType == qtype || rrType == dns.TypeCNAME {
+			hasAnswer = true
+			step.AnswerStrings = append(step.AnswerStrings, answerToString(rr))
+		}
+	}
+	if hasAnswer {
+		return TraceOutcomeAnswer, "", nil
+	}
+
+	child := ""
+	nsNames := make([]string, 0)
+	for _, rr := range resp.Ns {
+		if ns, ok := rr.(*dns.NS); ok {
+			child = dnsutil.Canonical(ns.Hdr.Name)
+			nsNames = append(nsNames, dnsutil.Canonical(ns.Ns))
+		}
+	}
+	if child != "" && !resp.Authoritative {
+		if child == zone || !dnsutil.IsBelow(zone, child) || !dnsutil.IsBelow(child, qname) {
+			step.Reason = fmt.Sprintf("referral to %s is not towards %s", child, qname)
+			return TraceOutcomeLame, "", nil
+		}
+
+		referral := &TraceReferral{Zone: child, NameServers: nsNames}
+		servers := make([]traceNameServer, 0, len(nsNames))
+		for _, nsName := range nsNames {
+			server := traceNameServer{name: nsName}
+			for _, rr := range resp.Extra {
+				if !dns.EqualName(rr.Header().Name, nsName) {
+					continue
+				}
+				switch glue := rr.(type) {
+				case *dns.A:
+					server.addrs = append(server.addrs, glue.Addr)
+				case *dns.AAAA:
+					server.addrs = append(server.addrs, glue.Addr)
+				default:
+					continue
+				}
+				server.glue = true
+				referral.Glue = append(referral.Glue, fmt.Sprintf("%s %s", nsName, answerToString(rr)))
+			}
+			servers = append(servers, server)
+		}
+		step.Referral = referral
+		return TraceOutcomeReferral, child, servers
+	}
+
+	if resp.Authoritative {
+		return TraceOutcomeNoData, "", nil
+	}
+	step.Reason = fmt.Sprintf("server is not authoritative for %s, and gave no referral", zone)
+	return TraceOutcomeLame, "", nil
+}
+
+// returns the addresses of name, found by iterating from the root, without emitting events
+func (t *dnsTracer) resolveAddrs(ctx context.Context, name string, depth int) []netip.Addr {
+	silent := &dnsTracer{
+		parameter: t.parameter,
+		transport: t.transport,
+		timeout:   t.timeout,
+		qclass:    dns.ClassINET,
+		roots:     t.roots,
+		port:      t.port,
+	}
+	addrs := make([]netip.Addr, 0)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answers, err := silent.resolve(ctx, name, qtype, depth+1)
+		if err != nil {
+			continue
+		}
+		for _, rr := range answers {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.Addr)
+			case *dns.AAAA:
+				addrs = append(addrs, rr.Addr)
+			}
+		}
+		if len(addrs) > 0 {
+			break
+		}
+	}
+	return addrs
+}
+
+func (t *dnsTracer) report(step TraceStep) {
+	if t.emit == nil {
+		return
+	}
+	t.step++
+	step.Step = t.step
+	step.CorrelationID = t.parameter.CorrelationID
+	step.QueryType = t.parameter.QueryType
+	t.emit(step)
+}
+
+// resolve iterates from the root down to the zone of qname, returns the answers eventually found
+func (t *dnsTracer) resolve(ctx context.Context, qname string, qtype uint16, depth int) ([]dns.RR, error) {
+	if depth > maxTraceDepth {
+		return nil, fmt.Errorf("%w: too many levels of glueless delegations", errTraceFailed)
+	}
+
+	qname = dnsutil.Canonical(qname)
+	numCNAMEs := 0
+	zone := "."
+	servers := t.roots
+	for numReferrals := 0; numReferrals < maxTraceReferrals; numReferrals++ {
+		// spread the load among the servers of a zone
+		servers = append([]traceNameServer{}, servers...)
+		rand.Shuffle(len(servers), func(i, j int) { servers[i], servers[j] = servers[j], servers[i] })
+
+		var nextZone string
+		var nextServers []traceNameServer
+		numTried := 0
+		for _, server := range servers {
+			if numTried >= maxTraceServersPerZone {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			step := TraceStep{Target: qname, Zone: zone, ServerName: server.name, GlueUsed: server.glue}
+			addrs := server.addrs
+			if len(addrs) == 0 {
+				// glueless delegation, the address of the name server has to be resolved first
+				step.GlueUsed = false
+				addrs = t.resolveAddrs(ctx, server.name, depth)
+			}
+			addr, ok := pickTraceAddr(addrs)
+			if !ok {
+				step.Outcome = TraceOutcomeError
+				step.ErrString = fmt.Sprintf("failed to resolve the address of name server %s", server.name)
+				t.report(step)
+				continue
+			}
+			numTried++
+
+			step.Server = addr.String()
+			step.StartedAt = time.Now()
+			resp, err := t.exchange(ctx, addr, qname, qtype)
+			step.RTT = time.Since(step.StartedAt)
+			if err != nil {
+				step.Outcome = TraceOutcomeError
+				step.ErrString = err.Error()
+				step.IOTimeout = errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded)
+				t.report(step)
+				continue
+			}
+			step.Rcode = dnsutil.RcodeToString(resp.Rcode)
+			step.Flags = &MsgFlags{
+				Authoritative:      resp.Authoritative,
+				Truncated:          resp.Truncated,
+				AuthenticatedData:  resp.AuthenticatedData,
+				RecursionAvailable: resp.RecursionAvailable,
+			}
+
+			outcome, child, childServers := classifyTraceResponse(resp, zone, qname, qtype, &step)
+			if outcome == TraceOutcomeAnswer {
+				answers := make([]dns.RR, 0)
+				cnameTarget := ""
+				for _, rr := range resp.Answer {
+					if dns.RRToType(rr) == qtype {
+						answers = append(answers, rr)
+					} else if cname, ok := rr.(*dns.CNAME); ok && dns.EqualName(cname.Hdr.Name, qname) {
+						cnameTarget = cname.Target
+					}
+				}
+				if len(answers) > 0 || cnameTarget == "" {
+					step.Outcome = TraceOutcomeAnswer
+					t.report(step)
+					return answers, nil
+				}
+
+				step.Outcome = TraceOutcomeCNAME
+				t.report(step)
+				numCNAMEs++
+				if numCNAMEs > maxTraceCNAMEs {
+					return nil, fmt.Errorf("%w: too many CNAMEs", errTraceFailed)
+				}
+				qname = dnsutil.Canonical(cnameTarget)
+				// the referrals are counted per name, the canonical name starts over from the root
+				numReferrals = -1
+				nextZone = "."
+				nextServers = t.roots
+				break
+			}
+
+			step.Outcome = outcome
+			t.report(step)
+			switch outcome {
+			case TraceOutcomeNXDomain, TraceOutcomeNoData:
+				return nil, nil
+			case TraceOutcomeReferral:
+				nextZone = child
+				nextServers = childServers
+			}
+			if nextServers != nil {
+				break
+			}
+		}
+
+		if nextServers == nil {
+			t.brokenZone = zone
+			return nil, fmt.Errorf("%w: none of the servers of %s gave an usable response for %s", errTraceFailed, zone, qname)
+		}
+		zone = nextZone
+		servers = nextServers
+	}
+	return nil, fmt.Errorf("%w: too many referrals", errTraceFailed)
+}
+
+// TraceDNS resolves the target iteratively, starting from the root hints and following the referrals,
+// like what `dig +trace` does. Each server queried results in an event. parameter.AddrPort is ignored,
+// and only udp and tcp transports are supported, since most authoritative servers don't speak anything else.
+func TraceDNS(ctx context.Context, parameter LookupParameter) <-chan TraceStep {
+	evChan := make(chan TraceStep)
+	go func() {
+		defer close(evChan)
+
+		startedAt := time.Now()
+		failed := func(zone string, reason string) {
+			select {
+			case evChan <- TraceStep{
+				CorrelationID: parameter.CorrelationID,
+				Target:        parameter.Target,
+				QueryType:     parameter.QueryType,
+				Zone:          zone,
+				Outcome:       TraceOutcomeFailed,
+				Reason:        reason,
+				StartedAt:     startedAt,
+			}:
+			case <-ctx.Done():
+			}
+		}
+
+		var transport Transport = defaultDNSProbeTransport
+		if parameter.Transport != nil {
+			transport = *parameter.Transport
+		}
+		if transport != TransportUDP && transport != TransportTCP {
+			failed("", fmt.Sprintf("transport %s is not supported in trace mode", transport))
+			return
+		}
+
+		var timeoutMs int64 = defaultDNSProbeTimeoutMs
+		if parameter.TimeoutMs != nil {
+			timeoutMs = *parameter.TimeoutMs
+		}
+		if timeoutMs < minTimeoutMs || timeoutMs > maxTimeoutMs {
+			failed("", fmt.Sprintf("timeout must be within %dms and %dms, got %dms", minTimeoutMs, maxTimeoutMs, timeoutMs))
+			return
+		}
+
+		m, err := buildQueryMsg(parameter.Target, parameter.QueryType)
+		if err != nil {
+			failed("", err.Error())
+			return
+		}
+		question := m.Question[0]
+
+		ctx, cancel := context.WithTimeout(ctx, maxTraceDuration)
+		defer cancel()
+
+		tracer := &dnsTracer{
+			parameter: parameter,
+			transport: transport,
+			timeout:   time.Duration(timeoutMs) * time.Millisecond,
+			dnssecOk:  parameter.DNSSECOk,
+			qclass:    question.Header().Class,
+			roots:     rootHints,
+			port:      53,
+			emit: func(step TraceStep) {
+				select {
+				case evChan <- step:
+				case <-ctx.Done():
+				}
+			},
+		}
+		if _, err := tracer.resolve(ctx, question.Header().Name, dns.RRToType(question), 0); err != nil {
+			failed(tracer.brokenZone, err.Error())
+		}
+	}()
+	return evChan
+}
@@ -0,0 +1,227 @@
+package dnsprobe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+func newTestNS(zone string, name string) dns.RR {
+	return &dns.NS{Hdr: dns.Header{Name: zone, Class: dns.ClassINET, TTL: 3600}, NS: rdata.NS{Ns: name}}
+}
+
+func TestClassifyTraceResponse_Referral(t *testing.T) {
+	resp := &dns.Msg{
+		Ns: []dns.RR{newTestNS("example.", "ns1.example."), newTestNS("example.", "ns.other.")},
+		Extra: []dns.RR{&dns.A{
+			Hdr: dns.Header{Name: "ns1.example.", Class: dns.ClassINET, TTL: 3600},
+			A:   rdata.A{Addr: netip.MustParseAddr("192.0.2.53")},
+		}},
+	}
+
+	step := new(TraceStep)
+	outcome, child, servers := classifyTraceResponse(resp, ".", "www.example.", dns.TypeA, step)
+	if outcome != TraceOutcomeReferral || child != "example." {
+		t.Fatalf("expected referral to example., got %s to %q", outcome, child)
+	}
+	if len(servers) != 2 || !servers[0].glue || len(servers[0].addrs) != 1 || servers[1].glue {
+		t.Fatalf("unexpected servers: %+v", servers)
+	}
+	if step.Referral == nil || len(step.Referral.Glue) != 1 {
+		t.Fatalf("unexpected referral: %+v", step.Referral)
+	}
+}
+
+func TestClassifyTraceResponse_Lame(t *testing.T) {
+	// upward referral, typical for a server which is not configured for the zone
+	resp := &dns.Msg{Ns: []dns.RR{newTestNS(".", "a.root-servers.net.")}}
+	if outcome, _, _ := classifyTraceResponse(resp, "example.", "www.example.", dns.TypeA, new(TraceStep)); outcome != TraceOutcomeLame {
+		t.Fatalf("expected lame on upward referral, got %s", outcome)
+	}
+
+	refused := &dns.Msg{MsgHeader: dns.MsgHeader{Rcode: dns.RcodeRefused}}
+	if outcome, _, _ := classifyTraceResponse(refused, "example.", "www.example.", dns.TypeA, new(TraceStep)); outcome != TraceOutcomeLame {
+		t.Fatalf("expected lame on REFUSED, got %s", outcome)
+	}
+
+	nodata := &dns.Msg{MsgHeader: dns.MsgHeader{Authoritative: true}}
+	if outcome, _, _ := classifyTraceResponse(nodata, "example.", "www.example.", dns.TypeA, new(TraceStep)); outcome != TraceOutcomeNoData {
+		t.Fatalf("expected nodata, got %s", outcome)
+	}
+}
+
+// a root server, the server of the test. TLD, and the server of example.test. which is delegated to a glueless name
+// server, the servers share the port
+type testTraceChain struct {
+	port uint16
+
+	lock sync.Mutex
+	// in the form of "<server> <class> <qname>"
+	queries []string
+}
+
+func (c *testTraceChain) handler(server string, answer func(m *dns.Msg, qname string)) dns.Handler {
+	return dns.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+		qname := dnsutil.Canonical(req.Question[0].Header().Name)
+		c.lock.Lock()
+		c.queries = append(c.queries, fmt.Sprintf("%s %s %s", server, dns.ClassToString[req.Question[0].Header().Class], qname))
+		c.lock.Unlock()
+
+		m := new(dns.Msg)
+		dnsutil.SetReply(m, req)
+		answer(m, qname)
+		io.Copy(w, m)
+	})
+}
+
+func (c *testTraceChain) countQueries(prefix string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := 0
+	for _, query := range c.queries {
+		if strings.HasPrefix(query, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func newTestA(name string, addr string) dns.RR {
+	return &dns.A{Hdr: dns.Header{Name: name, Class: dns.ClassINET, TTL: 3600}, A: rdata.A{Addr: netip.MustParseAddr(addr)}}
+}
+
+func startTestTraceChain(t *testing.T) *testTraceChain {
+	chain := new(testTraceChain)
+	rootAddr := startTestDNSServer(t, "127.0.0.21:0", chain.handler("root", func(m *dns.Msg, qname string) {
+		m.Ns = []dns.RR{newTestNS("test.", "ns.nic.test.")}
+		m.Extra = []dns.RR{newTestA("ns.nic.test.", "127.0.0.22")}
+	}))
+	_, portStr, _ := net.SplitHostPort(rootAddr)
+	port, _ := strconv.Atoi(portStr)
+	chain.port = uint16(port)
+
+	startTestDNSServer(t, net.JoinHostPort("127.0.0.22", portStr), chain.handler("tld", func(m *dns.Msg, qname string) {
+		labels := strings.Split(qname, ".")
+		zone := strings.Join(labels[max(len(labels)-3, 0):], ".")
+		switch {
+		case qname == "ns.hoster.test.":
+			m.Authoritative = true
+			m.Answer = []dns.RR{newTestA(qname, "127.0.0.23")}
+		case dnsutil.IsBelow("example.test.", qname):
+			m.Ns = []dns.RR{newTestNS("example.test.", "ns.hoster.test.")}
+		case strings.HasPrefix(zone, "deep"):
+			// deep<n>.test. is served by ns.deep<n+1>.test., the delegations nest without end
+			n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(zone, "deep"), ".test."))
+			m.Ns = []dns.RR{newTestNS(zone, fmt.Sprintf("ns.deep%d.test.", n+1))}
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+	}))
+
+	startTestDNSServer(t, net.JoinHostPort("127.0.0.23", portStr), chain.handler("auth", func(m *dns.Msg, qname string) {
+		m.Authoritative = true
+		switch qname {
+		case "www.example.test.":
+			m.Answer = []dns.RR{newTestA(qname, "192.0.2.1")}
+		case "loop1.example.test.":
+			m.Answer = []dns.RR{&dns.CNAME{Hdr: dns.Header{Name: qname, Class: dns.ClassINET, TTL: 3600}, CNAME: rdata.CNAME{Target: "loop2.example.test."}}}
+		case "loop2.example.test.":
+			m.Answer = []dns.RR{&dns.CNAME{Hdr: dns.Header{Name: qname, Class: dns.ClassINET, TTL: 3600}, CNAME: rdata.CNAME{Target: "loop1.example.test."}}}
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+	}))
+	return chain
+}
+
+func newTestTracer(chain *testTraceChain, qclass uint16, steps *[]TraceStep) *dnsTracer {
+	return &dnsTracer{
+		transport: TransportUDP,
+		timeout:   time.Second,
+		qclass:    qclass,
+		roots:     []traceNameServer{{name: "a.root.test.", addrs: []netip.Addr{netip.MustParseAddr("127.0.0.21")}}},
+		port:      chain.port,
+		emit: func(step TraceStep) {
+			*steps = append(*steps, step)
+		},
+	}
+}
+
+func TestDNSTracer_FollowsReferrals(t *testing.T) {
+	chain := startTestTraceChain(t)
+	steps := make([]TraceStep, 0)
+	answers, err := newTestTracer(chain, dns.ClassINET, &steps).resolve(context.Background(), "www.example.test.", dns.TypeA, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 1 || answerToString(answers[0]) != "192.0.2.1" {
+		t.Fatalf("unexpected answers: %v", answers)
+	}
+
+	// the resolution of the glueless name server is silent
+	if len(steps) != 3 {
+		t.Fatalf("expected 3 steps, got %+v", steps)
+	}
+	if steps[0].Zone != "." || steps[0].Outcome != TraceOutcomeReferral || steps[0].Referral.Zone != "test." {
+		t.Fatalf("unexpected step of the root: %+v", steps[0])
+	}
+	if steps[1].Zone != "test." || !steps[1].GlueUsed || steps[1].Server != "127.0.0.22" || steps[1].Outcome != TraceOutcomeReferral {
+		t.Fatalf("unexpected step of the tld: %+v", steps[1])
+	}
+	if steps[2].Zone != "example.test." || steps[2].GlueUsed || steps[2].Server != "127.0.0.23" || steps[2].Outcome != TraceOutcomeAnswer {
+		t.Fatalf("unexpected step of the glueless name server: %+v", steps[2])
+	}
+}
+
+func TestDNSTracer_ChaosClass(t *testing.T) {
+	chain := startTestTraceChain(t)
+	steps := make([]TraceStep, 0)
+	newTestTracer(chain, dns.ClassCHAOS, &steps).resolve(context.Background(), "www.example.test.", dns.TypeTXT, 0)
+
+	if n := chain.countQueries("auth CH www.example.test."); n != 1 {
+		t.Fatalf("expected the query to reach the auth server in class CH, got %v", chain.queries)
+	}
+	// the address of the glueless name server is still looked up in class IN
+	if n := chain.countQueries("tld IN ns.hoster.test."); n != 1 {
+		t.Fatalf("expected the name server to be resolved in class IN, got %v", chain.queries)
+	}
+}
+
+func TestDNSTracer_Limits(t *testing.T) {
+	chain := startTestTraceChain(t)
+
+	steps := make([]TraceStep, 0)
+	_, err := newTestTracer(chain, dns.ClassINET, &steps).resolve(context.Background(), "loop1.example.test.", dns.TypeA, 0)
+	if !errors.Is(err, errTraceFailed) || !strings.Contains(err.Error(), "too many CNAMEs") {
+		t.Fatalf("expected the CNAME loop to be cut, got %v", err)
+	}
+	if n := chain.countQueries("auth IN loop"); n != maxTraceCNAMEs+1 {
+		t.Fatalf("expected %d queries of the loop, got %d", maxTraceCNAMEs+1, n)
+	}
+
+	steps = steps[:0]
+	_, err = newTestTracer(chain, dns.ClassINET, &steps).resolve(context.Background(), "www.deep0.test.", dns.TypeA, 0)
+	if !errors.Is(err, errTraceFailed) {
+		t.Fatalf("expected the trace to fail, got %v", err)
+	}
+	// each level of the nesting starts from the root, until the depth limit is hit
+	deepest := fmt.Sprintf("root IN ns.deep%d.test.", maxTraceDepth)
+	if chain.countQueries(deepest) == 0 || chain.countQueries(fmt.Sprintf("root IN ns.deep%d.test.", maxTraceDepth+1)) != 0 {
+		t.Fatalf("expected the glueless resolution to stop at ns.deep%d.test., got %v", maxTraceDepth, chain.queries)
+	}
+	if last := steps[len(steps)-1]; last.Outcome != TraceOutcomeError || last.ServerName != "ns.deep1.test." {
+		t.Fatalf("expected the address of ns.deep1.test. to be unresolvable, got %+v", last)
+	}
+}
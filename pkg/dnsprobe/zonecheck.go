@@ -0,0 +1,332 @@
+package dnsprobe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+)
+
+type ZoneServerStatus string
+
+const (
+	ZoneServerStatusOK          ZoneServerStatus = "ok"
+	ZoneServerStatusUnreachable ZoneServerStatus = "unreachable"
+	ZoneServerStatusLame        ZoneServerStatus = "lame"
+	// the name server has no address of that family, which is not an error by itself
+	ZoneServerStatusNoAddress ZoneServerStatus = "no_address"
+)
+
+const (
+	zoneCheckFamilyIPv4 = "ip4"
+	zoneCheckFamilyIPv6 = "ip6"
+)
+
+const maxZoneCheckDuration = 60 * time.Second
+
+type ZoneServerResult struct {
+	ServerName string           `json:"server_name"`
+	Server     string           `json:"server,omitempty"`
+	Family     string           `json:"family"`
+	Status     ZoneServerStatus `json:"status"`
+	Reason     string           `json:"reason,omitempty"`
+
+	// of the SOA query
+	Rcode         string        `json:"rcode,omitempty"`
+	Authoritative bool          `json:"aa"`
+	RTT           time.Duration `json:"rtt,omitempty"`
+	Serial        *uint32       `json:"serial,omitempty"`
+
+	// whether the server responds with an OPT record, and whether it answers over TCP
+	EDNS bool `json:"edns"`
+	TCP  bool `json:"tcp"`
+
+	// of the chosen record, see ZoneCheckReport.Name
+	RecordRcode   string   `json:"record_rcode,omitempty"`
+	AnswerStrings []string `json:"answer_strings,omitempty"`
+}
+
+func (r *ZoneServerResult) String() string {
+	return fmt.Sprintf("%s(%s)", r.ServerName, r.Server)
+}
+
+type ZoneCheckReport struct {
+	CorrelationID string       `json:"corrId,omitempty"`
+	Zone          string       `json:"zone"`
+	Name          string       `json:"name"`
+	QueryType     DNSQueryType `json:"query_type"`
+	NameServers   []string     `json:"name_servers"`
+
+	Servers []ZoneServerResult `json:"servers"`
+
+	// distinct serials seen by the servers which are ok
+	Serials        []uint32 `json:"serials,omitempty"`
+	SerialMismatch bool     `json:"serial_mismatch"`
+	AnswerMismatch bool     `json:"answer_mismatch"`
+
+	// in the form of <server_name>(<server>)
+	Unreachable []string `json:"unreachable,omitempty"`
+	Lame        []string `json:"lame,omitempty"`
+	NoEDNS      []string `json:"no_edns,omitempty"`
+	NoTCP       []string `json:"no_tcp,omitempty"`
+
+	ErrString string        `json:"err_string,omitempty"`
+	StartedAt time.Time     `json:"started_at"`
+	Elapsed   time.Duration `json:"elapsed,omitempty"`
+}
+
+type zoneChecker struct {
+	zone      string
+	name      string
+	queryType DNSQueryType
+	timeout   time.Duration
+	// where the servers listen, 53 other than in tests
+	port uint16
+}
+
+func (c *zoneChecker) exchange(ctx context.Context, transport Transport, server netip.Addr, qname string, queryType DNSQueryType) (*dns.Msg, time.Duration, error) {
+	m, err := buildQueryMsg(qname, queryType)
+	if err != nil {
+		return nil, 0, err
+	}
+	m.RecursionDesired = false
+
+	exchange, err := getExchangeFunc(transport, netip.AddrPortFrom(server, c.port).String(), nil, c.timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	startedAt := time.Now()
+	resp, err := exchange(ctx, m)
+	return resp, time.Since(startedAt), err
+}
+
+func (c *zoneChecker) checkServer(ctx context.Context, result *ZoneServerResult, server netip.Addr) {
+	resp, rtt, err := c.exchange(ctx, TransportUDP, server, c.zone, DNSQueryTypeSOA)
+	tcpResp, tcpRTT, tcpErr := c.exchange(ctx, TransportTCP, server, c.zone, DNSQueryTypeSOA)
+	result.TCP = tcpErr == nil
+	if err != nil || resp.Truncated {
+		if tcpErr != nil {
+			result.Status = ZoneServerStatusUnreachable
+			if err == nil {
+				err = tcpErr
+			}
+			result.Reason = err.Error()
+			return
+		}
+		resp = tcpResp
+		rtt = tcpRTT
+	}
+
+	result.RTT = rtt
+	result.EDNS = resp.UDPSize > 0
+	result.Rcode = dnsutil.RcodeToString(resp.Rcode)
+	result.Authoritative = resp.Authoritative
+	if resp.Rcode != dns.RcodeSuccess {
+		result.Status = ZoneServerStatusLame
+		result.Reason = fmt.Sprintf("server responded with %s", result.Rcode)
+		return
+	}
+	if !resp.Authoritative {
+		result.Status = ZoneServerStatusLame
+		result.Reason = "server is not authoritative for the zone"
+		return
+	}
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && dns.EqualName(soa.Header().Name, c.zone) {
+			serial := soa.Serial
+			result.Serial = &serial
+			break
+		}
+	}
+	if result.Serial == nil {
+		result.Status = ZoneServerStatusLame
+		result.Reason = "no SOA record of the zone in the answer"
+		return
+	}
+	result.Status = ZoneServerStatusOK
+
+	if c.queryType == DNSQueryTypeSOA && dns.EqualName(c.name, c.zone) {
+		result.RecordRcode = result.Rcode
+		result.AnswerStrings = []string{fmt.Sprintf("%d", *result.Serial)}
+		return
+	}
+
+	resp, _, err = c.exchange(ctx, TransportUDP, server, c.name, c.queryType)
+	if err == nil && resp.Truncated {
+		resp, _, err = c.exchange(ctx, TransportTCP, server, c.name, c.queryType)
+	}
+	if err != nil {
+		result.Reason = fmt.Sprintf("failed to query %s: %v", c.name, err)
+		return
+	}
+	result.RecordRcode = dnsutil.RcodeToString(resp.Rcode)
+	rrType := dnsQueryTypeToRRType[c.queryType]
+	for _, rr := range resp.Answer {
+		if dns.RRToType(rr) == rrType {
+			result.AnswerStrings = append(result.AnswerStrings, answerToString(rr))
+		}
+	}
+	slices.Sort(result.AnswerStrings)
+}
+
+func summarizeZoneCheck(report *ZoneCheckReport) {
+	answerSets := make(map[string]bool)
+	for _, result := range report.Servers {
+		switch result.Status {
+		case ZoneServerStatusUnreachable:
+			report.Unreachable = append(report.Unreachable, result.String())
+			continue
+		case ZoneServerStatusLame:
+			report.Lame = append(report.Lame, result.String())
+		case ZoneServerStatusNoAddress:
+			continue
+		}
+
+		if !result.EDNS {
+			report.NoEDNS = append(report.NoEDNS, result.String())
+		}
+		if !result.TCP {
+			report.NoTCP = append(report.NoTCP, result.String())
+		}
+		if result.Status != ZoneServerStatusOK {
+			continue
+		}
+		if result.Serial != nil && !slices.Contains(report.Serials, *result.Serial) {
+			report.Serials = append(report.Serials, *result.Serial)
+		}
+		if result.RecordRcode != "" {
+			answerSets[result.RecordRcode+"|"+strings.Join(result.AnswerStrings, ",")] = true
+		}
+	}
+	slices.Sort(report.Serials)
+	report.SerialMismatch = len(report.Serials) > 1
+	report.AnswerMismatch = len(answerSets) > 1
+}
+
+// CheckZone queries every authoritative server of the zone (i.e. parameter.Target) over both IPv4 and IPv6,
+// and reports the inconsistencies among them. The NS set and the addresses of the name servers are
+// looked up with resolver, the default resolver is used when it's nil.
+func CheckZone(ctx context.Context, parameter LookupParameter, resolver *net.Resolver) *ZoneCheckReport {
+	return checkZone(ctx, parameter, resolver, 53)
+}
+
+func checkZone(ctx context.Context, parameter LookupParameter, resolver *net.Resolver, port uint16) *ZoneCheckReport {
+	report := &ZoneCheckReport{
+		CorrelationID: parameter.CorrelationID,
+		Zone:          dnsutil.Fqdn(parameter.Target),
+		Name:          dnsutil.Fqdn(parameter.Target),
+		QueryType:     parameter.QueryType,
+		Servers:       make([]ZoneServerResult, 0),
+		StartedAt:     time.Now(),
+	}
+	defer func() {
+		report.Elapsed = time.Since(report.StartedAt)
+	}()
+	if parameter.RecordName != "" {
+		report.Name = dnsutil.Fqdn(parameter.RecordName)
+	}
+	if report.QueryType == "" {
+		report.QueryType = DNSQueryTypeSOA
+	}
+	if _, ok := dnsQueryTypeToRRType[report.QueryType]; !ok || isChaosQueryType(report.QueryType) {
+		report.ErrString = fmt.Sprintf("invalid query type: %s", report.QueryType)
+		return report
+	}
+	if !dnsutil.IsBelow(report.Zone, report.Name) {
+		report.ErrString = fmt.Sprintf("%s is not within zone %s", report.Name, report.Zone)
+		return report
+	}
+
+	var timeoutMs int64 = defaultDNSProbeTimeoutMs
+	if parameter.TimeoutMs != nil {
+		timeoutMs = *parameter.TimeoutMs
+	}
+	if timeoutMs < minTimeoutMs || timeoutMs > maxTimeoutMs {
+		report.ErrString = fmt.Sprintf("timeout must be within %dms and %dms, got %dms", minTimeoutMs, maxTimeoutMs, timeoutMs)
+		return report
+	}
+
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, maxZoneCheckDuration)
+	defer cancel()
+
+	nsRecords, err := resolver.LookupNS(ctx, report.Zone)
+	if err != nil {
+		report.ErrString = fmt.Sprintf("failed to lookup NS of %s: %v", report.Zone, err)
+		return report
+	}
+	for _, ns := range nsRecords {
+		nsName := dnsutil.Fqdn(strings.ToLower(ns.Host))
+		if !slices.Contains(report.NameServers, nsName) {
+			report.NameServers = append(report.NameServers, nsName)
+		}
+	}
+	sort.Strings(report.NameServers)
+
+	checker := &zoneChecker{
+		zone:      report.Zone,
+		name:      report.Name,
+		queryType: report.QueryType,
+		timeout:   time.Duration(timeoutMs) * time.Millisecond,
+		port:      port,
+	}
+
+	lock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, nsName := range report.NameServers {
+		for _, family := range []string{zoneCheckFamilyIPv4, zoneCheckFamilyIPv6} {
+			addrs, err := resolver.LookupNetIP(ctx, family, nsName)
+			if err != nil || len(addrs) == 0 {
+				result := ZoneServerResult{ServerName: nsName, Family: family, Status: ZoneServerStatusNoAddress}
+				var dnsErr *net.DNSError
+				if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+					result.Reason = err.Error()
+				}
+				lock.Lock()
+				report.Servers = append(report.Servers, result)
+				lock.Unlock()
+				continue
+			}
+
+			for _, addr := range addrs {
+				wg.Add(1)
+				go func(addr netip.Addr) {
+					defer wg.Done()
+					result := ZoneServerResult{ServerName: nsName, Server: addr.String(), Family: family}
+					checker.checkServer(ctx, &result, addr)
+					lock.Lock()
+					defer lock.Unlock()
+					report.Servers = append(report.Servers, result)
+				}(addr.Unmap())
+			}
+		}
+	}
+	wg.Wait()
+
+	sort.SliceStable(report.Servers, func(i, j int) bool {
+		if report.Servers[i].ServerName != report.Servers[j].ServerName {
+			return report.Servers[i].ServerName < report.Servers[j].ServerName
+		}
+		if report.Servers[i].Family != report.Servers[j].Family {
+			return report.Servers[i].Family < report.Servers[j].Family
+		}
+		return report.Servers[i].Server < report.Servers[j].Server
+	})
+	summarizeZoneCheck(report)
+	return report
+}
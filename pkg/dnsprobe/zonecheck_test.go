@@ -0,0 +1,154 @@
+package dnsprobe
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+func newTestZoneServerResult(name string, status ZoneServerStatus, serial uint32, answers ...string) ZoneServerResult {
+	return ZoneServerResult{
+		ServerName:    name,
+		Server:        "192.0.2.1",
+		Status:        status,
+		Serial:        &serial,
+		EDNS:          true,
+		TCP:           true,
+		RecordRcode:   "NOERROR",
+		AnswerStrings: answers,
+	}
+}
+
+func TestSummarizeZoneCheck(t *testing.T) {
+	noTCP := newTestZoneServerResult("ns3.example.", ZoneServerStatusOK, 2024010101, "192.0.2.80")
+	noTCP.TCP = false
+	report := &ZoneCheckReport{
+		Servers: []ZoneServerResult{
+			newTestZoneServerResult("ns1.example.", ZoneServerStatusOK, 2024010101, "192.0.2.80"),
+			newTestZoneServerResult("ns2.example.", ZoneServerStatusOK, 2024010100, "192.0.2.81"),
+			noTCP,
+			{ServerName: "ns4.example.", Server: "192.0.2.4", Status: ZoneServerStatusUnreachable},
+			{ServerName: "ns4.example.", Family: zoneCheckFamilyIPv6, Status: ZoneServerStatusNoAddress},
+			{ServerName: "ns5.example.", Server: "192.0.2.5", Status: ZoneServerStatusLame, EDNS: true, TCP: true},
+		},
+	}
+	summarizeZoneCheck(report)
+
+	if !report.SerialMismatch || !slices.Equal(report.Serials, []uint32{2024010100, 2024010101}) {
+		t.Fatalf("expected serial mismatch, got %v", report.Serials)
+	}
+	if !report.AnswerMismatch {
+		t.Fatalf("expected answer mismatch")
+	}
+	if !slices.Equal(report.Unreachable, []string{"ns4.example.(192.0.2.4)"}) {
+		t.Fatalf("unexpected unreachable servers: %v", report.Unreachable)
+	}
+	if !slices.Equal(report.Lame, []string{"ns5.example.(192.0.2.5)"}) {
+		t.Fatalf("unexpected lame servers: %v", report.Lame)
+	}
+	if !slices.Equal(report.NoTCP, []string{"ns3.example.(192.0.2.1)"}) || len(report.NoEDNS) != 0 {
+		t.Fatalf("unexpected servers without tcp or edns: %v %v", report.NoTCP, report.NoEDNS)
+	}
+}
+
+// answers the SOA and the NS queries of example. authoritatively, the way a server of the zone would
+func newTestAuthHandler(serial uint32, edns bool, nsNames ...string) dns.Handler {
+	return dns.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		dnsutil.SetReply(m, req)
+		m.Authoritative = true
+		if edns {
+			m.UDPSize = ednsUDPSize
+		}
+		switch dns.RRToType(req.Question[0]) {
+		case dns.TypeSOA:
+			m.Answer = []dns.RR{&dns.SOA{
+				Hdr: dns.Header{Name: "example.", Class: dns.ClassINET, TTL: 3600},
+				SOA: rdata.SOA{Ns: "ns1.example.", Mbox: "hostmaster.example.", Serial: serial},
+			}}
+		case dns.TypeNS:
+			for _, nsName := range nsNames {
+				m.Answer = append(m.Answer, newTestNS("example.", nsName))
+			}
+		}
+		io.Copy(w, m)
+	})
+}
+
+func TestCheckZone(t *testing.T) {
+	// the servers of a zone share the port, the first one picks it
+	ns1 := startTestDNSServer(t, "127.0.0.11:0", newTestAuthHandler(2024010101, true, "ns1.example.", "ns2.example.", "ns3.example."))
+	_, portStr, _ := net.SplitHostPort(ns1)
+	port, _ := strconv.Atoi(portStr)
+	startTestDNSServer(t, net.JoinHostPort("127.0.0.12", portStr), newTestAuthHandler(2024010100, false, "ns1.example.", "ns2.example."))
+	// nothing listens on the address of ns3
+
+	nsAddrs := map[string]string{"ns1.example.": "127.0.0.11", "ns2.example.": "127.0.0.12", "ns3.example.": "127.0.0.13"}
+	resolverAddr := startTestDNSServer(t, "127.0.0.1:0", dns.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		dnsutil.SetReply(m, req)
+		name := req.Question[0].Header().Name
+		switch dns.RRToType(req.Question[0]) {
+		case dns.TypeNS:
+			for _, nsName := range []string{"ns1.example.", "ns2.example.", "ns3.example."} {
+				m.Answer = append(m.Answer, newTestNS("example.", nsName))
+			}
+		case dns.TypeA:
+			if addr, ok := nsAddrs[dnsutil.Canonical(name)]; ok {
+				m.Answer = []dns.RR{&dns.A{
+					Hdr: dns.Header{Name: name, Class: dns.ClassINET, TTL: 3600},
+					A:   rdata.A{Addr: netip.MustParseAddr(addr)},
+				}}
+			}
+		}
+		io.Copy(w, m)
+	}))
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, resolverAddr)
+		},
+	}
+
+	timeoutMs := int64(1000)
+	report := checkZone(context.Background(), LookupParameter{Target: "example", QueryType: DNSQueryTypeNS, TimeoutMs: &timeoutMs}, resolver, uint16(port))
+	if report.ErrString != "" {
+		t.Fatalf("unexpected error: %s", report.ErrString)
+	}
+	if !slices.Equal(report.NameServers, []string{"ns1.example.", "ns2.example.", "ns3.example."}) {
+		t.Fatalf("unexpected name servers: %v", report.NameServers)
+	}
+	// one result of each family for each of the name servers, none of which has an IPv6 address
+	if len(report.Servers) != 6 {
+		t.Fatalf("expected 6 results, got %+v", report.Servers)
+	}
+	for _, result := range report.Servers {
+		if result.Family == zoneCheckFamilyIPv6 && result.Status != ZoneServerStatusNoAddress {
+			t.Fatalf("expected no IPv6 address of %s, got %+v", result.ServerName, result)
+		}
+		if result.Status == ZoneServerStatusOK && (result.RTT <= 0 || !result.TCP) {
+			t.Fatalf("expected the rtt and tcp of %s to be recorded, got %+v", result.ServerName, result)
+		}
+	}
+
+	if !report.SerialMismatch || !slices.Equal(report.Serials, []uint32{2024010100, 2024010101}) {
+		t.Fatalf("expected serial mismatch, got %v", report.Serials)
+	}
+	if !report.AnswerMismatch {
+		t.Fatalf("expected the NS sets to mismatch")
+	}
+	if !slices.Equal(report.Unreachable, []string{"ns3.example.(127.0.0.13)"}) {
+		t.Fatalf("unexpected unreachable servers: %v", report.Unreachable)
+	}
+	if !slices.Equal(report.NoEDNS, []string{"ns2.example.(127.0.0.12)"}) || len(report.NoTCP) != 0 || len(report.Lame) != 0 {
+		t.Fatalf("unexpected servers without edns, tcp, or lame: %v %v %v", report.NoEDNS, report.NoTCP, report.Lame)
+	}
+}
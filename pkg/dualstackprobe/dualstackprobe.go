@@ -0,0 +1,377 @@
+package dualstackprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
+)
+
+// Recommended values of RFC 8305
+const (
+	// How long to wait for the AAAA records once the A records arrived first
+	ResolutionDelay = 50 * time.Millisecond
+	// How long to wait for an attempt before starting the next one
+	ConnectionAttemptDelay = 250 * time.Millisecond
+)
+
+const (
+	FamilyIPv6 = "ip6"
+	FamilyIPv4 = "ip4"
+)
+
+const defaultTimeout = 5 * time.Second
+
+// DualStackProbe resolves both address families of Target, and connects over each of them, in parallel and one after the other,
+// then it races the addresses the way a Happy Eyeballs (RFC 8305) client would, to tell which family such a client ends up with.
+type DualStackProbe struct {
+	// host:port, e.g. 'example.com:443', the host has to be a domain name
+	Target string `json:"target"`
+
+	// When true, a TLS handshake follows each connect of the per-family measurements, the race is of TCP only
+	TLS bool `json:"tls,omitempty"`
+
+	// Overrides the server name for SNI, default is the host of the target, the certificate is not verified
+	ServerName string `json:"serverName,omitempty"`
+
+	// Of each connect and each handshake, default is 5000
+	TimeoutMs *int `json:"timeoutMs,omitempty"`
+
+	Resolver *string `json:"resolver,omitempty"`
+
+	CorrelationID string `json:"correlationId,omitempty"`
+
+	// the one of net.Dialer when nil, tests replace it to tell the families apart on loopback
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+type FamilyResult struct {
+	Family string `json:"family"`
+
+	// Of the AAAA or the A lookup
+	Lookup time.Duration `json:"lookup"`
+	Addrs  []string      `json:"addrs,omitempty"`
+
+	// Only the first address is connected to
+	RemoteAddr   string        `json:"remote_addr,omitempty"`
+	Connect      time.Duration `json:"connect,omitempty"`
+	TLSHandshake time.Duration `json:"tls_handshake,omitempty"`
+	TLSVersion   string        `json:"tls_version,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+type RaceAttempt struct {
+	Addr   string        `json:"addr"`
+	Family string        `json:"family"`
+	Start  time.Duration `json:"start"`
+	Error  string        `json:"error,omitempty"`
+}
+
+type RaceResult struct {
+	// From the start of the resolution to the first connection attempt, with the Resolution Delay applied
+	StartAfter time.Duration `json:"start_after"`
+
+	Attempts []RaceAttempt `json:"attempts"`
+
+	WinnerFamily string `json:"winner_family,omitempty"`
+	WinnerAddr   string `json:"winner_addr,omitempty"`
+	// From the start of the resolution to the winning connection being established
+	Elapsed time.Duration `json:"elapsed,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+type DualStackProbeResult struct {
+	CorrelationID string    `json:"correlationId"`
+	Target        string    `json:"target"`
+	StartedAt     time.Time `json:"started_at"`
+
+	// The families connected to at the same time
+	Parallel []FamilyResult `json:"parallel"`
+	// The families connected to one after the other, IPv6 first
+	Sequential []FamilyResult `json:"sequential"`
+
+	Race *RaceResult `json:"race,omitempty"`
+
+	// True when there are AAAA records, but IPv6 connects fail while IPv4 ones succeed,
+	// which a Happy Eyeballs client hides at the cost of the Connection Attempt Delay.
+	IPv6Broken       bool   `json:"ipv6_broken"`
+	IPv6BrokenReason string `json:"ipv6_broken_reason,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+func (probe *DualStackProbe) Validate() error {
+	if err := pkgutils.ValidateHostPort(probe.Target, ""); err != nil {
+		return err
+	}
+	if host, _, _ := net.SplitHostPort(probe.Target); net.ParseIP(host) != nil {
+		return fmt.Errorf("the host of target %s has to be a domain name", probe.Target)
+	}
+	return nil
+}
+
+func (probe *DualStackProbe) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if probe.dial != nil {
+		return probe.dial(ctx, network, address)
+	}
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, network, address)
+}
+
+func (probe *DualStackProbe) getTimeout() time.Duration {
+	if probe.TimeoutMs == nil || *probe.TimeoutMs <= 0 {
+		return defaultTimeout
+	}
+	return time.Duration(*probe.TimeoutMs) * time.Millisecond
+}
+
+type familyLookup struct {
+	family   string
+	addrs    []string
+	duration time.Duration
+	doneAt   time.Duration
+	err      error
+}
+
+// lookupFamilies resolves both families concurrently, doneAt of each is relative to startedAt
+func lookupFamilies(ctx context.Context, resolver *net.Resolver, host string, startedAt time.Time) (*familyLookup, *familyLookup) {
+	v6 := &familyLookup{family: FamilyIPv6}
+	v4 := &familyLookup{family: FamilyIPv4}
+	wg := &sync.WaitGroup{}
+	for _, lookup := range []*familyLookup{v6, v4} {
+		wg.Add(1)
+		go func(lookup *familyLookup) {
+			defer wg.Done()
+			lookupStartedAt := time.Now()
+			ips, err := resolver.LookupIP(ctx, lookup.family, host)
+			lookup.duration = time.Since(lookupStartedAt)
+			lookup.doneAt = time.Since(startedAt)
+			lookup.err = err
+			for _, ip := range ips {
+				lookup.addrs = append(lookup.addrs, ip.String())
+			}
+		}(lookup)
+	}
+	wg.Wait()
+	return v6, v4
+}
+
+func (probe *DualStackProbe) measureFamily(ctx context.Context, lookup *familyLookup, port string) FamilyResult {
+	result := FamilyResult{Family: lookup.family, Lookup: lookup.duration, Addrs: lookup.addrs}
+	if lookup.err != nil {
+		result.Error = fmt.Sprintf("failed to lookup %s addresses: %v", lookup.family, lookup.err)
+		return result
+	}
+	if len(lookup.addrs) == 0 {
+		result.Error = fmt.Sprintf("no %s address found", lookup.family)
+		return result
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, probe.getTimeout())
+	defer cancel()
+
+	addr := net.JoinHostPort(lookup.addrs[0], port)
+	result.RemoteAddr = addr
+	connectStartedAt := time.Now()
+	conn, err := probe.dialContext(connectCtx, "tcp", addr)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to connect to %s: %v", addr, err)
+		return result
+	}
+	defer conn.Close()
+	result.Connect = time.Since(connectStartedAt)
+
+	if !probe.TLS {
+		return result
+	}
+
+	serverName := probe.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(probe.Target)
+	}
+	handshakeCtx, cancelHandshake := context.WithTimeout(ctx, probe.getTimeout())
+	defer cancelHandshake()
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	handshakeStartedAt := time.Now()
+	if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		result.Error = fmt.Sprintf("failed to handshake with %s: %v", addr, err)
+		return result
+	}
+	result.TLSHandshake = time.Since(handshakeStartedAt)
+	result.TLSVersion = tls.VersionName(tlsConn.ConnectionState().Version)
+	return result
+}
+
+// getStartAfter applies the Resolution Delay: an RFC 8305 client waits a little for the AAAA records when the A records arrive first
+func getStartAfter(v6, v4 *familyLookup) time.Duration {
+	v6Usable := v6.err == nil && len(v6.addrs) > 0
+	v4Usable := v4.err == nil && len(v4.addrs) > 0
+	switch {
+	case v6Usable && v4Usable:
+		if v6.doneAt <= v4.doneAt+ResolutionDelay {
+			return v6.doneAt
+		}
+		return v4.doneAt + ResolutionDelay
+	case v6Usable:
+		return v6.doneAt
+	case v4Usable:
+		return max(v4.doneAt, min(v6.doneAt, v4.doneAt+ResolutionDelay))
+	default:
+		return max(v6.doneAt, v4.doneAt)
+	}
+}
+
+type raceAddr struct {
+	family string
+	addr   string
+}
+
+// interleaveAddrs alternates the families, the one of primary first, see section 4 of RFC 8305
+func interleaveAddrs(primary, secondary *familyLookup, port string) []raceAddr {
+	addrs := make([]raceAddr, 0, len(primary.addrs)+len(secondary.addrs))
+	for i := 0; i < max(len(primary.addrs), len(secondary.addrs)); i++ {
+		for _, lookup := range []*familyLookup{primary, secondary} {
+			if i < len(lookup.addrs) {
+				addrs = append(addrs, raceAddr{family: lookup.family, addr: net.JoinHostPort(lookup.addrs[i], port)})
+			}
+		}
+	}
+	return addrs
+}
+
+type raceOutcome struct {
+	idx  int
+	conn net.Conn
+	err  error
+}
+
+// race starts an attempt every ConnectionAttemptDelay, or right after the previous one fails, the first established connection wins.
+func (probe *DualStackProbe) race(ctx context.Context, addrs []raceAddr, startAfter time.Duration) *RaceResult {
+	result := &RaceResult{StartAfter: startAfter, Attempts: make([]RaceAttempt, 0)}
+	if len(addrs) == 0 {
+		result.Error = "no address to race"
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probe.getTimeout())
+	defer cancel()
+
+	outcomes := make(chan raceOutcome, len(addrs))
+	startedAt := time.Now()
+	pending := 0
+	startNext := func() {
+		idx := len(result.Attempts)
+		result.Attempts = append(result.Attempts, RaceAttempt{Addr: addrs[idx].addr, Family: addrs[idx].family, Start: startAfter + time.Since(startedAt)})
+		pending++
+		go func() {
+			conn, err := probe.dialContext(ctx, "tcp", addrs[idx].addr)
+			outcomes <- raceOutcome{idx: idx, conn: conn, err: err}
+		}()
+	}
+
+	startNext()
+	timer := time.NewTimer(ConnectionAttemptDelay)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if len(result.Attempts) < len(addrs) {
+				startNext()
+				timer.Reset(ConnectionAttemptDelay)
+			}
+		case outcome := <-outcomes:
+			pending--
+			if outcome.err != nil {
+				result.Attempts[outcome.idx].Error = outcome.err.Error()
+				if len(result.Attempts) < len(addrs) {
+					startNext()
+					timer.Reset(ConnectionAttemptDelay)
+				}
+				continue
+			}
+
+			result.Elapsed = startAfter + time.Since(startedAt)
+			result.WinnerAddr = addrs[outcome.idx].addr
+			result.WinnerFamily = addrs[outcome.idx].family
+			outcome.conn.Close()
+
+			// the losers are cancelled, the ones that connected anyway are closed
+			cancel()
+			go func(pending int) {
+				for i := 0; i < pending; i++ {
+					if late := <-outcomes; late.conn != nil {
+						late.conn.Close()
+					}
+				}
+			}(pending)
+			return result
+		}
+	}
+
+	result.Error = "all the attempts failed"
+	return result
+}
+
+func succeeded(result FamilyResult) bool {
+	return result.Error == "" && result.RemoteAddr != ""
+}
+
+func (probe *DualStackProbe) Do(ctx context.Context) *DualStackProbeResult {
+	result := &DualStackProbeResult{
+		CorrelationID: probe.CorrelationID,
+		Target:        probe.Target,
+		StartedAt:     time.Now(),
+		Parallel:      make([]FamilyResult, 0),
+		Sequential:    make([]FamilyResult, 0),
+	}
+
+	host, port, err := net.SplitHostPort(probe.Target)
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid target %s, expected host:port: %v", probe.Target, err)
+		return result
+	}
+
+	resolver := pkgutils.NewCustomResolver(probe.Resolver, 10*time.Second)
+	v6, v4 := lookupFamilies(ctx, resolver, host, result.StartedAt)
+
+	// the race goes first, so that the other measurements don't warm it up,
+	// IPv6 is preferred, unless the AAAA records arrive too late to be
+	startAfter := getStartAfter(v6, v4)
+	primary, secondary := v6, v4
+	if v6.doneAt > startAfter {
+		primary, secondary = v4, v6
+	}
+	result.Race = probe.race(ctx, interleaveAddrs(primary, secondary, port), startAfter)
+
+	parallel := make([]FamilyResult, 2)
+	wg := &sync.WaitGroup{}
+	for idx, lookup := range []*familyLookup{v6, v4} {
+		wg.Add(1)
+		go func(idx int, lookup *familyLookup) {
+			defer wg.Done()
+			parallel[idx] = probe.measureFamily(ctx, lookup, port)
+		}(idx, lookup)
+	}
+	wg.Wait()
+	result.Parallel = parallel
+
+	for _, lookup := range []*familyLookup{v6, v4} {
+		result.Sequential = append(result.Sequential, probe.measureFamily(ctx, lookup, port))
+	}
+
+	if len(v6.addrs) > 0 {
+		v6Failed := !succeeded(result.Parallel[0]) && !succeeded(result.Sequential[0])
+		v4Succeeded := succeeded(result.Parallel[1]) || succeeded(result.Sequential[1])
+		if v6Failed && v4Succeeded {
+			result.IPv6Broken = true
+			result.IPv6BrokenReason = fmt.Sprintf("%s has AAAA records, but %s", host, result.Sequential[0].Error)
+		}
+	}
+	return result
+}
@@ -0,0 +1,251 @@
+package dualstackprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnsutil"
+	"codeberg.org/miekg/dns/rdata"
+)
+
+func TestGetStartAfter(t *testing.T) {
+	ms := time.Millisecond
+	cases := []struct {
+		v6, v4 *familyLookup
+		expect time.Duration
+	}{
+		// AAAA first, connecting right away
+		{&familyLookup{addrs: []string{"2001:db8::1"}, doneAt: 10 * ms}, &familyLookup{addrs: []string{"192.0.2.1"}, doneAt: 30 * ms}, 10 * ms},
+		// AAAA shortly after A, waiting for it
+		{&familyLookup{addrs: []string{"2001:db8::1"}, doneAt: 40 * ms}, &familyLookup{addrs: []string{"192.0.2.1"}, doneAt: 10 * ms}, 40 * ms},
+		// AAAA too late, giving up after the Resolution Delay
+		{&familyLookup{addrs: []string{"2001:db8::1"}, doneAt: 200 * ms}, &familyLookup{addrs: []string{"192.0.2.1"}, doneAt: 10 * ms}, 60 * ms},
+		// no AAAA records, the empty answer ends the wait
+		{&familyLookup{doneAt: 20 * ms}, &familyLookup{addrs: []string{"192.0.2.1"}, doneAt: 10 * ms}, 20 * ms},
+		{&familyLookup{err: errors.New("timeout"), doneAt: 500 * ms}, &familyLookup{addrs: []string{"192.0.2.1"}, doneAt: 10 * ms}, 60 * ms},
+	}
+	for idx, c := range cases {
+		if got := getStartAfter(c.v6, c.v4); got != c.expect {
+			t.Errorf("case %d: expected %v, got %v", idx, c.expect, got)
+		}
+	}
+}
+
+func TestInterleaveAddrs(t *testing.T) {
+	v6 := &familyLookup{family: FamilyIPv6, addrs: []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"}}
+	v4 := &familyLookup{family: FamilyIPv4, addrs: []string{"192.0.2.1"}}
+	addrs := interleaveAddrs(v6, v4, "443")
+	expected := []string{"[2001:db8::1]:443", "192.0.2.1:443", "[2001:db8::2]:443", "[2001:db8::3]:443"}
+	if len(addrs) != len(expected) {
+		t.Fatalf("expected %v, got %+v", expected, addrs)
+	}
+	for idx := range expected {
+		if addrs[idx].addr != expected[idx] {
+			t.Fatalf("expected %v, got %+v", expected, addrs)
+		}
+	}
+}
+
+// closeNotifyingConn tells when the race closes a connection it doesn't need
+type closeNotifyingConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (conn *closeNotifyingConn) Close() error {
+	close(conn.closed)
+	return conn.Conn.Close()
+}
+
+// testDialer has the IPv6 attempts, which can't be relied on in a sandbox, connect to the IPv4 loopback after v6Delay,
+// a negative v6Delay blackholes them instead
+type testDialer struct {
+	v6Delay time.Duration
+	v6Conn  atomic.Pointer[closeNotifyingConn]
+}
+
+func (dialer *testDialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, _ := net.SplitHostPort(address)
+	if !strings.Contains(host, ":") {
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+	if dialer.v6Delay < 0 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	// a connect that completes regardless of the cancellation, as a late SYN-ACK would
+	time.Sleep(dialer.v6Delay)
+	conn, err := net.Dial(network, net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		return nil, err
+	}
+	notifying := &closeNotifyingConn{Conn: conn, closed: make(chan struct{})}
+	dialer.v6Conn.Store(notifying)
+	return notifying, nil
+}
+
+func startTestListener(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func TestRace(t *testing.T) {
+	port := startTestListener(t)
+	v6 := &familyLookup{family: FamilyIPv6, addrs: []string{"::1"}}
+	v4 := &familyLookup{family: FamilyIPv4, addrs: []string{"127.0.0.1"}}
+	addrs := interleaveAddrs(v6, v4, port)
+
+	t.Run("ipv6 blackholed", func(t *testing.T) {
+		dialer := &testDialer{v6Delay: -1}
+		result := (&DualStackProbe{dial: dialer.dial}).race(context.Background(), addrs, 10*time.Millisecond)
+		if result.WinnerFamily != FamilyIPv4 || result.WinnerAddr != "127.0.0.1:"+port || len(result.Attempts) != 2 {
+			t.Fatalf("expected ipv4 to win the second attempt, got %+v", result)
+		}
+		// the fallback waits for the Connection Attempt Delay, on top of the Resolution Delay
+		if start := result.Attempts[1].Start; start < 10*time.Millisecond+ConnectionAttemptDelay || start > 10*time.Millisecond+2*ConnectionAttemptDelay {
+			t.Fatalf("expected the ipv4 attempt to start after the connection attempt delay, got %v", start)
+		}
+		if result.Elapsed < result.Attempts[1].Start {
+			t.Fatalf("expected the elapsed time %v to include the fallback delay", result.Elapsed)
+		}
+	})
+
+	t.Run("both reachable", func(t *testing.T) {
+		dialer := &testDialer{}
+		result := (&DualStackProbe{dial: dialer.dial}).race(context.Background(), addrs, 0)
+		if result.WinnerFamily != FamilyIPv6 || len(result.Attempts) != 1 {
+			t.Fatalf("expected ipv6 to win without a fallback, got %+v", result)
+		}
+		if conn := dialer.v6Conn.Load(); conn == nil {
+			t.Fatal("expected ipv6 to be connected to")
+		} else {
+			<-conn.closed
+		}
+	})
+
+	t.Run("loser closed", func(t *testing.T) {
+		dialer := &testDialer{v6Delay: ConnectionAttemptDelay + 100*time.Millisecond}
+		result := (&DualStackProbe{dial: dialer.dial}).race(context.Background(), addrs, 0)
+		if result.WinnerFamily != FamilyIPv4 {
+			t.Fatalf("expected ipv4 to win, got %+v", result)
+		}
+		// the ipv6 attempt connects after the race is over
+		deadline := time.Now().Add(time.Second)
+		for dialer.v6Conn.Load() == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		conn := dialer.v6Conn.Load()
+		if conn == nil {
+			t.Fatal("expected the late ipv6 attempt to connect")
+		}
+		select {
+		case <-conn.closed:
+		case <-time.After(time.Second):
+			t.Fatal("expected the late ipv6 connection to be closed")
+		}
+	})
+}
+
+func TestMeasureFamily(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	_, port, _ := net.SplitHostPort(tlsServer.Listener.Addr().String())
+
+	dialer := &testDialer{v6Delay: -1}
+	timeoutMs := 200
+	probe := &DualStackProbe{Target: "example.com:" + port, TLS: true, TimeoutMs: &timeoutMs, dial: dialer.dial}
+	result := probe.measureFamily(context.Background(), &familyLookup{family: FamilyIPv4, addrs: []string{"127.0.0.1"}}, port)
+	if !succeeded(result) || result.Connect <= 0 || result.TLSHandshake <= 0 || result.TLSVersion != tls.VersionName(tls.VersionTLS13) {
+		t.Fatalf("expected a tls connection over ipv4, got %+v", result)
+	}
+
+	result = probe.measureFamily(context.Background(), &familyLookup{family: FamilyIPv6, addrs: []string{"::1"}}, port)
+	if succeeded(result) || !strings.Contains(result.Error, "[::1]:"+port) {
+		t.Fatalf("expected the blackholed ipv6 connect to time out, got %+v", result)
+	}
+
+	result = probe.measureFamily(context.Background(), &familyLookup{family: FamilyIPv6}, port)
+	if succeeded(result) || result.Error != "no ip6 address found" {
+		t.Fatalf("expected the lack of addresses to be reported, got %+v", result)
+	}
+}
+
+// startTestResolver answers both A and AAAA of any name with the loopback addresses
+func startTestResolver(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		dnsutil.SetReply(m, req)
+		hdr := dns.Header{Name: req.Question[0].Header().Name, Class: dns.ClassINET, TTL: 300}
+		switch dns.RRToType(req.Question[0]) {
+		case dns.TypeA:
+			m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: rdata.A{Addr: netip.MustParseAddr("127.0.0.1")}}}
+		case dns.TypeAAAA:
+			m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: rdata.AAAA{Addr: netip.MustParseAddr("::1")}}}
+		}
+		io.Copy(w, m)
+	})}
+	server.NotifyStartedFunc = func(context.Context) { close(started) }
+	go server.ListenAndServe()
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	<-started
+	return pc.LocalAddr().String()
+}
+
+func TestDo(t *testing.T) {
+	port := startTestListener(t)
+	resolver := startTestResolver(t)
+	timeoutMs := 400
+
+	dialer := &testDialer{v6Delay: -1}
+	result := (&DualStackProbe{Target: "dualstack.example:" + port, TimeoutMs: &timeoutMs, Resolver: &resolver, dial: dialer.dial}).Do(context.Background())
+	if result.Error != "" || result.Race == nil || result.Race.WinnerFamily != FamilyIPv4 {
+		t.Fatalf("expected ipv4 to win the race, got %+v", result)
+	}
+	if len(result.Parallel) != 2 || len(result.Sequential) != 2 || succeeded(result.Sequential[0]) || !succeeded(result.Sequential[1]) {
+		t.Fatalf("expected only ipv4 to connect, got %+v %+v", result.Parallel, result.Sequential)
+	}
+	if !result.IPv6Broken || !strings.Contains(result.IPv6BrokenReason, "dualstack.example has AAAA records") {
+		t.Fatalf("expected ipv6 to be reported broken, got %+v", result)
+	}
+
+	dialer = &testDialer{}
+	result = (&DualStackProbe{Target: "dualstack.example:" + port, TimeoutMs: &timeoutMs, Resolver: &resolver, dial: dialer.dial}).Do(context.Background())
+	if result.Race == nil || result.Race.WinnerFamily != FamilyIPv6 || result.IPv6Broken {
+		t.Fatalf("expected ipv6 to win the race and not to be reported broken, got %+v", result)
+	}
+	for _, family := range append(result.Parallel, result.Sequential...) {
+		if !succeeded(family) {
+			t.Fatalf("expected both families to connect, got %+v", family)
+		}
+	}
+}
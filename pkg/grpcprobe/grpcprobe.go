@@ -0,0 +1,179 @@
+package grpcprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	pkghttpprobe "github.com/internetworklab/cloudping/pkg/httpprobe"
+	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// GRPCProbe calls grpc.health.v1.Health/Check of the target, see https://github.com/grpc/grpc/blob/master/doc/health-checking.md
+type GRPCProbe struct {
+	// host:port, e.g. 'example.com:443' or '[2001:db8::1]:50051'
+	Target string `json:"target"`
+
+	// The service to check, empty means the overall health of the server
+	Service string `json:"service,omitempty"`
+
+	// When true, h2 over TLS is used, otherwise it's h2c, i.e. HTTP/2 over plaintext TCP
+	TLS bool `json:"tls,omitempty"`
+
+	// Overrides the server name for SNI and the certificate verification, default is the host of the target
+	ServerName string `json:"serverName,omitempty"`
+
+	// Skip the verification of the server's certificate
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+
+	// Covers both the connect and the RPC, default is 10000
+	TimeoutMs *int `json:"timeoutMs,omitempty"`
+
+	Resolver *string                            `json:"resolver,omitempty"`
+	IPPref   *pkghttpprobe.InetFamilyPreference `json:"inetFamilyPreference,omitempty"`
+
+	CorrelationID string `json:"correlationId,omitempty"`
+
+	// list of paths to additional CAs to trust in addition to the system's default CAs
+	AddCA []string
+}
+
+type GRPCProbeResult struct {
+	CorrelationID string    `json:"correlationId"`
+	Target        string    `json:"target"`
+	Service       string    `json:"service,omitempty"`
+	TLS           bool      `json:"tls"`
+	StartedAt     time.Time `json:"started_at"`
+	RemoteAddr    string    `json:"remote_addr,omitempty"`
+
+	// From the start to the connection being ready, the dns lookup, the connect and the tls handshake included
+	Connect time.Duration `json:"connect"`
+	// Of the Check call alone
+	RPC time.Duration `json:"rpc"`
+
+	// e.g. 'SERVING', 'NOT_SERVING', 'SERVICE_UNKNOWN', empty if the call failed
+	ServingStatus string `json:"serving_status,omitempty"`
+	// The gRPC status code of the call, e.g. 'OK', 'NotFound', 'Unavailable'
+	StatusCode    string `json:"status_code"`
+	StatusMessage string `json:"status_message,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+func (probe *GRPCProbe) Validate() error {
+	return pkgutils.ValidateHostPort(probe.Target, "")
+}
+
+func (probe *GRPCProbe) getTransportCredentials() (credentials.TransportCredentials, error) {
+	if !probe.TLS {
+		return insecure.NewCredentials(), nil
+	}
+
+	roots, err := pkgutils.LoadRootCAs(probe.AddCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load additional CAs: %w", err)
+	}
+	return credentials.NewTLS(&tls.Config{
+		RootCAs:            roots,
+		ServerName:         probe.ServerName,
+		InsecureSkipVerify: probe.InsecureSkipVerify,
+	}), nil
+}
+
+// the target is resolved here rather than by grpc's resolver, so that the custom resolver and the inet family preference apply
+func (probe *GRPCProbe) getContextDialer(remoteAddr *string, lock *sync.Mutex) func(context.Context, string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split host and port from addr: %s: %v", addr, err)
+		}
+		ip, err := pkgutils.LookupFirstIP(ctx, probe.Resolver, probe.IPPref, host)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err != nil {
+			return nil, err
+		}
+		lock.Lock()
+		*remoteAddr = conn.RemoteAddr().String()
+		lock.Unlock()
+		return conn, nil
+	}
+}
+
+func (probe *GRPCProbe) Do(ctx context.Context) *GRPCProbeResult {
+	result := &GRPCProbeResult{
+		CorrelationID: probe.CorrelationID,
+		Target:        probe.Target,
+		Service:       probe.Service,
+		TLS:           probe.TLS,
+		StartedAt:     time.Now(),
+	}
+
+	timeout := defaultTimeout
+	if probe.TimeoutMs != nil && *probe.TimeoutMs > 0 {
+		timeout = time.Duration(*probe.TimeoutMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	creds, err := probe.getTransportCredentials()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	lock := &sync.Mutex{}
+	var remoteAddr string
+	conn, err := grpc.NewClient(
+		"passthrough:///"+probe.Target,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(probe.getContextDialer(&remoteAddr, lock)),
+		grpc.WithUserAgent("cloudping/1.0"),
+	)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to create grpc client for %s: %v", probe.Target, err)
+		return result
+	}
+	defer conn.Close()
+
+	// the connection is lazily established, so it's brought up explicitly to tell the connect latency apart from the RPC's
+	conn.Connect()
+	for state := conn.GetState(); state != connectivity.Ready; state = conn.GetState() {
+		if state == connectivity.TransientFailure || !conn.WaitForStateChange(ctx, state) {
+			break
+		}
+	}
+	result.Connect = time.Since(result.StartedAt)
+	lock.Lock()
+	result.RemoteAddr = remoteAddr
+	lock.Unlock()
+
+	rpcStartedAt := time.Now()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: probe.Service})
+	result.RPC = time.Since(rpcStartedAt)
+	if err != nil {
+		st := status.Convert(err)
+		result.StatusCode = st.Code().String()
+		result.StatusMessage = st.Message()
+		result.Error = fmt.Sprintf("health check of %s failed: %v", probe.Target, err)
+		return result
+	}
+	result.StatusCode = codes.OK.String()
+	result.ServingStatus = resp.GetStatus().String()
+	return result
+}
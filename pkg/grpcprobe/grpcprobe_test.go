@@ -0,0 +1,64 @@
+package grpcprobe
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		target string
+		valid  bool
+	}{
+		{"example.com:443", true},
+		{"[2001:db8::1]:50051", true},
+		{"example.com", false},
+		{":443", false},
+		{"example.com:0", false},
+		{"example.com:grpc", false},
+	}
+	for _, c := range cases {
+		probe := GRPCProbe{Target: c.target}
+		if err := probe.Validate(); (err == nil) != c.valid {
+			t.Errorf("validating %s, expected valid=%v, got err=%v", c.target, c.valid, err)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("svc.down", healthpb.HealthCheckResponse_NOT_SERVING)
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(ln)
+	defer server.Stop()
+
+	cases := []struct {
+		service       string
+		servingStatus string
+		statusCode    string
+	}{
+		{"", "SERVING", "OK"},
+		{"svc.down", "NOT_SERVING", "OK"},
+		{"svc.unknown", "", "NotFound"},
+	}
+	for _, c := range cases {
+		probe := GRPCProbe{Target: ln.Addr().String(), Service: c.service}
+		result := probe.Do(context.Background())
+		if result.ServingStatus != c.servingStatus || result.StatusCode != c.statusCode {
+			t.Errorf("checking %q, expected %s/%s, got %+v", c.service, c.statusCode, c.servingStatus, result)
+		}
+		if result.RemoteAddr != ln.Addr().String() {
+			t.Errorf("checking %q, expected remote addr %s, got %s", c.service, ln.Addr(), result.RemoteAddr)
+		}
+	}
+}
@@ -2,24 +2,36 @@ package handler
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	pkgbannerprobe "github.com/internetworklab/cloudping/pkg/bannerprobe"
+	pkgdualstackprobe "github.com/internetworklab/cloudping/pkg/dualstackprobe"
+	pkggrpcprobe "github.com/internetworklab/cloudping/pkg/grpcprobe"
 	pkghttpprobe "github.com/internetworklab/cloudping/pkg/httpprobe"
 	pkgipinfo "github.com/internetworklab/cloudping/pkg/ipinfo"
 	pkgmyprom "github.com/internetworklab/cloudping/pkg/myprom"
+	pkgntpprobe "github.com/internetworklab/cloudping/pkg/ntpprobe"
 	pkgpinger "github.com/internetworklab/cloudping/pkg/pinger"
+	pkgquicprobe "github.com/internetworklab/cloudping/pkg/quicprobe"
 	pkgratelimit "github.com/internetworklab/cloudping/pkg/ratelimit"
 	pkgraw "github.com/internetworklab/cloudping/pkg/raw"
+	pkgstunprobe "github.com/internetworklab/cloudping/pkg/stunprobe"
+	pkgthroughput "github.com/internetworklab/cloudping/pkg/throughput"
 	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
+	pkgwsprobe "github.com/internetworklab/cloudping/pkg/wsprobe"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -31,6 +43,16 @@ type PingHandler struct {
 	RespondRange          []net.IPNet
 	DomainRespondRange    []regexp.Regexp
 	HTTPProbeAdditionalCA []string
+
+	// The resolver to use when the request doesn't specify one, could be a plain address or a tls://, https:// or quic:// URI
+	Resolver string
+
+	// Nil if the agent doesn't take part in throughput tests as the receiver
+	ThroughputReceiver *pkgthroughput.Receiver
+	// Whether the agent takes part in throughput tests as the sender
+	ThroughputSender bool
+	// The sender presents the agent's client cert with it, since the receiver's HTTP endpoint likely requires one
+	ThroughputClientTLSConfig *tls.Config
 }
 
 func (ph *PingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -40,6 +62,9 @@ func (ph *PingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
 		return
 	}
+	if (pingRequest.Resolver == nil || *pingRequest.Resolver == "") && ph.Resolver != "" {
+		pingRequest.Resolver = &ph.Resolver
+	}
 
 	pingReqJSB, _ := json.Marshal(pingRequest)
 	log.Printf("Started ping request for %s: %s", pkgutils.GetRemoteAddr(r), string(pingReqJSB))
@@ -122,22 +147,127 @@ func (ph *PingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return resolver.LookupIP(ctx, ipPrefUsed, host)
 	}
 
+	// checkTargetHost tells if the probe is allowed to reach host through resolver, nil pref means the probe connects to
+	// every address of host, so all of them have to be in the respond range, rather than any of them
+	checkTargetHost := func(ctx context.Context, host string, resolver *string, pref *pkghttpprobe.InetFamilyPreference) error {
+		if len(ph.DomainRespondRange) > 0 && net.ParseIP(host) == nil && !pkgutils.CheckDomainInRange(host, ph.DomainRespondRange) {
+			return fmt.Errorf("host %s does not match any pattern in the domain respond range", host)
+		}
+		if len(ph.RespondRange) == 0 {
+			return nil
+		}
+
+		if resolver != nil && *resolver != "" {
+			resolverIPs, err := getResolverIPs(ctx, *resolver)
+			if err != nil {
+				return err
+			}
+			if !pkgutils.CheckIntersect(resolverIPs, ph.RespondRange) {
+				return fmt.Errorf("resolver %s is not in the respond range", *resolver)
+			}
+		}
+
+		if pref == nil {
+			dual := pkghttpprobe.InetFamilyPreferenceDual
+			ips, err := lookupIP(host, resolver, &dual)
+			if err != nil {
+				return fmt.Errorf("failed to lookup ip for host %s: %v", host, err)
+			}
+			for _, ip := range ips {
+				if !pkgutils.CheckIntersectIP(ip, ph.RespondRange) {
+					return fmt.Errorf("ip %s of host %s is not in the respond range", ip.String(), host)
+				}
+			}
+			return nil
+		}
+
+		ips, err := lookupIP(host, resolver, pref)
+		if err != nil {
+			return fmt.Errorf("failed to lookup ip for host %s: %v", host, err)
+		}
+		if !pkgutils.CheckIntersect(ips, ph.RespondRange) {
+			return fmt.Errorf("ips %v are not in the respond range", ips)
+		}
+		return nil
+	}
+
+	checker := &targetChecker{resolver: pingRequest.Resolver, ipPref: ipPref, check: checkTargetHost}
+
 	var pinger pkgpinger.Pinger = nil
 	if pingRequest.L7PacketType != nil {
 		switch *pingRequest.L7PacketType {
 		case pkgpinger.L7ProtoDNS:
+			dnsPinger := &pkgpinger.DNSPinger{
+				Requests:    pingRequest.DNSTargets,
+				RateLimiter: rateLimiterUsed,
+				AddCAPaths:  ph.HTTPProbeAdditionalCA,
+			}
+			// the bootstrap resolver of the servers specified by hostname
+			bootstrapResolver := net.DefaultResolver
+			if pingRequest.Resolver != nil && *pingRequest.Resolver != "" {
+				bootstrapResolver = pkgutils.NewCustomResolver(pingRequest.Resolver, 10*time.Second)
+				dnsPinger.Resolver = bootstrapResolver
+			}
+			if len(ph.RespondRange) > 0 {
+				dnsPinger.CheckServerAddr = func(addr netip.Addr) error {
+					if !pkgutils.CheckIntersectIP(net.IP(addr.AsSlice()), ph.RespondRange) {
+						return fmt.Errorf("ip %s is not in the respond range", addr.String())
+					}
+					return nil
+				}
+			}
+
 			dnsServers := make([]string, 0)
 			for _, tgt := range pingRequest.DNSTargets {
+				if tgt.Trace {
+					// in trace mode, queries are sent to the root servers and whichever authoritative servers the referrals lead to
+					if len(ph.RespondRange) > 0 {
+						json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: "dns trace is not available since the respond range is restricted"})
+						return
+					}
+					dnsServers = append(dnsServers, ".")
+					continue
+				}
+				if tgt.ZoneCheck {
+					// the authoritative servers of the zone are only known while checking
+					if len(ph.RespondRange) > 0 {
+						json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: "dns zone check is not available since the respond range is restricted"})
+						return
+					}
+					dnsServers = append(dnsServers, tgt.Target)
+					continue
+				}
 
-				dnsServerIP, err := pkgutils.GetHost(tgt.AddrPort)
+				dnsServerHost, err := tgt.GetServerHost()
 				if err != nil {
-					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Sprintf("failed to parse dns server ip from addrport: %s: %v", tgt.AddrPort, err)})
+					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Sprintf("failed to parse dns server host from addrport: %s: %v", tgt.AddrPort, err)})
 					return
 				}
 
-				if len(ph.RespondRange) > 0 && !pkgutils.CheckIntersectIP(dnsServerIP, ph.RespondRange) {
-					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("dns server ip %s is not in the respond range", dnsServerIP.String()).Error()})
-					return
+				if dnsServerIP := net.ParseIP(dnsServerHost); dnsServerIP != nil {
+					if len(ph.RespondRange) > 0 && !pkgutils.CheckIntersectIP(dnsServerIP, ph.RespondRange) {
+						json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("dns server ip %s is not in the respond range", dnsServerIP.String()).Error()})
+						return
+					}
+				} else {
+					// the server is given by hostname, it will be resolved by the bootstrap resolver
+					if len(ph.DomainRespondRange) > 0 && !pkgutils.CheckDomainInRange(dnsServerHost, ph.DomainRespondRange) {
+						json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("dns server %s does not match any pattern in the domain respond range", dnsServerHost).Error()})
+						return
+					}
+					if len(ph.RespondRange) > 0 {
+						// fails early on what's known to be out of range, while the address the server is eventually
+						// bootstrapped to is checked again right before the query is sent to it, see CheckServerAddr
+						ips, err := bootstrapResolver.LookupIP(ctx, "ip", dnsServerHost)
+						if err != nil {
+							json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("failed to lookup ip for dns server %s: %v", dnsServerHost, err).Error()})
+							return
+						}
+						if !pkgutils.CheckIntersect(ips, ph.RespondRange) {
+							json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("ips %v of dns server %s are not in the respond range", ips, dnsServerHost).Error()})
+							return
+						}
+					}
 				}
 
 				dnsServers = append(dnsServers, tgt.AddrPort)
@@ -146,17 +276,20 @@ func (ph *PingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// when in dns mode, we are mainly sending packets to dns servers, so, set targets to dns servers
 			commonLabels[pkgmyprom.PromLabelTarget] = strings.Join(dnsServers, ",")
 
-			pinger = &pkgpinger.DNSPinger{
-				Requests:    pingRequest.DNSTargets,
-				RateLimiter: rateLimiterUsed,
-				AddCAPaths:  ph.HTTPProbeAdditionalCA,
-			}
+			pinger = dnsPinger
 		case pkgpinger.L7ProtoHTTP:
 			httpUrls := make([]string, 0)
 			httpPinger := &pkgpinger.HTTPPinger{
 				Requests:    make([]pkghttpprobe.HTTPProbe, 0),
 				RateLimiter: rateLimiterUsed,
 				AddCA:       ph.HTTPProbeAdditionalCA,
+				CheckHost:   checkTargetHost,
+				OnVerdict: func(ctx context.Context, request pkghttpprobe.HTTPProbe, verdict *pkghttpprobe.HTTPVerdict) {
+					checkLabels := maps.Clone(commonLabels)
+					checkLabels[pkgmyprom.PromLabelTarget] = request.URL
+					checkLabels[pkgmyprom.PromLabelPassed] = strconv.FormatBool(verdict.Passed)
+					counterStore.HTTPChecks.With(checkLabels).Inc()
+				},
 			}
 			for _, tgt := range pingRequest.HTTPTargets {
 				urlObj, err := url.Parse(tgt.URL)
@@ -185,13 +318,13 @@ func (ph *PingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 				if len(ph.RespondRange) > 0 {
 					if tgt.Resolver != nil {
-						resolverIP := net.ParseIP(*tgt.Resolver)
-						if resolverIP == nil {
-							json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("failed to parse resolver ip from string: %s", *tgt.Resolver).Error()})
+						resolverIPs, err := getResolverIPs(ctx, *tgt.Resolver)
+						if err != nil {
+							json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
 							return
 						}
-						if !pkgutils.CheckIntersectIP(resolverIP, ph.RespondRange) {
-							json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("resolver ip %s is not in the respond range", resolverIP.String()).Error()})
+						if !pkgutils.CheckIntersect(resolverIPs, ph.RespondRange) {
+							json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("resolver %s is not in the respond range", *tgt.Resolver).Error()})
 							return
 						}
 					}
@@ -224,6 +357,234 @@ func (ph *PingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			commonLabels[pkgmyprom.PromLabelTarget] = strings.Join(httpUrls, ",")
 			pinger = httpPinger
+		case pkgpinger.L7ProtoWebSocket:
+			targets, labels, err := prepareProbeTargets(ctx, checker, pingRequest.WSTargets, func(tgt *pkgwsprobe.WSProbe) (probeTarget, error) {
+				urlObj, err := url.Parse(tgt.URL)
+				if err != nil {
+					return probeTarget{}, fmt.Errorf("failed to parse ws url %s: %v", tgt.URL, err)
+				}
+				if tgt.ExtraHeaders == nil {
+					tgt.ExtraHeaders = make(http.Header)
+				}
+				if tgt.ExtraHeaders.Get("User-Agent") == "" {
+					tgt.ExtraHeaders.Set("User-Agent", "cloudping/1.0")
+				}
+				return probeTarget{host: urlObj.Hostname(), label: tgt.URL, resolver: &tgt.Resolver, ipPref: &tgt.IPPref}, nil
+			})
+			if err != nil {
+				json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
+				return
+			}
+
+			commonLabels[pkgmyprom.PromLabelTarget] = strings.Join(labels, ",")
+			pinger = &pkgpinger.ProbePinger[pkgwsprobe.WSProbe]{
+				Requests:    targets,
+				RateLimiter: rateLimiterUsed,
+				Probe: func(ctx context.Context, req pkgwsprobe.WSProbe) any {
+					req.AddCA = ph.HTTPProbeAdditionalCA
+					return req.Do(ctx)
+				},
+			}
+		case pkgpinger.L7ProtoGRPC:
+			targets, labels, err := prepareProbeTargets(ctx, checker, pingRequest.GRPCTargets, func(tgt *pkggrpcprobe.GRPCProbe) (probeTarget, error) {
+				host, _, err := net.SplitHostPort(tgt.Target)
+				if err != nil {
+					return probeTarget{}, fmt.Errorf("failed to parse grpc target %s: %v", tgt.Target, err)
+				}
+				return probeTarget{host: host, label: tgt.Target, resolver: &tgt.Resolver, ipPref: &tgt.IPPref}, nil
+			})
+			if err != nil {
+				json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
+				return
+			}
+
+			commonLabels[pkgmyprom.PromLabelTarget] = strings.Join(labels, ",")
+			pinger = &pkgpinger.ProbePinger[pkggrpcprobe.GRPCProbe]{
+				Requests:    targets,
+				RateLimiter: rateLimiterUsed,
+				Probe: func(ctx context.Context, req pkggrpcprobe.GRPCProbe) any {
+					req.AddCA = ph.HTTPProbeAdditionalCA
+					return req.Do(ctx)
+				},
+			}
+		case pkgpinger.L7ProtoTLS:
+			targets, labels, err := prepareProbeTargets(ctx, checker, pingRequest.TLSTargets, func(tgt *pkghttpprobe.TLSScan) (probeTarget, error) {
+				host, _, err := net.SplitHostPort(tgt.Target)
+				if err != nil {
+					return probeTarget{}, fmt.Errorf("failed to parse tls target %s: %v", tgt.Target, err)
+				}
+				return probeTarget{host: host, label: tgt.Target, resolver: &tgt.Resolver, ipPref: &tgt.IPPref}, nil
+			})
+			if err != nil {
+				json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
+				return
+			}
+
+			commonLabels[pkgmyprom.PromLabelTarget] = strings.Join(labels, ",")
+			pinger = &pkgpinger.ProbePinger[pkghttpprobe.TLSScan]{
+				Requests:    targets,
+				RateLimiter: rateLimiterUsed,
+				Probe: func(ctx context.Context, req pkghttpprobe.TLSScan) any {
+					req.AddCA = ph.HTTPProbeAdditionalCA
+					return req.Do(ctx)
+				},
+			}
+		case pkgpinger.L7ProtoDualStack:
+			targets, labels, err := prepareProbeTargets(ctx, checker, pingRequest.DualStackTargets, func(tgt *pkgdualstackprobe.DualStackProbe) (probeTarget, error) {
+				host, _, err := net.SplitHostPort(tgt.Target)
+				if err != nil {
+					return probeTarget{}, fmt.Errorf("failed to parse dual-stack target %s: %v", tgt.Target, err)
+				}
+				// both families are connected to
+				return probeTarget{host: host, label: tgt.Target, resolver: &tgt.Resolver}, nil
+			})
+			if err != nil {
+				json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
+				return
+			}
+
+			commonLabels[pkgmyprom.PromLabelTarget] = strings.Join(labels, ",")
+			pinger = &pkgpinger.ProbePinger[pkgdualstackprobe.DualStackProbe]{
+				Requests:    targets,
+				RateLimiter: rateLimiterUsed,
+				Probe:       func(ctx context.Context, req pkgdualstackprobe.DualStackProbe) any { return req.Do(ctx) },
+			}
+		case pkgpinger.L7ProtoNTP:
+			targets, labels, err := prepareProbeTargets(ctx, checker, pingRequest.NTPTargets, func(tgt *pkgntpprobe.NTPProbe) (probeTarget, error) {
+				return probeTarget{host: tgt.GetHost(), label: tgt.Target, resolver: &tgt.Resolver, ipPref: &tgt.IPPref}, nil
+			})
+			if err != nil {
+				json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
+				return
+			}
+
+			commonLabels[pkgmyprom.PromLabelTarget] = strings.Join(labels, ",")
+			pinger = &pkgpinger.ProbePinger[pkgntpprobe.NTPProbe]{
+				Requests:    targets,
+				RateLimiter: rateLimiterUsed,
+				Probe:       func(ctx context.Context, req pkgntpprobe.NTPProbe) any { return req.Do(ctx) },
+			}
+		case pkgpinger.L7ProtoBanner:
+			targets, labels, err := prepareProbeTargets(ctx, checker, pingRequest.BannerTargets, func(tgt *pkgbannerprobe.BannerProbe) (probeTarget, error) {
+				host, _, err := net.SplitHostPort(tgt.Target)
+				if err != nil {
+					return probeTarget{}, fmt.Errorf("failed to parse banner target %s: %v", tgt.Target, err)
+				}
+				return probeTarget{host: host, label: tgt.Target, resolver: &tgt.Resolver, ipPref: &tgt.IPPref}, nil
+			})
+			if err != nil {
+				json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
+				return
+			}
+
+			commonLabels[pkgmyprom.PromLabelTarget] = strings.Join(labels, ",")
+			pinger = &pkgpinger.ProbePinger[pkgbannerprobe.BannerProbe]{
+				Requests:    targets,
+				RateLimiter: rateLimiterUsed,
+				Probe: func(ctx context.Context, req pkgbannerprobe.BannerProbe) any {
+					req.AddCA = ph.HTTPProbeAdditionalCA
+					return req.Do(ctx)
+				},
+			}
+		case pkgpinger.L7ProtoSTUN:
+			targets, labels, err := prepareProbeTargets(ctx, checker, pingRequest.STUNTargets, func(tgt *pkgstunprobe.STUNProbe) (probeTarget, error) {
+				return probeTarget{host: tgt.GetHost(), label: tgt.Target, resolver: &tgt.Resolver, ipPref: &tgt.IPPref}, nil
+			})
+			if err != nil {
+				json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
+				return
+			}
+
+			commonLabels[pkgmyprom.PromLabelTarget] = strings.Join(labels, ",")
+			pinger = &pkgpinger.ProbePinger[pkgstunprobe.STUNProbe]{
+				Requests:    targets,
+				RateLimiter: rateLimiterUsed,
+				Probe: func(ctx context.Context, req pkgstunprobe.STUNProbe) any {
+					if len(ph.RespondRange) > 0 {
+						req.CheckOtherAddr = func(addr netip.Addr) error {
+							if !pkgutils.CheckIntersectIP(net.IP(addr.AsSlice()), ph.RespondRange) {
+								return fmt.Errorf("ip %s is not in the respond range", addr.String())
+							}
+							return nil
+						}
+					}
+					return req.Do(ctx)
+				},
+			}
+		case pkgpinger.L7ProtoQUIC:
+			targets, labels, err := prepareProbeTargets(ctx, checker, pingRequest.QUICTargets, func(tgt *pkgquicprobe.QUICProbe) (probeTarget, error) {
+				return probeTarget{host: tgt.GetHost(), label: tgt.Target, resolver: &tgt.Resolver, ipPref: &tgt.IPPref}, nil
+			})
+			if err != nil {
+				json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
+				return
+			}
+
+			commonLabels[pkgmyprom.PromLabelTarget] = strings.Join(labels, ",")
+			pinger = &pkgpinger.ProbePinger[pkgquicprobe.QUICProbe]{
+				Requests:    targets,
+				RateLimiter: rateLimiterUsed,
+				Probe: func(ctx context.Context, req pkgquicprobe.QUICProbe) any {
+					req.AddCA = ph.HTTPProbeAdditionalCA
+					return req.Do(ctx)
+				},
+			}
+		case pkgpinger.L7ProtoThroughput:
+			throughputTargets := make([]string, 0)
+			throughputPinger := &pkgpinger.ThroughputPinger{
+				Requests:        make([]pkgthroughput.ThroughputTest, 0),
+				RateLimiter:     rateLimiterUsed,
+				Receiver:        ph.ThroughputReceiver,
+				ClientTLSConfig: ph.ThroughputClientTLSConfig,
+			}
+			for _, tgt := range pingRequest.ThroughputTargets {
+				switch tgt.Role {
+				case pkgthroughput.RoleReceiver:
+					if ph.ThroughputReceiver == nil {
+						json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: "throughput receiver is not enabled"})
+						return
+					}
+				case pkgthroughput.RoleSender:
+					if !ph.ThroughputSender {
+						json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: "throughput sender is not enabled"})
+						return
+					}
+
+					urlObj, err := url.Parse(tgt.ReceiverURL)
+					if err != nil {
+						json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("failed to parse receiver url %s: %v", tgt.ReceiverURL, err).Error()})
+						return
+					}
+
+					host := urlObj.Hostname()
+					if len(ph.DomainRespondRange) > 0 && net.ParseIP(host) == nil && !pkgutils.CheckDomainInRange(host, ph.DomainRespondRange) {
+						json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("host %s does not match any pattern in the domain respond range", host).Error()})
+						return
+					}
+
+					if len(ph.RespondRange) > 0 {
+						// the sender dials with the system resolver, so it's the one to check against
+						ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+						if err != nil {
+							json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("failed to lookup ip for host %s: %v", host, err).Error()})
+							return
+						}
+						if !pkgutils.CheckIntersect(ips, ph.RespondRange) {
+							json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("ips %v are not in the respond range", ips).Error()})
+							return
+						}
+					}
+				default:
+					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("throughput test %s has no role, it must be coordinated by the hub", tgt.CorrelationID).Error()})
+					return
+				}
+
+				throughputPinger.Requests = append(throughputPinger.Requests, tgt)
+				throughputTargets = append(throughputTargets, tgt.Receiver)
+			}
+
+			commonLabels[pkgmyprom.PromLabelTarget] = strings.Join(throughputTargets, ",")
+			pinger = throughputPinger
 		}
 	} else if pingRequest.L4PacketType != nil && *pingRequest.L4PacketType == pkgpinger.L4ProtoTCP {
 		tcpingPinger := &pkgpinger.TCPSYNPinger{
@@ -295,3 +656,68 @@ func (ph *PingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// targetChecker is what the probes connecting to a host check their targets with, along with the defaults of the request
+type targetChecker struct {
+	resolver *string
+	ipPref   string
+	check    func(ctx context.Context, host string, resolver *string, pref *pkghttpprobe.InetFamilyPreference) error
+}
+
+// probeTarget tells where a target of a probe connects to, ipPref is nil if the probe connects to every address of
+// the host rather than to those of the preferred family
+type probeTarget struct {
+	host     string
+	label    string
+	resolver **string
+	ipPref   **pkghttpprobe.InetFamilyPreference
+}
+
+// prepareProbeTargets fills in the resolver and the inet family preference the targets leave unset, checks the host
+// of each of them, and returns the targets along with their labels
+func prepareProbeTargets[T any](ctx context.Context, checker *targetChecker, targets []T, describe func(tgt *T) (probeTarget, error)) ([]T, []string, error) {
+	prepared := make([]T, 0, len(targets))
+	labels := make([]string, 0, len(targets))
+	for _, tgt := range targets {
+		target, err := describe(&tgt)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if *target.resolver == nil || **target.resolver == "" {
+			*target.resolver = checker.resolver
+		}
+		var pref *pkghttpprobe.InetFamilyPreference
+		if target.ipPref != nil {
+			if *target.ipPref == nil || **target.ipPref == "" {
+				*target.ipPref = new(pkghttpprobe.InetFamilyPreference)
+				**target.ipPref = pkghttpprobe.InetFamilyPreference(checker.ipPref)
+			}
+			pref = *target.ipPref
+		}
+		if err := checker.check(ctx, target.host, *target.resolver, pref); err != nil {
+			return nil, nil, err
+		}
+
+		prepared = append(prepared, tgt)
+		labels = append(labels, target.label)
+	}
+	return prepared, labels, nil
+}
+
+// The resolver could be a plain address, e.g. 8.8.8.8:53, or a tls://, https:// or quic:// URI,
+// the host of which might be a name, such name is always resolved by the default resolver.
+func getResolverIPs(ctx context.Context, resolver string) ([]net.IP, error) {
+	if ip, err := pkgutils.GetHost(resolver); err == nil {
+		return []net.IP{ip}, nil
+	}
+	urlObj, err := url.Parse(resolver)
+	if err != nil || urlObj.Hostname() == "" {
+		return nil, fmt.Errorf("failed to parse resolver ip from string: %s", resolver)
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", urlObj.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup ip of resolver %s: %v", resolver, err)
+	}
+	return ips, nil
+}
@@ -9,12 +9,26 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
+	pkgbannerprobe "github.com/internetworklab/cloudping/pkg/bannerprobe"
+	pkgdnsprobe "github.com/internetworklab/cloudping/pkg/dnsprobe"
+	pkgdualstackprobe "github.com/internetworklab/cloudping/pkg/dualstackprobe"
+	pkggrpcprobe "github.com/internetworklab/cloudping/pkg/grpcprobe"
+	pkghttpprobe "github.com/internetworklab/cloudping/pkg/httpprobe"
+	pkgipinfo "github.com/internetworklab/cloudping/pkg/ipinfo"
 	pkgnodereg "github.com/internetworklab/cloudping/pkg/nodereg"
+	pkgntpprobe "github.com/internetworklab/cloudping/pkg/ntpprobe"
 	pkgpinger "github.com/internetworklab/cloudping/pkg/pinger"
+	pkgquicprobe "github.com/internetworklab/cloudping/pkg/quicprobe"
+	pkgstunprobe "github.com/internetworklab/cloudping/pkg/stunprobe"
+	pkgthroughput "github.com/internetworklab/cloudping/pkg/throughput"
 	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
+	pkgwsprobe "github.com/internetworklab/cloudping/pkg/wsprobe"
 	quicHttp3 "github.com/quic-go/quic-go/http3"
 )
 
@@ -34,6 +48,18 @@ type PingTaskHandler struct {
 	MaxPktTimeout           *time.Duration
 	PktCountClamp           *int
 	HTTPResponseBodyClamp   *int
+	// The maximum size of the request body of an HTTP probe, in bytes
+	HTTPRequestBodyClamp *int
+	// When not empty, HTTP probes using other methods are rejected
+	HTTPAllowedMethods []string
+	// Limits of a throughput test, tests asking for more are lowered to them
+	ThroughputBytesClamp    *int64
+	ThroughputDurationClamp *time.Duration
+
+	// Used for annotating the answers in the dns divergence report
+	IPInfoReg *pkgipinfo.IPInfoProviderRegistry
+	// Name of the ipinfo provider to use when the request doesn't specify one
+	DNSDivergenceIPInfoProvider string
 }
 
 const (
@@ -48,6 +74,7 @@ func getConnWithCapability(connRegistry *pkgnodereg.ConnRegistry, from string, c
 	regData, err := connRegistry.SearchByAttributes(pkgnodereg.ConnectionAttributes{
 		pkgnodereg.AttributeKeyPingCapability: "true",
 		pkgnodereg.AttributeKeyNodeName:       from,
+		capability:                            "true",
 	})
 	if err != nil {
 		log.Printf("Failed to search by attributes: %v", err)
@@ -62,14 +89,6 @@ func getConnWithCapability(connRegistry *pkgnodereg.ConnRegistry, from string, c
 	return regData.Clone()
 }
 
-func tryStripPort(addrport string) string {
-	host, _, err := net.SplitHostPort(addrport)
-	if err == nil {
-		return host
-	}
-	return addrport
-}
-
 func getTransport(regData *pkgnodereg.ConnRegistryData) (*string, *http.Client) {
 	if regData.QUICConn != nil {
 		tr := &quicHttp3.Transport{}
@@ -97,6 +116,133 @@ func getTransport(regData *pkgnodereg.ConnRegistryData) (*string, *http.Client)
 	return nil, nil
 }
 
+// newRemotePinger builds the pinger that has the agent of regData run request, kind names the probe in the logs
+func (handler *PingTaskHandler) newRemotePinger(regData *pkgnodereg.ConnRegistryData, nodeName string, request *pkgpinger.SimplePingRequest, extraRequestHeader map[string]string, kind string) (*pkgpinger.SimpleRemotePinger, error) {
+	remotePingerEndpoint, quicClient := getTransport(regData)
+	if remotePingerEndpoint == nil && quicClient == nil {
+		return nil, fmt.Errorf("no transport available for %s on %s", kind, nodeName)
+	}
+
+	sp := &pkgpinger.SimpleRemotePinger{
+		Request:            *request,
+		ClientTLSConfig:    handler.ClientTLSConfig,
+		ExtraRequestHeader: extraRequestHeader,
+		QUICClient:         quicClient,
+		NodeName:           nodeName,
+	}
+	if remotePingerEndpoint != nil {
+		log.Printf("Sending %s to remote pinger %s via http endpoint %+v", kind, nodeName, remotePingerEndpoint)
+		sp.Endpoint = *remotePingerEndpoint
+	}
+	return sp, nil
+}
+
+// filterTargetsByPolicy keeps the targets the agent of regData is allowed to probe, the rejected ones are reported to w.
+// getHost returns the host of a target to be checked, and how the target is shown in the errors.
+func filterTargetsByPolicy[T any](ctx context.Context, w http.ResponseWriter, handler *PingTaskHandler, regData *pkgnodereg.ConnRegistryData, kind string, targets []T, getHost func(T) (string, string, error)) []T {
+	result := make([]T, 0, len(targets))
+	for _, tgt := range targets {
+		host, shown, err := getHost(tgt)
+		if err != nil {
+			json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("failed to parse %s target %s: %v", kind, shown, err).Error()})
+			continue
+		}
+
+		if !checkRemotePingerPolicy(ctx, regData, host, handler.Resolver, handler.OutOfRespondRangePolicy) {
+			json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("failed to check remote pinger policy for %s target: %s", kind, shown).Error()})
+			continue
+		}
+
+		result = append(result, tgt)
+	}
+	return result
+}
+
+// getAddrPortHost is the getHost of filterTargetsByPolicy for the targets in the form of host:port
+func getAddrPortHost(target string) (string, string, error) {
+	host, _, err := net.SplitHostPort(target)
+	return host, target, err
+}
+
+// l7Probe is how the hub dispatches an L7 type whose targets are probed by the agent on its own
+type l7Probe struct {
+	// the capability the agent has to announce
+	capability string
+	// how the probe is called in the errors and the logs
+	label string
+	// filters the targets of the form by the policy of the agent, and derives the request of the rest, nil when none is left
+	derive func(ctx context.Context, w http.ResponseWriter, handler *PingTaskHandler, regData *pkgnodereg.ConnRegistryData, form *pkgpinger.SimplePingRequest, from string) *pkgpinger.SimplePingRequest
+}
+
+// newL7Probe binds the type to its field of targets in the request, kind is how a target is called in the errors of filterTargetsByPolicy
+func newL7Probe[T any](capability string, kind string, label string, targetsOf func(request *pkgpinger.SimplePingRequest) *[]T, getHost func(T) (string, string, error)) l7Probe {
+	return l7Probe{
+		capability: capability,
+		label:      label,
+		derive: func(ctx context.Context, w http.ResponseWriter, handler *PingTaskHandler, regData *pkgnodereg.ConnRegistryData, form *pkgpinger.SimplePingRequest, from string) *pkgpinger.SimplePingRequest {
+			targets := filterTargetsByPolicy(ctx, w, handler, regData, kind, *targetsOf(form), getHost)
+			if len(targets) == 0 {
+				return nil
+			}
+			return form.DeriveAsProbeRequest(from, func(derived *pkgpinger.SimplePingRequest) { *targetsOf(derived) = targets })
+		},
+	}
+}
+
+var l7Probes = map[pkgpinger.L7PacketTypeOption]l7Probe{
+	// the upgrade handshake is an HTTP request, so it's up to the same capability as the HTTP probe
+	pkgpinger.L7ProtoWebSocket: newL7Probe(pkgnodereg.AttributeKeyHTTPProbeCapability, "ws", "ws probe",
+		func(req *pkgpinger.SimplePingRequest) *[]pkgwsprobe.WSProbe { return &req.WSTargets },
+		func(tgt pkgwsprobe.WSProbe) (string, string, error) {
+			urlObj, err := url.Parse(tgt.URL)
+			if err != nil {
+				return "", tgt.URL, err
+			}
+			return urlObj.Hostname(), tgt.URL, nil
+		}),
+	// gRPC runs over HTTP/2, so it's up to the same capability as the HTTP probe
+	pkgpinger.L7ProtoGRPC: newL7Probe(pkgnodereg.AttributeKeyHTTPProbeCapability, "grpc", "grpc probe",
+		func(req *pkgpinger.SimplePingRequest) *[]pkggrpcprobe.GRPCProbe { return &req.GRPCTargets },
+		func(tgt pkggrpcprobe.GRPCProbe) (string, string, error) { return getAddrPortHost(tgt.Target) }),
+	// the scan reuses the dial plumbing of the HTTP probe, so it's up to the same capability
+	pkgpinger.L7ProtoTLS: newL7Probe(pkgnodereg.AttributeKeyHTTPProbeCapability, "tls", "tls scan",
+		func(req *pkgpinger.SimplePingRequest) *[]pkghttpprobe.TLSScan { return &req.TLSTargets },
+		func(tgt pkghttpprobe.TLSScan) (string, string, error) { return getAddrPortHost(tgt.Target) }),
+	// plain connects and handshakes, nothing beyond what an HTTP probe does
+	pkgpinger.L7ProtoDualStack: newL7Probe(pkgnodereg.AttributeKeyHTTPProbeCapability, "dual-stack", "dual-stack probe",
+		func(req *pkgpinger.SimplePingRequest) *[]pkgdualstackprobe.DualStackProbe {
+			return &req.DualStackTargets
+		},
+		func(tgt pkgdualstackprobe.DualStackProbe) (string, string, error) { return getAddrPortHost(tgt.Target) }),
+	pkgpinger.L7ProtoNTP: newL7Probe(pkgnodereg.AttributeKeyNTPProbeCapability, "ntp", "ntp probe",
+		func(req *pkgpinger.SimplePingRequest) *[]pkgntpprobe.NTPProbe { return &req.NTPTargets },
+		func(tgt pkgntpprobe.NTPProbe) (string, string, error) { return tgt.GetHost(), tgt.Target, nil }),
+	// arbitrary payloads to arbitrary ports, so the agent has to opt in with its own capability
+	pkgpinger.L7ProtoBanner: newL7Probe(pkgnodereg.AttributeKeyBannerProbeCapability, "banner", "banner probe",
+		func(req *pkgpinger.SimplePingRequest) *[]pkgbannerprobe.BannerProbe { return &req.BannerTargets },
+		func(tgt pkgbannerprobe.BannerProbe) (string, string, error) { return getAddrPortHost(tgt.Target) }),
+	// a plain UDP client socket, no raw socket is needed, so it's up to the same capability as the HTTP probe
+	pkgpinger.L7ProtoSTUN: newL7Probe(pkgnodereg.AttributeKeyHTTPProbeCapability, "stun", "stun probe",
+		func(req *pkgpinger.SimplePingRequest) *[]pkgstunprobe.STUNProbe { return &req.STUNTargets },
+		func(tgt pkgstunprobe.STUNProbe) (string, string, error) { return tgt.GetHost(), tgt.Target, nil }),
+	// the same quic-go client the HTTP/3 flavor of the HTTP probe uses, hence the same capability
+	pkgpinger.L7ProtoQUIC: newL7Probe(pkgnodereg.AttributeKeyHTTPProbeCapability, "quic", "quic probe",
+		func(req *pkgpinger.SimplePingRequest) *[]pkgquicprobe.QUICProbe { return &req.QUICTargets },
+		func(tgt pkgquicprobe.QUICProbe) (string, string, error) { return tgt.GetHost(), tgt.Target, nil }),
+}
+
+// getL7Probe returns the entry of the L7 type in l7Probes, and the registration of from if it has the capability of the type
+func getL7Probe(connRegistry *pkgnodereg.ConnRegistry, from string, l7Type *pkgpinger.L7PacketTypeOption) (*l7Probe, *pkgnodereg.ConnRegistryData) {
+	if l7Type == nil {
+		return nil, nil
+	}
+	probe, ok := l7Probes[*l7Type]
+	if !ok {
+		return nil, nil
+	}
+	return &probe, getConnWithCapability(connRegistry, from, probe.capability)
+}
+
 func checkRemotePingerPolicy(ctx context.Context, regData *pkgnodereg.ConnRegistryData, target string, resolver *net.Resolver, outOfRangePolicy OutOfRespondRangePolicy) bool {
 	// When OutOfRange policy is 'deny', the hub will carefully consider the RespondRange attribute announced by the agent,
 	// and make sure the ping request won't be distributed to whom that are not desired.
@@ -200,6 +346,149 @@ func getRealPktIntv(req *http.Request, pingReq *pkgpinger.SimplePingRequest, min
 	return time.Duration(intvMs) * time.Millisecond
 }
 
+func (handler *PingTaskHandler) getDNSDivergenceIPInfoAdapter(pingReq *pkgpinger.SimplePingRequest) pkgipinfo.GeneralIPInfoAdapter {
+	if handler.IPInfoReg == nil {
+		return nil
+	}
+
+	name := handler.DNSDivergenceIPInfoProvider
+	if pingReq.IPInfoProviderName != nil && *pingReq.IPInfoProviderName != "" {
+		name = *pingReq.IPInfoProviderName
+	}
+	if name == "" {
+		return nil
+	}
+
+	adapter, err := handler.IPInfoReg.GetAdapter(name)
+	if err != nil {
+		log.Printf("Failed to get ipinfo adapter %s: %v", name, err)
+		return nil
+	}
+	return adapter
+}
+
+func decodeDNSQueryResult(ev pkgpinger.PingEvent) *pkgdnsprobe.QueryResult {
+	if ev.Data == nil {
+		return nil
+	}
+
+	// the event was decoded from the agent's response, so the data is a generic map at this point
+	j, err := json.Marshal(ev.Data)
+	if err != nil {
+		log.Printf("Failed to marshal dns event data: %v", err)
+		return nil
+	}
+	result := new(pkgdnsprobe.QueryResult)
+	if err := json.Unmarshal(j, result); err != nil {
+		log.Printf("Failed to unmarshal dns event data: %v", err)
+		return nil
+	}
+	if result.Target == "" {
+		return nil
+	}
+	return result
+}
+
+func decodeHTTPContentDigest(ev pkgpinger.PingEvent) (string, *pkghttpprobe.HTTPContentDigest) {
+	// most of the events of an http probe are transport events, skip them before paying for the round trip
+	if m, ok := ev.Data.(map[string]interface{}); !ok || m["content"] == nil {
+		return "", nil
+	}
+
+	j, err := json.Marshal(ev.Data)
+	if err != nil {
+		log.Printf("Failed to marshal http event data: %v", err)
+		return "", nil
+	}
+	httpEv := new(pkghttpprobe.Event)
+	if err := json.Unmarshal(j, httpEv); err != nil {
+		log.Printf("Failed to unmarshal http event data: %v", err)
+		return "", nil
+	}
+	return httpEv.CorrelationID, httpEv.Content
+}
+
+// getThroughputReceiverURL returns where the senders could reach the receiver of the node, it has to be a HTTP endpoint,
+// a node connected over QUIC is reachable only by the hub.
+func getThroughputReceiverURL(regData *pkgnodereg.ConnRegistryData) (string, error) {
+	nodeName := regData.Attributes[pkgnodereg.AttributeKeyNodeName]
+	if regData.Attributes[pkgnodereg.AttributeKeyThroughputCapability] != "true" {
+		return "", fmt.Errorf("node %s doesn't support throughput tests", nodeName)
+	}
+	httpEndpoint := regData.Attributes[pkgnodereg.AttributeKeyHttpEndpoint]
+	if httpEndpoint == "" {
+		return "", fmt.Errorf("node %s has no http endpoint", nodeName)
+	}
+	urlObj, err := url.Parse(httpEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse http endpoint of node %s: %w", nodeName, err)
+	}
+	urlObj.Path = pkgthroughput.ReceiverPath
+	return urlObj.String(), nil
+}
+
+// How long the receiver is given to report after the sender is done, before it's cancelled
+const throughputReceiverGrace = 5 * time.Second
+
+// throughputPinger runs both ends of a throughput test, and starts the sender only after the receiver is ready
+type throughputPinger struct {
+	receiver pkgpinger.Pinger
+	sender   pkgpinger.Pinger
+}
+
+func isThroughputReceiverReady(ev pkgpinger.PingEvent) bool {
+	if m, ok := ev.Data.(map[string]interface{}); ok {
+		return m["ready"] == true
+	}
+	return false
+}
+
+func (tp *throughputPinger) Ping(ctx context.Context) <-chan pkgpinger.PingEvent {
+	evChan := make(chan pkgpinger.PingEvent)
+	go func() {
+		defer close(evChan)
+
+		receiverCtx, cancelReceiver := context.WithCancel(ctx)
+		defer cancelReceiver()
+		receiverEvs := tp.receiver.Ping(receiverCtx)
+		for ready := false; !ready; {
+			ev, ok := <-receiverEvs
+			if !ok {
+				// the receiver failed before being ready, there is no point to start the sender
+				return
+			}
+			evChan <- ev
+			ready = isThroughputReceiverReady(ev)
+		}
+
+		senderEvs := tp.sender.Ping(ctx)
+		var graceC <-chan time.Time
+		for receiverEvs != nil || senderEvs != nil {
+			select {
+			case ev, ok := <-receiverEvs:
+				if !ok {
+					receiverEvs = nil
+					continue
+				}
+				evChan <- ev
+			case ev, ok := <-senderEvs:
+				if !ok {
+					senderEvs = nil
+					graceTimer := time.NewTimer(throughputReceiverGrace)
+					defer graceTimer.Stop()
+					graceC = graceTimer.C
+					continue
+				}
+				evChan <- ev
+			case <-graceC:
+				graceC = nil
+				cancelReceiver()
+			}
+		}
+	}()
+	return evChan
+}
+
 func (handler *PingTaskHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Set headers for streaming response
 	w.Header().Set("Content-Type", "application/x-ndjson")
@@ -242,6 +531,27 @@ func (handler *PingTaskHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	extraRequestHeader["X-Forwarded-For"] = pkgutils.GetRemoteAddr(r)
 	extraRequestHeader["X-Real-IP"] = pkgutils.GetRemoteAddr(r)
 
+	// the targets are asked for the content digest, which is what the divergence report is built from
+	httpDivergence := form.HTTPDivergence != nil && *form.HTTPDivergence && form.L7PacketType != nil && *form.L7PacketType == pkgpinger.L7ProtoHTTP
+	httpTargets := form.HTTPTargets
+	if httpDivergence {
+		// the digests are grouped by correlation id, so it has to tell the targets apart
+		httpTargets = make([]pkghttpprobe.HTTPProbe, 0, len(form.HTTPTargets))
+		seenCorrIds := make(map[string]bool)
+		for _, tgt := range form.HTTPTargets {
+			if tgt.CorrelationID == "" {
+				json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("invalid http target %s: correlation id is empty, it's required by the divergence report", tgt.URL).Error()})
+				continue
+			}
+			if seenCorrIds[tgt.CorrelationID] {
+				json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("invalid http target %s: correlation id %s is used by another target", tgt.URL, tgt.CorrelationID).Error()})
+				continue
+			}
+			seenCorrIds[tgt.CorrelationID] = true
+			httpTargets = append(httpTargets, tgt)
+		}
+	}
+
 	pingersFlat := make([]pkgpinger.Pinger, 0)
 	for _, from := range form.From {
 		if dnsProbeable := getConnWithCapability(handler.ConnRegistry, from, pkgnodereg.AttributeKeyDNSProbeCapability); dnsProbeable != nil && form.L7PacketType != nil && *form.L7PacketType == pkgpinger.L7ProtoDNS {
@@ -251,14 +561,33 @@ func (handler *PingTaskHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("invalid dns target from %s: correlation id is empty", pkgutils.GetRemoteAddr(r)).Error()})
 					continue
 				}
-				if dnsTarget.AddrPort == "" {
-					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("invalid dns target from %s: addrport is empty", pkgutils.GetRemoteAddr(r)).Error()})
-					continue
-				}
-
-				if !checkRemotePingerPolicy(ctx, dnsProbeable, tryStripPort(dnsTarget.AddrPort), handler.Resolver, handler.OutOfRespondRangePolicy) {
-					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("failed to check remote pinger policy for dns target: %v", err).Error()})
-					continue
+				if dnsTarget.Trace {
+					// the servers to be queried are only known while tracing, so it's up to the agent
+					if handler.OutOfRespondRangePolicy == ORPolicyDeny && dnsProbeable.Attributes[pkgnodereg.AttributeKeyRespondRange] != "" {
+						json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("dns trace is not available on %s since its respond range is restricted", from).Error()})
+						continue
+					}
+				} else if dnsTarget.ZoneCheck {
+					if handler.OutOfRespondRangePolicy == ORPolicyDeny && dnsProbeable.Attributes[pkgnodereg.AttributeKeyRespondRange] != "" {
+						json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("dns zone check is not available on %s since its respond range is restricted", from).Error()})
+						continue
+					}
+				} else {
+					if dnsTarget.AddrPort == "" {
+						json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("invalid dns target from %s: addrport is empty", pkgutils.GetRemoteAddr(r)).Error()})
+						continue
+					}
+
+					dnsServerHost, err := dnsTarget.GetServerHost()
+					if err != nil {
+						json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("invalid dns target from %s: %v", pkgutils.GetRemoteAddr(r), err).Error()})
+						continue
+					}
+
+					if !checkRemotePingerPolicy(ctx, dnsProbeable, dnsServerHost, handler.Resolver, handler.OutOfRespondRangePolicy) {
+						json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("failed to check remote pinger policy for dns target: %v", err).Error()})
+						continue
+					}
 				}
 
 				remotePingerEndpoint, quicClient := getTransport(dnsProbeable)
@@ -286,7 +615,9 @@ func (handler *PingTaskHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 				pingers[from][corrId] = remotePinger
 			}
 		} else if httpProbeable := getConnWithCapability(handler.ConnRegistry, from, pkgnodereg.AttributeKeyHTTPProbeCapability); httpProbeable != nil && form.L7PacketType != nil && *form.L7PacketType == pkgpinger.L7ProtoHTTP {
-			for _, tgt := range form.HTTPTargets {
+			httpForm := *form
+			httpForm.HTTPTargets = make([]pkghttpprobe.HTTPProbe, 0)
+			for _, tgt := range httpTargets {
 				urlObj, err := url.Parse(tgt.URL)
 				if err != nil {
 					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("failed to parse http target: %v", err).Error()})
@@ -294,10 +625,22 @@ func (handler *PingTaskHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 				}
 
 				if !checkRemotePingerPolicy(ctx, httpProbeable, urlObj.Hostname(), handler.Resolver, handler.OutOfRespondRangePolicy) {
-					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("failed to check remote pinger policy for http target: %v", err).Error()})
+					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("failed to check remote pinger policy for http target: %s", tgt.URL).Error()})
 					continue
 				}
 
+				if err := handler.checkHTTPRequestPolicy(&tgt); err != nil {
+					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("http target %s is rejected: %v", tgt.URL, err).Error()})
+					continue
+				}
+
+				if httpDivergence {
+					tgt.BodyDigest = true
+				}
+				httpForm.HTTPTargets = append(httpForm.HTTPTargets, tgt)
+			}
+			if len(httpForm.HTTPTargets) == 0 {
+				continue
 			}
 
 			remotePingerEndpoint, quicClient := getTransport(httpProbeable)
@@ -307,7 +650,7 @@ func (handler *PingTaskHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 			}
 
 			sp := &pkgpinger.SimpleRemotePinger{
-				Request:            *form.DeriveAdHTTPProbeRequest(from, handler.HTTPResponseBodyClamp),
+				Request:            *httpForm.DeriveAdHTTPProbeRequest(from, handler.HTTPResponseBodyClamp),
 				ClientTLSConfig:    handler.ClientTLSConfig,
 				ExtraRequestHeader: extraRequestHeader,
 				QUICClient:         quicClient,
@@ -322,6 +665,79 @@ func (handler *PingTaskHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 			pingersFlat = append(pingersFlat, WithMetadata(remotePinger, map[string]string{
 				pkgpinger.MetadataKeyFrom: from,
 			}))
+		} else if probe, probeable := getL7Probe(handler.ConnRegistry, from, form.L7PacketType); probeable != nil {
+			request := probe.derive(ctx, w, handler, probeable, form, from)
+			if request == nil {
+				continue
+			}
+
+			remotePinger, err := handler.newRemotePinger(probeable, from, request, extraRequestHeader, probe.label)
+			if err != nil {
+				json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
+				continue
+			}
+
+			pingersFlat = append(pingersFlat, WithMetadata(remotePinger, map[string]string{
+				pkgpinger.MetadataKeyFrom: from,
+			}))
+		} else if throughputSender := getConnWithCapability(handler.ConnRegistry, from, pkgnodereg.AttributeKeyThroughputSenderCapability); throughputSender != nil && form.L7PacketType != nil && *form.L7PacketType == pkgpinger.L7ProtoThroughput {
+			// the receiving end also needs an HTTP endpoint, hence the capabilities of the two ends
+			for _, tgt := range form.ThroughputTargets {
+				if tgt.Receiver == from {
+					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("throughput test from %s to itself is not allowed", from).Error()})
+					continue
+				}
+				throughputReceiver := getConnWithCapability(handler.ConnRegistry, tgt.Receiver, pkgnodereg.AttributeKeyThroughputCapability)
+				if throughputReceiver == nil {
+					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("receiver %s of throughput test is not connected, or can't be the receiver", tgt.Receiver).Error()})
+					continue
+				}
+				receiverURL, err := getThroughputReceiverURL(throughputReceiver)
+				if err != nil {
+					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
+					continue
+				}
+				receiverURLObj, _ := url.Parse(receiverURL)
+				if !checkRemotePingerPolicy(ctx, throughputSender, receiverURLObj.Hostname(), handler.Resolver, handler.OutOfRespondRangePolicy) {
+					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: fmt.Errorf("failed to check remote pinger policy for throughput receiver: %s", tgt.Receiver).Error()})
+					continue
+				}
+
+				tgt.Clamp(handler.ThroughputBytesClamp, handler.ThroughputDurationClamp)
+				tgt.Token = uuid.NewString()
+				receiverTgt := tgt
+				receiverTgt.Role = pkgthroughput.RoleReceiver
+				senderTgt := tgt
+				senderTgt.Role = pkgthroughput.RoleSender
+				senderTgt.ReceiverURL = receiverURL
+
+				receiverPinger, err := handler.newRemotePinger(throughputReceiver, tgt.Receiver, form.DeriveAsProbeRequest(tgt.Receiver, func(derived *pkgpinger.SimplePingRequest) {
+					derived.ThroughputTargets = []pkgthroughput.ThroughputTest{receiverTgt}
+				}), extraRequestHeader, "throughput test")
+				if err != nil {
+					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
+					continue
+				}
+				senderPinger, err := handler.newRemotePinger(throughputSender, from, form.DeriveAsProbeRequest(from, func(derived *pkgpinger.SimplePingRequest) {
+					derived.ThroughputTargets = []pkgthroughput.ThroughputTest{senderTgt}
+				}), extraRequestHeader, "throughput test")
+				if err != nil {
+					json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
+					continue
+				}
+				log.Printf("Starting throughput test from %s to %s via %s", from, tgt.Receiver, receiverURL)
+
+				pingersFlat = append(pingersFlat, &throughputPinger{
+					receiver: WithMetadata(receiverPinger, map[string]string{
+						pkgpinger.MetadataKeyFrom:   tgt.Receiver,
+						pkgpinger.MetadataKeyTarget: tgt.Receiver,
+					}),
+					sender: WithMetadata(senderPinger, map[string]string{
+						pkgpinger.MetadataKeyFrom:   from,
+						pkgpinger.MetadataKeyTarget: tgt.Receiver,
+					}),
+				})
+			}
 		} else if remotePingable := getConnWithCapability(handler.ConnRegistry, from, pkgnodereg.AttributeKeyPingCapability); remotePingable != nil {
 			for _, target := range form.Targets {
 				if !checkRemotePingerPolicy(ctx, remotePingable, target, handler.Resolver, handler.OutOfRespondRangePolicy) {
@@ -372,6 +788,25 @@ func (handler *PingTaskHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// corrId -> from -> result, only collected when the divergence report is asked for
+	var dnsResults map[string]map[string]*pkgdnsprobe.QueryResult
+	// trace steps and zone check reports are not comparable
+	skippedCorrIds := make(map[string]bool)
+	if form.DNSDivergence != nil && *form.DNSDivergence && form.L7PacketType != nil && *form.L7PacketType == pkgpinger.L7ProtoDNS {
+		dnsResults = make(map[string]map[string]*pkgdnsprobe.QueryResult)
+		for _, dnsTarget := range form.DNSTargets {
+			if dnsTarget.Trace || dnsTarget.ZoneCheck {
+				skippedCorrIds[dnsTarget.CorrelationID] = true
+			}
+		}
+	}
+
+	// corrId -> from -> digest
+	var httpDigests map[string]map[string]*pkghttpprobe.HTTPContentDigest
+	if httpDivergence {
+		httpDigests = make(map[string]map[string]*pkghttpprobe.HTTPContentDigest)
+	}
+
 	// Start multiple pings in parallel, and stream events as line-delimited JSON
 	encoder := json.NewEncoder(w)
 	for ev := range pkgpinger.StartMultiplePings(ctx, pingersFlat) {
@@ -393,5 +828,74 @@ func (handler *PingTaskHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 		}
 
 		pkgutils.TryFlush(w)
+
+		if httpDigests != nil && ev.Metadata != nil {
+			if corrId, digest := decodeHTTPContentDigest(ev); digest != nil {
+				if _, ok := httpDigests[corrId]; !ok {
+					httpDigests[corrId] = make(map[string]*pkghttpprobe.HTTPContentDigest)
+				}
+				httpDigests[corrId][ev.Metadata[pkgpinger.MetadataKeyFrom]] = digest
+			}
+		}
+
+		if dnsResults != nil && ev.Metadata != nil && !skippedCorrIds[ev.Metadata[pkgpinger.MetadataKeyTarget]] {
+			if result := decodeDNSQueryResult(ev); result != nil {
+				corrId := ev.Metadata[pkgpinger.MetadataKeyTarget]
+				if _, ok := dnsResults[corrId]; !ok {
+					dnsResults[corrId] = make(map[string]*pkgdnsprobe.QueryResult)
+				}
+				dnsResults[corrId][ev.Metadata[pkgpinger.MetadataKeyFrom]] = result
+			}
+		}
+	}
+
+	if dnsResults != nil {
+		ipinfoAdapter := handler.getDNSDivergenceIPInfoAdapter(form)
+		summary := pkgdnsprobe.DNSDivergenceSummary{Reports: make([]pkgdnsprobe.DNSDivergenceReport, 0)}
+		corrIds := make([]string, 0, len(dnsResults))
+		for corrId := range dnsResults {
+			corrIds = append(corrIds, corrId)
+		}
+		sort.Strings(corrIds)
+		for _, corrId := range corrIds {
+			summary.Reports = append(summary.Reports, pkgdnsprobe.AnalyzeDNSDivergence(ctx, dnsResults[corrId], ipinfoAdapter))
+		}
+		if err := encoder.Encode(pkgpinger.PingEvent{Data: summary}); err != nil {
+			log.Printf("Failed to encode dns divergence summary: %v", err)
+		}
+		pkgutils.TryFlush(w)
+	}
+
+	if httpDigests != nil {
+		summary := pkghttpprobe.HTTPDivergenceSummary{Reports: make([]pkghttpprobe.HTTPDivergenceReport, 0)}
+		corrIds := make([]string, 0, len(httpDigests))
+		for corrId := range httpDigests {
+			corrIds = append(corrIds, corrId)
+		}
+		sort.Strings(corrIds)
+		for _, corrId := range corrIds {
+			summary.Reports = append(summary.Reports, pkghttpprobe.AnalyzeHTTPDivergence(corrId, httpDigests[corrId]))
+		}
+		if err := encoder.Encode(pkgpinger.PingEvent{Data: summary}); err != nil {
+			log.Printf("Failed to encode http divergence summary: %v", err)
+		}
+		pkgutils.TryFlush(w)
+	}
+}
+
+func (handler *PingTaskHandler) checkHTTPRequestPolicy(tgt *pkghttpprobe.HTTPProbe) error {
+	if len(handler.HTTPAllowedMethods) > 0 && !slices.ContainsFunc(handler.HTTPAllowedMethods, func(method string) bool {
+		return strings.EqualFold(method, tgt.GetMethod())
+	}) {
+		return fmt.Errorf("http method %s is not allowed, allowed methods are: %s", tgt.GetMethod(), strings.Join(handler.HTTPAllowedMethods, ", "))
+	}
+
+	body, err := tgt.GetRequestBody()
+	if err != nil {
+		return err
+	}
+	if handler.HTTPRequestBodyClamp != nil && len(body) > *handler.HTTPRequestBodyClamp {
+		return fmt.Errorf("request body of %d bytes exceeds the limit of %d bytes", len(body), *handler.HTTPRequestBodyClamp)
 	}
+	return nil
 }
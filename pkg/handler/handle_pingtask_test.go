@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	pkghttpprobe "github.com/internetworklab/cloudping/pkg/httpprobe"
+	pkgnodereg "github.com/internetworklab/cloudping/pkg/nodereg"
+	pkgpinger "github.com/internetworklab/cloudping/pkg/pinger"
+	pkgsafemap "github.com/internetworklab/cloudping/pkg/safemap"
+	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
+)
+
+// startTestHTTPProbeAgent answers every http target with a digest of its url, except for the url of censored,
+// whose body is a different one
+func startTestHTTPProbeAgent(t *testing.T, censored string) string {
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		form, err := pkgpinger.ParseSimplePingRequest(r)
+		if err != nil {
+			json.NewEncoder(w).Encode(pkgutils.ErrorResponse{Error: err.Error()})
+			return
+		}
+		encoder := json.NewEncoder(w)
+		for _, tgt := range form.HTTPTargets {
+			if !tgt.BodyDigest {
+				t.Errorf("expected a body digest to be asked for %s", tgt.URL)
+			}
+			digest := &pkghttpprobe.HTTPContentDigest{URL: tgt.URL, StatusCode: http.StatusOK, BodySHA256: tgt.URL}
+			if tgt.URL == censored {
+				digest.BodySHA256 = "blockpage"
+			}
+			encoder.Encode(pkgpinger.PingEvent{Data: pkghttpprobe.Event{CorrelationID: tgt.CorrelationID, Content: digest}})
+		}
+	}))
+	t.Cleanup(agent.Close)
+	return agent.URL
+}
+
+func newTestConnRegistry(t *testing.T, endpoints map[string]string) *pkgnodereg.ConnRegistry {
+	cr := pkgnodereg.NewConnRegistry(pkgsafemap.NewSafeMap())
+	for nodeName, endpoint := range endpoints {
+		cr.OpenConnection(nodeName, nil)
+		if err := cr.Register(nodeName, pkgnodereg.RegisterPayload{NodeName: nodeName}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := cr.SetAttributes(nodeName, &pkgnodereg.AttributesAnnouncementPayload{Attributes: pkgnodereg.ConnectionAttributes{
+			pkgnodereg.AttributeKeyNodeName:            nodeName,
+			pkgnodereg.AttributeKeyPingCapability:      "true",
+			pkgnodereg.AttributeKeyHTTPProbeCapability: "true",
+			pkgnodereg.AttributeKeyHttpEndpoint:        endpoint,
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cr
+}
+
+func TestPingTaskHandler_HTTPDivergence(t *testing.T) {
+	handler := &PingTaskHandler{ConnRegistry: newTestConnRegistry(t, map[string]string{
+		"node1": startTestHTTPProbeAgent(t, ""),
+		"node2": startTestHTTPProbeAgent(t, "http://b.example/"),
+	})}
+
+	query := url.Values{}
+	query.Set(pkgpinger.ParamFrom, "node1,node2")
+	query.Set(pkgpinger.ParamL7PacketType, string(pkgpinger.L7ProtoHTTP))
+	query.Set(pkgpinger.ParamHTTPDivergence, "true")
+	for _, tgt := range []string{
+		`{"url":"http://a.example/","correlationId":"a"}`,
+		`{"url":"http://b.example/","correlationId":"b"}`,
+		`{"url":"http://c.example/"}`,
+		`{"url":"http://d.example/","correlationId":"a"}`,
+	} {
+		query.Add(pkgpinger.ParamHTTPTarget, tgt)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/?"+query.Encode(), nil))
+
+	var errs []string
+	var summary *pkghttpprobe.HTTPDivergenceSummary
+	numDigests := 0
+	scanner := bufio.NewScanner(recorder.Body)
+	for scanner.Scan() {
+		line := struct {
+			Error string          `json:"err"`
+			Data  json.RawMessage `json:"data"`
+		}{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("failed to unmarshal %s: %v", scanner.Text(), err)
+		}
+		if line.Error != "" {
+			errs = append(errs, line.Error)
+			continue
+		}
+		if strings.Contains(string(line.Data), `"httpDivergence"`) {
+			summary = new(pkghttpprobe.HTTPDivergenceSummary)
+			if err := json.Unmarshal(line.Data, summary); err != nil {
+				t.Fatal(err)
+			}
+		} else if strings.Contains(string(line.Data), `"content"`) {
+			numDigests++
+		}
+	}
+
+	// the target without an id and the one reusing an id are dropped before any agent is asked
+	if len(errs) != 2 || !strings.Contains(errs[0], "c.example") || !strings.Contains(errs[1], "d.example") {
+		t.Fatalf("expected the targets without a unique correlation id to be rejected, got %v", errs)
+	}
+	if numDigests != 4 {
+		t.Fatalf("expected a digest of each of the 2 targets from each of the 2 agents, got %d", numDigests)
+	}
+	if summary == nil || len(summary.Reports) != 2 {
+		t.Fatalf("expected a report for each of the targets, got %+v", summary)
+	}
+	for _, report := range summary.Reports {
+		if report.NumAgents != 2 {
+			t.Errorf("expected the report of %s to be built from both agents, got %+v", report.CorrelationID, report)
+		}
+		if expected := report.CorrelationID == "b"; report.Divergent != expected || report.URL != "http://"+report.CorrelationID+".example/" {
+			t.Errorf("unexpected report of %s: %+v", report.CorrelationID, report)
+		}
+	}
+}
+
+func TestPingTaskHandler_L7Probes(t *testing.T) {
+	var lock sync.Mutex
+	received := make([]*pkgpinger.SimplePingRequest, 0)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		form, err := pkgpinger.ParseSimplePingRequest(r)
+		if err != nil {
+			t.Errorf("failed to parse the request to the agent: %v", err)
+			return
+		}
+		lock.Lock()
+		received = append(received, form)
+		lock.Unlock()
+	}))
+	defer agent.Close()
+	handler := &PingTaskHandler{ConnRegistry: newTestConnRegistry(t, map[string]string{"node1": agent.URL})}
+
+	query := url.Values{}
+	query.Set(pkgpinger.ParamFrom, "node1")
+	query.Set(pkgpinger.ParamL7PacketType, string(pkgpinger.L7ProtoQUIC))
+	query.Add(pkgpinger.ParamQUICTarget, `{"target":"example.com","correlationId":"a"}`)
+	query.Add(pkgpinger.ParamQUICTarget, `{"target":"example.org:4433","correlationId":"b"}`)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?"+query.Encode(), nil))
+
+	if len(received) != 1 || len(received[0].QUICTargets) != 2 || received[0].QUICTargets[1].Target != "example.org:4433" {
+		t.Fatalf("expected the quic targets to be sent to the agent, got %+v", received)
+	}
+	if received[0].L7PacketType == nil || *received[0].L7PacketType != pkgpinger.L7ProtoQUIC {
+		t.Fatalf("expected the l7 type to be kept, got %+v", received[0])
+	}
+
+	// the agent doesn't announce the capability of banner probes
+	received = received[:0]
+	query.Set(pkgpinger.ParamL7PacketType, string(pkgpinger.L7ProtoBanner))
+	query.Add(pkgpinger.ParamBannerTarget, `{"target":"example.com:25","correlationId":"c"}`)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?"+query.Encode(), nil))
+	if len(received) != 0 {
+		t.Fatalf("expected nothing to be sent to an agent without the capability, got %+v", received)
+	}
+}
@@ -0,0 +1,188 @@
+package httpprobe
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPAssertions turns an HTTP probe into a synthetic check, every assertion present must hold for the probe to pass.
+type HTTPAssertions struct {
+	// Each is either a code, e.g. '200', a class, e.g. '2xx', or a range, e.g. '200-299',
+	// the status code must match at least one of them.
+	StatusCodes []string `json:"statusCodes,omitempty"`
+
+	// The header must be present, and when the expected value is not empty, one of its values must contain it,
+	// e.g. { "Content-Type": "text/html" }.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Matched against the part of the body that is read, i.e. within SizeLimit
+	BodyContains string `json:"bodyContains,omitempty"`
+	BodyRegex    string `json:"bodyRegex,omitempty"`
+
+	// The maximum total time, from the start of the probe to the end of the body
+	MaxTotalTimeMs *int64 `json:"maxTotalTimeMs,omitempty"`
+
+	// The leaf certificate of the final response must not expire within that many days,
+	// a response not over TLS fails it.
+	MinDaysUntilExpiry *int `json:"minDaysUntilExpiry,omitempty"`
+}
+
+type HTTPVerdict struct {
+	Passed bool `json:"passed"`
+	// why it failed, one for each failed assertion
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// What the assertions are evaluated against
+type httpProbeOutcome struct {
+	err        error
+	proto      string
+	statusCode int
+	header     http.Header
+	body       bytes.Buffer
+
+	// of the final response, after following the redirects
+	finalURL string
+	// of the final response, or of the last handshake failing the verification when there is no response
+	tls *TLSInspection
+	// the probe opted out of failing the verdict on a certificate that can't be verified
+	insecureSkipVerify bool
+	// only present when the content digest is asked for
+	digester *bodyDigester
+}
+
+func matchStatusCode(spec string, code int) (bool, error) {
+	spec = strings.TrimSpace(spec)
+	if len(spec) == 3 && strings.HasSuffix(strings.ToLower(spec), "xx") {
+		class, err := strconv.Atoi(spec[:1])
+		if err != nil {
+			return false, fmt.Errorf("invalid status code class: %s", spec)
+		}
+		return code/100 == class, nil
+	}
+	if lo, hi, found := strings.Cut(spec, "-"); found {
+		loCode, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return false, fmt.Errorf("invalid status code range: %s", spec)
+		}
+		hiCode, err := strconv.Atoi(strings.TrimSpace(hi))
+		if err != nil {
+			return false, fmt.Errorf("invalid status code range: %s", spec)
+		}
+		return code >= loCode && code <= hiCode, nil
+	}
+	expected, err := strconv.Atoi(spec)
+	if err != nil {
+		return false, fmt.Errorf("invalid status code: %s", spec)
+	}
+	return code == expected, nil
+}
+
+func (assertions *HTTPAssertions) Validate() error {
+	for _, spec := range assertions.StatusCodes {
+		if _, err := matchStatusCode(spec, 0); err != nil {
+			return err
+		}
+	}
+	if assertions.BodyRegex != "" {
+		if _, err := regexp.Compile(assertions.BodyRegex); err != nil {
+			return fmt.Errorf("invalid body regex %s: %w", assertions.BodyRegex, err)
+		}
+	}
+	if assertions.MaxTotalTimeMs != nil && *assertions.MaxTotalTimeMs <= 0 {
+		return fmt.Errorf("max total time must be positive, got %dms", *assertions.MaxTotalTimeMs)
+	}
+	if assertions.MinDaysUntilExpiry != nil && *assertions.MinDaysUntilExpiry < 0 {
+		return fmt.Errorf("min days until expiry must not be negative, got %d", *assertions.MinDaysUntilExpiry)
+	}
+	return nil
+}
+
+func (assertions *HTTPAssertions) needsBody() bool {
+	return assertions.BodyContains != "" || assertions.BodyRegex != ""
+}
+
+func (assertions *HTTPAssertions) evaluate(outcome *httpProbeOutcome, total time.Duration) *HTTPVerdict {
+	verdict := &HTTPVerdict{Reasons: make([]string, 0)}
+	fail := func(format string, args ...any) {
+		verdict.Reasons = append(verdict.Reasons, fmt.Sprintf(format, args...))
+	}
+
+	if outcome.err != nil {
+		fail("request failed: %v", outcome.err)
+		return verdict
+	}
+
+	// whatever the response is, it means nothing if the peer might not be the one asked for
+	if outcome.tls != nil && !outcome.tls.Verified && !outcome.insecureSkipVerify {
+		fail("tls verification failed: %s", outcome.tls.VerifyError)
+	}
+	if assertions.MinDaysUntilExpiry != nil {
+		if outcome.tls == nil {
+			fail("no tls session to check the certificate expiry of")
+		} else if outcome.tls.DaysUntilExpiry < *assertions.MinDaysUntilExpiry {
+			fail("certificate expires in %d days, expected at least %d", outcome.tls.DaysUntilExpiry, *assertions.MinDaysUntilExpiry)
+		}
+	}
+
+	if len(assertions.StatusCodes) > 0 {
+		matched := false
+		for _, spec := range assertions.StatusCodes {
+			if ok, err := matchStatusCode(spec, outcome.statusCode); err == nil && ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("status code %d is not one of %s", outcome.statusCode, strings.Join(assertions.StatusCodes, ","))
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(assertions.Headers)) {
+		expected := assertions.Headers[name]
+		values := outcome.header.Values(name)
+		if len(values) == 0 {
+			fail("header %s is missing", name)
+			continue
+		}
+		if expected == "" {
+			continue
+		}
+		found := false
+		for _, value := range values {
+			if strings.Contains(value, expected) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("header %s is %q, expected to contain %q", name, strings.Join(values, " "), expected)
+		}
+	}
+
+	if assertions.BodyContains != "" && !bytes.Contains(outcome.body.Bytes(), []byte(assertions.BodyContains)) {
+		fail("body does not contain %q", assertions.BodyContains)
+	}
+	if assertions.BodyRegex != "" {
+		re, err := regexp.Compile(assertions.BodyRegex)
+		if err != nil {
+			fail("invalid body regex %s: %v", assertions.BodyRegex, err)
+		} else if !re.Match(outcome.body.Bytes()) {
+			fail("body does not match %s", assertions.BodyRegex)
+		}
+	}
+
+	if assertions.MaxTotalTimeMs != nil && total > time.Duration(*assertions.MaxTotalTimeMs)*time.Millisecond {
+		fail("total time %dms exceeds %dms", total.Milliseconds(), *assertions.MaxTotalTimeMs)
+	}
+
+	verdict.Passed = len(verdict.Reasons) == 0
+	return verdict
+}
@@ -0,0 +1,81 @@
+package httpprobe
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEvaluateAssertions(t *testing.T) {
+	outcome := &httpProbeOutcome{
+		statusCode: 204,
+		header:     http.Header{"Content-Type": []string{"text/html; charset=utf-8"}},
+	}
+	outcome.body.WriteString("<html>hello</html>")
+
+	maxTotalTimeMs := int64(100)
+	assertions := &HTTPAssertions{
+		StatusCodes:    []string{"301", "2xx"},
+		Headers:        map[string]string{"content-type": "text/html"},
+		BodyContains:   "hello",
+		BodyRegex:      "^<html>",
+		MaxTotalTimeMs: &maxTotalTimeMs,
+	}
+	if err := assertions.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if verdict := assertions.evaluate(outcome, 50*time.Millisecond); !verdict.Passed {
+		t.Fatalf("expected to pass, got %v", verdict.Reasons)
+	}
+
+	assertions = &HTTPAssertions{
+		StatusCodes:    []string{"200-203"},
+		Headers:        map[string]string{"Content-Type": "json", "X-Cache": ""},
+		BodyContains:   "world",
+		MaxTotalTimeMs: &maxTotalTimeMs,
+	}
+	if verdict := assertions.evaluate(outcome, 150*time.Millisecond); verdict.Passed || len(verdict.Reasons) != 5 {
+		t.Fatalf("expected 5 failures, got %v", verdict.Reasons)
+	}
+
+	if verdict := assertions.evaluate(&httpProbeOutcome{err: errors.New("timeout")}, 0); verdict.Passed || len(verdict.Reasons) != 1 {
+		t.Fatalf("expected the request failure, got %v", verdict.Reasons)
+	}
+
+	negativeDays := -1
+	for _, invalid := range []*HTTPAssertions{{StatusCodes: []string{"2x"}}, {StatusCodes: []string{"abc-200"}}, {BodyRegex: "("}, {MinDaysUntilExpiry: &negativeDays}} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("expected %+v to be invalid", invalid)
+		}
+	}
+}
+
+func TestEvaluateTLSAssertions(t *testing.T) {
+	minDays := 14
+	assertions := &HTTPAssertions{StatusCodes: []string{"2xx"}, MinDaysUntilExpiry: &minDays}
+
+	verified := &httpProbeOutcome{statusCode: 200, tls: &TLSInspection{Verified: true, DaysUntilExpiry: 30}}
+	if verdict := assertions.evaluate(verified, 0); !verdict.Passed {
+		t.Fatalf("expected to pass, got %v", verdict.Reasons)
+	}
+
+	expiring := &httpProbeOutcome{statusCode: 200, tls: &TLSInspection{Verified: true, DaysUntilExpiry: 3}}
+	if verdict := assertions.evaluate(expiring, 0); verdict.Passed || len(verdict.Reasons) != 1 {
+		t.Fatalf("expected the expiry to fail, got %v", verdict.Reasons)
+	}
+
+	if verdict := assertions.evaluate(&httpProbeOutcome{statusCode: 200}, 0); verdict.Passed || len(verdict.Reasons) != 1 {
+		t.Fatalf("expected a plain http response to fail the expiry, got %v", verdict.Reasons)
+	}
+
+	// e.g. intercepted by a middlebox
+	unverified := &httpProbeOutcome{statusCode: 200, tls: &TLSInspection{VerifyError: "x509: certificate signed by unknown authority", DaysUntilExpiry: 30}}
+	if verdict := (&HTTPAssertions{}).evaluate(unverified, 0); verdict.Passed || len(verdict.Reasons) != 1 {
+		t.Fatalf("expected the verification failure to fail, got %v", verdict.Reasons)
+	}
+	unverified.insecureSkipVerify = true
+	if verdict := (&HTTPAssertions{}).evaluate(unverified, 0); !verdict.Passed {
+		t.Fatalf("expected to pass when opted out, got %v", verdict.Reasons)
+	}
+}
@@ -0,0 +1,193 @@
+package httpprobe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// An entry of the Alt-Svc header, see RFC7838, e.g. h3=":443"; ma=86400
+type AltSvcEntry struct {
+	ProtocolID string `json:"protocol_id"`
+	Authority  string `json:"authority"`
+}
+
+type HTTPProtoResult struct {
+	Proto HTTPProto `json:"proto"`
+	OK    bool      `json:"ok"`
+	Error string    `json:"error,omitempty"`
+	// e.g. HTTP/2.0, which might differ from what's asked for
+	ResponseProto string     `json:"response_proto,omitempty"`
+	ALPN          string     `json:"alpn,omitempty"`
+	StatusCode    int        `json:"status_code,omitempty"`
+	Timing        HTTPTiming `json:"timing"`
+}
+
+// HTTPProtoComparison is the result of fetching the same URL over each of the protocols.
+type HTTPProtoComparison struct {
+	Results []HTTPProtoResult `json:"results"`
+
+	// Seen in the responses over TCP
+	AltSvc        []AltSvcEntry `json:"alt_svc,omitempty"`
+	H3Advertised  bool          `json:"h3_advertised"`
+	H3Authority   string        `json:"h3_authority,omitempty"`
+	H3Unreachable bool          `json:"h3_unreachable"`
+	// The alternative authority isn't allowed by the policy of the agent, so h3 isn't checked
+	H3RefusedByPolicy bool `json:"h3_refused_by_policy,omitempty"`
+
+	// What a browser-like client would end up on, i.e. h2 if negotiated via ALPN, otherwise http/1.1,
+	// upgraded to h3 only when advertised in Alt-Svc and reachable, empty if none works.
+	BrowserProto HTTPProto `json:"browser_proto,omitempty"`
+}
+
+func parseAltSvc(values []string) []AltSvcEntry {
+	entries := make([]AltSvcEntry, 0)
+	for _, value := range values {
+		if strings.TrimSpace(value) == "clear" {
+			continue
+		}
+		for _, alternative := range strings.Split(value, ",") {
+			// parameters like ma and persist are of no interest
+			alternative, _, _ = strings.Cut(alternative, ";")
+			protocolID, authority, found := strings.Cut(strings.TrimSpace(alternative), "=")
+			if !found {
+				continue
+			}
+			entries = append(entries, AltSvcEntry{
+				ProtocolID: strings.TrimSpace(protocolID),
+				Authority:  strings.Trim(strings.TrimSpace(authority), "\""),
+			})
+		}
+	}
+	return entries
+}
+
+// The dial address of the origin of urlStr mapped to the one of the alternative authority, the key is formed the way
+// the h3 transport forms the address it dials, nil when the authority can't be parsed
+func getAltSvcAddrs(urlStr string, authority string) map[string]string {
+	urlObj, err := url.Parse(urlStr)
+	if err != nil {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		return nil
+	}
+	if host == "" {
+		host = urlObj.Hostname()
+	}
+	originPort := urlObj.Port()
+	if originPort == "" {
+		originPort = "443"
+	}
+	return map[string]string{
+		net.JoinHostPort(urlObj.Hostname(), originPort): net.JoinHostPort(host, port),
+	}
+}
+
+// checkAltAddrs checks the hosts of the alternative authorities with the CheckHost of probe, if any
+func checkAltAddrs(ctx context.Context, probe HTTPProbe, altAddrs map[string]string) error {
+	if probe.CheckHost == nil {
+		return nil
+	}
+	for _, altAddr := range altAddrs {
+		host, _, err := net.SplitHostPort(altAddr)
+		if err != nil {
+			return err
+		}
+		if err := probe.CheckHost(ctx, host, probe.Resolver, probe.IPPref); err != nil {
+			return fmt.Errorf("h3 is not checked by policy, alternative authority %s is not allowed: %v", altAddr, err)
+		}
+	}
+	return nil
+}
+
+// the events are consumed here, only what matters to the comparison is kept
+func fetchWithProto(ctx context.Context, probe HTTPProbe, proto HTTPProto) (HTTPProtoResult, http.Header) {
+	probe.Proto = &proto
+	probe.Assertions = nil
+	recorder := newTimingRecorder()
+	outcome := &httpProbeOutcome{}
+	eventChan, errChan := sendRequest(ctx, probe, recorder, outcome)
+
+	result := HTTPProtoResult{Proto: proto}
+	for eventChan != nil || errChan != nil {
+		select {
+		case ev, ok := <-eventChan:
+			if !ok {
+				eventChan = nil
+				continue
+			}
+			if ev.TLS != nil {
+				result.ALPN = ev.TLS.ALPN
+			}
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			if result.Error == "" {
+				result.Error = err.Error()
+			}
+		}
+	}
+
+	result.OK = outcome.err == nil && result.Error == ""
+	result.ResponseProto = outcome.proto
+	result.StatusCode = outcome.statusCode
+	result.Timing = recorder.getTiming()
+	return result, outcome.header
+}
+
+// compareProtos fetches over h1 and h2 first, then over h3 at the alternative authority, if there is one.
+func compareProtos(ctx context.Context, probe HTTPProbe) *HTTPProtoComparison {
+	comparison := &HTTPProtoComparison{Results: make([]HTTPProtoResult, 0)}
+
+	var altSvcHeader []string
+	for _, proto := range []HTTPProto{HTTPProtoHTTP1, HTTPProtoHTTP2} {
+		result, header := fetchWithProto(ctx, probe, proto)
+		comparison.Results = append(comparison.Results, result)
+		if result.OK && len(altSvcHeader) == 0 {
+			altSvcHeader = header.Values("Alt-Svc")
+		}
+	}
+	comparison.AltSvc = parseAltSvc(altSvcHeader)
+	for _, entry := range comparison.AltSvc {
+		if entry.ProtocolID == "h3" {
+			comparison.H3Advertised = true
+			comparison.H3Authority = entry.Authority
+			break
+		}
+	}
+
+	h3Probe := probe
+	var h3Result HTTPProtoResult
+	if comparison.H3Advertised {
+		// only where the connection goes changes, the origin, hence the SNI, the :authority and the certificate name, stays the same
+		h3Probe.altAddrs = getAltSvcAddrs(probe.URL, comparison.H3Authority)
+		if err := checkAltAddrs(ctx, probe, h3Probe.altAddrs); err != nil {
+			// the authority is chosen by the server, so it's never dialed unless the policy allows it
+			h3Result = HTTPProtoResult{Proto: HTTPProtoHTTP3, Error: err.Error()}
+			comparison.H3RefusedByPolicy = true
+		}
+	}
+	if !comparison.H3RefusedByPolicy {
+		h3Result, _ = fetchWithProto(ctx, h3Probe, HTTPProtoHTTP3)
+	}
+	comparison.Results = append(comparison.Results, h3Result)
+	comparison.H3Unreachable = comparison.H3Advertised && !comparison.H3RefusedByPolicy && !h3Result.OK
+
+	h1Result, h2Result := comparison.Results[0], comparison.Results[1]
+	switch {
+	case comparison.H3Advertised && h3Result.OK:
+		comparison.BrowserProto = HTTPProtoHTTP3
+	case h2Result.OK && h2Result.ALPN == "h2":
+		comparison.BrowserProto = HTTPProtoHTTP2
+	case h1Result.OK:
+		comparison.BrowserProto = HTTPProtoHTTP1
+	}
+	return comparison
+}
@@ -0,0 +1,170 @@
+package httpprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	quicHttp3 "github.com/quic-go/quic-go/http3"
+)
+
+func TestParseAltSvc(t *testing.T) {
+	entries := parseAltSvc([]string{`h3=":443"; ma=86400, h3-29=":443"; ma=86400`, `h2="alt.example.com:8443"`, "clear"})
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %+v", entries)
+	}
+	if entries[0].ProtocolID != "h3" || entries[0].Authority != ":443" || entries[2].Authority != "alt.example.com:8443" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+
+	if addrs := getAltSvcAddrs("https://example.com/path?q=1", ":8443"); addrs["example.com:443"] != "example.com:8443" {
+		t.Fatalf("unexpected addrs: %+v", addrs)
+	}
+	if addrs := getAltSvcAddrs("https://example.com:8443/", "alt.example.com:443"); addrs["example.com:8443"] != "alt.example.com:443" {
+		t.Fatalf("unexpected addrs: %+v", addrs)
+	}
+	if addrs := getAltSvcAddrs("https://example.com/", "invalid"); len(addrs) != 0 {
+		t.Fatalf("unexpected addrs: %+v", addrs)
+	}
+}
+
+// startTestAltSvcServer serves h1 and h2 with the certificate of httptest, advertising h3 at altSvcPort,
+// returns the url and the path to the CA of the certificate
+func startTestAltSvcServer(t *testing.T, altSvcPort func(tlsConfig *tls.Config) int) (string, string) {
+	var advertised atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%d"; ma=86400`, advertised.Load()))
+		io.WriteString(w, "hello")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	advertised.Store(int32(altSvcPort(server.TLS.Clone())))
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return server.URL + "/", caPath
+}
+
+func TestCompareProtos(t *testing.T) {
+	t.Run("h3 unreachable", func(t *testing.T) {
+		urlStr, caPath := startTestAltSvcServer(t, func(*tls.Config) int {
+			// swallows the Initial packets, as a firewall dropping UDP would
+			silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { silent.Close() })
+			return silent.LocalAddr().(*net.UDPAddr).Port
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		comparison := compareProtos(ctx, HTTPProbe{URL: urlStr, AddCA: []string{caPath}})
+
+		if len(comparison.Results) != 3 {
+			t.Fatalf("expected a result of each proto, got %+v", comparison.Results)
+		}
+		h1, h2, h3 := comparison.Results[0], comparison.Results[1], comparison.Results[2]
+		if !h1.OK || h1.ResponseProto != "HTTP/1.1" || h1.StatusCode != http.StatusOK {
+			t.Errorf("expected h1 to succeed, got %+v", h1)
+		}
+		if !h2.OK || h2.ResponseProto != "HTTP/2.0" || h2.ALPN != "h2" {
+			t.Errorf("expected h2 to succeed, got %+v", h2)
+		}
+		if h3.OK || h3.Proto != HTTPProtoHTTP3 {
+			t.Errorf("expected h3 to fail, got %+v", h3)
+		}
+		if !comparison.H3Advertised || !comparison.H3Unreachable || comparison.BrowserProto != HTTPProtoHTTP2 {
+			t.Errorf("expected h3 to be advertised but unreachable, and a browser to stay on h2, got %+v", comparison)
+		}
+	})
+
+	t.Run("h3 reachable", func(t *testing.T) {
+		urlStr, caPath := startTestAltSvcServer(t, func(tlsConfig *tls.Config) int {
+			udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h3Server := &quicHttp3.Server{
+				TLSConfig: quicHttp3.ConfigureTLSConfig(tlsConfig),
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					io.WriteString(w, "hello")
+				}),
+			}
+			go h3Server.Serve(udpConn)
+			t.Cleanup(func() {
+				h3Server.Close()
+				udpConn.Close()
+			})
+			return udpConn.LocalAddr().(*net.UDPAddr).Port
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		comparison := compareProtos(ctx, HTTPProbe{URL: urlStr, AddCA: []string{caPath}})
+
+		if h3 := comparison.Results[2]; !h3.OK || h3.ResponseProto != "HTTP/3.0" {
+			t.Errorf("expected h3 to succeed at the alternative port, got %+v", h3)
+		}
+		if comparison.H3Unreachable || comparison.BrowserProto != HTTPProtoHTTP3 {
+			t.Errorf("expected a browser to upgrade to h3, got %+v", comparison)
+		}
+	})
+
+	t.Run("h3 refused by policy", func(t *testing.T) {
+		var received atomic.Int32
+		urlStr, caPath := startTestAltSvcServer(t, func(*tls.Config) int {
+			listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { listener.Close() })
+			go func() {
+				buf := make([]byte, 1500)
+				for {
+					if _, _, err := listener.ReadFrom(buf); err != nil {
+						return
+					}
+					received.Add(1)
+				}
+			}()
+			return listener.LocalAddr().(*net.UDPAddr).Port
+		})
+		checked := make([]string, 0)
+		probe := HTTPProbe{
+			URL:   urlStr,
+			AddCA: []string{caPath},
+			CheckHost: func(ctx context.Context, host string, resolver *string, pref *InetFamilyPreference) error {
+				checked = append(checked, host)
+				return fmt.Errorf("ip %s is not in the respond range", host)
+			},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		comparison := compareProtos(ctx, probe)
+
+		if len(checked) != 1 || checked[0] != "127.0.0.1" {
+			t.Errorf("expected the alternative authority to be checked once, got %v", checked)
+		}
+		if h3 := comparison.Results[2]; h3.OK || h3.Proto != HTTPProtoHTTP3 || h3.Error == "" {
+			t.Errorf("expected h3 to be refused with an error, got %+v", h3)
+		}
+		if !comparison.H3RefusedByPolicy || comparison.H3Unreachable || comparison.BrowserProto != HTTPProtoHTTP2 {
+			t.Errorf("expected h3 to be refused by policy rather than unreachable, got %+v", comparison)
+		}
+		if n := received.Load(); n != 0 {
+			t.Errorf("expected the alternative authority not to be dialed, got %d packets", n)
+		}
+	})
+}
@@ -0,0 +1,301 @@
+package httpprobe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"math/bits"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// number of consecutive words hashed together by the simhash
+const simHashShingleSize = 3
+
+// Headers that differ from response to response anyway, so they don't indicate any divergence
+var volatileHeaders = []string{
+	"Age",
+	"Cf-Ray",
+	"Date",
+	"Expires",
+	"Nel",
+	"Report-To",
+	"Server-Timing",
+	"Set-Cookie",
+	"X-Amz-Cf-Id",
+	"X-Amz-Request-Id",
+	"X-Request-Id",
+	"X-Served-By",
+	"X-Timer",
+}
+
+// HTTPContentDigest summarizes the final response of a probe, so that the responses seen by different agents could be compared
+// without shipping the bodies to the hub.
+type HTTPContentDigest struct {
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code,omitempty"`
+	FinalURL   string      `json:"final_url,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+
+	// Of the body read, which is at most SizeLimit bytes
+	BodySHA256    string `json:"body_sha256"`
+	BodySize      int64  `json:"body_size"`
+	BodyTruncated bool   `json:"body_truncated,omitempty"`
+
+	// 64-bit simhash of the words of the body, in hex, the number of differing bits tells how different two bodies are
+	SimHash string `json:"simhash"`
+
+	Error string `json:"error,omitempty"`
+}
+
+type bodyDigester struct {
+	sha256    hash.Hash
+	size      int64
+	truncated bool
+	// what the simhash is computed over, capped at maxAssertionBodySize
+	sample bytes.Buffer
+}
+
+func newBodyDigester() *bodyDigester {
+	return &bodyDigester{sha256: sha256.New()}
+}
+
+func (digester *bodyDigester) write(p []byte) {
+	digester.sha256.Write(p)
+	digester.size += int64(len(p))
+	if digester.sample.Len() < maxAssertionBodySize {
+		digester.sample.Write(p[:min(len(p), maxAssertionBodySize-digester.sample.Len())])
+	}
+}
+
+func getContentDigest(probe *HTTPProbe, outcome *httpProbeOutcome) *HTTPContentDigest {
+	digest := &HTTPContentDigest{
+		URL:        probe.URL,
+		StatusCode: outcome.statusCode,
+		FinalURL:   outcome.finalURL,
+		Header:     outcome.header,
+	}
+	if outcome.err != nil {
+		digest.Error = outcome.err.Error()
+	}
+	if digester := outcome.digester; digester != nil {
+		digest.BodySHA256 = hex.EncodeToString(digester.sha256.Sum(nil))
+		digest.BodySize = digester.size
+		digest.BodyTruncated = digester.truncated
+		digest.SimHash = fmt.Sprintf("%016x", computeSimHash(digester.sample.Bytes()))
+	}
+	return digest
+}
+
+func getWords(body []byte) []string {
+	return strings.FieldsFunc(strings.ToLower(string(body)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// computeSimHash returns the simhash of the word shingles of the body, see Charikar's 'Similarity Estimation Techniques from Rounding Algorithms'
+func computeSimHash(body []byte) uint64 {
+	words := getWords(body)
+	if len(words) == 0 {
+		return 0
+	}
+	shingleSize := min(simHashShingleSize, len(words))
+
+	// each distinct shingle counts once, so that a repeated boilerplate doesn't outweigh the rest of the page
+	seen := make(map[uint64]bool)
+	var weights [64]int
+	for i := 0; i+shingleSize <= len(words); i++ {
+		hasher := fnv.New64a()
+		hasher.Write([]byte(strings.Join(words[i:i+shingleSize], " ")))
+		sum := hasher.Sum64()
+		if seen[sum] {
+			continue
+		}
+		seen[sum] = true
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+
+	var simHash uint64
+	for bit := 0; bit < 64; bit++ {
+		if weights[bit] > 0 {
+			simHash |= 1 << bit
+		}
+	}
+	return simHash
+}
+
+// getSimilarity returns a score within 0 and 1 of how alike the bodies of two digests are, 1 means identical.
+func getSimilarity(a, b *HTTPContentDigest) float64 {
+	if a.BodySHA256 == b.BodySHA256 {
+		return 1
+	}
+	hashA, errA := strconv.ParseUint(a.SimHash, 16, 64)
+	hashB, errB := strconv.ParseUint(b.SimHash, 16, 64)
+	if errA != nil || errB != nil {
+		return 0
+	}
+	return 1 - float64(bits.OnesCount64(hashA^hashB))/64
+}
+
+type HeaderDifference struct {
+	Name string `json:"name"`
+	// empty when the header is absent
+	Value    []string `json:"value,omitempty"`
+	Majority []string `json:"majority,omitempty"`
+}
+
+func getHeaderDifferences(header, majority http.Header) []HeaderDifference {
+	names := make([]string, 0)
+	for _, h := range []http.Header{header, majority} {
+		for name := range h {
+			name = http.CanonicalHeaderKey(name)
+			if !slices.Contains(volatileHeaders, name) && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+
+	diffs := make([]HeaderDifference, 0)
+	for _, name := range names {
+		value := header.Values(name)
+		majorityValue := majority.Values(name)
+		if !slices.Equal(value, majorityValue) {
+			diffs = append(diffs, HeaderDifference{Name: name, Value: value, Majority: majorityValue})
+		}
+	}
+	return diffs
+}
+
+type ContentCluster struct {
+	StatusCode int    `json:"status_code,omitempty"`
+	FinalURL   string `json:"final_url,omitempty"`
+	BodySHA256 string `json:"body_sha256,omitempty"`
+	BodySize   int64  `json:"body_size"`
+	Error      string `json:"error,omitempty"`
+
+	Agents []string `json:"agents"`
+}
+
+type ContentOutlier struct {
+	Agent string `json:"agent"`
+	// Of the body to the one of the majority, within 0 and 1, 1 means identical
+	Similarity       float64            `json:"similarity"`
+	Reasons          []string           `json:"reasons"`
+	DifferingHeaders []HeaderDifference `json:"differing_headers,omitempty"`
+}
+
+// HTTPDivergenceReport compares the responses of the same probe (i.e. the same correlation id) seen by different agents
+type HTTPDivergenceReport struct {
+	CorrelationID string           `json:"corrId,omitempty"`
+	URL           string           `json:"url"`
+	NumAgents     int              `json:"num_agents"`
+	Divergent     bool             `json:"divergent"`
+	Clusters      []ContentCluster `json:"clusters"`
+	Outliers      []ContentOutlier `json:"outliers,omitempty"`
+}
+
+type HTTPDivergenceSummary struct {
+	Reports []HTTPDivergenceReport `json:"httpDivergence"`
+}
+
+func getClusterKey(digest *HTTPContentDigest) string {
+	if digest.Error != "" {
+		return "error|" + digest.Error
+	}
+	return strings.Join([]string{strconv.Itoa(digest.StatusCode), digest.FinalURL, digest.BodySHA256}, "|")
+}
+
+// AnalyzeHTTPDivergence clusters the digests by body hash, status and final url, the agents outside of the largest cluster are the outliers,
+// digests is keyed by agent name, all digests are expected to be of the same probe.
+func AnalyzeHTTPDivergence(corrId string, digests map[string]*HTTPContentDigest) HTTPDivergenceReport {
+	report := HTTPDivergenceReport{CorrelationID: corrId, NumAgents: len(digests)}
+
+	agents := make([]string, 0, len(digests))
+	for agent := range digests {
+		agents = append(agents, agent)
+	}
+	sort.Strings(agents)
+
+	clusters := make(map[string]*ContentCluster)
+	clusterKeys := make([]string, 0)
+	for _, agent := range agents {
+		digest := digests[agent]
+		if report.URL == "" {
+			report.URL = digest.URL
+		}
+
+		key := getClusterKey(digest)
+		cluster, ok := clusters[key]
+		if !ok {
+			cluster = &ContentCluster{
+				StatusCode: digest.StatusCode,
+				FinalURL:   digest.FinalURL,
+				BodySHA256: digest.BodySHA256,
+				BodySize:   digest.BodySize,
+				Error:      digest.Error,
+			}
+			clusters[key] = cluster
+			clusterKeys = append(clusterKeys, key)
+		}
+		cluster.Agents = append(cluster.Agents, agent)
+	}
+
+	for _, key := range clusterKeys {
+		report.Clusters = append(report.Clusters, *clusters[key])
+	}
+	sort.SliceStable(report.Clusters, func(i, j int) bool {
+		return len(report.Clusters[i].Agents) > len(report.Clusters[j].Agents)
+	})
+	report.Divergent = len(report.Clusters) > 1
+	if !report.Divergent {
+		return report
+	}
+
+	// the first agent of the largest cluster represents the majority
+	majorityCluster := report.Clusters[0]
+	majority := digests[majorityCluster.Agents[0]]
+	for _, cluster := range report.Clusters[1:] {
+		for _, agent := range cluster.Agents {
+			digest := digests[agent]
+			outlier := ContentOutlier{
+				Agent:            agent,
+				Similarity:       getSimilarity(digest, majority),
+				DifferingHeaders: getHeaderDifferences(digest.Header, majority.Header),
+			}
+			if digest.Error != "" {
+				outlier.Reasons = append(outlier.Reasons, fmt.Sprintf("failed with %s", digest.Error))
+				outlier.Similarity = 0
+			} else if majority.Error != "" {
+				outlier.Reasons = append(outlier.Reasons, fmt.Sprintf("got status %d, while most agents failed with %s", digest.StatusCode, majority.Error))
+				outlier.Similarity = 0
+			} else {
+				if digest.StatusCode != majority.StatusCode {
+					outlier.Reasons = append(outlier.Reasons, fmt.Sprintf("got status %d, while most agents got %d", digest.StatusCode, majority.StatusCode))
+				}
+				if digest.FinalURL != majority.FinalURL {
+					outlier.Reasons = append(outlier.Reasons, fmt.Sprintf("ended up at %s, while most agents ended up at %s", digest.FinalURL, majority.FinalURL))
+				}
+				if digest.BodySHA256 != majority.BodySHA256 {
+					outlier.Reasons = append(outlier.Reasons, fmt.Sprintf("got a different body of %d bytes, while most agents got %d bytes, similarity is %.2f", digest.BodySize, majority.BodySize, outlier.Similarity))
+				}
+			}
+			report.Outliers = append(report.Outliers, outlier)
+		}
+	}
+
+	return report
+}
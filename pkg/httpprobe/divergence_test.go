@@ -0,0 +1,62 @@
+package httpprobe
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func getTestDigest(statusCode int, body string, header http.Header) *HTTPContentDigest {
+	digester := newBodyDigester()
+	digester.write([]byte(body))
+	return getContentDigest(&HTTPProbe{URL: "https://example.com/"}, &httpProbeOutcome{
+		statusCode: statusCode,
+		finalURL:   "https://example.com/",
+		header:     header,
+		digester:   digester,
+	})
+}
+
+func TestAnalyzeHTTPDivergence(t *testing.T) {
+	var sb strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&sb, "<p>paragraph %d of the article</p>\n", i)
+	}
+	page := sb.String()
+	header := http.Header{"Content-Type": {"text/html"}, "Date": {"Mon, 01 Jan 2024 00:00:00 GMT"}}
+	digests := map[string]*HTTPContentDigest{
+		"agent1": getTestDigest(200, page, header),
+		"agent2": getTestDigest(200, page, http.Header{"Content-Type": {"text/html"}, "Date": {"Tue, 02 Jan 2024 00:00:00 GMT"}}),
+		"agent3": getTestDigest(200, page+"<script>injected()</script>", http.Header{"Content-Type": {"text/html"}, "Via": {"1.1 proxy"}}),
+		"agent4": getTestDigest(403, "access to this site is blocked", header),
+	}
+
+	report := AnalyzeHTTPDivergence("corr1", digests)
+	if !report.Divergent || len(report.Clusters) != 3 {
+		t.Fatalf("expected 3 clusters, got %+v", report.Clusters)
+	}
+	if len(report.Clusters[0].Agents) != 2 || report.Clusters[0].Agents[0] != "agent1" {
+		t.Fatalf("expected agent1 and agent2 to be the majority, got %+v", report.Clusters[0])
+	}
+	if len(report.Outliers) != 2 {
+		t.Fatalf("expected 2 outliers, got %+v", report.Outliers)
+	}
+
+	injected, blocked := report.Outliers[0], report.Outliers[1]
+	if injected.Agent != "agent3" || injected.Similarity < 0.8 || injected.Similarity == 1 {
+		t.Fatalf("expected the injected page to be similar but not identical, got %+v", injected)
+	}
+	if len(injected.DifferingHeaders) != 1 || injected.DifferingHeaders[0].Name != "Via" {
+		t.Fatalf("expected only Via to differ, got %+v", injected.DifferingHeaders)
+	}
+	if blocked.Agent != "agent4" || blocked.Similarity >= injected.Similarity || len(blocked.Reasons) != 2 {
+		t.Fatalf("unexpected outlier of the block page: %+v", blocked)
+	}
+
+	delete(digests, "agent3")
+	delete(digests, "agent4")
+	if report := AnalyzeHTTPDivergence("corr1", digests); report.Divergent || len(report.Outliers) > 0 {
+		t.Fatalf("expected no divergence, got %+v", report)
+	}
+}
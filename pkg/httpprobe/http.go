@@ -1,15 +1,20 @@
 package httpprobe
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
@@ -67,9 +72,21 @@ type TransportEvent struct {
 }
 
 type Event struct {
-	Transport     *TransportEvent `json:"transport,omitempty"`
-	Error         string          `json:"error,omitempty"`
-	CorrelationID string          `json:"correlationId"`
+	Transport *TransportEvent `json:"transport,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	// emitted once the response of an HTTPS request arrives
+	TLS *TLSInspection `json:"tls,omitempty"`
+	// emitted at the end of a probe which got redirected
+	Redirects *HTTPRedirectChain `json:"redirects,omitempty"`
+	// emitted once at the end of every probe
+	Timing *HTTPTiming `json:"timing,omitempty"`
+	// emitted after the timing when the probe has assertions
+	Verdict *HTTPVerdict `json:"verdict,omitempty"`
+	// the only event of a probe with CompareProtos
+	ProtoComparison *HTTPProtoComparison `json:"protoComparison,omitempty"`
+	// emitted after the timing when the probe has BodyDigest
+	Content       *HTTPContentDigest `json:"content,omitempty"`
+	CorrelationID string             `json:"correlationId"`
 }
 
 func (e *TransportEvent) String() string {
@@ -83,35 +100,62 @@ type loggingTransport struct {
 	errChan             <-chan error
 	headerFieldsLimit   *int
 	logger              *Logger
+	tlsVerifier         *tlsVerifier
 }
 
 const maxHeaderFieldSize = 4 * 1024
 
 type Logger struct {
-	evChan chan<- TransportEvent
+	evChan chan<- Event
+
+	// a dial might outlive the request it's for, e.g. the one of h3 once the context is done,
+	// what it logs after the close is dropped
+	lock   sync.Mutex
+	closed bool
 }
 
-func NewLogger(evChan chan<- TransportEvent) *Logger {
+func NewLogger(evChan chan<- Event) *Logger {
 	return &Logger{
 		evChan: evChan,
 	}
 }
 
 func (lg *Logger) Close() {
+	lg.lock.Lock()
+	defer lg.lock.Unlock()
+	lg.closed = true
 	close(lg.evChan)
 }
 
+// Log discards the event when the logger is nil, e.g. when dialing for a TLS scan
 func (lg *Logger) Log(Type TransportEventType, Name TransportEventName, Value string) {
-	lg.evChan <- TransportEvent{
-		Type:  Type,
-		Name:  Name,
-		Value: Value,
-		Date:  time.Now(),
+	if lg == nil {
+		return
+	}
+	lg.Report(Event{
+		Transport: &TransportEvent{
+			Type:  Type,
+			Name:  Name,
+			Value: Value,
+			Date:  time.Now(),
+		},
+	})
+}
+
+// Report emits a structured event, e.g. the TLS inspection result, in order with the transport events
+func (lg *Logger) Report(ev Event) {
+	lg.lock.Lock()
+	defer lg.lock.Unlock()
+	if lg.closed {
+		return
 	}
+	lg.evChan <- ev
 }
 
 // RoundTrip implements the http.RoundTripper interface
 func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.tlsVerifier.setHost(req.URL.Hostname())
+
 	// 1. Log Request Line: Method, URL, and Protocol
 	t.logger.Log(TransportEventTypeRequest, TransportEventNameMethod, req.Method)
 	t.logger.Log(TransportEventTypeRequest, TransportEventNameURL, req.URL.String())
@@ -163,6 +207,9 @@ func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error)
 
 const defaultBufSize = 1024
 
+// body assertions only look at that much of the body even if there is no SizeLimit
+const maxAssertionBodySize = 1024 * 1024
+
 type HTTPProto string
 
 const (
@@ -217,30 +264,87 @@ func doDNSLookup(ctx context.Context, logger *Logger, resolver *net.Resolver, ne
 	return reJoinedAddr, nil
 }
 
-func getHTTP3Transport(logger *Logger, resolver *net.Resolver, pref *InetFamilyPreference, addCA []string) (*quicHTTP3.Transport, error) {
-	tr := &quicHTTP3.Transport{}
+// tlsVerifier verifies the handshakes of a probe by itself, a failing chain never aborts the handshake, it's only recorded,
+// so that it's still reported if the request fails afterwards. The requests of a probe, the redirected ones included,
+// are sequential, so the host of the current request is the one to verify against.
+type tlsVerifier struct {
+	// nil means the system's pool
+	roots *x509.CertPool
+
+	mu   sync.Mutex
+	host string
+	// the inspection of the last handshake failing the verification, if any
+	failed *TLSInspection
+}
 
-	if len(addCA) > 0 {
-		caPool, err := pkgutils.GetExtendedCAPool(addCA)
-		if err != nil {
-			return nil, err
-		}
-		tr.TLSClientConfig = &tls.Config{
-			RootCAs: caPool,
-		}
+func (v *tlsVerifier) setHost(host string) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.host = host
+}
+
+func (v *tlsVerifier) getFailed() *TLSInspection {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.failed
+}
+
+func (v *tlsVerifier) verifyConnection(state tls.ConnectionState) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	serverName := state.ServerName
+	if serverName == "" {
+		// no SNI is sent to an IP address
+		serverName = v.host
+	}
+	if inspection := inspectTLS(&state, serverName, v.roots, time.Now()); !inspection.Verified {
+		v.failed = inspection
+	}
+	return nil
+}
+
+func (v *tlsVerifier) getTLSConfig() *tls.Config {
+	return &tls.Config{
+		// it's verifyConnection that verifies the chain, and the TLS event that reports the result
+		InsecureSkipVerify: true,
+		RootCAs:            v.roots,
+		VerifyConnection:   v.verifyConnection,
+	}
+}
+
+// altAddrs maps the host:port of an origin to the one to dial instead, the request, hence the SNI and the :authority, is left untouched
+func getHTTP3Transport(logger *Logger, resolver *net.Resolver, pref *InetFamilyPreference, tlsConfig *tls.Config, altAddrs map[string]string) (*quicHTTP3.Transport, error) {
+	tr := &quicHTTP3.Transport{
+		TLSClientConfig: tlsConfig,
 	}
 
 	dialFunc := func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quicGo.Config) (*quicGo.Conn, error) {
 		nw := "quic"
 
-		resolvedAddr, err := doDNSLookup(ctx, logger, resolver, nw, addr, pref)
+		dialAddr := addr
+		if altAddr, ok := altAddrs[addr]; ok {
+			dialAddr = altAddr
+		}
+
+		resolvedAddr, err := doDNSLookup(ctx, logger, resolver, nw, dialAddr, pref)
 		if err != nil {
 			return nil, err
 		}
 
-		logger.Log(TransportEventTypeConnection, TransportEventNameDialStarted, fmt.Sprintf("network=%s,addr=%s,resolvedAddr=%s", nw, addr, resolvedAddr))
+		logger.Log(TransportEventTypeConnection, TransportEventNameDialStarted, fmt.Sprintf("network=%s,addr=%s,dialAddr=%s,resolvedAddr=%s", nw, addr, dialAddr, resolvedAddr))
 
+		// there is no net.Dialer involved, so the connect phase, which also covers the handshake, is traced by ourselves
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.ConnectStart != nil {
+			trace.ConnectStart(nw, resolvedAddr)
+		}
 		conn, err := quicGo.DialAddr(ctx, resolvedAddr, tlsCfg, cfg)
+		if trace != nil && trace.ConnectDone != nil {
+			trace.ConnectDone(nw, resolvedAddr, err)
+		}
 		if err != nil {
 			logger.Log(TransportEventTypeConnection, TransportEventNameDialError, err.Error())
 		} else {
@@ -253,7 +357,7 @@ func getHTTP3Transport(logger *Logger, resolver *net.Resolver, pref *InetFamilyP
 	return tr, nil
 }
 
-func getTransport(httpProto HTTPProto, logger *Logger, resolver *net.Resolver, pref *InetFamilyPreference, addCA []string) (http.RoundTripper, error) {
+func getTransport(httpProto HTTPProto, logger *Logger, resolver *net.Resolver, pref *InetFamilyPreference, tlsConfig *tls.Config, altAddrs map[string]string) (http.RoundTripper, error) {
 	// Clone the system's default transport
 	defaultTransport, ok := http.DefaultTransport.(*http.Transport)
 	if !ok {
@@ -291,16 +395,8 @@ func getTransport(httpProto HTTPProto, logger *Logger, resolver *net.Resolver, p
 		return conn, err
 	}
 
-	defaultTransport.TLSClientConfig = &tls.Config{
-		NextProtos: []string{"http/1.1"},
-	}
-	if len(addCA) > 0 {
-		caPool, err := pkgutils.GetExtendedCAPool(addCA)
-		if err != nil {
-			return nil, err
-		}
-		defaultTransport.TLSClientConfig.RootCAs = caPool
-	}
+	defaultTransport.TLSClientConfig = tlsConfig.Clone()
+	defaultTransport.TLSClientConfig.NextProtos = []string{"http/1.1"}
 
 	defaultTransport.Protocols.SetHTTP1(false)
 	defaultTransport.Protocols.SetHTTP2(false)
@@ -316,7 +412,7 @@ func getTransport(httpProto HTTPProto, logger *Logger, resolver *net.Resolver, p
 		defaultTransport.ForceAttemptHTTP2 = true
 		defaultTransport.TLSClientConfig.NextProtos = []string{"h2"}
 	case HTTPProtoHTTP3:
-		return getHTTP3Transport(logger, resolver, pref, addCA)
+		return getHTTP3Transport(logger, resolver, pref, tlsConfig, altAddrs)
 	default:
 		panic("Invalid HTTP protocol")
 	}
@@ -338,6 +434,14 @@ type HTTPProbe struct {
 	// A dictionary of string slices, e.g. { "X-Forwarded-For": ["127.0.0.1"], "X-Real-IP": ["127.0.0.1"] }
 	ExtraHeaders http.Header `json:"extraHeaders,omitempty"`
 
+	// Acceptable values are listed in GetAcceptableHTTPMethods, default is 'GET'.
+	Method string `json:"method,omitempty"`
+
+	// The request body, either as is, or base64 encoded for binary data, at most one of them could be present.
+	// The Content-Type header, if needed, should be set in ExtraHeaders.
+	Body       *string `json:"body,omitempty"`
+	BodyBase64 *string `json:"bodyBase64,omitempty"`
+
 	// Acceptable values: 'http/1.1', 'http/2', 'http/3', default is 'http/1.1'.
 	Proto *HTTPProto `json:"proto,omitempty"`
 
@@ -361,8 +465,34 @@ type HTTPProbe struct {
 	// A (agent_id, correlation_id) tuple uniquely identifies a http probing event stream in the global scope.
 	CorrelationID string `json:"correlationId,omitempty"`
 
+	// When true, the URL is fetched over each of 'http/1.1', 'http/2' and 'http/3', regardless of Proto,
+	// and instead of the events of each fetch, only a comparison event is emitted.
+	CompareProtos bool `json:"compareProtos,omitempty"`
+
+	// The maximum number of redirects to follow, default is 10, 0 means not following any redirect.
+	MaxRedirects *int `json:"maxRedirects,omitempty"`
+
+	// When present, a verdict event is emitted at the end of the probe, see HTTPAssertions
+	Assertions *HTTPAssertions `json:"assertions,omitempty"`
+
+	// When true, a content event carrying the hash of the body read, the status, the final url and the headers
+	// is emitted at the end of the probe, it's what the hub compares the responses of different agents with.
+	BodyDigest bool `json:"bodyDigest,omitempty"`
+
+	// A certificate failing the verification never aborts the probe, it's reported in the TLS event along with the
+	// verification error, and fails the verdict of the assertions, if any, unless this is true.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+
 	// list of paths to additional CAs to trust in addition to the system's default CAs
 	AddCA []string
+
+	// Tells if the probe is allowed to connect to host through resolver, it's what a host the target itself points to,
+	// e.g. the alternative authority of the protocol comparison, is checked with, nil allows any
+	CheckHost func(ctx context.Context, host string, resolver *string, pref *InetFamilyPreference) error `json:"-"`
+
+	// set by the protocol comparison, the h3 connection to an origin listed here is dialed at the alternative authority
+	// advertised in its Alt-Svc, while the URL, the SNI and the certificate name stay those of the origin (RFC 7838 section 2)
+	altAddrs map[string]string
 }
 
 func (probe *HTTPProbe) Do(ctx context.Context) <-chan Event {
@@ -370,8 +500,41 @@ func (probe *HTTPProbe) Do(ctx context.Context) <-chan Event {
 	outEVChan := make(chan Event)
 
 	go func(ctx context.Context) {
-		eventChan, errChan := sendRequest(ctx, *probe)
+		if probe.CompareProtos {
+			defer close(outEVChan)
+			outEVChan <- Event{
+				ProtoComparison: compareProtos(ctx, *probe),
+				CorrelationID:   probe.CorrelationID,
+			}
+			return
+		}
+
+		recorder := newTimingRecorder()
+		outcome := &httpProbeOutcome{insecureSkipVerify: probe.InsecureSkipVerify}
+		if probe.BodyDigest {
+			outcome.digester = newBodyDigester()
+		}
+		eventChan, errChan := sendRequest(ctx, *probe, recorder, outcome)
 		defer close(outEVChan)
+		defer func() {
+			timing := recorder.getTiming()
+			outEVChan <- Event{
+				Timing:        &timing,
+				CorrelationID: probe.CorrelationID,
+			}
+			if probe.Assertions != nil {
+				outEVChan <- Event{
+					Verdict:       probe.Assertions.evaluate(outcome, timing.Total),
+					CorrelationID: probe.CorrelationID,
+				}
+			}
+			if probe.BodyDigest {
+				outEVChan <- Event{
+					Content:       getContentDigest(probe, outcome),
+					CorrelationID: probe.CorrelationID,
+				}
+			}
+		}()
 
 		for {
 			select {
@@ -379,10 +542,8 @@ func (probe *HTTPProbe) Do(ctx context.Context) <-chan Event {
 				if !ok {
 					return
 				}
-				outEVChan <- Event{
-					Transport:     &ev,
-					CorrelationID: probe.CorrelationID,
-				}
+				ev.CorrelationID = probe.CorrelationID
+				outEVChan <- ev
 			case err, ok := <-errChan:
 				if !ok {
 					return
@@ -398,7 +559,8 @@ func (probe *HTTPProbe) Do(ctx context.Context) <-chan Event {
 	return outEVChan
 }
 
-func sendRequest(ctx context.Context, probe HTTPProbe) (<-chan TransportEvent, <-chan error) {
+// The outcome is filled for evaluating the assertions, it's complete once the returned channels are closed
+func sendRequest(ctx context.Context, probe HTTPProbe, recorder *timingRecorder, outcome *httpProbeOutcome) (<-chan Event, <-chan error) {
 	url := probe.URL
 	extraHeaders := probe.ExtraHeaders
 	var httpProto HTTPProto = HTTPProtoHTTP1
@@ -406,7 +568,7 @@ func sendRequest(ctx context.Context, probe HTTPProbe) (<-chan TransportEvent, <
 		httpProto = *probe.Proto
 	}
 
-	eventChan := make(chan TransportEvent)
+	eventChan := make(chan Event)
 	errChan := make(chan error)
 
 	go func(ctx context.Context) {
@@ -416,9 +578,42 @@ func sendRequest(ctx context.Context, probe HTTPProbe) (<-chan TransportEvent, <
 		logger := NewLogger(eventChan)
 		defer logger.Close()
 
-		defaultTransport, err := getTransport(httpProto, logger, pkgutils.NewCustomResolver(probe.Resolver, 10*time.Second), probe.IPPref, probe.AddCA)
-		if err != nil {
+		fail := func(err error) {
+			outcome.err = err
 			errChan <- err
+		}
+
+		if probe.Assertions != nil {
+			if err := probe.Assertions.Validate(); err != nil {
+				fail(err)
+				return
+			}
+		}
+
+		maxRedirects := defaultMaxRedirects
+		if probe.MaxRedirects != nil {
+			maxRedirects = *probe.MaxRedirects
+		}
+		if maxRedirects < 0 || maxRedirects > maxMaxRedirects {
+			fail(fmt.Errorf("max redirects must be within 0 and %d, got %d", maxMaxRedirects, maxRedirects))
+			return
+		}
+
+		// nil means the system's pool
+		var rootCAs *x509.CertPool
+		if len(probe.AddCA) > 0 {
+			caPool, err := pkgutils.GetExtendedCAPool(probe.AddCA)
+			if err != nil {
+				fail(err)
+				return
+			}
+			rootCAs = caPool
+		}
+
+		verifier := &tlsVerifier{roots: rootCAs}
+		defaultTransport, err := getTransport(httpProto, logger, pkgutils.NewCustomResolver(probe.Resolver, 10*time.Second), probe.IPPref, verifier.getTLSConfig(), probe.altAddrs)
+		if err != nil {
+			fail(err)
 			return
 		}
 
@@ -427,25 +622,56 @@ func sendRequest(ctx context.Context, probe HTTPProbe) (<-chan TransportEvent, <
 			errChan:             errChan,
 			headerFieldsLimit:   probe.NumHeadersFieldsLimit,
 			logger:              logger,
+			tlsVerifier:         verifier,
 		}
 
 		// Create a client using the custom transport
+		redirectChain := &HTTPRedirectChain{Hops: make([]HTTPRedirectHop, 0)}
 		client := &http.Client{
-			Transport: customTransport,
-			Timeout:   10 * time.Second,
+			Transport:     customTransport,
+			Timeout:       10 * time.Second,
+			CheckRedirect: getCheckRedirectFunc(redirectChain, recorder, maxRedirects),
+		}
+
+		if err := probe.ValidateRequest(); err != nil {
+			fail(err)
+			return
+		}
+		reqBody, _ := probe.GetRequestBody()
+		var reqBodyReader io.Reader
+		if reqBody != nil {
+			// so that the body could be sent again when redirected with 307 or 308
+			reqBodyReader = bytes.NewReader(reqBody)
 		}
 
-		// Test request
-		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, recorder.getClientTrace()), probe.GetMethod(), url, reqBodyReader)
+		if err != nil {
+			fail(fmt.Errorf("failed to create http request: %w", err))
+			return
+		}
 		if extraHeaders != nil {
 			req.Header = extraHeaders
 		}
 
 		resp, err := client.Do(req)
 		if err != nil {
-			errChan <- err
+			if inspection := verifier.getFailed(); inspection != nil {
+				outcome.tls = inspection
+				logger.Report(Event{TLS: inspection})
+			}
+			fail(err)
 			return
 		}
+		defer resp.Body.Close()
+		outcome.proto = resp.Proto
+		outcome.statusCode = resp.StatusCode
+		outcome.header = resp.Header
+		outcome.finalURL = resp.Request.URL.String()
+
+		if resp.TLS != nil {
+			outcome.tls = inspectTLS(resp.TLS, resp.Request.URL.Hostname(), rootCAs, time.Now())
+			logger.Report(Event{TLS: outcome.tls})
+		}
 
 		logger.Log(TransportEventTypeMetadata, TransportEventNameBodyStart, "---- Start Response Body ----")
 		var sizeLimit int64 = 0
@@ -466,21 +692,37 @@ func sendRequest(ctx context.Context, probe HTTPProbe) (<-chan TransportEvent, <
 			}
 			buf := make([]byte, bufSize)
 			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				logger.Log(TransportEventTypeResponse, TransportEventNameBodyChunkBase64, base64.StdEncoding.EncodeToString(buf[:n]))
+				if probe.Assertions != nil && probe.Assertions.needsBody() && outcome.body.Len() < maxAssertionBodySize {
+					outcome.body.Write(buf[:min(n, maxAssertionBodySize-outcome.body.Len())])
+				}
+				if outcome.digester != nil {
+					outcome.digester.write(buf[:n])
+				}
+			}
+			bodyBytesRead += int64(n)
 			if err != nil {
 				break
 			}
 
-			logger.Log(TransportEventTypeResponse, TransportEventNameBodyChunkBase64, base64.StdEncoding.EncodeToString(buf[:n]))
-
-			bodyBytesRead += int64(n)
 			if probe.SizeLimit != nil && bodyBytesRead >= sizeLimit {
 				logger.Log(TransportEventTypeResponse, TransportEventNameBodyReadTruncated, fmt.Sprintf("read=%d,limit=%d", bodyBytesRead, sizeLimit))
+				if outcome.digester != nil {
+					outcome.digester.truncated = true
+				}
 				break
 			}
 		}
+		recorder.markBodyDone()
 		logger.Log(TransportEventTypeResponse, TransportEventNameBodyEnd, "---- End Response Body ----")
 		logger.Log(TransportEventTypeResponse, TransportEventNameBodyBytesRead, strconv.FormatInt(bodyBytesRead, 10))
 
+		if len(redirectChain.Hops) > 0 {
+			finishRedirectChain(redirectChain, resp, recorder.getTiming())
+			logger.Report(Event{Redirects: redirectChain})
+		}
+
 	}(ctx)
 
 	return eventChan, errChan
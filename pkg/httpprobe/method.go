@@ -0,0 +1,64 @@
+package httpprobe
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// The hard limit of the request body an agent would send, the hub might clamp it further
+const MaxRequestBodySize = 64 * 1024
+
+// CONNECT and TRACE are left out on purpose
+func GetAcceptableHTTPMethods() []string {
+	return []string{
+		http.MethodGet,
+		http.MethodHead,
+		http.MethodPost,
+		http.MethodPut,
+		http.MethodPatch,
+		http.MethodDelete,
+		http.MethodOptions,
+	}
+}
+
+func (probe *HTTPProbe) GetMethod() string {
+	if probe.Method == "" {
+		return http.MethodGet
+	}
+	return strings.ToUpper(probe.Method)
+}
+
+// GetRequestBody returns nil when the probe has no body, Body and BodyBase64 are mutually exclusive.
+func (probe *HTTPProbe) GetRequestBody() ([]byte, error) {
+	if probe.Body != nil && probe.BodyBase64 != nil {
+		return nil, fmt.Errorf("body and bodyBase64 can't be both present")
+	}
+	var body []byte
+	if probe.Body != nil {
+		body = []byte(*probe.Body)
+	} else if probe.BodyBase64 != nil {
+		decoded, err := base64.StdEncoding.DecodeString(*probe.BodyBase64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64 body: %w", err)
+		}
+		body = decoded
+	} else {
+		return nil, nil
+	}
+	if len(body) > MaxRequestBodySize {
+		return nil, fmt.Errorf("request body of %d bytes exceeds the limit of %d bytes", len(body), MaxRequestBodySize)
+	}
+	return body, nil
+}
+
+// ValidateRequest checks the method and the body of the request to send
+func (probe *HTTPProbe) ValidateRequest() error {
+	if method := probe.GetMethod(); !slices.Contains(GetAcceptableHTTPMethods(), method) {
+		return fmt.Errorf("unacceptable http method: %s, allowed values are: %s", method, strings.Join(GetAcceptableHTTPMethods(), ", "))
+	}
+	_, err := probe.GetRequestBody()
+	return err
+}
@@ -0,0 +1,37 @@
+package httpprobe
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRequest(t *testing.T) {
+	inline := "{}"
+	encoded := "AAEC"
+	invalidBase64 := "!!"
+	tooLarge := strings.Repeat("x", MaxRequestBodySize+1)
+
+	probe := &HTTPProbe{Method: "options"}
+	if err := probe.ValidateRequest(); err != nil || probe.GetMethod() != "OPTIONS" {
+		t.Fatalf("expected OPTIONS to be valid, got %v", err)
+	}
+	if method := (&HTTPProbe{}).GetMethod(); method != "GET" {
+		t.Fatalf("expected GET by default, got %s", method)
+	}
+
+	probe = &HTTPProbe{Method: "POST", BodyBase64: &encoded}
+	if body, err := probe.GetRequestBody(); err != nil || string(body) != "\x00\x01\x02" {
+		t.Fatalf("unexpected body %v, %v", body, err)
+	}
+
+	for _, invalid := range []*HTTPProbe{
+		{Method: "CONNECT"},
+		{Method: "POST", Body: &inline, BodyBase64: &encoded},
+		{Method: "POST", BodyBase64: &invalidBase64},
+		{Method: "POST", Body: &tooLarge},
+	} {
+		if err := invalid.ValidateRequest(); err == nil {
+			t.Fatalf("expected %s to be invalid", invalid.Method)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package httpprobe
+
+import (
+	"net/http"
+)
+
+const (
+	// Same as what the http.Client does by default
+	defaultMaxRedirects = 10
+	maxMaxRedirects     = 30
+)
+
+type HTTPRedirectHop struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status_code"`
+	Location   string `json:"location,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// HTTPS to HTTP
+	Downgrade bool       `json:"downgrade,omitempty"`
+	Timing    HTTPTiming `json:"timing"`
+}
+
+// HTTPRedirectChain is emitted at the end of a probe which got redirected at least once,
+// the last hop is the response that's finally read.
+type HTTPRedirectChain struct {
+	Hops         []HTTPRedirectHop `json:"hops"`
+	NumRedirects int               `json:"num_redirects"`
+	FinalURL     string            `json:"final_url"`
+	Loop         bool              `json:"loop"`
+	Downgrade    bool              `json:"downgrade"`
+	// the chain was cut short by MaxRedirects, so the last hop is still a redirect
+	MaxRedirectsReached bool `json:"max_redirects_reached"`
+}
+
+func newRedirectHop(resp *http.Response, timing HTTPTiming) HTTPRedirectHop {
+	return HTTPRedirectHop{
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Location:   resp.Header.Get("Location"),
+		RemoteAddr: timing.RemoteAddr,
+		Timing:     timing,
+	}
+}
+
+// getCheckRedirectFunc stops following at a loop, or once maxRedirects redirects have been followed,
+// in either case, the redirect response itself is what the probe ends up with.
+func getCheckRedirectFunc(chain *HTTPRedirectChain, recorder *timingRecorder, maxRedirects int) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		hop := newRedirectHop(req.Response, recorder.getTiming())
+		if req.Response.Request.URL.Scheme == "https" && req.URL.Scheme == "http" {
+			hop.Downgrade = true
+			chain.Downgrade = true
+		}
+		chain.Hops = append(chain.Hops, hop)
+
+		for _, prev := range via {
+			if prev.URL.String() == req.URL.String() {
+				chain.Loop = true
+				return http.ErrUseLastResponse
+			}
+		}
+		if len(via) > maxRedirects {
+			chain.MaxRedirectsReached = true
+			return http.ErrUseLastResponse
+		}
+		chain.NumRedirects++
+		return nil
+	}
+}
+
+// completes the chain with the final response, the last hop is already there if the chain was cut short
+func finishRedirectChain(chain *HTTPRedirectChain, resp *http.Response, timing HTTPTiming) {
+	if chain.Loop || chain.MaxRedirectsReached {
+		if len(chain.Hops) > 0 {
+			chain.Hops[len(chain.Hops)-1].Timing = timing
+		}
+	} else {
+		chain.Hops = append(chain.Hops, newRedirectHop(resp, timing))
+	}
+	chain.FinalURL = resp.Request.URL.String()
+}
@@ -0,0 +1,54 @@
+package httpprobe
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func newTestRedirect(t *testing.T, from string, statusCode int, to string) *http.Request {
+	fromURL, err := url.Parse(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toURL, err := url.Parse(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Request{
+		URL: toURL,
+		Response: &http.Response{
+			StatusCode: statusCode,
+			Header:     http.Header{"Location": []string{to}},
+			Request:    &http.Request{URL: fromURL},
+		},
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	chain := &HTTPRedirectChain{}
+	checkRedirect := getCheckRedirectFunc(chain, newTimingRecorder(), 1)
+
+	first := newTestRedirect(t, "https://example.com/", http.StatusMovedPermanently, "http://example.com/a")
+	if err := checkRedirect(first, []*http.Request{first.Response.Request}); err != nil {
+		t.Fatalf("expected to follow the first redirect, got %v", err)
+	}
+	if !chain.Downgrade || !chain.Hops[0].Downgrade || chain.NumRedirects != 1 {
+		t.Fatalf("expected a downgrade, got %+v", chain)
+	}
+
+	second := newTestRedirect(t, "http://example.com/a", http.StatusFound, "http://example.com/b")
+	if err := checkRedirect(second, []*http.Request{first.Response.Request, first}); err != http.ErrUseLastResponse {
+		t.Fatalf("expected to stop at max redirects, got %v", err)
+	}
+	if !chain.MaxRedirectsReached || chain.Loop || len(chain.Hops) != 2 || chain.Hops[1].Location != "http://example.com/b" {
+		t.Fatalf("unexpected chain: %+v", chain)
+	}
+
+	chain = &HTTPRedirectChain{}
+	checkRedirect = getCheckRedirectFunc(chain, newTimingRecorder(), defaultMaxRedirects)
+	loop := newTestRedirect(t, "http://example.com/a", http.StatusFound, "http://example.com/")
+	if err := checkRedirect(loop, []*http.Request{{URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/"}}, loop.Response.Request}); err != http.ErrUseLastResponse || !chain.Loop {
+		t.Fatalf("expected a loop, got %v, %+v", err, chain)
+	}
+}
@@ -0,0 +1,192 @@
+package httpprobe
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+type HTTPTimingPhaseName string
+
+const (
+	HTTPTimingPhaseDNSLookup       HTTPTimingPhaseName = "dns-lookup"
+	HTTPTimingPhaseConnect         HTTPTimingPhaseName = "connect"
+	HTTPTimingPhaseTLSHandshake    HTTPTimingPhaseName = "tls-handshake"
+	HTTPTimingPhaseRequest         HTTPTimingPhaseName = "request"
+	HTTPTimingPhaseWaiting         HTTPTimingPhaseName = "waiting"
+	HTTPTimingPhaseContentTransfer HTTPTimingPhaseName = "content-transfer"
+)
+
+// A phase starts at StartedAt+Offset, it's for drawing the waterfall
+type HTTPTimingPhase struct {
+	Name     HTTPTimingPhaseName `json:"name"`
+	Offset   time.Duration       `json:"offset"`
+	Duration time.Duration       `json:"duration"`
+}
+
+// HTTPTiming is the per-phase breakdown of an HTTP probe, when the request got redirected,
+// only the phases of the last request are kept, but Total still counts from the very beginning.
+type HTTPTiming struct {
+	StartedAt time.Time `json:"started_at"`
+
+	DNSLookup    time.Duration `json:"dns_lookup,omitempty"`
+	Connect      time.Duration `json:"connect,omitempty"`
+	TLSHandshake time.Duration `json:"tls_handshake,omitempty"`
+	// from the request being fully written to the first byte of the response
+	TimeToFirstByte time.Duration `json:"ttfb,omitempty"`
+	ContentTransfer time.Duration `json:"content_transfer,omitempty"`
+	Total           time.Duration `json:"total"`
+
+	ConnReused   bool          `json:"conn_reused"`
+	ConnWasIdle  bool          `json:"conn_was_idle,omitempty"`
+	ConnIdleTime time.Duration `json:"conn_idle_time,omitempty"`
+	RemoteAddr   string        `json:"remote_addr,omitempty"`
+	LocalAddr    string        `json:"local_addr,omitempty"`
+	TLSVersion   string        `json:"tls_version,omitempty"`
+
+	Phases []HTTPTimingPhase `json:"phases"`
+}
+
+type timingRecorder struct {
+	lock      sync.Mutex
+	startedAt time.Time
+	timingMarks
+}
+
+// what are reset when a new round starts
+type timingMarks struct {
+	dnsInProgress bool
+	dnsStart      time.Time
+	dnsDone       time.Time
+	connectStart  time.Time
+	connectDone   time.Time
+	tlsStart      time.Time
+	tlsDone       time.Time
+	gotConn       time.Time
+	wroteRequest  time.Time
+	firstByte     time.Time
+	bodyDone      time.Time
+
+	connInfo    httptrace.GotConnInfo
+	connectAddr string
+	tlsVersion  uint16
+}
+
+func newTimingRecorder() *timingRecorder {
+	return &timingRecorder{startedAt: time.Now()}
+}
+
+func (r *timingRecorder) mark(f func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f()
+}
+
+func (r *timingRecorder) getClientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			r.mark(func() {
+				// a new round, e.g. following a redirect
+				r.timingMarks = timingMarks{}
+			})
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			r.mark(func() {
+				r.dnsInProgress = true
+				r.dnsStart = time.Now()
+			})
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			r.mark(func() {
+				r.dnsInProgress = false
+				r.dnsDone = time.Now()
+			})
+		},
+		ConnectStart: func(network, addr string) {
+			r.mark(func() {
+				// the resolver might also connect to the name server, which is not what we are interested in
+				if !r.dnsInProgress && r.connectStart.IsZero() {
+					r.connectStart = time.Now()
+				}
+			})
+		},
+		ConnectDone: func(network, addr string, err error) {
+			r.mark(func() {
+				if !r.dnsInProgress && err == nil {
+					r.connectDone = time.Now()
+					r.connectAddr = addr
+				}
+			})
+		},
+		TLSHandshakeStart: func() {
+			r.mark(func() { r.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			r.mark(func() {
+				r.tlsDone = time.Now()
+				r.tlsVersion = state.Version
+			})
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.mark(func() {
+				r.gotConn = time.Now()
+				r.connInfo = info
+			})
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			r.mark(func() { r.wroteRequest = time.Now() })
+		},
+		GotFirstResponseByte: func() {
+			r.mark(func() { r.firstByte = time.Now() })
+		},
+	}
+}
+
+func (r *timingRecorder) markBodyDone() {
+	r.mark(func() { r.bodyDone = time.Now() })
+}
+
+func (r *timingRecorder) getTiming() HTTPTiming {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	timing := HTTPTiming{
+		StartedAt:    r.startedAt,
+		Total:        time.Since(r.startedAt),
+		ConnReused:   r.connInfo.Reused,
+		ConnWasIdle:  r.connInfo.WasIdle,
+		ConnIdleTime: r.connInfo.IdleTime,
+		RemoteAddr:   r.connectAddr,
+		Phases:       make([]HTTPTimingPhase, 0),
+	}
+	if r.connInfo.Conn != nil {
+		timing.RemoteAddr = r.connInfo.Conn.RemoteAddr().String()
+		timing.LocalAddr = r.connInfo.Conn.LocalAddr().String()
+	}
+	if r.tlsVersion != 0 {
+		timing.TLSVersion = tls.VersionName(r.tlsVersion)
+	}
+	if !r.bodyDone.IsZero() {
+		timing.Total = r.bodyDone.Sub(r.startedAt)
+	}
+
+	addPhase := func(name HTTPTimingPhaseName, start, end time.Time) time.Duration {
+		if start.IsZero() || end.IsZero() || end.Before(start) {
+			return 0
+		}
+		timing.Phases = append(timing.Phases, HTTPTimingPhase{
+			Name:     name,
+			Offset:   start.Sub(r.startedAt),
+			Duration: end.Sub(start),
+		})
+		return end.Sub(start)
+	}
+	timing.DNSLookup = addPhase(HTTPTimingPhaseDNSLookup, r.dnsStart, r.dnsDone)
+	timing.Connect = addPhase(HTTPTimingPhaseConnect, r.connectStart, r.connectDone)
+	timing.TLSHandshake = addPhase(HTTPTimingPhaseTLSHandshake, r.tlsStart, r.tlsDone)
+	addPhase(HTTPTimingPhaseRequest, r.gotConn, r.wroteRequest)
+	timing.TimeToFirstByte = addPhase(HTTPTimingPhaseWaiting, r.wroteRequest, r.firstByte)
+	timing.ContentTransfer = addPhase(HTTPTimingPhaseContentTransfer, r.firstByte, r.bodyDone)
+	return timing
+}
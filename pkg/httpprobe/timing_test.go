@@ -0,0 +1,118 @@
+package httpprobe
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetTiming(t *testing.T) {
+	startedAt := time.Now()
+	at := func(ms int) time.Time {
+		return startedAt.Add(time.Duration(ms) * time.Millisecond)
+	}
+	recorder := &timingRecorder{startedAt: startedAt}
+	recorder.dnsStart, recorder.dnsDone = at(1), at(11)
+	recorder.connectStart, recorder.connectDone = at(12), at(32)
+	recorder.tlsStart, recorder.tlsDone = at(32), at(72)
+	recorder.gotConn, recorder.wroteRequest = at(72), at(73)
+	recorder.firstByte, recorder.bodyDone = at(123), at(133)
+
+	timing := recorder.getTiming()
+	if timing.DNSLookup != 10*time.Millisecond || timing.Connect != 20*time.Millisecond || timing.TLSHandshake != 40*time.Millisecond {
+		t.Fatalf("unexpected timing: %+v", timing)
+	}
+	if timing.TimeToFirstByte != 50*time.Millisecond || timing.ContentTransfer != 10*time.Millisecond || timing.Total != 133*time.Millisecond {
+		t.Fatalf("unexpected timing: %+v", timing)
+	}
+	if len(timing.Phases) != 6 || timing.Phases[2].Name != HTTPTimingPhaseTLSHandshake || timing.Phases[2].Offset != 32*time.Millisecond {
+		t.Fatalf("unexpected phases: %+v", timing.Phases)
+	}
+
+	// a reused connection has neither dns lookup, connect nor tls handshake
+	recorder.timingMarks = timingMarks{gotConn: at(1), wroteRequest: at(2), firstByte: at(12), bodyDone: at(13)}
+	recorder.connInfo.Reused = true
+	timing = recorder.getTiming()
+	if !timing.ConnReused || len(timing.Phases) != 3 || timing.DNSLookup != 0 {
+		t.Fatalf("unexpected timing of a reused connection: %+v", timing)
+	}
+}
+
+func TestProbeTiming(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caPath, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// by the name rather than the IP address, so that there is a dns lookup
+	urlStr := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	var timing *HTTPTiming
+	probe := HTTPProbe{URL: urlStr, AddCA: []string{caPath}}
+	for ev := range probe.Do(context.Background()) {
+		if ev.Error != "" {
+			t.Fatalf("unexpected error: %s", ev.Error)
+		}
+		if ev.Timing != nil {
+			timing = ev.Timing
+		}
+	}
+	if timing == nil {
+		t.Fatal("expected a timing event")
+	}
+	if timing.ConnReused || timing.TLSVersion == "" || timing.RemoteAddr == "" {
+		t.Fatalf("expected a fresh tls connection, got %+v", timing)
+	}
+
+	expectedPhases := []HTTPTimingPhaseName{
+		HTTPTimingPhaseDNSLookup,
+		HTTPTimingPhaseConnect,
+		HTTPTimingPhaseTLSHandshake,
+		HTTPTimingPhaseRequest,
+		HTTPTimingPhaseWaiting,
+		HTTPTimingPhaseContentTransfer,
+	}
+	if len(timing.Phases) != len(expectedPhases) {
+		t.Fatalf("expected the phases %v, got %+v", expectedPhases, timing.Phases)
+	}
+	var lastEnd time.Duration
+	for i, phase := range timing.Phases {
+		if phase.Name != expectedPhases[i] {
+			t.Errorf("%s: expected phase %d to be %s", phase.Name, i, expectedPhases[i])
+		}
+		if phase.Offset < 0 || phase.Duration < 0 {
+			t.Errorf("%s: expected a non-negative offset and duration, got %+v", phase.Name, phase)
+		}
+		if phase.Offset < lastEnd {
+			t.Errorf("%s: expected to start after the previous phase ended at %v, got %+v", phase.Name, lastEnd, phase)
+		}
+		lastEnd = phase.Offset + phase.Duration
+	}
+	if lastEnd > timing.Total {
+		t.Errorf("expected the phases to end within the total %v, got %v", timing.Total, lastEnd)
+	}
+
+	durations := map[string]time.Duration{
+		"dns lookup":       timing.DNSLookup,
+		"connect":          timing.Connect,
+		"tls handshake":    timing.TLSHandshake,
+		"ttfb":             timing.TimeToFirstByte,
+		"content transfer": timing.ContentTransfer,
+	}
+	for name, d := range durations {
+		if d <= 0 {
+			t.Errorf("%s: expected to be recorded, got %v", name, d)
+		}
+	}
+}
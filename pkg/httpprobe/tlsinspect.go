@@ -0,0 +1,175 @@
+package httpprobe
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type OCSPStatus string
+
+const (
+	OCSPStatusNotStapled OCSPStatus = "not_stapled"
+	OCSPStatusGood       OCSPStatus = "good"
+	OCSPStatusRevoked    OCSPStatus = "revoked"
+	OCSPStatusUnknown    OCSPStatus = "unknown"
+	// the stapled response can't be parsed or doesn't match the leaf certificate
+	OCSPStatusInvalid OCSPStatus = "invalid"
+)
+
+type TLSCertificate struct {
+	Subject           string    `json:"subject"`
+	SANs              []string  `json:"sans,omitempty"`
+	Issuer            string    `json:"issuer"`
+	SerialNumber      string    `json:"serial_number"`
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+	KeyType           string    `json:"key_type"`
+	IsCA              bool      `json:"is_ca"`
+	SHA256Fingerprint string    `json:"sha256_fingerprint"`
+}
+
+// TLSInspection describes the TLS session of the connection the response came from,
+// agents seeing different leaf fingerprints of the same target might be a sign of TLS interception.
+type TLSInspection struct {
+	ServerName  string `json:"server_name,omitempty"`
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ALPN        string `json:"alpn,omitempty"`
+	Resumed     bool   `json:"resumed"`
+
+	OCSPStatus     OCSPStatus `json:"ocsp_status"`
+	OCSPProducedAt *time.Time `json:"ocsp_produced_at,omitempty"`
+
+	// the chain is always inspected, even if it fails the verification
+	Verified    bool   `json:"verified"`
+	VerifyError string `json:"verify_error,omitempty"`
+
+	// of the leaf certificate, negative once expired
+	DaysUntilExpiry  int              `json:"days_until_expiry"`
+	LeafSHA256       string           `json:"leaf_sha256,omitempty"`
+	PeerCertificates []TLSCertificate `json:"peer_certificates"`
+}
+
+func getKeyType(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA-%s", key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
+
+func inspectCertificate(cert *x509.Certificate) TLSCertificate {
+	fingerprint := sha256.Sum256(cert.Raw)
+	sans := make([]string, 0)
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+
+	return TLSCertificate{
+		Subject:           cert.Subject.String(),
+		SANs:              sans,
+		Issuer:            cert.Issuer.String(),
+		SerialNumber:      hex.EncodeToString(cert.SerialNumber.Bytes()),
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+		KeyType:           getKeyType(cert),
+		IsCA:              cert.IsCA,
+		SHA256Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+}
+
+func inspectOCSP(inspection *TLSInspection, state *tls.ConnectionState) {
+	if len(state.OCSPResponse) == 0 || len(state.PeerCertificates) == 0 {
+		inspection.OCSPStatus = OCSPStatusNotStapled
+		return
+	}
+
+	var issuer *x509.Certificate
+	if len(state.PeerCertificates) > 1 {
+		issuer = state.PeerCertificates[1]
+	}
+	resp, err := ocsp.ParseResponseForCert(state.OCSPResponse, state.PeerCertificates[0], issuer)
+	if err != nil {
+		inspection.OCSPStatus = OCSPStatusInvalid
+		return
+	}
+	producedAt := resp.ProducedAt
+	inspection.OCSPProducedAt = &producedAt
+	switch resp.Status {
+	case ocsp.Good:
+		inspection.OCSPStatus = OCSPStatusGood
+	case ocsp.Revoked:
+		inspection.OCSPStatus = OCSPStatusRevoked
+	default:
+		inspection.OCSPStatus = OCSPStatusUnknown
+	}
+}
+
+// inspectTLS verifies the peer certificates against roots by itself, so that a chain failing the verification
+// is still inspected, nil roots means the system's pool, serverName is the host of the request, which might be an IP address.
+func inspectTLS(state *tls.ConnectionState, serverName string, roots *x509.CertPool, now time.Time) *TLSInspection {
+	inspection := &TLSInspection{
+		ServerName:       serverName,
+		Version:          tls.VersionName(state.Version),
+		CipherSuite:      tls.CipherSuiteName(state.CipherSuite),
+		ALPN:             state.NegotiatedProtocol,
+		Resumed:          state.DidResume,
+		PeerCertificates: make([]TLSCertificate, 0),
+	}
+	inspectOCSP(inspection, state)
+
+	if len(state.PeerCertificates) == 0 {
+		inspection.VerifyError = "no peer certificate presented"
+		return inspection
+	}
+	for _, cert := range state.PeerCertificates {
+		inspection.PeerCertificates = append(inspection.PeerCertificates, inspectCertificate(cert))
+	}
+
+	leaf := state.PeerCertificates[0]
+	inspection.LeafSHA256 = inspection.PeerCertificates[0].SHA256Fingerprint
+	// rounded down, so that a certificate expired within a day is at -1 rather than 0
+	inspection.DaysUntilExpiry = int(math.Floor(leaf.NotAfter.Sub(now).Hours() / 24))
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       serverName,
+		CurrentTime:   now,
+	})
+	if err != nil {
+		inspection.VerifyError = err.Error()
+		return inspection
+	}
+	inspection.Verified = true
+	return inspection
+}
+
+// InspectTLS is inspectTLS for the probes outside of this package that do their own handshakes, e.g. the QUIC one
+func InspectTLS(state *tls.ConnectionState, serverName string, roots *x509.CertPool) *TLSInspection {
+	return inspectTLS(state, serverName, roots, time.Now())
+}
@@ -0,0 +1,165 @@
+package httpprobe
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInspectTLS(t *testing.T) {
+	now := time.Now()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "example.com"},
+		DNSNames:              []string{"example.com"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(30*24*time.Hour + time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &tls.ConnectionState{
+		Version:          tls.VersionTLS13,
+		CipherSuite:      tls.TLS_AES_128_GCM_SHA256,
+		PeerCertificates: []*x509.Certificate{cert},
+	}
+
+	inspection := inspectTLS(state, "example.com", x509.NewCertPool(), now)
+	if inspection.Verified || inspection.VerifyError == "" {
+		t.Fatalf("expected a verification error with an empty pool")
+	}
+	if inspection.DaysUntilExpiry != 30 || inspection.OCSPStatus != OCSPStatusNotStapled {
+		t.Fatalf("unexpected inspection: %+v", inspection)
+	}
+	if len(inspection.PeerCertificates) != 1 || inspection.PeerCertificates[0].KeyType != "Ed25519" || inspection.LeafSHA256 != inspection.PeerCertificates[0].SHA256Fingerprint {
+		t.Fatalf("unexpected peer certificates: %+v", inspection.PeerCertificates)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	if inspection := inspectTLS(state, "example.com", roots, now); !inspection.Verified {
+		t.Fatalf("expected to be verified, got %s", inspection.VerifyError)
+	}
+	if inspection := inspectTLS(state, "example.org", roots, now); inspection.Verified {
+		t.Fatalf("expected name mismatch")
+	}
+}
+
+func TestInspectTLS_JustExpired(t *testing.T) {
+	now := time.Now()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    now.Add(-30 * 24 * time.Hour),
+		NotAfter:     now.Add(-23 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inspection := inspectTLS(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, "example.com", nil, now)
+	if inspection.DaysUntilExpiry != -1 {
+		t.Fatalf("expected a certificate expired 23 hours ago to be at -1 day, got %d", inspection.DaysUntilExpiry)
+	}
+
+	minDays := 0
+	outcome := &httpProbeOutcome{statusCode: 200, tls: inspection, insecureSkipVerify: true}
+	if verdict := (&HTTPAssertions{MinDaysUntilExpiry: &minDays}).evaluate(outcome, 0); verdict.Passed {
+		t.Fatalf("expected the expiry assertion to fail")
+	}
+}
+
+// collectProbe runs the probe to the end, and returns the TLS inspection and the errors seen
+func collectProbe(t *testing.T, probe HTTPProbe) (*TLSInspection, []string) {
+	t.Helper()
+	var inspection *TLSInspection
+	errs := make([]string, 0)
+	for ev := range probe.Do(context.Background()) {
+		if ev.TLS != nil {
+			inspection = ev.TLS
+		}
+		if ev.Error != "" {
+			errs = append(errs, ev.Error)
+		}
+	}
+	return inspection, errs
+}
+
+func TestProbeVerifiesTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// the certificate of the test server isn't trusted by the system, which is reported without aborting the probe
+	inspection, errs := collectProbe(t, HTTPProbe{URL: server.URL})
+	if len(errs) != 0 || inspection == nil || inspection.Verified || inspection.VerifyError == "" {
+		t.Fatalf("expected the failure to be only reported, got %v and %+v", errs, inspection)
+	}
+
+	// but it fails the verdict, unless opted out
+	var verdict *HTTPVerdict
+	probe := HTTPProbe{URL: server.URL, Assertions: &HTTPAssertions{StatusCodes: []string{"200"}}}
+	for ev := range probe.Do(context.Background()) {
+		if ev.Verdict != nil {
+			verdict = ev.Verdict
+		}
+	}
+	if verdict == nil || verdict.Passed || len(verdict.Reasons) != 1 {
+		t.Fatalf("expected the verdict to fail on the verification, got %+v", verdict)
+	}
+	probe.InsecureSkipVerify = true
+	for ev := range probe.Do(context.Background()) {
+		if ev.Verdict != nil {
+			verdict = ev.Verdict
+		}
+	}
+	if !verdict.Passed {
+		t.Fatalf("expected the verdict to pass when opted out, got %+v", verdict)
+	}
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caPath, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// the URL is of an IP address, to which no SNI is sent
+	inspection, errs = collectProbe(t, HTTPProbe{URL: server.URL, AddCA: []string{caPath}})
+	if len(errs) != 0 || inspection == nil || !inspection.Verified {
+		t.Fatalf("expected to be verified with the added CA, got %v and %+v", errs, inspection)
+	}
+}
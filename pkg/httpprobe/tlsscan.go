@@ -0,0 +1,231 @@
+package httpprobe
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
+)
+
+const (
+	tlsScanHandshakeTimeout = 5 * time.Second
+	tlsScanTimeout          = 90 * time.Second
+)
+
+// Older versions first, SSLv3 is not implemented by crypto/tls, so it can't be tried
+var tlsScanVersions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+// TLSScan tries each TLS version, and each of the cipher suites crypto/tls implements, against Target.
+type TLSScan struct {
+	// host:port, e.g. 'example.com:443'
+	Target string `json:"target"`
+
+	// default is the host of the target, unless it's an IP address
+	SNI string `json:"sni,omitempty"`
+
+	// Same as the ones of HTTPProbe
+	Resolver *string               `json:"resolver,omitempty"`
+	IPPref   *InetFamilyPreference `json:"inetFamilyPreference,omitempty"`
+
+	CorrelationID string `json:"correlationId,omitempty"`
+
+	// list of paths to additional CAs to trust in addition to the system's default CAs
+	AddCA []string
+}
+
+type TLSVersionSupport struct {
+	Version   string `json:"version"`
+	Supported bool   `json:"supported"`
+
+	// Accepted suites, TLS 1.3 suites are not configurable in crypto/tls, so only the negotiated one is listed for it
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+
+	// Obtained by offering all the accepted suites and dropping the chosen one round after round,
+	// it's the server's order if the server enforces one, otherwise it's the one of crypto/tls.
+	PreferredOrder []string `json:"preferred_order,omitempty"`
+}
+
+type TLSScanResult struct {
+	CorrelationID string        `json:"correlationId"`
+	Target        string        `json:"target"`
+	SNI           string        `json:"sni,omitempty"`
+	RemoteAddr    string        `json:"remote_addr,omitempty"`
+	StartedAt     time.Time     `json:"started_at"`
+	Duration      time.Duration `json:"duration"`
+
+	Versions []TLSVersionSupport `json:"versions"`
+
+	// Whether h2 is chosen when offering both h2 and http/1.1 via ALPN
+	ALPNH2 bool `json:"alpn_h2"`
+
+	// Of the leaf certificate, e.g. 'RSA' and 2048, or 'ECDSA' and 256
+	KeyAlgorithm string `json:"key_algorithm,omitempty"`
+	KeyBits      int    `json:"key_bits,omitempty"`
+
+	// Of the handshake done with the default settings
+	Inspection *TLSInspection `json:"inspection,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+func (scan *TLSScan) Validate() error {
+	return pkgutils.ValidateHostPort(scan.Target, "")
+}
+
+func getKeyStrength(cert *x509.Certificate) (string, int) {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA", key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	default:
+		return cert.PublicKeyAlgorithm.String(), 0
+	}
+}
+
+func getCipherSuitesOfVersion(version uint16) []*tls.CipherSuite {
+	suites := make([]*tls.CipherSuite, 0)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if slices.Contains(suite.SupportedVersions, version) {
+			suites = append(suites, suite)
+		}
+	}
+	return suites
+}
+
+type tlsScanner struct {
+	addr       string
+	serverName string
+	dialer     *net.Dialer
+}
+
+// handshake returns the state of a completed handshake, the connection is closed right away
+func (scanner *tlsScanner) handshake(ctx context.Context, config *tls.Config) (*tls.ConnectionState, error) {
+	ctx, cancel := context.WithTimeout(ctx, tlsScanHandshakeTimeout)
+	defer cancel()
+
+	conn, err := defaultTransportDialContext(scanner.dialer)(ctx, "tcp", scanner.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	config.ServerName = scanner.serverName
+	config.InsecureSkipVerify = true
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	return &state, nil
+}
+
+func (scanner *tlsScanner) scanVersion(ctx context.Context, version uint16) TLSVersionSupport {
+	support := TLSVersionSupport{Version: tls.VersionName(version)}
+
+	if version == tls.VersionTLS13 {
+		state, err := scanner.handshake(ctx, &tls.Config{MinVersion: version, MaxVersion: version})
+		if err == nil {
+			support.Supported = true
+			support.CipherSuites = []string{tls.CipherSuiteName(state.CipherSuite)}
+		}
+		return support
+	}
+
+	accepted := make([]uint16, 0)
+	for _, suite := range getCipherSuitesOfVersion(version) {
+		if ctx.Err() != nil {
+			break
+		}
+		if _, err := scanner.handshake(ctx, &tls.Config{MinVersion: version, MaxVersion: version, CipherSuites: []uint16{suite.ID}}); err == nil {
+			accepted = append(accepted, suite.ID)
+			support.CipherSuites = append(support.CipherSuites, suite.Name)
+		}
+	}
+	support.Supported = len(accepted) > 0
+
+	remaining := slices.Clone(accepted)
+	for len(remaining) > 0 && ctx.Err() == nil {
+		state, err := scanner.handshake(ctx, &tls.Config{MinVersion: version, MaxVersion: version, CipherSuites: remaining})
+		if err != nil || !slices.Contains(remaining, state.CipherSuite) {
+			break
+		}
+		support.PreferredOrder = append(support.PreferredOrder, tls.CipherSuiteName(state.CipherSuite))
+		remaining = slices.DeleteFunc(remaining, func(id uint16) bool { return id == state.CipherSuite })
+	}
+	return support
+}
+
+func (scan *TLSScan) Do(ctx context.Context) *TLSScanResult {
+	result := &TLSScanResult{
+		CorrelationID: scan.CorrelationID,
+		Target:        scan.Target,
+		StartedAt:     time.Now(),
+		Versions:      make([]TLSVersionSupport, 0),
+	}
+	defer func() {
+		result.Duration = time.Since(result.StartedAt)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, tlsScanTimeout)
+	defer cancel()
+
+	host, _, err := net.SplitHostPort(scan.Target)
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid target %s, expected host:port: %v", scan.Target, err)
+		return result
+	}
+	serverName := scan.SNI
+	if serverName == "" && net.ParseIP(host) == nil {
+		serverName = host
+	}
+	result.SNI = serverName
+
+	rootCAs, err := pkgutils.LoadRootCAs(scan.AddCA)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	// resolved once, so that every handshake goes to the same server behind the name
+	addr, err := doDNSLookup(ctx, nil, pkgutils.NewCustomResolver(scan.Resolver, 10*time.Second), "tcp", scan.Target, scan.IPPref)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.RemoteAddr = addr
+	scanner := &tlsScanner{addr: addr, serverName: serverName, dialer: &net.Dialer{}}
+
+	state, err := scanner.handshake(ctx, &tls.Config{MinVersion: tls.VersionTLS10, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to handshake with %s: %v", scan.Target, err)
+		return result
+	}
+	result.ALPNH2 = state.NegotiatedProtocol == "h2"
+	verifyName := serverName
+	if verifyName == "" {
+		verifyName = host
+	}
+	result.Inspection = inspectTLS(state, verifyName, rootCAs, time.Now())
+	if len(state.PeerCertificates) > 0 {
+		result.KeyAlgorithm, result.KeyBits = getKeyStrength(state.PeerCertificates[0])
+	}
+
+	for _, version := range tlsScanVersions {
+		result.Versions = append(result.Versions, scanner.scanVersion(ctx, version))
+	}
+	if ctx.Err() != nil {
+		result.Error = fmt.Sprintf("scan of %s is incomplete: %v", scan.Target, ctx.Err())
+	}
+	return result
+}
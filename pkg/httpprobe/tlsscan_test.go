@@ -0,0 +1,94 @@
+package httpprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGetCipherSuitesOfVersion(t *testing.T) {
+	tls12 := getCipherSuitesOfVersion(tls.VersionTLS12)
+	tls10 := getCipherSuitesOfVersion(tls.VersionTLS10)
+	if len(tls12) == 0 || len(tls10) == 0 || len(tls10) >= len(tls12) {
+		t.Fatalf("unexpected number of suites, tls1.0: %d, tls1.2: %d", len(tls10), len(tls12))
+	}
+	for _, suite := range tls10 {
+		if !slices.Contains(suite.SupportedVersions, uint16(tls.VersionTLS10)) {
+			t.Errorf("suite %s doesn't support tls1.0", suite.Name)
+		}
+	}
+	// the AEAD suites are TLS 1.2 only
+	if slices.ContainsFunc(tls10, func(suite *tls.CipherSuite) bool { return suite.ID == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 }) {
+		t.Errorf("unexpected tls1.2 only suite in the tls1.0 suites")
+	}
+
+	scan := TLSScan{Target: "example.com"}
+	if err := scan.Validate(); err == nil {
+		t.Errorf("expected target without port to be invalid")
+	}
+}
+
+func startTLSScanTestServer(t *testing.T, config *tls.Config, enableHTTP2 bool) string {
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = config
+	server.EnableHTTP2 = enableHTTP2
+	// most of the handshakes of a scan are meant to fail
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "https://")
+}
+
+func TestTLSScan(t *testing.T) {
+	suites := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	target := startTLSScanTestServer(t, &tls.Config{MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS12, CipherSuites: suites}, true)
+
+	scan := TLSScan{Target: target}
+	result := scan.Do(context.Background())
+	if result.Error != "" {
+		t.Fatal(result.Error)
+	}
+	if !result.ALPNH2 || result.KeyAlgorithm != "RSA" || result.Inspection == nil {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if len(result.Versions) != len(tlsScanVersions) {
+		t.Fatalf("expected %d versions, got %+v", len(tlsScanVersions), result.Versions)
+	}
+	for _, support := range result.Versions {
+		if support.Version != "TLS 1.2" {
+			if support.Supported || len(support.CipherSuites) != 0 {
+				t.Errorf("expected %s not to be supported, got %+v", support.Version, support)
+			}
+			continue
+		}
+		accepted := slices.Sorted(slices.Values(support.CipherSuites))
+		expected := []string{tls.CipherSuiteName(suites[1]), tls.CipherSuiteName(suites[0])}
+		if !support.Supported || !slices.Equal(accepted, expected) {
+			t.Errorf("expected %v to be accepted, got %+v", expected, support)
+		}
+		// crypto/tls servers choose by their own order, in which AES-128 comes before AES-256
+		if !slices.Equal(support.PreferredOrder, expected) {
+			t.Errorf("expected the preferred order %v, got %v", expected, support.PreferredOrder)
+		}
+	}
+
+	target = startTLSScanTestServer(t, &tls.Config{MinVersion: tls.VersionTLS13}, false)
+	scan = TLSScan{Target: target}
+	result = scan.Do(context.Background())
+	if result.Error != "" || result.ALPNH2 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	tls13 := result.Versions[len(result.Versions)-1]
+	if tls13.Version != "TLS 1.3" || !tls13.Supported || len(tls13.CipherSuites) != 1 || len(tls13.PreferredOrder) != 0 {
+		t.Fatalf("unexpected support of TLS 1.3: %+v", tls13)
+	}
+	if slices.ContainsFunc(result.Versions[:len(result.Versions)-1], func(support TLSVersionSupport) bool { return support.Supported }) {
+		t.Fatalf("expected only TLS 1.3 to be supported, got %+v", result.Versions)
+	}
+}
@@ -20,6 +20,7 @@ type CounterStore struct {
 	NumBytesReceived       *prometheus.CounterVec
 	IPInfoRequests         *prometheus.CounterVec
 	IPInfoServedDurationMs *prometheus.CounterVec
+	HTTPChecks             *prometheus.CounterVec
 }
 
 func (counterStore *CounterStore) LogPktSent(labels *prometheus.Labels) {
@@ -42,6 +43,7 @@ const (
 	PromLabelClient   = "client"
 	PromLabelCacheHit = "cachehit"
 	PromLabelHasError = "haserror"
+	PromLabelPassed   = "passed"
 )
 
 func NewCounterStore() *CounterStore {
@@ -143,6 +145,17 @@ func NewCounterStore() *CounterStore {
 		log.Printf("IPInfoRequests might have been already registered: %v", err)
 	}
 
+	cs.HTTPChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "globalping_num_http_checks",
+			Help: "The number of HTTP probes with assertions evaluated by the globalping system, by verdict",
+		},
+		append(commonLabels, PromLabelPassed),
+	)
+	if err := prometheus.Register(cs.HTTPChecks); err != nil {
+		log.Printf("HTTPChecks might have been already registered: %v", err)
+	}
+
 	return cs
 }
 
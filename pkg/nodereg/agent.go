@@ -24,6 +24,7 @@ const (
 	AttributeKeyPingCapability      = "CapabilityPing"
 	AttributeKeyDNSProbeCapability  = "CapabilityDNSProbe"
 	AttributeKeyHTTPProbeCapability = "CapabilityHTTPProbe"
+	AttributeKeyNTPProbeCapability  = "CapabilityNTPProbe"
 	AttributeKeySupportQUICTunnel   = "SupportQUICTunnel"
 	AttributeKeyHttpEndpoint        = "HttpEndpoint"
 	AttributeKeyRespondRange        = "RespondRange"
@@ -40,6 +41,14 @@ const (
 	AttributeKeySupportTCP          = "SupportTCP"
 	AttributeKeyVersion             = "Version"
 	AttributeKeyLivenessCheck       = "LivenessCheck"
+	// JSON of the result of the STUN probe the agent runs on startup, when a STUN server is configured
+	AttributeKeyNATDiscovery = "NATDiscovery"
+	// The agent could be the receiving end of a throughput test, on its HTTP endpoint
+	AttributeKeyThroughputCapability = "CapabilityThroughput"
+	// The agent could be the sending end of a throughput test, which needs no HTTP endpoint
+	AttributeKeyThroughputSenderCapability = "CapabilityThroughputSender"
+	// TCP banner grabbing, which sends arbitrary payloads to arbitrary ports, so agents have to opt in
+	AttributeKeyBannerProbeCapability = "CapabilityBannerProbe"
 )
 
 type NodeRegistrationAgent struct {
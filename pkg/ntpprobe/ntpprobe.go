@@ -0,0 +1,270 @@
+package ntpprobe
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	pkghttpprobe "github.com/internetworklab/cloudping/pkg/httpprobe"
+	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
+)
+
+const (
+	defaultPort    = "123"
+	defaultTimeout = 5 * time.Second
+
+	packetSize    = 48
+	ntpVersion    = 4
+	modeClient    = 3
+	modeServer    = 4
+	modeBroadcast = 5
+
+	// Seconds from 1900-01-01, the NTP era 0 epoch, to 1970-01-01, the unix epoch
+	ntpEpochOffset = 2208988800
+)
+
+type LeapIndicator string
+
+const (
+	LeapNoWarning      LeapIndicator = "no_warning"
+	LeapLastMinute61   LeapIndicator = "last_minute_61"
+	LeapLastMinute59   LeapIndicator = "last_minute_59"
+	LeapUnsynchronized LeapIndicator = "unsynchronized"
+)
+
+var leapIndicators = []LeapIndicator{LeapNoWarning, LeapLastMinute61, LeapLastMinute59, LeapUnsynchronized}
+
+// Meanings of the kiss codes, see section 7.4 of RFC 5905
+var kissCodes = map[string]string{
+	"ACST": "the association belongs to a unicast server",
+	"AUTH": "server authentication failed",
+	"AUTO": "autokey sequence failed",
+	"BCST": "the association belongs to a broadcast server",
+	"CRYP": "cryptographic authentication or identification failed",
+	"DENY": "access denied by remote server",
+	"DROP": "lost peer in symmetric mode",
+	"RSTR": "access denied due to local policy",
+	"INIT": "the association has not yet synchronized for the first time",
+	"MCST": "the association belongs to a dynamically discovered server",
+	"NKEY": "no key found",
+	"RATE": "rate exceeded, the server has temporarily denied access because the client exceeded the rate threshold",
+	"RMOT": "alteration of association from a remote host running ntpdc",
+	"STEP": "a step change in system time has occurred, but the association has not yet resynchronized",
+}
+
+// NTPProbe sends an SNTPv4 (RFC 4330) client request to Target, and reports the clock of the server relative to the agent's.
+type NTPProbe struct {
+	// host or host:port, default port is 123, e.g. 'pool.ntp.org' or '[2001:db8::1]:123'
+	Target string `json:"target"`
+
+	// default is 5000
+	TimeoutMs *int `json:"timeoutMs,omitempty"`
+
+	Resolver *string                            `json:"resolver,omitempty"`
+	IPPref   *pkghttpprobe.InetFamilyPreference `json:"inetFamilyPreference,omitempty"`
+
+	CorrelationID string `json:"correlationId,omitempty"`
+}
+
+// NTPKissOfDeath is what a server with stratum 0 responds with, to tell the client to back off, or to go away.
+type NTPKissOfDeath struct {
+	Code    string `json:"code"`
+	Meaning string `json:"meaning,omitempty"`
+}
+
+type NTPProbeResult struct {
+	CorrelationID string    `json:"correlationId"`
+	Target        string    `json:"target"`
+	RemoteAddr    string    `json:"remote_addr,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+
+	// Round trip delay, excluding the time the server spent on the request
+	RTT time.Duration `json:"rtt"`
+	// How much the server's clock is ahead of the agent's, negative when it's behind
+	Offset time.Duration `json:"offset"`
+
+	Version        int           `json:"version,omitempty"`
+	Stratum        int           `json:"stratum"`
+	ReferenceID    string        `json:"reference_id,omitempty"`
+	ReferenceTime  *time.Time    `json:"reference_time,omitempty"`
+	LeapIndicator  LeapIndicator `json:"leap_indicator,omitempty"`
+	RootDelay      time.Duration `json:"root_delay"`
+	RootDispersion time.Duration `json:"root_dispersion"`
+
+	KissOfDeath *NTPKissOfDeath `json:"kiss_of_death,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+func (probe *NTPProbe) getAddr() string {
+	return pkgutils.WithDefaultPort(probe.Target, defaultPort)
+}
+
+// GetHost returns the host of the target, without the port
+func (probe *NTPProbe) GetHost() string {
+	host, _, _ := net.SplitHostPort(probe.getAddr())
+	return host
+}
+
+func (probe *NTPProbe) Validate() error {
+	return pkgutils.ValidateHostPort(probe.Target, defaultPort)
+}
+
+func toNTPTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := (uint64(t.Nanosecond()) << 32) / 1e9
+	return secs<<32 | frac
+}
+
+// fromNTPTime assumes era 0, which lasts until 2036, and era 1 for the timestamps that would otherwise be before 1968
+func fromNTPTime(ntpTime uint64) time.Time {
+	secs := int64(ntpTime >> 32)
+	if secs < 0x80000000 {
+		secs += 1 << 32
+	}
+	nanos := (int64(ntpTime&0xffffffff) * 1e9) >> 32
+	return time.Unix(secs-ntpEpochOffset, nanos).UTC()
+}
+
+// fromNTPShort converts the 16.16 fixed point seconds of the root delay and the root dispersion
+func fromNTPShort(short uint32) time.Duration {
+	return time.Duration((int64(short) * int64(time.Second)) >> 16)
+}
+
+// newRequest returns a client request, with a random transmit timestamp that the server echoes back as the origin timestamp,
+// so that the local clock isn't disclosed, see RFC 9109
+func newRequest() ([]byte, uint64, error) {
+	packet := make([]byte, packetSize)
+	packet[0] = ntpVersion<<3 | modeClient
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, 0, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	copy(packet[40:48], nonce)
+	return packet, binary.BigEndian.Uint64(nonce), nil
+}
+
+func getReferenceID(stratum int, refID []byte) string {
+	if stratum <= 1 {
+		// e.g. 'GPS', 'PPS', or the kiss code when stratum is 0
+		return strings.TrimRight(string(refID), "\x00 ")
+	}
+	// the IPv4 address of the upstream server, or the first 4 bytes of the MD5 hash of the IPv6 one
+	return net.IP(refID).String()
+}
+
+// parseResponse fills result with the fields of the response, t1 is when the request was sent and t4 is when the response arrived
+func parseResponse(packet []byte, nonce uint64, t1, t4 time.Time, result *NTPProbeResult) error {
+	if len(packet) < packetSize {
+		return fmt.Errorf("response is too short, %d bytes", len(packet))
+	}
+	mode := packet[0] & 0x7
+	if mode != modeServer && mode != modeBroadcast {
+		return fmt.Errorf("unexpected mode %d of response", mode)
+	}
+	if origin := binary.BigEndian.Uint64(packet[24:32]); origin != nonce {
+		return errors.New("origin timestamp of response doesn't match the request")
+	}
+
+	result.LeapIndicator = leapIndicators[packet[0]>>6]
+	result.Version = int(packet[0]>>3) & 0x7
+	result.Stratum = int(packet[1])
+	result.RootDelay = fromNTPShort(binary.BigEndian.Uint32(packet[4:8]))
+	result.RootDispersion = fromNTPShort(binary.BigEndian.Uint32(packet[8:12]))
+	result.ReferenceID = getReferenceID(result.Stratum, packet[12:16])
+
+	if result.Stratum == 0 {
+		result.KissOfDeath = &NTPKissOfDeath{Code: result.ReferenceID, Meaning: kissCodes[result.ReferenceID]}
+		return fmt.Errorf("kiss of death: %s", result.ReferenceID)
+	}
+
+	transmit := binary.BigEndian.Uint64(packet[40:48])
+	if transmit == 0 {
+		return errors.New("transmit timestamp of response is zero")
+	}
+	if reference := binary.BigEndian.Uint64(packet[16:24]); reference != 0 {
+		referenceTime := fromNTPTime(reference)
+		result.ReferenceTime = &referenceTime
+	}
+	t2 := fromNTPTime(binary.BigEndian.Uint64(packet[32:40]))
+	t3 := fromNTPTime(transmit)
+
+	result.Offset = (t2.Sub(t1) + t3.Sub(t4)) / 2
+	result.RTT = t4.Sub(t1) - t3.Sub(t2)
+	if result.LeapIndicator == LeapUnsynchronized {
+		return errors.New("server clock is unsynchronized")
+	}
+	return nil
+}
+
+func (probe *NTPProbe) Do(ctx context.Context) *NTPProbeResult {
+	result := &NTPProbeResult{
+		CorrelationID: probe.CorrelationID,
+		Target:        probe.Target,
+		StartedAt:     time.Now(),
+	}
+
+	timeout := defaultTimeout
+	if probe.TimeoutMs != nil && *probe.TimeoutMs > 0 {
+		timeout = time.Duration(*probe.TimeoutMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	host, port, err := net.SplitHostPort(probe.getAddr())
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid target %s: %v", probe.Target, err)
+		return result
+	}
+	ip, err := pkgutils.LookupFirstIP(ctx, probe.Resolver, probe.IPPref, host)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to dial %s: %v", probe.Target, err)
+		return result
+	}
+	defer conn.Close()
+	result.RemoteAddr = conn.RemoteAddr().String()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	request, nonce, err := newRequest()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	t1 := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		result.Error = fmt.Sprintf("failed to send request to %s: %v", probe.Target, err)
+		return result
+	}
+
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		t4 := time.Now()
+		if err != nil {
+			result.Error = fmt.Sprintf("failed to receive response from %s: %v", probe.Target, err)
+			return result
+		}
+		// a stray or spoofed response doesn't end the wait for the genuine one
+		if n >= packetSize && binary.BigEndian.Uint64(buf[24:32]) != nonce {
+			continue
+		}
+		if err := parseResponse(buf[:n], nonce, t1, t4, result); err != nil {
+			result.Error = err.Error()
+		}
+		return result
+	}
+}
@@ -0,0 +1,141 @@
+package ntpprobe
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getTestResponse(stratum byte, refID string, nonce uint64, t2, t3 time.Time) []byte {
+	packet := make([]byte, packetSize)
+	packet[0] = ntpVersion<<3 | modeServer
+	packet[1] = stratum
+	binary.BigEndian.PutUint32(packet[8:12], 1<<15)
+	copy(packet[12:16], refID)
+	binary.BigEndian.PutUint64(packet[24:32], nonce)
+	binary.BigEndian.PutUint64(packet[32:40], toNTPTime(t2))
+	binary.BigEndian.PutUint64(packet[40:48], toNTPTime(t3))
+	return packet
+}
+
+func TestParseResponse(t *testing.T) {
+	t1 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	t4 := t1.Add(40 * time.Millisecond)
+	// the server is 1s ahead, and spent 10ms on the request, the path is symmetric
+	t2 := t1.Add(15*time.Millisecond + time.Second)
+	t3 := t2.Add(10 * time.Millisecond)
+
+	result := &NTPProbeResult{}
+	if err := parseResponse(getTestResponse(1, "GPS", 42, t2, t3), 42, t1, t4, result); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d := result.Offset - time.Second; d < -time.Microsecond || d > time.Microsecond {
+		t.Errorf("expected offset of 1s, got %v", result.Offset)
+	}
+	if d := result.RTT - 30*time.Millisecond; d < -time.Microsecond || d > time.Microsecond {
+		t.Errorf("expected rtt of 30ms, got %v", result.RTT)
+	}
+	if result.Stratum != 1 || result.ReferenceID != "GPS" || result.Version != ntpVersion || result.LeapIndicator != LeapNoWarning {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if result.RootDispersion != 500*time.Millisecond {
+		t.Errorf("expected root dispersion of 500ms, got %v", result.RootDispersion)
+	}
+
+	result = &NTPProbeResult{}
+	if err := parseResponse(getTestResponse(0, "RATE", 42, t2, t3), 42, t1, t4, result); err == nil || result.KissOfDeath == nil || result.KissOfDeath.Code != "RATE" {
+		t.Errorf("expected kiss of death, got %+v", result)
+	}
+
+	if err := parseResponse(getTestResponse(2, "\xc0\x00\x02\x01", 43, t2, t3), 42, t1, t4, &NTPProbeResult{}); err == nil {
+		t.Errorf("expected mismatched origin timestamp to be rejected")
+	}
+}
+
+func TestNTPTime(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 34, 56, 789000000, time.UTC)
+	if got := fromNTPTime(toNTPTime(now)); got.Sub(now).Abs() > time.Microsecond {
+		t.Errorf("expected %v, got %v", now, got)
+	}
+}
+
+// startTestNTPServer answers each request with what respond returns for the nonce of the request, in order
+func startTestNTPServer(t *testing.T, respond func(nonce uint64) [][]byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < packetSize {
+				continue
+			}
+			for _, packet := range respond(binary.BigEndian.Uint64(buf[40:48])) {
+				conn.WriteTo(packet, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDo(t *testing.T) {
+	// a stray response to some other request arrives first, then the genuine one of a server 1s ahead
+	addr := startTestNTPServer(t, func(nonce uint64) [][]byte {
+		now := time.Now().Add(time.Second)
+		return [][]byte{
+			getTestResponse(2, "\xc0\x00\x02\x01", nonce+1, now.Add(time.Hour), now.Add(time.Hour)),
+			getTestResponse(2, "\xc0\x00\x02\x01", nonce, now, now),
+		}
+	})
+	result := (&NTPProbe{Target: addr, CorrelationID: "a"}).Do(context.Background())
+	if result.Error != "" {
+		t.Fatalf("unexpected error: %s", result.Error)
+	}
+	if result.CorrelationID != "a" || result.RemoteAddr != addr || result.Stratum != 2 || result.ReferenceID != "192.0.2.1" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if d := result.Offset - time.Second; d < -100*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("expected offset of about 1s from the genuine response, got %v", result.Offset)
+	}
+	if result.RTT < 0 {
+		t.Errorf("expected a non-negative rtt, got %v", result.RTT)
+	}
+}
+
+func TestDo_KissOfDeath(t *testing.T) {
+	addr := startTestNTPServer(t, func(nonce uint64) [][]byte {
+		return [][]byte{getTestResponse(0, "RATE", nonce, time.Now(), time.Now())}
+	})
+	result := (&NTPProbe{Target: addr}).Do(context.Background())
+	if result.KissOfDeath == nil || result.KissOfDeath.Code != "RATE" || result.KissOfDeath.Meaning != kissCodes["RATE"] {
+		t.Fatalf("expected a kiss of death of RATE, got %+v", result)
+	}
+	if !strings.Contains(result.Error, "kiss of death") {
+		t.Errorf("expected the kiss of death to be the error, got %q", result.Error)
+	}
+}
+
+func TestDo_Timeout(t *testing.T) {
+	// answers only with responses to some other request
+	addr := startTestNTPServer(t, func(nonce uint64) [][]byte {
+		return [][]byte{getTestResponse(2, "\xc0\x00\x02\x01", nonce+1, time.Now(), time.Now())}
+	})
+	timeoutMs := 200
+	startedAt := time.Now()
+	result := (&NTPProbe{Target: addr, TimeoutMs: &timeoutMs}).Do(context.Background())
+	if !strings.Contains(result.Error, "failed to receive response") || result.Stratum != 0 {
+		t.Fatalf("expected to time out waiting for the genuine response, got %+v", result)
+	}
+	if elapsed := time.Since(startedAt); elapsed > 2*time.Second {
+		t.Errorf("expected to give up after the timeout, took %v", elapsed)
+	}
+}
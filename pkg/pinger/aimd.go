@@ -0,0 +1,174 @@
+package pinger
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type AIMDDecision string
+
+const (
+	AIMDDecisionIncrease AIMDDecision = "increase"
+	AIMDDecisionDecrease AIMDDecision = "decrease"
+	AIMDDecisionHold     AIMDDecision = "hold"
+)
+
+const (
+	defaultAIMDDecreaseFactor  = 0.5
+	defaultAIMDSpikeThreshold  = 0.1
+	defaultAIMDBaselineWeight  = 0.1
+	defaultAIMDMinSamples      = 8
+	defaultAIMDIncreaseDivisor = 16
+	defaultAIMDMinRateDivisor  = 64
+
+	// used as the upper bound when neither the requested interval nor the agent tells us one
+	defaultAIMDMaxRate = 1000.0
+)
+
+type AIMDStatus struct {
+	Decision     AIMDDecision `json:"decision"`
+	Rate         float64      `json:"rate"`
+	PrevRate     float64      `json:"prevRate"`
+	MaxRate      float64      `json:"maxRate"`
+	MinRate      float64      `json:"minRate"`
+	TimeoutRatio float64      `json:"timeoutRatio"`
+	Baseline     float64      `json:"baseline"`
+	NumReplied   int          `json:"numReplied"`
+	NumTimedOut  int          `json:"numTimedOut"`
+	Date         time.Time    `json:"date"`
+}
+
+// AIMDRateController adjusts the sending rate of a block scan based on the ratio
+// of timed-out probes observed from the ICMP tracker. It increases the rate additively
+// while the timeout ratio stays close to its baseline, and cuts the rate multiplicatively
+// once the ratio spikes, which is typically a sign of the path being policed.
+//
+// In a block scan a high timeout ratio is normal (most addresses are simply not in use),
+// so the controller reacts to spikes relative to a slowly-moving baseline rather than
+// to the absolute ratio.
+type AIMDRateController struct {
+	// All rates are in unit of packets per second.
+	MinRate float64
+	MaxRate float64
+
+	// Amount of rate to add after a window without loss spike.
+	IncreaseStep float64
+
+	// The rate is multiplied with this factor after a window with loss spike.
+	DecreaseFactor float64
+
+	// How far (in ratio) above the baseline the timeout ratio must go to be considered as a spike.
+	SpikeThreshold float64
+
+	// Windows with fewer samples than this keep the rate unchanged.
+	MinSamples int
+
+	lock        sync.Mutex
+	rate        float64
+	baseline    float64
+	hasBaseline bool
+	numReplied  int
+	numTimedOut int
+}
+
+// NewAIMDRateController creates a controller starting at the rate implied by intv,
+// never going beyond maxRate when maxRate is positive.
+func NewAIMDRateController(intv time.Duration, maxRate float64) *AIMDRateController {
+	upper := defaultAIMDMaxRate
+	if intv > 0 {
+		upper = float64(time.Second) / float64(intv)
+	}
+	if maxRate > 0 {
+		upper = math.Min(upper, maxRate)
+	}
+
+	return &AIMDRateController{
+		MinRate:        math.Max(math.Min(1.0, upper), upper/defaultAIMDMinRateDivisor),
+		MaxRate:        upper,
+		IncreaseStep:   math.Max(1.0, upper/defaultAIMDIncreaseDivisor),
+		DecreaseFactor: defaultAIMDDecreaseFactor,
+		SpikeThreshold: defaultAIMDSpikeThreshold,
+		MinSamples:     defaultAIMDMinSamples,
+		rate:           upper,
+	}
+}
+
+// Observe records the outcome of a single probe.
+func (ctl *AIMDRateController) Observe(replied bool) {
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+
+	if replied {
+		ctl.numReplied++
+	} else {
+		ctl.numTimedOut++
+	}
+}
+
+func (ctl *AIMDRateController) GetRate() float64 {
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+
+	return ctl.rate
+}
+
+// GetInterval returns the pause to take between two consecutive probes at the current rate.
+func (ctl *AIMDRateController) GetInterval() time.Duration {
+	rate := ctl.GetRate()
+	if rate <= 0 {
+		return time.Second
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// Adjust closes the current observation window and decides the rate for the next one.
+func (ctl *AIMDRateController) Adjust() AIMDStatus {
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+
+	status := AIMDStatus{
+		Decision:    AIMDDecisionHold,
+		PrevRate:    ctl.rate,
+		MaxRate:     ctl.MaxRate,
+		MinRate:     ctl.MinRate,
+		NumReplied:  ctl.numReplied,
+		NumTimedOut: ctl.numTimedOut,
+		Date:        time.Now(),
+	}
+
+	total := ctl.numReplied + ctl.numTimedOut
+	if total > 0 {
+		status.TimeoutRatio = float64(ctl.numTimedOut) / float64(total)
+	}
+
+	if total >= ctl.MinSamples && total > 0 {
+		ratio := status.TimeoutRatio
+		if !ctl.hasBaseline {
+			ctl.baseline = ratio
+			ctl.hasBaseline = true
+		}
+
+		if ratio-ctl.baseline > ctl.SpikeThreshold {
+			ctl.rate = math.Max(ctl.MinRate, ctl.rate*ctl.DecreaseFactor)
+			status.Decision = AIMDDecisionDecrease
+		} else {
+			ctl.rate = math.Min(ctl.MaxRate, ctl.rate+ctl.IncreaseStep)
+			status.Decision = AIMDDecisionIncrease
+
+			// the baseline follows lower ratios immediately but only creeps up slowly,
+			// so that a loss spike can't quickly become the new normal.
+			ctl.baseline = math.Min(ratio, ctl.baseline*(1-defaultAIMDBaselineWeight)+ratio*defaultAIMDBaselineWeight)
+		}
+		if status.Decision != AIMDDecisionHold && ctl.rate == status.PrevRate {
+			status.Decision = AIMDDecisionHold
+		}
+
+		ctl.numReplied = 0
+		ctl.numTimedOut = 0
+	}
+
+	status.Rate = ctl.rate
+	status.Baseline = ctl.baseline
+	return status
+}
@@ -0,0 +1,79 @@
+package pinger
+
+import (
+	"testing"
+	"time"
+)
+
+func observeN(ctl *AIMDRateController, numReplied int, numTimedOut int) {
+	for range numReplied {
+		ctl.Observe(true)
+	}
+	for range numTimedOut {
+		ctl.Observe(false)
+	}
+}
+
+func TestAIMDRateController_NeverExceedsMaxRate(t *testing.T) {
+	// requested 100 pkts/sec, but the agent only allows 50 pkts/sec
+	ctl := NewAIMDRateController(10*time.Millisecond, 50)
+	if ctl.GetRate() != 50 {
+		t.Fatalf("expected initial rate to be clamped to 50, got %f", ctl.GetRate())
+	}
+
+	for range 10 {
+		observeN(ctl, 20, 0)
+		status := ctl.Adjust()
+		if status.Rate > 50 {
+			t.Fatalf("rate %f exceeds the max rate 50", status.Rate)
+		}
+	}
+}
+
+func TestAIMDRateController_BacksOffOnSpikeAndRecovers(t *testing.T) {
+	ctl := NewAIMDRateController(10*time.Millisecond, 0)
+	initialRate := ctl.GetRate()
+
+	// sparse block: 80% of addresses never reply, that's the baseline
+	observeN(ctl, 4, 16)
+	if status := ctl.Adjust(); status.Decision == AIMDDecisionDecrease {
+		t.Fatalf("expected no back off on the baseline window, got %s", status.Decision)
+	}
+
+	// policing kicks in
+	observeN(ctl, 1, 19)
+	status := ctl.Adjust()
+	if status.Decision != AIMDDecisionDecrease {
+		t.Fatalf("expected to back off on loss spike, got %s", status.Decision)
+	}
+	if status.Rate >= initialRate {
+		t.Fatalf("expected rate to drop below %f, got %f", initialRate, status.Rate)
+	}
+
+	// replies recover
+	lowest := status.Rate
+	for range 32 {
+		observeN(ctl, 4, 16)
+		status = ctl.Adjust()
+		if status.Decision == AIMDDecisionDecrease {
+			t.Fatalf("unexpected back off after replies recovered")
+		}
+	}
+	if status.Rate <= lowest {
+		t.Fatalf("expected rate to recover above %f, got %f", lowest, status.Rate)
+	}
+	if status.Rate != initialRate {
+		t.Fatalf("expected rate to recover to %f, got %f", initialRate, status.Rate)
+	}
+}
+
+func TestAIMDRateController_HoldsOnTooFewSamples(t *testing.T) {
+	ctl := NewAIMDRateController(10*time.Millisecond, 0)
+	rate := ctl.GetRate()
+
+	observeN(ctl, 0, defaultAIMDMinSamples-1)
+	status := ctl.Adjust()
+	if status.Decision != AIMDDecisionHold || status.Rate != rate {
+		t.Fatalf("expected hold at %f, got %s at %f", rate, status.Decision, status.Rate)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"crypto/x509"
 	"errors"
+	"net"
+	"net/netip"
 	"sync"
 
 	pkgdnsprobe "github.com/internetworklab/cloudping/pkg/dnsprobe"
@@ -15,6 +17,12 @@ type DNSPinger struct {
 	Requests    []pkgdnsprobe.LookupParameter
 	RateLimiter pkgratelimit.RateLimiter
 	AddCAPaths  []string
+
+	// For resolving the servers specified by hostname, the default resolver is used when it's nil
+	Resolver *net.Resolver
+
+	// what the bootstrapped addresses of the servers specified by hostname are checked with, see LookupParameter.CheckServerAddr
+	CheckServerAddr func(addr netip.Addr) error
 }
 
 func (dp *DNSPinger) Ping(ctx context.Context) <-chan PingEvent {
@@ -38,7 +46,18 @@ func (dp *DNSPinger) Ping(ctx context.Context) <-chan PingEvent {
 			wg.Add(1)
 			go func(req pkgdnsprobe.LookupParameter) {
 				defer wg.Done()
-				queryResult, err := pkgdnsprobe.LookupDNS(ctx, req, certPool)
+				if req.Trace {
+					for step := range pkgdnsprobe.TraceDNS(ctx, req) {
+						evChan <- PingEvent{Data: step}
+					}
+					return
+				}
+				if req.ZoneCheck {
+					evChan <- PingEvent{Data: pkgdnsprobe.CheckZone(ctx, req, dp.Resolver)}
+					return
+				}
+				req.CheckServerAddr = dp.CheckServerAddr
+				queryResult, err := pkgdnsprobe.LookupDNS(ctx, req, certPool, dp.Resolver)
 				if err != nil {
 					evChan <- PingEvent{Error: err}
 					return
@@ -12,6 +12,12 @@ type HTTPPinger struct {
 	Requests    []pkghttpprobe.HTTPProbe
 	RateLimiter pkgratelimit.RateLimiter
 	AddCA       []string
+
+	// what the hosts the targets point to, rather than the targets themselves, are checked with, see HTTPProbe.CheckHost
+	CheckHost func(ctx context.Context, host string, resolver *string, pref *pkghttpprobe.InetFamilyPreference) error
+
+	// called once the verdict of a probe with assertions is out
+	OnVerdict func(ctx context.Context, request pkghttpprobe.HTTPProbe, verdict *pkghttpprobe.HTTPVerdict)
 }
 
 func (dp *HTTPPinger) Ping(ctx context.Context) <-chan PingEvent {
@@ -27,7 +33,11 @@ func (dp *HTTPPinger) Ping(ctx context.Context) <-chan PingEvent {
 			go func(req pkghttpprobe.HTTPProbe) {
 				defer wg.Done()
 				req.AddCA = dp.AddCA
+				req.CheckHost = dp.CheckHost
 				for ev := range req.Do(ctx) {
+					if ev.Verdict != nil && dp.OnVerdict != nil {
+						dp.OnVerdict(ctx, req, ev.Verdict)
+					}
 					wrappedEV := PingEvent{
 						Data: &ev,
 					}
@@ -0,0 +1,34 @@
+package pinger
+
+import (
+	"context"
+	"sync"
+
+	pkgratelimit "github.com/internetworklab/cloudping/pkg/ratelimit"
+)
+
+// ProbePinger probes each of the requests once, concurrently, it serves the kinds of probe that produce a single
+// result per target, e.g. the WebSocket, gRPC, NTP or QUIC probes
+type ProbePinger[T any] struct {
+	Requests    []T
+	RateLimiter pkgratelimit.RateLimiter
+	// Probe does the actual probing, what it returns becomes the data of the event
+	Probe func(ctx context.Context, request T) any
+}
+
+func (pp *ProbePinger[T]) Ping(ctx context.Context) <-chan PingEvent {
+	evChan := make(chan PingEvent)
+	go func() {
+		defer close(evChan)
+		wg := &sync.WaitGroup{}
+		defer wg.Wait()
+		for request := range pkgratelimit.GetThrottledRequests(ctx, pp.Requests, pp.RateLimiter) {
+			wg.Add(1)
+			go func(req T) {
+				defer wg.Done()
+				evChan <- PingEvent{Data: pp.Probe(ctx, req)}
+			}(request)
+		}
+	}()
+	return evChan
+}
@@ -12,9 +12,17 @@ import (
 	"strings"
 	"sync"
 
+	pkgbannerprobe "github.com/internetworklab/cloudping/pkg/bannerprobe"
 	pkgdnsprobe "github.com/internetworklab/cloudping/pkg/dnsprobe"
+	pkgdualstackprobe "github.com/internetworklab/cloudping/pkg/dualstackprobe"
+	pkggrpcprobe "github.com/internetworklab/cloudping/pkg/grpcprobe"
 	pkghttpprobe "github.com/internetworklab/cloudping/pkg/httpprobe"
+	pkgntpprobe "github.com/internetworklab/cloudping/pkg/ntpprobe"
+	pkgquicprobe "github.com/internetworklab/cloudping/pkg/quicprobe"
+	pkgstunprobe "github.com/internetworklab/cloudping/pkg/stunprobe"
+	pkgthroughput "github.com/internetworklab/cloudping/pkg/throughput"
 	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
+	pkgwsprobe "github.com/internetworklab/cloudping/pkg/wsprobe"
 )
 
 type L4PacketTypeOption string
@@ -30,6 +38,24 @@ type L7PacketTypeOption string
 const (
 	L7ProtoDNS  L7PacketTypeOption = "dns"
 	L7ProtoHTTP L7PacketTypeOption = "http"
+	// The WebSocket upgrade handshake, the targets are either ws:// or wss:// URLs
+	L7ProtoWebSocket L7PacketTypeOption = "ws"
+	// grpc.health.v1.Health/Check, over either h2 or h2c
+	L7ProtoGRPC L7PacketTypeOption = "grpc"
+	// Enumeration of the TLS versions and the cipher suites accepted by the target
+	L7ProtoTLS L7PacketTypeOption = "tls"
+	// Happy Eyeballs (RFC 8305) measurement of a dual-stack target
+	L7ProtoDualStack L7PacketTypeOption = "dualstack"
+	// SNTPv4 client requests, the targets are NTP servers
+	L7ProtoNTP L7PacketTypeOption = "ntp"
+	// Reads what a TCP service says first, e.g. the greeting of an SMTP, SSH or FTP server
+	L7ProtoBanner L7PacketTypeOption = "banner"
+	// STUN (RFC 5389) Binding requests, optionally with the NAT behavior discovery of RFC 5780
+	L7ProtoSTUN L7PacketTypeOption = "stun"
+	// A bare QUIC handshake, without any HTTP/3 request
+	L7ProtoQUIC L7PacketTypeOption = "quic"
+	// Bulk transfer from one agent to another, the targets name the receiving agents
+	L7ProtoThroughput L7PacketTypeOption = "throughput"
 )
 
 type SimplePingRequest struct {
@@ -46,13 +72,34 @@ type SimplePingRequest struct {
 	ResolveTimeoutMilliseconds *int
 	IPInfoProviderName         *string
 
-	L4PacketType *L4PacketTypeOption
-	L7PacketType *L7PacketTypeOption
-	DNSTargets   []pkgdnsprobe.LookupParameter
-	HTTPTargets  []pkghttpprobe.HTTPProbe
+	L4PacketType      *L4PacketTypeOption
+	L7PacketType      *L7PacketTypeOption
+	DNSTargets        []pkgdnsprobe.LookupParameter
+	HTTPTargets       []pkghttpprobe.HTTPProbe
+	WSTargets         []pkgwsprobe.WSProbe
+	GRPCTargets       []pkggrpcprobe.GRPCProbe
+	TLSTargets        []pkghttpprobe.TLSScan
+	DualStackTargets  []pkgdualstackprobe.DualStackProbe
+	NTPTargets        []pkgntpprobe.NTPProbe
+	BannerTargets     []pkgbannerprobe.BannerProbe
+	STUNTargets       []pkgstunprobe.STUNProbe
+	QUICTargets       []pkgquicprobe.QUICProbe
+	ThroughputTargets []pkgthroughput.ThroughputTest
 
 	// Take effect only when L3PacketType is 'udp'
 	UDPDstPort *int
+
+	// Take effect only when scanning a CIDR block, when true, the sending rate is
+	// adjusted according to the observed timeout ratio instead of being fixed.
+	AdaptiveRate *bool
+
+	// Take effect only on DNS probes coordinated by the hub, when true, the hub compares the
+	// answers seen by different agents and reports the divergence at the end of the stream.
+	DNSDivergence *bool
+
+	// Take effect only on HTTP probes coordinated by the hub, when true, the hub compares the
+	// responses seen by different agents and reports the divergence at the end of the stream.
+	HTTPDivergence *bool
 }
 
 func (pingReq *SimplePingRequest) DeriveAsPingRequest(from string, target string) *SimplePingRequest {
@@ -89,6 +136,16 @@ func (pingReq *SimplePingRequest) DeriveAdHTTPProbeRequest(from string, maximumB
 	return derivedPingRequest
 }
 
+// DeriveAsProbeRequest copies the request for the agent named from, setTargets puts the targets left to that agent
+// into the copy, e.g. those the policy of the hub allows it to probe
+func (pingReq *SimplePingRequest) DeriveAsProbeRequest(from string, setTargets func(derived *SimplePingRequest)) *SimplePingRequest {
+	derivedPingRequest := new(SimplePingRequest)
+	*derivedPingRequest = *pingReq
+	derivedPingRequest.From = []string{from}
+	setTargets(derivedPingRequest)
+	return derivedPingRequest
+}
+
 const ParamTargets = "targets"
 const ParamFrom = "from"
 const ParamCount = "count"
@@ -109,15 +166,28 @@ const ParamL4PacketType = "l4PacketType"
 const ParamL7PacketType = "l7PacketType"
 const ParamDNSTarget = "dnsTarget"
 const ParamHTTPTarget = "httpTarget"
+const ParamWSTarget = "wsTarget"
+const ParamGRPCTarget = "grpcTarget"
+const ParamTLSTarget = "tlsTarget"
+const ParamDualStackTarget = "dualStackTarget"
+const ParamNTPTarget = "ntpTarget"
+const ParamBannerTarget = "bannerTarget"
+const ParamSTUNTarget = "stunTarget"
+const ParamQUICTarget = "quicTarget"
+const ParamThroughputTarget = "throughputTarget"
 
 // it was a typo to name it 'l3PacketType', it should be 'l4PacketType' instead, use it only for backward compatibility
 const ParamL3PacketType = "l3PacketType"
 const ParamUDPDstPort = "udpDstPort"
+const ParamAdaptiveRate = "adaptiveRate"
+const ParamDNSDivergence = "dnsDivergence"
+const ParamHTTPDivergence = "httpDivergence"
 
 const defaultTTL = 64
 
 func ParseSimplePingRequest(r *http.Request) (*SimplePingRequest, error) {
 	result := new(SimplePingRequest)
+	var err error
 
 	if httpTgts := r.URL.Query()[ParamHTTPTarget]; httpTgts != nil {
 		result.HTTPTargets = make([]pkghttpprobe.HTTPProbe, 0)
@@ -138,10 +208,42 @@ func ParseSimplePingRequest(r *http.Request) (*SimplePingRequest, error) {
 				}
 			}
 
+			if err := tgtObject.ValidateRequest(); err != nil {
+				return nil, fmt.Errorf("invalid http target %s: %w", tgtObject.URL, err)
+			}
+
 			result.HTTPTargets = append(result.HTTPTargets, tgtObject)
 		}
 	}
 
+	if result.WSTargets, err = parseProbeTargets(r.URL.Query()[ParamWSTarget], "ws", func(tgt *pkgwsprobe.WSProbe) string { return tgt.URL }); err != nil {
+		return nil, err
+	}
+	if result.GRPCTargets, err = parseProbeTargets(r.URL.Query()[ParamGRPCTarget], "grpc", func(tgt *pkggrpcprobe.GRPCProbe) string { return tgt.Target }); err != nil {
+		return nil, err
+	}
+	if result.TLSTargets, err = parseProbeTargets(r.URL.Query()[ParamTLSTarget], "tls", func(tgt *pkghttpprobe.TLSScan) string { return tgt.Target }); err != nil {
+		return nil, err
+	}
+	if result.DualStackTargets, err = parseProbeTargets(r.URL.Query()[ParamDualStackTarget], "dual-stack", func(tgt *pkgdualstackprobe.DualStackProbe) string { return tgt.Target }); err != nil {
+		return nil, err
+	}
+	if result.NTPTargets, err = parseProbeTargets(r.URL.Query()[ParamNTPTarget], "ntp", func(tgt *pkgntpprobe.NTPProbe) string { return tgt.Target }); err != nil {
+		return nil, err
+	}
+	if result.BannerTargets, err = parseProbeTargets(r.URL.Query()[ParamBannerTarget], "banner", func(tgt *pkgbannerprobe.BannerProbe) string { return tgt.Target }); err != nil {
+		return nil, err
+	}
+	if result.STUNTargets, err = parseProbeTargets(r.URL.Query()[ParamSTUNTarget], "stun", func(tgt *pkgstunprobe.STUNProbe) string { return tgt.Target }); err != nil {
+		return nil, err
+	}
+	if result.QUICTargets, err = parseProbeTargets(r.URL.Query()[ParamQUICTarget], "quic", func(tgt *pkgquicprobe.QUICProbe) string { return tgt.Target }); err != nil {
+		return nil, err
+	}
+	if result.ThroughputTargets, err = parseProbeTargets(r.URL.Query()[ParamThroughputTarget], "throughput", func(tgt *pkgthroughput.ThroughputTest) string { return tgt.Receiver }); err != nil {
+		return nil, err
+	}
+
 	if dnsTargets := r.URL.Query()[ParamDNSTarget]; dnsTargets != nil {
 		result.DNSTargets = make([]pkgdnsprobe.LookupParameter, 0)
 		for _, tgt := range dnsTargets {
@@ -176,6 +278,30 @@ func ParseSimplePingRequest(r *http.Request) (*SimplePingRequest, error) {
 		result.UDPDstPort = &udpDstPortInt
 	}
 
+	if adaptiveRate := r.URL.Query().Get(ParamAdaptiveRate); adaptiveRate != "" {
+		adaptiveRateBool, err := strconv.ParseBool(adaptiveRate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse adaptive rate: %v", err)
+		}
+		result.AdaptiveRate = &adaptiveRateBool
+	}
+
+	if dnsDivergence := r.URL.Query().Get(ParamDNSDivergence); dnsDivergence != "" {
+		dnsDivergenceBool, err := strconv.ParseBool(dnsDivergence)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse dns divergence: %v", err)
+		}
+		result.DNSDivergence = &dnsDivergenceBool
+	}
+
+	if httpDivergence := r.URL.Query().Get(ParamHTTPDivergence); httpDivergence != "" {
+		httpDivergenceBool, err := strconv.ParseBool(httpDivergence)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse http divergence: %v", err)
+		}
+		result.HTTPDivergence = &httpDivergenceBool
+	}
+
 	if ipInfoProviderName := r.URL.Query().Get(ParamsIPInfoProviderName); ipInfoProviderName != "" {
 		result.IPInfoProviderName = &ipInfoProviderName
 	}
@@ -336,6 +462,15 @@ func (pr *SimplePingRequest) ToURLValues() url.Values {
 	if pr.UDPDstPort != nil {
 		vals.Add(ParamUDPDstPort, strconv.Itoa(*pr.UDPDstPort))
 	}
+	if pr.AdaptiveRate != nil {
+		vals.Add(ParamAdaptiveRate, strconv.FormatBool(*pr.AdaptiveRate))
+	}
+	if pr.DNSDivergence != nil {
+		vals.Add(ParamDNSDivergence, strconv.FormatBool(*pr.DNSDivergence))
+	}
+	if pr.HTTPDivergence != nil {
+		vals.Add(ParamHTTPDivergence, strconv.FormatBool(*pr.HTTPDivergence))
+	}
 	if pr.L7PacketType != nil && *pr.L7PacketType != "" {
 		vals.Add(ParamL7PacketType, string(*pr.L7PacketType))
 	}
@@ -360,6 +495,16 @@ func (pr *SimplePingRequest) ToURLValues() url.Values {
 		}
 	}
 
+	encodeProbeTargets(vals, ParamWSTarget, pr.WSTargets, "ws")
+	encodeProbeTargets(vals, ParamGRPCTarget, pr.GRPCTargets, "grpc")
+	encodeProbeTargets(vals, ParamTLSTarget, pr.TLSTargets, "tls")
+	encodeProbeTargets(vals, ParamDualStackTarget, pr.DualStackTargets, "dual-stack")
+	encodeProbeTargets(vals, ParamNTPTarget, pr.NTPTargets, "ntp")
+	encodeProbeTargets(vals, ParamBannerTarget, pr.BannerTargets, "banner")
+	encodeProbeTargets(vals, ParamSTUNTarget, pr.STUNTargets, "stun")
+	encodeProbeTargets(vals, ParamQUICTarget, pr.QUICTargets, "quic")
+	encodeProbeTargets(vals, ParamThroughputTarget, pr.ThroughputTargets, "throughput")
+
 	return vals
 }
 
@@ -467,3 +612,39 @@ func (rt *RangeTTL) String() string {
 	}
 	return strings.Join(segs, ",")
 }
+
+// encodeProbeTargets adds each of the targets encoded as a value of param, it's the counterpart of parseProbeTargets,
+// kind tells what the targets are in the log
+func encodeProbeTargets[T any](vals url.Values, param string, targets []T, kind string) {
+	for _, tgt := range targets {
+		j, err := json.Marshal(tgt)
+		if err != nil {
+			log.Printf("failed to marshal %s target: %v", kind, err)
+			continue
+		}
+		vals.Add(param, string(j))
+	}
+}
+
+// parseProbeTargets decodes each of the values as a target of the kind and validates it, name tells what the target is
+// called in the error, nil is returned if there are no values at all
+func parseProbeTargets[T any, PT interface {
+	*T
+	Validate() error
+}](values []string, kind string, name func(tgt *T) string) ([]T, error) {
+	if values == nil {
+		return nil, nil
+	}
+	targets := make([]T, 0, len(values))
+	for _, value := range values {
+		var tgt T
+		if err := json.Unmarshal([]byte(value), &tgt); err != nil {
+			return nil, fmt.Errorf("failed to parse %s target: %v", kind, err)
+		}
+		if err := PT(&tgt).Validate(); err != nil {
+			return nil, fmt.Errorf("invalid %s target %s: %w", kind, name(&tgt), err)
+		}
+		targets = append(targets, tgt)
+	}
+	return targets, nil
+}
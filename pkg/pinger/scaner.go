@@ -31,6 +31,23 @@ type IPProbeEvent struct {
 	Peer string
 }
 
+// Emitted periodically when the scan is running with adaptive rate enabled.
+type ScanRateControlEvent struct {
+	CIDR        string      `json:"cidr"`
+	RateControl *AIMDStatus `json:"rateControl"`
+}
+
+// How often the adaptive rate controller re-evaluates the sending rate.
+const scanRateAdjustInterval = 1 * time.Second
+
+// Returns the maximum rate (pkts/sec) the agent allows us to send at, 0 if unknown.
+func (sp *SimpleBlockScanner) getOutboundRateLimit() float64 {
+	if reporter, ok := sp.RateLimiter.(pkgratelimit.RateReporter); ok && reporter != nil {
+		return reporter.GetMaxRate()
+	}
+	return 0
+}
+
 func (sp *SimpleBlockScanner) withRateLimiter(unthrottled <-chan net.IP, rateLimiter pkgratelimit.RateLimiter) <-chan net.IP {
 	// Use context.Background() so the rate limiter is NOT tied to any parent
 	// context lifecycle.  The only way to cancel it is closing the source channel
@@ -121,6 +138,11 @@ func (sp *SimpleBlockScanner) pingCIDR(ctx context.Context, ipCidrStr string) <-
 		}
 		tracker.Run(ctx)
 
+		var rateCtl *AIMDRateController
+		if pingRequest.AdaptiveRate != nil && *pingRequest.AdaptiveRate {
+			rateCtl = NewAIMDRateController(pkgInterval, sp.getOutboundRateLimit())
+		}
+
 		nwAddr, ipNet, err := net.ParseCIDR(ipCidrStr)
 		if err != nil {
 			ch <- PingEvent{Error: fmt.Errorf("invalid cidr %w: %s", err, ipCidrStr)}
@@ -219,6 +241,9 @@ func (sp *SimpleBlockScanner) pingCIDR(ctx context.Context, ipCidrStr string) <-
 		go func() {
 			defer goroutineWG.Done()
 			for ev := range tracker.RecvEvC {
+				if rateCtl != nil {
+					rateCtl.Observe(ev.HasReceived())
+				}
 				select {
 				case ch <- PingEvent{Data: sp.newProbeEvent(&ev)}:
 					inFlightPktWg.Done()
@@ -231,6 +256,43 @@ func (sp *SimpleBlockScanner) pingCIDR(ctx context.Context, ipCidrStr string) <-
 			}
 		}()
 
+		// Rate control goroutine: periodically let the controller decide the
+		// next sending rate and report the decision in the event stream.
+		if rateCtl != nil {
+			stopRateCtl := make(chan struct{})
+			var rateCtlWG sync.WaitGroup
+			// Registered after close(ch), so it runs before it.
+			defer func() {
+				close(stopRateCtl)
+				rateCtlWG.Wait()
+			}()
+
+			rateCtlWG.Add(1)
+			go func() {
+				defer rateCtlWG.Done()
+				ticker := time.NewTicker(scanRateAdjustInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-stopRateCtl:
+						return
+					case <-ticker.C:
+						status := rateCtl.Adjust()
+						ev := PingEvent{Data: &ScanRateControlEvent{CIDR: ipNet.String(), RateControl: &status}}
+						select {
+						case ch <- ev:
+						case <-ctx.Done():
+							return
+						case <-stopRateCtl:
+							return
+						}
+					}
+				}
+			}()
+		}
+
 		// Main loop: iterate addresses and send pings.
 		addressesChRaw := pkgutils.GetMemberAddresses32(ctx, *ipNet)
 		var addressesCh <-chan net.IP
@@ -289,7 +351,11 @@ func (sp *SimpleBlockScanner) pingCIDR(ctx context.Context, ipCidrStr string) <-
 
 				numPktsSent++
 				counterStore.LogPktSent(commonLabels)
-				<-time.After(pkgInterval)
+				if rateCtl != nil {
+					<-time.After(rateCtl.GetInterval())
+				} else {
+					<-time.After(pkgInterval)
+				}
 			}
 		}
 	}()
@@ -0,0 +1,65 @@
+package pinger
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+
+	pkgratelimit "github.com/internetworklab/cloudping/pkg/ratelimit"
+	pkgthroughput "github.com/internetworklab/cloudping/pkg/throughput"
+)
+
+// ThroughputPinger runs the agent's part of throughput tests, the hub has decided which part it is
+type ThroughputPinger struct {
+	Requests    []pkgthroughput.ThroughputTest
+	RateLimiter pkgratelimit.RateLimiter
+	// Where the tests of the receiver role are opened
+	Receiver *pkgthroughput.Receiver
+	// What the sender uses to connect to the receiver's HTTP endpoint
+	ClientTLSConfig *tls.Config
+}
+
+func (tp *ThroughputPinger) Ping(ctx context.Context) <-chan PingEvent {
+	evChan := make(chan PingEvent)
+	go func() {
+		defer close(evChan)
+		wg := &sync.WaitGroup{}
+		defer wg.Wait()
+		for _, request := range tp.Requests {
+			wg.Add(1)
+			go func(req pkgthroughput.ThroughputTest) {
+				defer wg.Done()
+				if req.Role == pkgthroughput.RoleReceiver {
+					tp.receive(ctx, req, evChan)
+				} else {
+					tp.send(ctx, req, evChan)
+				}
+			}(request)
+		}
+	}()
+	return evChan
+}
+
+func (tp *ThroughputPinger) receive(ctx context.Context, req pkgthroughput.ThroughputTest, evChan chan<- PingEvent) {
+	if tp.Receiver == nil {
+		evChan <- PingEvent{Error: fmt.Errorf("throughput receiver is not enabled")}
+		return
+	}
+	session, err := tp.Receiver.Open(req)
+	if err != nil {
+		evChan <- PingEvent{Error: fmt.Errorf("failed to open throughput receiver session: %w", err)}
+		return
+	}
+	// the hub starts the sender only after seeing this
+	evChan <- PingEvent{Data: pkgthroughput.ThroughputEvent{CorrelationID: req.CorrelationID, Role: req.Role, Ready: true}}
+	result := tp.Receiver.Wait(ctx, session)
+	evChan <- PingEvent{Data: pkgthroughput.ThroughputEvent{CorrelationID: req.CorrelationID, Role: req.Role, Result: result}}
+}
+
+func (tp *ThroughputPinger) send(ctx context.Context, req pkgthroughput.ThroughputTest, evChan chan<- PingEvent) {
+	result := req.Send(ctx, tp.ClientTLSConfig, tp.RateLimiter, func(interval pkgthroughput.ThroughputInterval) {
+		evChan <- PingEvent{Data: pkgthroughput.ThroughputEvent{CorrelationID: req.CorrelationID, Role: req.Role, Interval: &interval}}
+	})
+	evChan <- PingEvent{Data: pkgthroughput.ThroughputEvent{CorrelationID: req.CorrelationID, Role: req.Role, Result: result}}
+}
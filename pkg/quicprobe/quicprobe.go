@@ -0,0 +1,389 @@
+package quicprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	pkghttpprobe "github.com/internetworklab/cloudping/pkg/httpprobe"
+	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
+	quicGo "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/qlogwriter"
+)
+
+const (
+	defaultPort    = "443"
+	defaultTimeout = 10 * time.Second
+
+	// How long to wait for a session ticket after the first handshake, before trying 0-RTT
+	sessionTicketWait = time.Second
+
+	// How long to wait for an ICMP port unreachable, after the handshake got nothing back
+	portUnreachableWait = 500 * time.Millisecond
+)
+
+var defaultALPN = []string{"h3"}
+
+var quicVersions = map[string]quicGo.Version{
+	"v1": quicGo.Version1,
+	"v2": quicGo.Version2,
+}
+
+type QUICErrorKind string
+
+const (
+	// The server doesn't support any of the versions offered
+	QUICErrorVersionNegotiation QUICErrorKind = "version_negotiation"
+	// Some packets came back from the server, but the handshake didn't complete in time
+	QUICErrorHandshakeTimeout QUICErrorKind = "handshake_timeout"
+	// Nothing came back from the server at all, UDP is likely filtered somewhere on the path
+	QUICErrorUDPBlocked QUICErrorKind = "udp_blocked"
+	// Nothing came back to the handshake, but an ICMP port unreachable came back to a datagram sent on a
+	// connected socket, UDP gets through but nothing listens on the port
+	QUICErrorPortUnreachable QUICErrorKind = "port_unreachable"
+	// The server aborted the TLS handshake, e.g. because none of the ALPNs is acceptable
+	QUICErrorTLS   QUICErrorKind = "tls"
+	QUICErrorOther QUICErrorKind = "other"
+)
+
+// QUICProbe does a bare QUIC handshake with Target, no HTTP/3 request is sent, so that the reachability
+// of QUIC is told apart from the behavior of the HTTP/3 server.
+type QUICProbe struct {
+	// host or host:port, default port is 443, e.g. 'cloudflare.com' or '[2001:db8::1]:4433'
+	Target string `json:"target"`
+
+	// default is 'h3'
+	ALPN []string `json:"alpn,omitempty"`
+
+	// default is the host of the target, unless it's an IP address
+	SNI string `json:"sni,omitempty"`
+
+	// QUIC versions to offer, 'v1' (RFC 9000) and/or 'v2' (RFC 9369), default is both
+	Versions []string `json:"versions,omitempty"`
+
+	// When true, a second handshake is done with the session ticket obtained from the first one, to tell whether 0-RTT is accepted
+	Try0RTT bool `json:"try0RTT,omitempty"`
+
+	// Of each handshake, default is 10000
+	TimeoutMs *int `json:"timeoutMs,omitempty"`
+
+	Resolver *string                            `json:"resolver,omitempty"`
+	IPPref   *pkghttpprobe.InetFamilyPreference `json:"inetFamilyPreference,omitempty"`
+
+	CorrelationID string `json:"correlationId,omitempty"`
+
+	// list of paths to additional CAs to trust in addition to the system's default CAs
+	AddCA []string
+}
+
+type QUIC0RTTResult struct {
+	// Whether a session ticket was issued by the server at all
+	TicketReceived bool          `json:"ticket_received"`
+	Accepted       bool          `json:"accepted"`
+	HandshakeRTT   time.Duration `json:"handshake_rtt,omitempty"`
+	Error          string        `json:"error,omitempty"`
+}
+
+type QUICProbeResult struct {
+	CorrelationID string    `json:"correlationId"`
+	Target        string    `json:"target"`
+	SNI           string    `json:"sni,omitempty"`
+	RemoteAddr    string    `json:"remote_addr,omitempty"`
+	LocalAddr     string    `json:"local_addr,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+
+	// From sending the first Initial packet to the completion of the handshake
+	HandshakeRTT time.Duration `json:"handshake_rtt"`
+	Version      string        `json:"version,omitempty"`
+	ALPN         string        `json:"alpn,omitempty"`
+	// Whether the server asked for an address validation by a Retry packet
+	RetryReceived bool `json:"retry_received"`
+	// Versions the server listed in its Version Negotiation packet, if any
+	ServerVersions []string `json:"server_versions,omitempty"`
+
+	ZeroRTT *QUIC0RTTResult             `json:"zero_rtt,omitempty"`
+	TLS     *pkghttpprobe.TLSInspection `json:"tls,omitempty"`
+
+	ErrorKind QUICErrorKind `json:"error_kind,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// packetTracer is a qlog trace that only keeps what the probe is interested in
+type packetTracer struct {
+	received      atomic.Int32
+	retryReceived atomic.Bool
+}
+
+func (tracer *packetTracer) AddProducer() qlogwriter.Recorder {
+	return tracer
+}
+
+func (tracer *packetTracer) SupportsSchemas(schema string) bool {
+	return true
+}
+
+func (tracer *packetTracer) RecordEvent(ev qlogwriter.Event) {
+	switch ev := ev.(type) {
+	case qlog.PacketReceived:
+		tracer.received.Add(1)
+		if ev.Header.PacketType == qlog.PacketTypeRetry {
+			tracer.retryReceived.Store(true)
+		}
+	case qlog.PacketDropped, qlog.VersionNegotiationReceived:
+		// undecryptable packets still prove that UDP gets through
+		tracer.received.Add(1)
+	}
+}
+
+func (tracer *packetTracer) Close() error {
+	return nil
+}
+
+// sessionCache notifies when a session ticket is stored
+type sessionCache struct {
+	tls.ClientSessionCache
+	stored chan struct{}
+}
+
+func (cache *sessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	cache.ClientSessionCache.Put(sessionKey, cs)
+	if cs != nil {
+		select {
+		case cache.stored <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (probe *QUICProbe) getAddr() string {
+	return pkgutils.WithDefaultPort(probe.Target, defaultPort)
+}
+
+// GetHost returns the host of the target, without the port
+func (probe *QUICProbe) GetHost() string {
+	host, _, _ := net.SplitHostPort(probe.getAddr())
+	return host
+}
+
+func (probe *QUICProbe) Validate() error {
+	if err := pkgutils.ValidateHostPort(probe.Target, defaultPort); err != nil {
+		return err
+	}
+	if _, err := probe.getVersions(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (probe *QUICProbe) getVersions() ([]quicGo.Version, error) {
+	if len(probe.Versions) == 0 {
+		return nil, nil
+	}
+	versions := make([]quicGo.Version, 0, len(probe.Versions))
+	for _, name := range probe.Versions {
+		version, ok := quicVersions[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported quic version %s, expected v1 or v2", name)
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// getErrorKind tells why the handshake failed, packetsReceived is the number of packets seen from the server
+func getErrorKind(err error, packetsReceived int) QUICErrorKind {
+	var vnErr *quicGo.VersionNegotiationError
+	if errors.As(err, &vnErr) {
+		return QUICErrorVersionNegotiation
+	}
+	if errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) {
+		return QUICErrorUDPBlocked
+	}
+	var handshakeTimeoutErr *quicGo.HandshakeTimeoutError
+	var idleTimeoutErr *quicGo.IdleTimeoutError
+	if errors.As(err, &handshakeTimeoutErr) || errors.As(err, &idleTimeoutErr) || errors.Is(err, context.DeadlineExceeded) {
+		if packetsReceived == 0 {
+			return QUICErrorUDPBlocked
+		}
+		return QUICErrorHandshakeTimeout
+	}
+	var transportErr *quicGo.TransportError
+	if errors.As(err, &transportErr) && transportErr.ErrorCode.IsCryptoError() {
+		return QUICErrorTLS
+	}
+	return QUICErrorOther
+}
+
+// isPortUnreachable tells whether an ICMP port unreachable comes back from addr, the socket quic-go dials on isn't connected,
+// so the ICMP error never reaches the handshake, it only shows on a connected one
+func isPortUnreachable(ctx context.Context, addr string) bool {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(portUnreachableWait))
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return errors.Is(err, syscall.ECONNREFUSED)
+	}
+	_, err = conn.Read(make([]byte, 1))
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func getErrorMessage(kind QUICErrorKind, err error, timeout time.Duration) string {
+	switch kind {
+	case QUICErrorVersionNegotiation:
+		return fmt.Sprintf("version negotiation failed: %v", err)
+	case QUICErrorUDPBlocked:
+		return fmt.Sprintf("udp blocked, no response from the server: %v", err)
+	case QUICErrorPortUnreachable:
+		return fmt.Sprintf("port unreachable, nothing listens on the port: %v", err)
+	case QUICErrorHandshakeTimeout:
+		return fmt.Sprintf("handshake didn't complete within %v: %v", timeout, err)
+	case QUICErrorTLS:
+		return fmt.Sprintf("tls handshake failed: %v", err)
+	default:
+		return fmt.Sprintf("failed to handshake: %v", err)
+	}
+}
+
+func (probe *QUICProbe) Do(ctx context.Context) *QUICProbeResult {
+	result := &QUICProbeResult{
+		CorrelationID: probe.CorrelationID,
+		Target:        probe.Target,
+		StartedAt:     time.Now(),
+	}
+
+	timeout := defaultTimeout
+	if probe.TimeoutMs != nil && *probe.TimeoutMs > 0 {
+		timeout = time.Duration(*probe.TimeoutMs) * time.Millisecond
+	}
+
+	host, port, err := net.SplitHostPort(probe.getAddr())
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid target %s: %v", probe.Target, err)
+		return result
+	}
+	versions, err := probe.getVersions()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	serverName := probe.SNI
+	if serverName == "" && net.ParseIP(host) == nil {
+		serverName = host
+	}
+	result.SNI = serverName
+	alpn := probe.ALPN
+	if len(alpn) == 0 {
+		alpn = defaultALPN
+	}
+
+	rootCAs, err := pkgutils.LoadRootCAs(probe.AddCA)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	ip, err := pkgutils.LookupFirstIP(ctx, probe.Resolver, probe.IPPref, host)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	addr := net.JoinHostPort(ip.String(), port)
+	result.RemoteAddr = addr
+
+	cache := &sessionCache{ClientSessionCache: tls.NewLRUClientSessionCache(1), stored: make(chan struct{}, 1)}
+	// The certificates are verified by InspectTLS after the handshake, so that a bad one is reported rather than aborting the probe
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         alpn,
+		InsecureSkipVerify: true,
+		ClientSessionCache: cache,
+	}
+	tracer := &packetTracer{}
+	quicConfig := &quicGo.Config{
+		Versions:             versions,
+		HandshakeIdleTimeout: timeout,
+		Tracer: func(ctx context.Context, isClient bool, connID quicGo.ConnectionID) qlogwriter.Trace {
+			return tracer
+		},
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	startedAt := time.Now()
+	conn, err := quicGo.DialAddr(dialCtx, addr, tlsConfig, quicConfig)
+	result.RetryReceived = tracer.retryReceived.Load()
+	if err != nil {
+		var vnErr *quicGo.VersionNegotiationError
+		if errors.As(err, &vnErr) {
+			for _, version := range vnErr.Theirs {
+				result.ServerVersions = append(result.ServerVersions, version.String())
+			}
+		}
+		result.ErrorKind = getErrorKind(err, int(tracer.received.Load()))
+		if result.ErrorKind == QUICErrorUDPBlocked && isPortUnreachable(ctx, addr) {
+			result.ErrorKind = QUICErrorPortUnreachable
+		}
+		result.Error = getErrorMessage(result.ErrorKind, err, timeout)
+		return result
+	}
+	result.HandshakeRTT = time.Since(startedAt)
+	result.LocalAddr = conn.LocalAddr().String()
+
+	state := conn.ConnectionState()
+	result.Version = state.Version.String()
+	result.ALPN = state.TLS.NegotiatedProtocol
+	verifyName := serverName
+	if verifyName == "" {
+		verifyName = host
+	}
+	result.TLS = pkghttpprobe.InspectTLS(&state.TLS, verifyName, rootCAs)
+
+	if !probe.Try0RTT {
+		conn.CloseWithError(0, "")
+		return result
+	}
+
+	result.ZeroRTT = &QUIC0RTTResult{}
+	// the ticket arrives after the handshake, the connection has to stay open until then
+	select {
+	case <-cache.stored:
+		result.ZeroRTT.TicketReceived = true
+	case <-time.After(sessionTicketWait):
+	case <-ctx.Done():
+	}
+	conn.CloseWithError(0, "")
+	if !result.ZeroRTT.TicketReceived {
+		result.ZeroRTT.Error = "no session ticket received from the server"
+		return result
+	}
+
+	earlyCtx, earlyCancel := context.WithTimeout(ctx, timeout)
+	defer earlyCancel()
+	startedAt = time.Now()
+	earlyConn, err := quicGo.DialAddrEarly(earlyCtx, addr, tlsConfig, quicConfig)
+	if err != nil {
+		result.ZeroRTT.Error = fmt.Sprintf("failed to dial with 0-rtt: %v", err)
+		return result
+	}
+	defer earlyConn.CloseWithError(0, "")
+	select {
+	case <-earlyConn.HandshakeComplete():
+	case <-earlyCtx.Done():
+		result.ZeroRTT.Error = fmt.Sprintf("0-rtt handshake didn't complete within %v", timeout)
+		return result
+	}
+	result.ZeroRTT.HandshakeRTT = time.Since(startedAt)
+	result.ZeroRTT.Accepted = earlyConn.ConnectionState().Used0RTT
+	return result
+}
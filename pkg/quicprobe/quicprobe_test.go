@@ -0,0 +1,167 @@
+package quicprobe
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	quicGo "github.com/quic-go/quic-go"
+)
+
+func TestGetErrorKind(t *testing.T) {
+	cases := []struct {
+		err             error
+		packetsReceived int
+		expected        QUICErrorKind
+	}{
+		{&quicGo.VersionNegotiationError{Theirs: []quicGo.Version{0x1a2a3a4a}}, 1, QUICErrorVersionNegotiation},
+		{&quicGo.HandshakeTimeoutError{}, 0, QUICErrorUDPBlocked},
+		{&quicGo.IdleTimeoutError{}, 0, QUICErrorUDPBlocked},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), 0, QUICErrorUDPBlocked},
+		{&quicGo.HandshakeTimeoutError{}, 3, QUICErrorHandshakeTimeout},
+		// CRYPTO_ERROR of the no_application_protocol alert
+		{&quicGo.TransportError{ErrorCode: 0x100 + 120, Remote: true}, 2, QUICErrorTLS},
+		{&quicGo.TransportError{ErrorCode: quicGo.ProtocolViolation, Remote: true}, 2, QUICErrorOther},
+	}
+	for _, c := range cases {
+		if kind := getErrorKind(c.err, c.packetsReceived); kind != c.expected {
+			t.Errorf("expected %s for %v with %d packets received, got %s", c.expected, c.err, c.packetsReceived, kind)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, target := range []string{"example.com", "example.com:4433", "[2001:db8::1]:443", "2001:db8::1"} {
+		probe := &QUICProbe{Target: target, Versions: []string{"v1", "V2"}}
+		if err := probe.Validate(); err != nil {
+			t.Errorf("expected %s to be valid, got %v", target, err)
+		}
+	}
+	if err := (&QUICProbe{Target: "example.com", Versions: []string{"draft-29"}}).Validate(); err == nil {
+		t.Errorf("expected unsupported version to be rejected")
+	}
+	if err := (&QUICProbe{Target: "example.com:0"}).Validate(); err == nil {
+		t.Errorf("expected port 0 to be rejected")
+	}
+}
+
+// listens with the certificate of an httptest server, which is valid for example.com, returns the address and
+// the path to the CA of the certificate
+func startTestQUICServer(t *testing.T, alpn []string, quicConfig *quicGo.Config, requireRetry bool) (string, string) {
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(tlsServer.Close)
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := tlsServer.TLS.Clone()
+	tlsConfig.NextProtos = alpn
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &quicGo.Transport{Conn: udpConn}
+	if requireRetry {
+		tr.VerifySourceAddress = func(net.Addr) bool { return true }
+	}
+	t.Cleanup(func() { tr.Close() })
+	ln, err := tr.ListenEarly(tlsConfig, quicConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				<-conn.Context().Done()
+			}()
+		}
+	}()
+	return udpConn.LocalAddr().String(), caPath
+}
+
+func TestDo(t *testing.T) {
+	addr, caPath := startTestQUICServer(t, []string{"h3"}, &quicGo.Config{Allow0RTT: true}, false)
+	probe := &QUICProbe{Target: addr, SNI: "example.com", ALPN: []string{"foo", "h3"}, Versions: []string{"v2"}, Try0RTT: true, AddCA: []string{caPath}}
+	result := probe.Do(context.Background())
+	if result.Error != "" {
+		t.Fatalf("unexpected error: %s", result.Error)
+	}
+	if result.Version != "v2" || result.ALPN != "h3" || result.HandshakeRTT <= 0 || result.RetryReceived {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if result.TLS == nil || !result.TLS.Verified {
+		t.Fatalf("expected the certificate to be verified against the additional CA, got %+v", result.TLS)
+	}
+	if result.ZeroRTT == nil || !result.ZeroRTT.TicketReceived || !result.ZeroRTT.Accepted {
+		t.Fatalf("expected 0-rtt to be accepted, got %+v", result.ZeroRTT)
+	}
+}
+
+func TestDo_0RTTRejected(t *testing.T) {
+	addr, _ := startTestQUICServer(t, []string{"h3"}, &quicGo.Config{}, false)
+	result := (&QUICProbe{Target: addr, Try0RTT: true}).Do(context.Background())
+	if result.Error != "" {
+		t.Fatalf("unexpected error: %s", result.Error)
+	}
+	// tickets are issued for resumption all the same
+	if result.ZeroRTT == nil || !result.ZeroRTT.TicketReceived || result.ZeroRTT.Accepted {
+		t.Fatalf("expected 0-rtt to be rejected, got %+v", result.ZeroRTT)
+	}
+}
+
+func TestDo_Retry(t *testing.T) {
+	addr, _ := startTestQUICServer(t, []string{"h3"}, &quicGo.Config{}, true)
+	result := (&QUICProbe{Target: addr}).Do(context.Background())
+	if result.Error != "" || !result.RetryReceived {
+		t.Fatalf("expected the handshake to succeed after a retry, got %+v", result)
+	}
+}
+
+func TestDo_Errors(t *testing.T) {
+	v1Addr, _ := startTestQUICServer(t, []string{"h3"}, &quicGo.Config{Versions: []quicGo.Version{quicGo.Version1}}, false)
+	result := (&QUICProbe{Target: v1Addr, Versions: []string{"v2"}}).Do(context.Background())
+	if result.ErrorKind != QUICErrorVersionNegotiation || !slices.Contains(result.ServerVersions, "v1") {
+		t.Errorf("expected the version negotiation to fail with the server listing v1 among the greased versions, got %+v", result)
+	}
+
+	result = (&QUICProbe{Target: v1Addr, ALPN: []string{"foo"}}).Do(context.Background())
+	if result.ErrorKind != QUICErrorTLS {
+		t.Errorf("expected a tls error for an unacceptable alpn, got %+v", result)
+	}
+
+	// swallows whatever it receives
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	timeoutMs := 300
+	result = (&QUICProbe{Target: silent.LocalAddr().String(), TimeoutMs: &timeoutMs}).Do(context.Background())
+	if result.ErrorKind != QUICErrorUDPBlocked {
+		t.Errorf("expected udp to look blocked, got %+v", result)
+	}
+
+	// nothing listens on the port, an ICMP port unreachable comes back
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.LocalAddr().String()
+	closed.Close()
+	result = (&QUICProbe{Target: closedAddr, TimeoutMs: &timeoutMs}).Do(context.Background())
+	if result.ErrorKind != QUICErrorPortUnreachable {
+		t.Errorf("expected the port to be unreachable, got %+v", result)
+	}
+}
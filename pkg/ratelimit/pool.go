@@ -109,3 +109,10 @@ func (pool *MemoryBasedRateLimitPool) Consume(ctx context.Context, key string) (
 
 	return <-resultCh, <-serviceRequest.Err
 }
+
+func (pool *MemoryBasedRateLimitPool) GetMaxRate() float64 {
+	if pool.RefreshIntv <= 0 {
+		return 0
+	}
+	return float64(pool.NumTokensPerKey) / pool.RefreshIntv.Seconds()
+}
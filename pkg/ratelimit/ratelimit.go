@@ -68,3 +68,10 @@ func (rl *MemoryBasedRateLimiter) GetIO(ctx context.Context) (chan<- interface{}
 
 	return inC, outC
 }
+
+func (rl *MemoryBasedRateLimiter) GetMaxRate() float64 {
+	if reporter, ok := rl.Pool.(RateReporter); ok {
+		return reporter.GetMaxRate()
+	}
+	return 0
+}
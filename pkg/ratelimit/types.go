@@ -26,3 +26,11 @@ type RateLimitPool interface {
 	// Block until refresh
 	WaitForRefresh(ctx context.Context) error
 }
+
+// Implemented by rate limiters (or pools) whose steady-state throughput is known in advance,
+// so that adaptive senders can make sure they never go beyond it.
+type RateReporter interface {
+	// returns the maximum number of items per second allowed for a single key,
+	// a non-positive value means the rate is unknown.
+	GetMaxRate() float64
+}
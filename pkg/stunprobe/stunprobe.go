@@ -0,0 +1,438 @@
+package stunprobe
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	pkghttpprobe "github.com/internetworklab/cloudping/pkg/httpprobe"
+	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
+)
+
+const (
+	defaultPort    = "3478"
+	defaultTimeout = 1500 * time.Millisecond
+
+	// the retransmission timeout of the first attempt, it's doubled for each of the following ones, see section 7.2.1 of RFC 5389
+	initialRTO = 500 * time.Millisecond
+
+	headerSize  = 20
+	magicCookie = 0x2112A442
+
+	typeBindingRequest  = 0x0001
+	typeBindingSuccess  = 0x0101
+	typeBindingError    = 0x0111
+	attrMappedAddress   = 0x0001
+	attrChangeRequest   = 0x0003
+	attrChangedAddress  = 0x0005
+	attrErrorCode       = 0x0009
+	attrXORMappedAddr   = 0x0020
+	attrSoftware        = 0x8022
+	attrOtherAddress    = 0x802C
+	changeRequestIP     = 0x04
+	changeRequestPort   = 0x02
+	familyIPv4          = 0x01
+	familyIPv6          = 0x02
+	maxResponseDatagram = 1500
+)
+
+// See section 4.3 and 4.4 of RFC 5780
+type NATBehavior string
+
+const (
+	// No NAT at all, i.e. the mapped address is the local address
+	NATBehaviorNone                    NATBehavior = "no_nat"
+	NATBehaviorEndpointIndependent     NATBehavior = "endpoint_independent"
+	NATBehaviorAddressDependent        NATBehavior = "address_dependent"
+	NATBehaviorAddressAndPortDependent NATBehavior = "address_and_port_dependent"
+	// The server doesn't have an alternate address, so that the behavior can't be told
+	NATBehaviorUnknown NATBehavior = "unknown"
+)
+
+// STUNProbe sends Binding requests to a STUN server, to discover the mapped address of the agent, and the behavior of the NAT in between.
+type STUNProbe struct {
+	// host or host:port, default port is 3478, e.g. 'stun.example.com' or 'stun.l.google.com:19302'
+	Target string `json:"target"`
+
+	// When true, the mapping and the filtering behaviors are discovered as well, which takes several more requests,
+	// and requires the server to support RFC 5780, i.e. to have an alternate address.
+	DiscoverBehavior bool `json:"discoverBehavior,omitempty"`
+
+	// Of each transaction, including the retransmissions, default is 1500
+	TimeoutMs *int `json:"timeoutMs,omitempty"`
+
+	Resolver *string                            `json:"resolver,omitempty"`
+	IPPref   *pkghttpprobe.InetFamilyPreference `json:"inetFamilyPreference,omitempty"`
+
+	CorrelationID string `json:"correlationId,omitempty"`
+
+	// Tells if the agent is allowed to send to the alternate address the server tells about, nil allows any,
+	// since that address is chosen by the server rather than the requester, it's checked only here.
+	CheckOtherAddr func(addr netip.Addr) error `json:"-"`
+}
+
+type STUNProbeResult struct {
+	CorrelationID string    `json:"correlationId"`
+	Target        string    `json:"target"`
+	RemoteAddr    string    `json:"remote_addr,omitempty"`
+	LocalAddr     string    `json:"local_addr,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+
+	// Of the first Binding transaction
+	RTT time.Duration `json:"rtt"`
+
+	// The public address of the agent as seen by the server, from XOR-MAPPED-ADDRESS, or MAPPED-ADDRESS of older servers
+	MappedAddress string `json:"mapped_address,omitempty"`
+	// The alternate address of the server, from OTHER-ADDRESS, or CHANGED-ADDRESS of older servers
+	OtherAddress string `json:"other_address,omitempty"`
+	Software     string `json:"software,omitempty"`
+
+	MappingBehavior   NATBehavior `json:"mapping_behavior,omitempty"`
+	FilteringBehavior NATBehavior `json:"filtering_behavior,omitempty"`
+	// Why the mapping behavior is unknown although the server has an alternate address, e.g. it's not allowed to be sent to
+	MappingError string `json:"mapping_error,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+type bindingResponse struct {
+	mappedAddress netip.AddrPort
+	otherAddress  netip.AddrPort
+	software      string
+}
+
+func (probe *STUNProbe) getAddr() string {
+	return pkgutils.WithDefaultPort(probe.Target, defaultPort)
+}
+
+// GetHost returns the host of the target, without the port
+func (probe *STUNProbe) GetHost() string {
+	host, _, _ := net.SplitHostPort(probe.getAddr())
+	return host
+}
+
+func (probe *STUNProbe) Validate() error {
+	return pkgutils.ValidateHostPort(probe.Target, defaultPort)
+}
+
+func (probe *STUNProbe) getTimeout() time.Duration {
+	if probe.TimeoutMs == nil || *probe.TimeoutMs <= 0 {
+		return defaultTimeout
+	}
+	return time.Duration(*probe.TimeoutMs) * time.Millisecond
+}
+
+// newBindingRequest returns the request and its transaction id, changeFlags is the value of CHANGE-REQUEST, 0 means not having one
+func newBindingRequest(changeFlags uint32) ([]byte, []byte, error) {
+	txID := make([]byte, 12)
+	if _, err := rand.Read(txID); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate transaction id: %w", err)
+	}
+	msg := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(msg[0:2], typeBindingRequest)
+	binary.BigEndian.PutUint32(msg[4:8], magicCookie)
+	copy(msg[8:20], txID)
+	if changeFlags != 0 {
+		attr := make([]byte, 8)
+		binary.BigEndian.PutUint16(attr[0:2], attrChangeRequest)
+		binary.BigEndian.PutUint16(attr[2:4], 4)
+		binary.BigEndian.PutUint32(attr[4:8], changeFlags)
+		msg = append(msg, attr...)
+	}
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)-headerSize))
+	return msg, txID, nil
+}
+
+// parseAddress decodes MAPPED-ADDRESS and the alike, or XOR-MAPPED-ADDRESS when xor is true
+func parseAddress(value []byte, txID []byte, xor bool) (netip.AddrPort, error) {
+	if len(value) < 4 {
+		return netip.AddrPort{}, errors.New("address attribute is too short")
+	}
+	port := binary.BigEndian.Uint16(value[2:4])
+	var ip []byte
+	switch value[1] {
+	case familyIPv4:
+		if len(value) < 8 {
+			return netip.AddrPort{}, errors.New("ipv4 address attribute is too short")
+		}
+		ip = append(ip, value[4:8]...)
+	case familyIPv6:
+		if len(value) < 20 {
+			return netip.AddrPort{}, errors.New("ipv6 address attribute is too short")
+		}
+		ip = append(ip, value[4:20]...)
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unknown address family %d", value[1])
+	}
+	if xor {
+		port ^= magicCookie >> 16
+		key := binary.BigEndian.AppendUint32(nil, magicCookie)
+		key = append(key, txID...)
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr.Unmap(), port), nil
+}
+
+func parseBindingResponse(msg []byte, txID []byte) (*bindingResponse, error) {
+	if len(msg) < headerSize {
+		return nil, fmt.Errorf("response is too short, %d bytes", len(msg))
+	}
+	msgType := binary.BigEndian.Uint16(msg[0:2])
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	if binary.BigEndian.Uint32(msg[4:8]) != magicCookie {
+		return nil, errors.New("response has no magic cookie")
+	}
+	if headerSize+length > len(msg) {
+		return nil, errors.New("response is truncated")
+	}
+
+	response := &bindingResponse{}
+	var mappedAddress netip.AddrPort
+	var errorCode string
+	attrs := msg[headerSize : headerSize+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+attrLen > len(attrs) {
+			return nil, fmt.Errorf("attribute 0x%04x is truncated", attrType)
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case attrXORMappedAddr:
+			addr, err := parseAddress(value, txID, true)
+			if err != nil {
+				return nil, err
+			}
+			response.mappedAddress = addr
+		case attrMappedAddress:
+			addr, err := parseAddress(value, txID, false)
+			if err != nil {
+				return nil, err
+			}
+			mappedAddress = addr
+		case attrOtherAddress, attrChangedAddress:
+			addr, err := parseAddress(value, txID, false)
+			if err != nil {
+				return nil, err
+			}
+			response.otherAddress = addr
+		case attrSoftware:
+			response.software = string(value)
+		case attrErrorCode:
+			if len(value) >= 4 {
+				errorCode = fmt.Sprintf("%d%02d %s", value[2]&0x7, value[3], string(value[4:]))
+			}
+		}
+		// attributes are padded to a multiple of 4 bytes
+		attrs = attrs[min(len(attrs), 4+(attrLen+3)/4*4):]
+	}
+
+	switch msgType {
+	case typeBindingSuccess:
+	case typeBindingError:
+		return nil, fmt.Errorf("server responded with error %s", errorCode)
+	default:
+		return nil, fmt.Errorf("unexpected message type 0x%04x", msgType)
+	}
+	if !response.mappedAddress.IsValid() {
+		response.mappedAddress = mappedAddress
+	}
+	if !response.mappedAddress.IsValid() {
+		return nil, errors.New("response has no mapped address")
+	}
+	return response, nil
+}
+
+// what transact returns when all the attempts time out, which is what tells a filtered response apart from a failed one
+var errNoResponse = errors.New("no binding response")
+
+// transact sends a Binding request to dst and waits for the response, the request is retransmitted with a doubling timeout,
+// responses of other transactions are ignored, the one of CHANGE-REQUEST is expected from a different address.
+func transact(ctx context.Context, conn net.PacketConn, dst net.Addr, changeFlags uint32, timeout time.Duration) (*bindingResponse, time.Duration, error) {
+	request, txID, err := newBindingRequest(changeFlags)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	buf := make([]byte, maxResponseDatagram)
+	rto := initialRTO
+	sentAt := time.Now()
+	for time.Now().Before(deadline) {
+		sentAt = time.Now()
+		if _, err := conn.WriteTo(request, dst); err != nil {
+			return nil, 0, fmt.Errorf("failed to send binding request to %s: %v", dst.String(), err)
+		}
+		attemptDeadline := sentAt.Add(rto)
+		if attemptDeadline.After(deadline) {
+			attemptDeadline = deadline
+		}
+		conn.SetReadDeadline(attemptDeadline)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break
+				}
+				return nil, 0, fmt.Errorf("failed to receive binding response: %v", err)
+			}
+			if n < headerSize || string(buf[8:20]) != string(txID) {
+				continue
+			}
+			response, err := parseBindingResponse(buf[:n], txID)
+			return response, time.Since(sentAt), err
+		}
+		rto *= 2
+	}
+	return nil, 0, fmt.Errorf("%w from %s within %v", errNoResponse, dst.String(), timeout)
+}
+
+func (probe *STUNProbe) Do(ctx context.Context) *STUNProbeResult {
+	result := &STUNProbeResult{
+		CorrelationID: probe.CorrelationID,
+		Target:        probe.Target,
+		StartedAt:     time.Now(),
+	}
+
+	host, port, err := net.SplitHostPort(probe.getAddr())
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid target %s: %v", probe.Target, err)
+		return result
+	}
+	ip, err := pkgutils.LookupFirstIP(ctx, probe.Resolver, probe.IPPref, host)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	serverAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.RemoteAddr = serverAddr.String()
+
+	// the same socket is used for all the transactions, so that the mappings of different destinations could be compared
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to listen: %v", err)
+		return result
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	timeout := probe.getTimeout()
+	first, rtt, err := transact(ctx, conn, serverAddr, 0, timeout)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.RTT = rtt
+	result.MappedAddress = first.mappedAddress.String()
+	result.Software = first.software
+	if first.otherAddress.IsValid() {
+		result.OtherAddress = first.otherAddress.String()
+	}
+
+	localAddr := getLocalAddr(serverAddr, conn.LocalAddr())
+	if localAddr.IsValid() {
+		result.LocalAddr = localAddr.String()
+	}
+
+	if !probe.DiscoverBehavior {
+		return result
+	}
+	if localAddr.IsValid() && localAddr == first.mappedAddress {
+		result.MappingBehavior = NATBehaviorNone
+		result.FilteringBehavior = NATBehaviorNone
+		return result
+	}
+	if !first.otherAddress.IsValid() {
+		result.MappingBehavior = NATBehaviorUnknown
+		result.FilteringBehavior = NATBehaviorUnknown
+		return result
+	}
+
+	// the filtering tests only send to the server address, whereas the mapping tests send to the alternate one
+	if probe.CheckOtherAddr != nil {
+		if err := probe.CheckOtherAddr(first.otherAddress.Addr()); err != nil {
+			result.MappingBehavior = NATBehaviorUnknown
+			result.MappingError = fmt.Sprintf("other address %s is not allowed: %v", first.otherAddress.String(), err)
+		}
+	}
+	if result.MappingBehavior == "" {
+		result.MappingBehavior = discoverMapping(ctx, conn, serverAddr, first, timeout)
+	}
+	result.FilteringBehavior = discoverFiltering(ctx, conn, serverAddr, timeout)
+	return result
+}
+
+// getLocalAddr returns the address the mapped address is compared with, the source address is the one the kernel picks for dst
+func getLocalAddr(dst *net.UDPAddr, listenAddr net.Addr) netip.AddrPort {
+	probeConn, err := net.DialUDP("udp", nil, dst)
+	if err != nil {
+		return netip.AddrPort{}
+	}
+	defer probeConn.Close()
+	localIP, ok := netip.AddrFromSlice(probeConn.LocalAddr().(*net.UDPAddr).IP)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	listenUDPAddr, ok := listenAddr.(*net.UDPAddr)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(localIP.Unmap(), uint16(listenUDPAddr.Port))
+}
+
+// Test II and III of section 4.3 of RFC 5780
+func discoverMapping(ctx context.Context, conn net.PacketConn, serverAddr *net.UDPAddr, first *bindingResponse, timeout time.Duration) NATBehavior {
+	otherIP := first.otherAddress.Addr().AsSlice()
+	second, _, err := transact(ctx, conn, &net.UDPAddr{IP: otherIP, Port: serverAddr.Port}, 0, timeout)
+	if err != nil {
+		return NATBehaviorUnknown
+	}
+	if second.mappedAddress == first.mappedAddress {
+		return NATBehaviorEndpointIndependent
+	}
+	third, _, err := transact(ctx, conn, net.UDPAddrFromAddrPort(first.otherAddress), 0, timeout)
+	if err != nil {
+		return NATBehaviorUnknown
+	}
+	if third.mappedAddress == second.mappedAddress {
+		return NATBehaviorAddressDependent
+	}
+	return NATBehaviorAddressAndPortDependent
+}
+
+// Test II and III of section 4.4 of RFC 5780, only a timeout means the response is filtered,
+// an error response, e.g. 420 of a server not supporting CHANGE-REQUEST, or a socket error tells nothing about the NAT.
+func discoverFiltering(ctx context.Context, conn net.PacketConn, serverAddr *net.UDPAddr, timeout time.Duration) NATBehavior {
+	_, _, err := transact(ctx, conn, serverAddr, changeRequestIP|changeRequestPort, timeout)
+	if err == nil {
+		return NATBehaviorEndpointIndependent
+	}
+	if !errors.Is(err, errNoResponse) || ctx.Err() != nil {
+		return NATBehaviorUnknown
+	}
+	_, _, err = transact(ctx, conn, serverAddr, changeRequestPort, timeout)
+	if err == nil {
+		return NATBehaviorAddressDependent
+	}
+	if !errors.Is(err, errNoResponse) || ctx.Err() != nil {
+		return NATBehaviorUnknown
+	}
+	return NATBehaviorAddressAndPortDependent
+}
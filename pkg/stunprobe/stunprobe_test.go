@@ -0,0 +1,189 @@
+package stunprobe
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func getTestResponse(msgType uint16, txID []byte, attrs ...[]byte) []byte {
+	msg := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(msg[0:2], msgType)
+	binary.BigEndian.PutUint32(msg[4:8], magicCookie)
+	copy(msg[8:20], txID)
+	for _, attr := range attrs {
+		msg = append(msg, attr...)
+	}
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)-headerSize))
+	return msg
+}
+
+func TestParseBindingResponse(t *testing.T) {
+	// the XOR-MAPPED-ADDRESS of the IPv4 sample response of RFC 5769
+	txID := []byte{0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xae}
+	xorMapped := []byte{0x00, 0x20, 0x00, 0x08, 0x00, 0x01, 0xa1, 0x47, 0xe1, 0x12, 0xa6, 0x43}
+	software := []byte{0x80, 0x22, 0x00, 0x05, 't', 'e', 's', 't', 's', 0x00, 0x00, 0x00}
+	other := []byte{0x80, 0x2c, 0x00, 0x08, 0x00, 0x01, 0x0d, 0x97, 198, 51, 100, 2}
+
+	response, err := parseBindingResponse(getTestResponse(typeBindingSuccess, txID, software, xorMapped, other), txID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := response.mappedAddress.String(); got != "192.0.2.1:32853" {
+		t.Errorf("expected mapped address 192.0.2.1:32853, got %s", got)
+	}
+	if got := response.otherAddress.String(); got != "198.51.100.2:3479" {
+		t.Errorf("expected other address 198.51.100.2:3479, got %s", got)
+	}
+	if response.software != "tests" {
+		t.Errorf("expected software 'tests', got %q", response.software)
+	}
+
+	errorCode := []byte{0x00, 0x09, 0x00, 0x0b, 0x00, 0x00, 0x04, 0x00, 'B', 'a', 'd', ' ', 'R', 'e', 'q', 0x00}
+	if _, err := parseBindingResponse(getTestResponse(typeBindingError, txID, errorCode), txID); err == nil {
+		t.Errorf("expected error response to be rejected")
+	}
+	if _, err := parseBindingResponse(getTestResponse(typeBindingSuccess, txID, software), txID); err == nil {
+		t.Errorf("expected response without mapped address to be rejected")
+	}
+}
+
+func TestNewBindingRequest(t *testing.T) {
+	request, txID, err := newBindingRequest(changeRequestIP | changeRequestPort)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(request) != headerSize+8 || binary.BigEndian.Uint16(request[2:4]) != 8 {
+		t.Fatalf("unexpected request length %d", len(request))
+	}
+	if string(request[8:20]) != string(txID) || binary.BigEndian.Uint32(request[24:28]) != 0x06 {
+		t.Errorf("unexpected request %x", request)
+	}
+}
+
+// serves Binding requests on the loopback, respond returns the response to a request of the given CHANGE-REQUEST flags, nil to drop it
+func startTestServer(t *testing.T, respond func(changeFlags uint32, txID []byte) []byte) *net.UDPAddr {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxResponseDatagram)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < headerSize || binary.BigEndian.Uint16(buf[0:2]) != typeBindingRequest {
+				continue
+			}
+			var changeFlags uint32
+			if n >= headerSize+8 && binary.BigEndian.Uint16(buf[20:22]) == attrChangeRequest {
+				changeFlags = binary.BigEndian.Uint32(buf[24:28])
+			}
+			if response := respond(changeFlags, buf[8:20]); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestDiscoverFiltering(t *testing.T) {
+	mapped := []byte{0x00, 0x01, 0x00, 0x08, 0x00, 0x01, 0x0d, 0x96, 192, 0, 2, 1}
+	unknownAttr := []byte{0x00, 0x09, 0x00, 0x15, 0x00, 0x00, 0x04, 0x14, 'U', 'n', 'k', 'n', 'o', 'w', 'n', ' ', 'A', 't', 't', 'r', 'i', 'b', 'u', 't', 'e', 0x00, 0x00, 0x00}
+	cases := []struct {
+		name     string
+		respond  func(changeFlags uint32, txID []byte) []byte
+		behavior NATBehavior
+	}{
+		{"all answered", func(changeFlags uint32, txID []byte) []byte {
+			return getTestResponse(typeBindingSuccess, txID, mapped)
+		}, NATBehaviorEndpointIndependent},
+		{"only the change of port answered", func(changeFlags uint32, txID []byte) []byte {
+			if changeFlags&changeRequestIP != 0 {
+				return nil
+			}
+			return getTestResponse(typeBindingSuccess, txID, mapped)
+		}, NATBehaviorAddressDependent},
+		{"none answered", func(changeFlags uint32, txID []byte) []byte {
+			return nil
+		}, NATBehaviorAddressAndPortDependent},
+		{"CHANGE-REQUEST not supported", func(changeFlags uint32, txID []byte) []byte {
+			return getTestResponse(typeBindingError, txID, unknownAttr)
+		}, NATBehaviorUnknown},
+		{"change of port not supported", func(changeFlags uint32, txID []byte) []byte {
+			if changeFlags&changeRequestIP != 0 {
+				return nil
+			}
+			return getTestResponse(typeBindingError, txID, unknownAttr)
+		}, NATBehaviorUnknown},
+	}
+	for _, c := range cases {
+		serverAddr := startTestServer(t, c.respond)
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		behavior := discoverFiltering(context.Background(), conn, serverAddr, 200*time.Millisecond)
+		conn.Close()
+		if behavior != c.behavior {
+			t.Errorf("%s: expected %s, got %s", c.name, c.behavior, behavior)
+		}
+	}
+
+	// a socket error isn't a timeout either
+	serverAddr := startTestServer(t, func(changeFlags uint32, txID []byte) []byte { return nil })
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if behavior := discoverFiltering(context.Background(), conn, serverAddr, 200*time.Millisecond); behavior != NATBehaviorUnknown {
+		t.Errorf("socket error: expected %s, got %s", NATBehaviorUnknown, behavior)
+	}
+}
+
+func TestDoOtherAddressNotAllowed(t *testing.T) {
+	mapped := []byte{0x00, 0x01, 0x00, 0x08, 0x00, 0x01, 0x0d, 0x96, 192, 0, 2, 1}
+	// an alternate address outside of what the agent is allowed to send to
+	other := []byte{0x80, 0x2c, 0x00, 0x08, 0x00, 0x01, 0x0d, 0x97, 10, 0, 0, 1}
+	serverAddr := startTestServer(t, func(changeFlags uint32, txID []byte) []byte {
+		return getTestResponse(typeBindingSuccess, txID, mapped, other)
+	})
+
+	checked := make([]netip.Addr, 0)
+	probe := &STUNProbe{
+		Target:           serverAddr.String(),
+		DiscoverBehavior: true,
+		CheckOtherAddr: func(addr netip.Addr) error {
+			checked = append(checked, addr)
+			if !netip.MustParsePrefix("127.0.0.0/8").Contains(addr) {
+				return fmt.Errorf("ip %s is not in the respond range", addr.String())
+			}
+			return nil
+		},
+	}
+	result := probe.Do(context.Background())
+	if result.Error != "" {
+		t.Fatalf("unexpected error: %s", result.Error)
+	}
+	if result.OtherAddress != "10.0.0.1:3479" {
+		t.Errorf("expected other address 10.0.0.1:3479, got %s", result.OtherAddress)
+	}
+	if len(checked) != 1 || checked[0] != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("expected the other address to be checked once, got %v", checked)
+	}
+	if result.MappingBehavior != NATBehaviorUnknown || result.MappingError == "" {
+		t.Errorf("expected unknown mapping behavior with an error, got %s %q", result.MappingBehavior, result.MappingError)
+	}
+	// the filtering tests only send to the server itself
+	if result.FilteringBehavior != NATBehaviorEndpointIndependent {
+		t.Errorf("expected filtering behavior %s, got %s", NATBehaviorEndpointIndependent, result.FilteringBehavior)
+	}
+}
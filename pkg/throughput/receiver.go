@@ -0,0 +1,169 @@
+package throughput
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	pkgratelimit "github.com/internetworklab/cloudping/pkg/ratelimit"
+	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
+)
+
+// ReceiverSession is a test the receiver is waiting for the sender of
+type ReceiverSession struct {
+	test   ThroughputTest
+	result chan *ThroughputResult
+}
+
+// Receiver keeps the tests the agent is the receiver of, it serves ReceiverPath on the agent's HTTP endpoint,
+// and a session only lives from Open to the end of the transfer, so the path refuses anything else.
+type Receiver struct {
+	mu       sync.Mutex
+	sessions map[string]*ReceiverSession
+}
+
+func NewReceiver() *Receiver {
+	return &Receiver{sessions: make(map[string]*ReceiverSession)}
+}
+
+func (rcv *Receiver) take(token string) *ReceiverSession {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	session, ok := rcv.sessions[token]
+	if !ok {
+		return nil
+	}
+	// a token is good for only one transfer
+	delete(rcv.sessions, token)
+	return session
+}
+
+func (rcv *Receiver) Open(test ThroughputTest) (*ReceiverSession, error) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if _, ok := rcv.sessions[test.Token]; ok {
+		return nil, errors.New("a session with the same token is already open")
+	}
+	session := &ReceiverSession{test: test, result: make(chan *ThroughputResult, 1)}
+	rcv.sessions[test.Token] = session
+	return session, nil
+}
+
+func (rcv *Receiver) close(token string, session *ReceiverSession) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if rcv.sessions[token] == session {
+		delete(rcv.sessions, token)
+	}
+}
+
+// Wait returns the result once the sender is done, the session is closed if the sender doesn't show up in time.
+func (rcv *Receiver) Wait(ctx context.Context, session *ReceiverSession) *ThroughputResult {
+	timer := time.NewTimer(acceptTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-session.result:
+		return result
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	rcv.close(session.test.Token, session)
+	// the sender might have been accepted right before the session was closed
+	select {
+	case result := <-session.result:
+		return result
+	default:
+	}
+	result := &ThroughputResult{CorrelationID: session.test.CorrelationID, Role: RoleReceiver, StartedAt: time.Now(), Intervals: make([]ThroughputInterval, 0)}
+	if ctx.Err() != nil {
+		result.Error = fmt.Sprintf("cancelled before the sender showed up: %v", ctx.Err())
+	} else {
+		result.Error = fmt.Sprintf("the sender didn't show up within %v", acceptTimeout)
+	}
+	return result
+}
+
+func (rcv *Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session := rcv.take(r.Header.Get(HeaderToken))
+	if session == nil {
+		http.Error(w, "no such session", http.StatusForbidden)
+		return
+	}
+
+	var rateLimiter pkgratelimit.RateLimiter
+	if rateLimitAny := r.Context().Value(pkgutils.CtxKeySharedRateLimitEnforcer); rateLimitAny != nil {
+		rateLimiter, _ = rateLimitAny.(pkgratelimit.RateLimiter)
+	}
+
+	// so that a sender that stalls doesn't hold the receiver forever
+	deadline := time.Now().Add(session.test.GetDuration() + drainGrace)
+	if err := http.NewResponseController(w).SetReadDeadline(deadline); err != nil {
+		log.Printf("failed to set read deadline of throughput test %s: %v", session.test.CorrelationID, err)
+	}
+	result := receive(r.Context(), &session.test, r.Body, rateLimiter)
+	result.Peer = pkgutils.GetRemoteAddr(r)
+	session.result <- result
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("failed to send the result of throughput test %s: %v", session.test.CorrelationID, err)
+	}
+}
+
+// receive reads body until the sender stops, or one of the limits is reached
+func receive(ctx context.Context, test *ThroughputTest, body io.Reader, rateLimiter pkgratelimit.RateLimiter) *ThroughputResult {
+	result := &ThroughputResult{CorrelationID: test.CorrelationID, Role: RoleReceiver, StartedAt: time.Now()}
+	maxBytes := test.GetMaxBytes()
+	rec := newIntervalRecorder(result.StartedAt, test.GetInterval(), nil)
+	limiter := newThrottle(ctx, rateLimiter)
+	defer limiter.close()
+
+	buf := make([]byte, ChunkSize)
+	for {
+		limiter.wait()
+		// a full chunk per token, as on the sender's side
+		n, err := io.ReadFull(body, buf[:min(int64(len(buf)), maxBytes-rec.total)])
+		now := time.Now()
+		rec.add(now, int64(n))
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// it's the read deadline
+				result.StoppedBy = StopReasonDuration
+				break
+			}
+			result.StoppedBy = StopReasonPeer
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				result.Error = fmt.Sprintf("failed to receive: %v", err)
+			}
+			break
+		}
+		if rec.total >= maxBytes {
+			result.StoppedBy = StopReasonMaxBytes
+			break
+		}
+		if now.Sub(result.StartedAt) >= test.GetDuration()+drainGrace {
+			result.StoppedBy = StopReasonDuration
+			break
+		}
+	}
+
+	now := time.Now()
+	result.Intervals = rec.finish(now)
+	result.Duration = now.Sub(result.StartedAt)
+	result.Bytes = rec.total
+	result.GoodputBitsPerSecond = getBitsPerSecond(result.Bytes, result.Duration)
+	return result
+}
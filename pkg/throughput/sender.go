@@ -0,0 +1,130 @@
+package throughput
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	pkgratelimit "github.com/internetworklab/cloudping/pkg/ratelimit"
+)
+
+// Send feeds the receiver at ReceiverURL until one of the limits is reached, onInterval is called as each interval closes.
+func (test *ThroughputTest) Send(ctx context.Context, tlsConfig *tls.Config, rateLimiter pkgratelimit.RateLimiter, onInterval func(ThroughputInterval)) *ThroughputResult {
+	result := &ThroughputResult{CorrelationID: test.CorrelationID, Role: RoleSender, StartedAt: time.Now(), Intervals: make([]ThroughputInterval, 0)}
+
+	connMu := sync.Mutex{}
+	var conn net.Conn
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := dialer.DialContext(ctx, network, addr)
+			if err == nil {
+				connMu.Lock()
+				conn = c
+				connMu.Unlock()
+			}
+			return c, err
+		},
+		// one test, one connection, so that TCP_INFO tells about this test only
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(ctx, test.GetDuration()+acceptTimeout)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, test.ReceiverURL, pr)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to create request: %v", err)
+		return result
+	}
+	req.Header.Set(HeaderToken, test.Token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	var retransmits *uint32
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		defer pw.Close()
+
+		maxBytes := test.GetMaxBytes()
+		limiter := newThrottle(ctx, rateLimiter)
+		defer limiter.close()
+
+		// the clock starts with the first chunk, not with the dial
+		result.StartedAt = time.Now()
+		rec := newIntervalRecorder(result.StartedAt, test.GetInterval(), onInterval)
+		deadline := result.StartedAt.Add(test.GetDuration())
+		chunk := make([]byte, ChunkSize)
+		for {
+			if ctx.Err() != nil {
+				result.StoppedBy = StopReasonPeer
+				break
+			}
+			limiter.wait()
+			n, err := pw.Write(chunk[:min(int64(len(chunk)), maxBytes-rec.total)])
+			now := time.Now()
+			rec.add(now, int64(n))
+			if err != nil {
+				result.StoppedBy = StopReasonPeer
+				break
+			}
+			if rec.total >= maxBytes {
+				result.StoppedBy = StopReasonMaxBytes
+				break
+			}
+			if !now.Before(deadline) {
+				result.StoppedBy = StopReasonDuration
+				break
+			}
+		}
+
+		now := time.Now()
+		result.Intervals = rec.finish(now)
+		result.Duration = now.Sub(result.StartedAt)
+		result.Bytes = rec.total
+
+		// read before the connection is gone
+		connMu.Lock()
+		if conn != nil {
+			retransmits = getRetransmits(conn)
+		}
+		connMu.Unlock()
+	}()
+
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	// unblocks the writer in case the request failed before the body was fully consumed
+	pr.CloseWithError(errors.New("request is done"))
+	if err != nil {
+		<-writeDone
+		result.Retransmits = retransmits
+		result.Error = fmt.Sprintf("failed to send: %v", err)
+		return result
+	}
+	defer resp.Body.Close()
+
+	receiverResult := new(ThroughputResult)
+	decodeErr := json.NewDecoder(resp.Body).Decode(receiverResult)
+	<-writeDone
+	result.Retransmits = retransmits
+	if resp.StatusCode != http.StatusOK {
+		result.Error = fmt.Sprintf("receiver responded with %s", resp.Status)
+		return result
+	}
+	if decodeErr != nil {
+		result.Error = fmt.Sprintf("failed to decode the result of the receiver: %v", decodeErr)
+		return result
+	}
+	result.Receiver = receiverResult
+	result.GoodputBitsPerSecond = receiverResult.GoodputBitsPerSecond
+	return result
+}
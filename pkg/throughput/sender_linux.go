@@ -0,0 +1,31 @@
+package throughput
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// getRetransmits returns the total retransmissions of conn, or nil if the kernel doesn't tell
+func getRetransmits(conn net.Conn) *uint32 {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var info *unix.TCPInfo
+	var sockErr error
+	ctrlErr := rawConn.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if ctrlErr != nil || sockErr != nil {
+		return nil
+	}
+	retransmits := info.Total_retrans
+	return &retransmits
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package throughput
+
+import (
+	"net"
+)
+
+// getRetransmits returns nil, TCP_INFO is only read on Linux
+func getRetransmits(conn net.Conn) *uint32 {
+	return nil
+}
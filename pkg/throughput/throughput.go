@@ -0,0 +1,267 @@
+package throughput
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	pkgratelimit "github.com/internetworklab/cloudping/pkg/ratelimit"
+)
+
+const (
+	// Path of the receiver on the agent's HTTP endpoint
+	ReceiverPath = "/throughput"
+	// The one-time token the hub hands to both ends of a test
+	HeaderToken = "X-Throughput-Token"
+
+	DefaultMaxBytes int64 = 16 << 20
+	HardMaxBytes    int64 = 256 << 20
+	DefaultDuration       = 10 * time.Second
+	HardMaxDuration       = 30 * time.Second
+	DefaultInterval       = time.Second
+	MinInterval           = 100 * time.Millisecond
+
+	// Each chunk takes one token of the shared outbound rate limit, on both ends
+	ChunkSize = 64 << 10
+
+	// How long the receiver waits for the sender to show up
+	acceptTimeout = 15 * time.Second
+	// How long the receiver keeps reading after the duration is up, for what's still in flight
+	drainGrace = 5 * time.Second
+)
+
+type Role string
+
+const (
+	RoleSender   Role = "sender"
+	RoleReceiver Role = "receiver"
+)
+
+type StopReason string
+
+const (
+	StopReasonMaxBytes StopReason = "max_bytes"
+	StopReasonDuration StopReason = "duration"
+	// The other end stopped first
+	StopReasonPeer StopReason = "peer"
+)
+
+// ThroughputTest measures how fast data flows from the agent it's sent to, i.e. the sender, to the agent named Receiver.
+// The hub splits a test into a receiver part and a sender part, and starts the sender once the receiver is ready.
+type ThroughputTest struct {
+	// Node name of the receiving agent, it must have an HTTP endpoint the sender could reach
+	Receiver string `json:"receiver"`
+
+	// default is 16MiB, at most 256MiB, the hub might clamp it further
+	MaxBytes *int64 `json:"maxBytes,omitempty"`
+
+	// default is 10000, at most 30000, the hub might clamp it further
+	DurationMs *int `json:"durationMs,omitempty"`
+
+	// Of the time series, default is 1000, at least 100
+	IntervalMs *int `json:"intervalMs,omitempty"`
+
+	// Identifies the result among the ones of the other tests in the same request
+	CorrelationID string `json:"correlationId,omitempty"`
+
+	// Filled in by the hub
+	Role Role `json:"role,omitempty"`
+	// So that only the sender picked by the hub could feed the receiver
+	Token string `json:"token,omitempty"`
+	// Where the sender sends to, i.e. the receiver path of the receiver's HTTP endpoint
+	ReceiverURL string `json:"receiverUrl,omitempty"`
+}
+
+type ThroughputInterval struct {
+	// Offsets from the start of the transfer
+	Start         time.Duration `json:"start"`
+	End           time.Duration `json:"end"`
+	Bytes         int64         `json:"bytes"`
+	BitsPerSecond float64       `json:"bits_per_second"`
+}
+
+type ThroughputResult struct {
+	CorrelationID string    `json:"correlationId"`
+	Role          Role      `json:"role"`
+	Peer          string    `json:"peer,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+
+	Duration time.Duration `json:"duration"`
+	// Sent by the sender, or received by the receiver
+	Bytes int64 `json:"bytes"`
+	// Of the bytes the receiver has got, it's what the receiver reported, in the result of the sender
+	GoodputBitsPerSecond float64    `json:"goodput_bps"`
+	StoppedBy            StopReason `json:"stopped_by,omitempty"`
+
+	// Of the sender's TCP connection, from TCP_INFO, absent when it can't be observed
+	Retransmits *uint32 `json:"retransmits,omitempty"`
+
+	Intervals []ThroughputInterval `json:"intervals"`
+
+	// What the receiver reported to the sender, only in the result of the sender
+	Receiver *ThroughputResult `json:"receiver,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// ThroughputEvent is what both ends stream while a test is running
+type ThroughputEvent struct {
+	CorrelationID string `json:"correlationId"`
+	Role          Role   `json:"role"`
+	// Sent by the receiver once it accepts the sender
+	Ready    bool                `json:"ready,omitempty"`
+	Interval *ThroughputInterval `json:"interval,omitempty"`
+	Result   *ThroughputResult   `json:"result,omitempty"`
+}
+
+func (test *ThroughputTest) Validate() error {
+	if test.Receiver == "" {
+		return errors.New("receiver is empty")
+	}
+	if test.MaxBytes != nil && *test.MaxBytes <= 0 {
+		return fmt.Errorf("invalid max bytes %d", *test.MaxBytes)
+	}
+	if test.DurationMs != nil && *test.DurationMs <= 0 {
+		return fmt.Errorf("invalid duration %dms", *test.DurationMs)
+	}
+	if test.IntervalMs != nil && *test.IntervalMs <= 0 {
+		return fmt.Errorf("invalid interval %dms", *test.IntervalMs)
+	}
+	switch test.Role {
+	case "":
+	case RoleReceiver:
+		if test.Token == "" {
+			return errors.New("receiver has no token")
+		}
+	case RoleSender:
+		if test.Token == "" || test.ReceiverURL == "" {
+			return errors.New("sender has no token or no receiver url")
+		}
+	default:
+		return fmt.Errorf("unknown role %s", test.Role)
+	}
+	return nil
+}
+
+func (test *ThroughputTest) GetMaxBytes() int64 {
+	if test.MaxBytes == nil {
+		return DefaultMaxBytes
+	}
+	return min(*test.MaxBytes, HardMaxBytes)
+}
+
+func (test *ThroughputTest) GetDuration() time.Duration {
+	if test.DurationMs == nil {
+		return DefaultDuration
+	}
+	return min(time.Duration(*test.DurationMs)*time.Millisecond, HardMaxDuration)
+}
+
+func (test *ThroughputTest) GetInterval() time.Duration {
+	if test.IntervalMs == nil {
+		return DefaultInterval
+	}
+	return max(time.Duration(*test.IntervalMs)*time.Millisecond, MinInterval)
+}
+
+// Clamp lowers the limits of the test to the ones of the hub, nil means no limit
+func (test *ThroughputTest) Clamp(maxBytes *int64, maxDuration *time.Duration) {
+	if maxBytes != nil && test.GetMaxBytes() > *maxBytes {
+		test.MaxBytes = new(int64)
+		*test.MaxBytes = *maxBytes
+	}
+	if maxDuration != nil && test.GetDuration() > *maxDuration {
+		test.DurationMs = new(int)
+		*test.DurationMs = int(maxDuration.Milliseconds())
+	}
+}
+
+func getBitsPerSecond(nBytes int64, duration time.Duration) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	return float64(nBytes) * 8 / duration.Seconds()
+}
+
+// intervalRecorder slices the transfer into a time series
+type intervalRecorder struct {
+	startedAt time.Time
+	interval  time.Duration
+	onClosed  func(ThroughputInterval)
+
+	total     int64
+	current   ThroughputInterval
+	intervals []ThroughputInterval
+}
+
+func newIntervalRecorder(startedAt time.Time, interval time.Duration, onClosed func(ThroughputInterval)) *intervalRecorder {
+	return &intervalRecorder{
+		startedAt: startedAt,
+		interval:  interval,
+		onClosed:  onClosed,
+		current:   ThroughputInterval{End: interval},
+		intervals: make([]ThroughputInterval, 0),
+	}
+}
+
+func (rec *intervalRecorder) close(end time.Duration) {
+	rec.current.End = end
+	rec.current.BitsPerSecond = getBitsPerSecond(rec.current.Bytes, rec.current.End-rec.current.Start)
+	rec.intervals = append(rec.intervals, rec.current)
+	if rec.onClosed != nil {
+		rec.onClosed(rec.current)
+	}
+}
+
+// add accounts n bytes at now, the intervals before now are closed first, idle ones included
+func (rec *intervalRecorder) add(now time.Time, n int64) {
+	elapsed := now.Sub(rec.startedAt)
+	for elapsed >= rec.current.End {
+		rec.close(rec.current.End)
+		rec.current = ThroughputInterval{Start: rec.current.End, End: rec.current.End + rec.interval}
+	}
+	rec.current.Bytes += n
+	rec.total += n
+}
+
+// finish closes the last, likely partial, interval and returns the series
+func (rec *intervalRecorder) finish(now time.Time) []ThroughputInterval {
+	rec.add(now, 0)
+	if end := now.Sub(rec.startedAt); end > rec.current.Start {
+		rec.close(end)
+	}
+	return rec.intervals
+}
+
+// throttle takes one token of the shared outbound rate limit per chunk, a nil one doesn't throttle at all
+type throttle struct {
+	inC  chan<- interface{}
+	outC <-chan interface{}
+}
+
+func newThrottle(ctx context.Context, rateLimiter pkgratelimit.RateLimiter) *throttle {
+	if rateLimiter == nil {
+		return nil
+	}
+	// the limiter treats the cancellation while waiting for a refresh as fatal, so it's never cancelled,
+	// and it's stopped by closing the input instead, which only happens when no chunk is waiting for a token.
+	inC, outC := rateLimiter.GetIO(context.WithoutCancel(ctx))
+	return &throttle{inC: inC, outC: outC}
+}
+
+// wait blocks until there is a token, which takes at most a refresh interval of the rate limiter
+func (t *throttle) wait() {
+	if t == nil {
+		return
+	}
+	t.inC <- struct{}{}
+	<-t.outC
+}
+
+func (t *throttle) close() {
+	if t == nil {
+		return
+	}
+	close(t.inC)
+}
@@ -0,0 +1,86 @@
+package throughput
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIntervalRecorder(t *testing.T) {
+	startedAt := time.Now()
+	closed := 0
+	rec := newIntervalRecorder(startedAt, time.Second, func(ThroughputInterval) { closed++ })
+	rec.add(startedAt.Add(100*time.Millisecond), 1000)
+	rec.add(startedAt.Add(900*time.Millisecond), 1000)
+	// the second interval is idle
+	rec.add(startedAt.Add(2500*time.Millisecond), 500)
+	intervals := rec.finish(startedAt.Add(2750 * time.Millisecond))
+
+	if len(intervals) != 3 || closed != 3 {
+		t.Fatalf("expected 3 intervals, got %d, %d closed", len(intervals), closed)
+	}
+	if intervals[0].Bytes != 2000 || intervals[0].BitsPerSecond != 16000 {
+		t.Errorf("unexpected first interval %+v", intervals[0])
+	}
+	if intervals[1].Bytes != 0 {
+		t.Errorf("unexpected second interval %+v", intervals[1])
+	}
+	if intervals[2].End != 2750*time.Millisecond || intervals[2].Bytes != 500 {
+		t.Errorf("unexpected last interval %+v", intervals[2])
+	}
+	if rec.total != 2500 {
+		t.Errorf("expected 2500 bytes in total, got %d", rec.total)
+	}
+}
+
+func TestClamp(t *testing.T) {
+	maxBytes := int64(1 << 20)
+	maxDuration := 2 * time.Second
+	test := &ThroughputTest{Receiver: "a"}
+	test.Clamp(&maxBytes, &maxDuration)
+	if test.GetMaxBytes() != maxBytes || test.GetDuration() != maxDuration {
+		t.Errorf("expected the limits of the hub, got %d bytes and %v", test.GetMaxBytes(), test.GetDuration())
+	}
+
+	lower := int64(1024)
+	test = &ThroughputTest{Receiver: "a", MaxBytes: &lower}
+	test.Clamp(&maxBytes, nil)
+	if test.GetMaxBytes() != lower || test.GetDuration() != DefaultDuration {
+		t.Errorf("expected the limits of the test, got %d bytes and %v", test.GetMaxBytes(), test.GetDuration())
+	}
+}
+
+func TestSendReceive(t *testing.T) {
+	receiver := NewReceiver()
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	maxBytes := int64(ChunkSize*3 + 1)
+	test := ThroughputTest{Receiver: "b", MaxBytes: &maxBytes, CorrelationID: "1", Token: "secret", ReceiverURL: server.URL + ReceiverPath}
+	session, err := receiver.Open(test)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcvResultC := make(chan *ThroughputResult, 1)
+	go func() { rcvResultC <- receiver.Wait(context.Background(), session) }()
+
+	sndResult := test.Send(context.Background(), nil, nil, nil)
+	if sndResult.Error != "" {
+		t.Fatalf("unexpected error of the sender: %s", sndResult.Error)
+	}
+	if sndResult.Bytes != maxBytes || sndResult.StoppedBy != StopReasonMaxBytes {
+		t.Errorf("unexpected result of the sender %+v", sndResult)
+	}
+	if sndResult.Receiver == nil || sndResult.Receiver.Bytes != maxBytes {
+		t.Errorf("unexpected result of the receiver in the one of the sender %+v", sndResult.Receiver)
+	}
+	if rcvResult := <-rcvResultC; rcvResult.Bytes != maxBytes || rcvResult.Error != "" {
+		t.Errorf("unexpected result of the receiver %+v", rcvResult)
+	}
+
+	// the token has been used
+	if result := test.Send(context.Background(), nil, nil, nil); result.Error == "" {
+		t.Errorf("expected the second transfer to be refused")
+	}
+}
@@ -5,16 +5,21 @@ import (
 	"fmt"
 	"net"
 	"time"
+
+	pkgdnsprobe "github.com/internetworklab/cloudping/pkg/dnsprobe"
 )
 
 func NewCustomResolver(resolverAddress *string, resolveTimeout time.Duration) *net.Resolver {
 	var resolver *net.Resolver = net.DefaultResolver
+	if resolverAddress != nil && pkgdnsprobe.IsEncryptedResolverURI(*resolverAddress) {
+		return pkgdnsprobe.NewEncryptedResolver(*resolverAddress, resolveTimeout)
+	}
 	if resolverAddress != nil && *resolverAddress != "" {
 		_, _, err := net.SplitHostPort(*resolverAddress)
 		if err != nil {
 			port := 53
-			resolverAddress = new(string)
-			*resolverAddress = fmt.Sprintf("%s:%d", *resolverAddress, port)
+			addrWithPort := net.JoinHostPort(*resolverAddress, fmt.Sprintf("%d", port))
+			resolverAddress = &addrWithPort
 		}
 
 		resolver = &net.Resolver{
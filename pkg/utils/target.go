@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithDefaultPort returns target as host:port, target is either host or host:port,
+// an IPv6 address may or may not be in brackets when it comes without a port
+func WithDefaultPort(target string, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target
+	}
+	return net.JoinHostPort(strings.Trim(target, "[]"), defaultPort)
+}
+
+// ValidateHostPort checks that target is host:port, a target without the port is accepted only when defaultPort isn't empty
+func ValidateHostPort(target string, defaultPort string) error {
+	addr, expected := target, "host:port"
+	if defaultPort != "" {
+		addr, expected = WithDefaultPort(target, defaultPort), "host or host:port"
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid target %s, expected %s: %w", target, expected, err)
+	}
+	if host == "" {
+		return fmt.Errorf("target %s has no host", target)
+	}
+	if portNum, err := strconv.Atoi(port); err != nil || portNum <= 0 || portNum > 65535 {
+		return fmt.Errorf("invalid port of target %s", target)
+	}
+	return nil
+}
+
+// LookupFirstIP resolves host with the resolver given by address, nil means the system's one, and returns the first ip found,
+// pref is one of 'ip', 'ip4' and 'ip6', nil or empty means 'ip'
+func LookupFirstIP[P ~string](ctx context.Context, resolver *string, pref *P, host string) (net.IP, error) {
+	prefUsed := "ip"
+	if pref != nil && *pref != "" {
+		prefUsed = string(*pref)
+	}
+	ips, err := NewCustomResolver(resolver, 10*time.Second).LookupIP(ctx, prefUsed, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup ip from host %s: %v", host, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no ip found for host %s", host)
+	}
+	return ips[0], nil
+}
+
+// LoadRootCAs returns the system's CAs extended with the ones at paths, or nil when paths is empty,
+// which in a tls.Config means the system's CAs as well
+func LoadRootCAs(paths []string) (*x509.CertPool, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	return GetExtendedCAPool(paths)
+}
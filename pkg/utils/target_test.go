@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestWithDefaultPort(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{target: "example.com", want: "example.com:443"},
+		{target: "example.com:8443", want: "example.com:8443"},
+		{target: "2001:db8::1", want: "[2001:db8::1]:443"},
+		{target: "[2001:db8::1]", want: "[2001:db8::1]:443"},
+		{target: "[2001:db8::1]:8443", want: "[2001:db8::1]:8443"},
+	}
+	for _, tt := range tests {
+		if got := WithDefaultPort(tt.target, "443"); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.target, tt.want, got)
+		}
+	}
+}
+
+func TestValidateHostPort(t *testing.T) {
+	tests := []struct {
+		target      string
+		defaultPort string
+		valid       bool
+	}{
+		{target: "example.com:53", valid: true},
+		{target: "[2001:db8::1]:53", valid: true},
+		{target: "example.com", valid: false},
+		{target: "example.com", defaultPort: "53", valid: true},
+		{target: "2001:db8::1", defaultPort: "53", valid: true},
+		{target: ":53", valid: false},
+		{target: "example.com:0", valid: false},
+		{target: "example.com:65536", valid: false},
+		{target: "example.com:dns", valid: false},
+	}
+	for _, tt := range tests {
+		if err := ValidateHostPort(tt.target, tt.defaultPort); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid to be %v, got %v", tt.target, tt.valid, err)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package wsprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	pkghttpprobe "github.com/internetworklab/cloudping/pkg/httpprobe"
+	pkgutils "github.com/internetworklab/cloudping/pkg/utils"
+)
+
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultPingInterval     = 1 * time.Second
+	defaultPongTimeout      = 3 * time.Second
+	MaxPingCount            = 30
+
+	minPingIntervalMs = 100
+	maxPingIntervalMs = 10 * 1000
+	minPongTimeoutMs  = 100
+	maxPongTimeoutMs  = 10 * 1000
+)
+
+// WSProbe performs the WebSocket upgrade handshake against URL, then optionally exchanges ping/pong control frames.
+type WSProbe struct {
+	// Either ws:// or wss://
+	URL string `json:"url"`
+
+	ExtraHeaders http.Header `json:"extraHeaders,omitempty"`
+
+	// Sent in the Sec-WebSocket-Protocol header, the one chosen by the server is reported
+	Subprotocols []string `json:"subprotocols,omitempty"`
+
+	// Number of ping frames to send once upgraded, default is 0, i.e. closing right after the handshake
+	PingCount int `json:"pingCount,omitempty"`
+
+	// default is 1000, clamped within 100 and 10000
+	PingIntervalMs *int `json:"pingIntervalMs,omitempty"`
+
+	// How long to wait for the pong of each ping, default is 3000, clamped within 100 and 10000
+	PongTimeoutMs *int `json:"pongTimeoutMs,omitempty"`
+
+	// default is 10000
+	HandshakeTimeoutMs *int `json:"handshakeTimeoutMs,omitempty"`
+
+	Resolver *string                            `json:"resolver,omitempty"`
+	IPPref   *pkghttpprobe.InetFamilyPreference `json:"inetFamilyPreference,omitempty"`
+
+	CorrelationID string `json:"correlationId,omitempty"`
+
+	// list of paths to additional CAs to trust in addition to the system's default CAs
+	AddCA []string
+}
+
+type WSPing struct {
+	Seq int `json:"seq"`
+	// zero when timed out
+	RTT     time.Duration `json:"rtt"`
+	Timeout bool          `json:"timeout"`
+}
+
+type WSProbeResult struct {
+	CorrelationID string    `json:"correlationId"`
+	URL           string    `json:"url"`
+	StartedAt     time.Time `json:"started_at"`
+	RemoteAddr    string    `json:"remote_addr,omitempty"`
+	LocalAddr     string    `json:"local_addr,omitempty"`
+
+	DNSLookup    time.Duration `json:"dns_lookup"`
+	Connect      time.Duration `json:"connect"`
+	TLSHandshake time.Duration `json:"tls_handshake"`
+	TLSVersion   string        `json:"tls_version,omitempty"`
+	// From the start of the probe to the arrival of the response of the upgrade request,
+	// the dns lookup, the connect and the tls handshake included.
+	Handshake time.Duration `json:"handshake"`
+
+	// 101 if upgraded, otherwise whatever the server or the middlebox responded with
+	StatusCode  int         `json:"status_code,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Upgraded    bool        `json:"upgraded"`
+	Subprotocol string      `json:"subprotocol,omitempty"`
+
+	Pings         []WSPing      `json:"pings,omitempty"`
+	PongsReceived int           `json:"pongs_received"`
+	MinRTT        time.Duration `json:"min_rtt,omitempty"`
+	AvgRTT        time.Duration `json:"avg_rtt,omitempty"`
+	MaxRTT        time.Duration `json:"max_rtt,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+func getMillisecondsOrDefault(ms *int, defaultValue time.Duration) time.Duration {
+	if ms == nil || *ms <= 0 {
+		return defaultValue
+	}
+	return time.Duration(*ms) * time.Millisecond
+}
+
+// unset or non-positive values are left as is, the defaults apply to them
+func clampMs(ms *int, minMs int, maxMs int) *int {
+	if ms == nil || *ms <= 0 {
+		return ms
+	}
+	clamped := min(max(*ms, minMs), maxMs)
+	return &clamped
+}
+
+// Validate also clamps the ping interval and the pong timeout, so that the pings don't hold the agent for too long
+func (probe *WSProbe) Validate() error {
+	urlObj, err := url.Parse(probe.URL)
+	if err != nil {
+		return fmt.Errorf("failed to parse url %s: %w", probe.URL, err)
+	}
+	if urlObj.Scheme != "ws" && urlObj.Scheme != "wss" {
+		return fmt.Errorf("unacceptable scheme of url %s, allowed values are: ws, wss", probe.URL)
+	}
+	if urlObj.Hostname() == "" {
+		return fmt.Errorf("url %s has no host", probe.URL)
+	}
+	if probe.PingCount < 0 || probe.PingCount > MaxPingCount {
+		return fmt.Errorf("ping count must be within 0 and %d, got %d", MaxPingCount, probe.PingCount)
+	}
+	probe.PingIntervalMs = clampMs(probe.PingIntervalMs, minPingIntervalMs, maxPingIntervalMs)
+	probe.PongTimeoutMs = clampMs(probe.PongTimeoutMs, minPongTimeoutMs, maxPongTimeoutMs)
+	return nil
+}
+
+// the wsprobe counterpart of the timing of the http probe, only the handshake related marks are kept
+type handshakeMarks struct {
+	lock         sync.Mutex
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	tlsVersion   uint16
+}
+
+func (marks *handshakeMarks) mark(t *time.Time) {
+	marks.lock.Lock()
+	defer marks.lock.Unlock()
+	*t = time.Now()
+}
+
+func (marks *handshakeMarks) fill(result *WSProbeResult) {
+	marks.lock.Lock()
+	defer marks.lock.Unlock()
+	if !marks.dnsDone.IsZero() {
+		result.DNSLookup = marks.dnsDone.Sub(marks.dnsStart)
+	}
+	if !marks.connectDone.IsZero() {
+		result.Connect = marks.connectDone.Sub(marks.connectStart)
+	}
+	if !marks.tlsDone.IsZero() {
+		result.TLSHandshake = marks.tlsDone.Sub(marks.tlsStart)
+		result.TLSVersion = tls.VersionName(marks.tlsVersion)
+	}
+}
+
+func (probe *WSProbe) getDialer(marks *handshakeMarks, roots *x509.CertPool) *websocket.Dialer {
+	netDialer := &net.Dialer{}
+
+	return &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to split host and port from addr: %s: %v", addr, err)
+			}
+			marks.mark(&marks.dnsStart)
+			ip, err := pkgutils.LookupFirstIP(ctx, probe.Resolver, probe.IPPref, host)
+			if err != nil {
+				return nil, err
+			}
+			marks.mark(&marks.dnsDone)
+
+			marks.mark(&marks.connectStart)
+			conn, err := netDialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err != nil {
+				return nil, err
+			}
+			marks.mark(&marks.connectDone)
+			return conn, nil
+		},
+		TLSClientConfig: &tls.Config{
+			RootCAs: roots,
+		},
+		HandshakeTimeout: getMillisecondsOrDefault(probe.HandshakeTimeoutMs, defaultHandshakeTimeout),
+		Subprotocols:     probe.Subprotocols,
+	}
+}
+
+func (probe *WSProbe) Do(ctx context.Context) *WSProbeResult {
+	result := &WSProbeResult{
+		CorrelationID: probe.CorrelationID,
+		URL:           probe.URL,
+		StartedAt:     time.Now(),
+	}
+
+	roots, err := pkgutils.LoadRootCAs(probe.AddCA)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to load additional CAs: %v", err)
+		return result
+	}
+
+	marks := &handshakeMarks{}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			result.RemoteAddr = info.Conn.RemoteAddr().String()
+			result.LocalAddr = info.Conn.LocalAddr().String()
+		},
+		TLSHandshakeStart: func() {
+			marks.mark(&marks.tlsStart)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			marks.mark(&marks.tlsDone)
+			marks.lock.Lock()
+			marks.tlsVersion = state.Version
+			marks.lock.Unlock()
+		},
+	}
+
+	dialer := probe.getDialer(marks, roots)
+	conn, resp, err := dialer.DialContext(httptrace.WithClientTrace(ctx, trace), probe.URL, probe.ExtraHeaders)
+	result.Handshake = time.Since(result.StartedAt)
+	marks.fill(result)
+	if resp != nil {
+		result.StatusCode = resp.StatusCode
+		result.Header = resp.Header
+	}
+	if err != nil {
+		if errors.Is(err, websocket.ErrBadHandshake) && resp != nil {
+			result.Error = fmt.Sprintf("upgrade rejected with status %d", resp.StatusCode)
+		} else {
+			result.Error = fmt.Sprintf("failed to dial %s: %v", probe.URL, err)
+		}
+		return result
+	}
+	defer conn.Close()
+	result.Upgraded = true
+	result.Subprotocol = conn.Subprotocol()
+
+	if probe.PingCount > 0 {
+		exchangePings(ctx, probe, conn, result)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+	return result
+}
+
+// The pongs are matched with the pings by the payload, which is the sequence number.
+func exchangePings(ctx context.Context, probe *WSProbe, conn *websocket.Conn, result *WSProbeResult) {
+	pongChan := make(chan int, probe.PingCount)
+	conn.SetPongHandler(func(appData string) error {
+		if seq, err := strconv.Atoi(appData); err == nil {
+			select {
+			case pongChan <- seq:
+			default:
+			}
+		}
+		return nil
+	})
+	// control frames are only processed while reading, the data frames, if any, are discarded
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	interval := getMillisecondsOrDefault(probe.PingIntervalMs, defaultPingInterval)
+	pongTimeout := getMillisecondsOrDefault(probe.PongTimeoutMs, defaultPongTimeout)
+	var totalRTT time.Duration
+	for seq := 0; seq < probe.PingCount; seq++ {
+		if seq > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+
+		sentAt := time.Now()
+		if err := conn.WriteControl(websocket.PingMessage, []byte(strconv.Itoa(seq)), sentAt.Add(pongTimeout)); err != nil {
+			result.Error = fmt.Sprintf("failed to send ping %d: %v", seq, err)
+			return
+		}
+
+		ping := WSPing{Seq: seq, Timeout: true}
+		timer := time.NewTimer(pongTimeout)
+	waitPong:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				result.Pings = append(result.Pings, ping)
+				return
+			case <-timer.C:
+				break waitPong
+			case pongSeq := <-pongChan:
+				// a late pong of a previous ping
+				if pongSeq != seq {
+					continue
+				}
+				timer.Stop()
+				ping.RTT = time.Since(sentAt)
+				ping.Timeout = false
+				break waitPong
+			}
+		}
+		result.Pings = append(result.Pings, ping)
+
+		if ping.Timeout {
+			continue
+		}
+		result.PongsReceived++
+		totalRTT += ping.RTT
+		if result.MinRTT == 0 || ping.RTT < result.MinRTT {
+			result.MinRTT = ping.RTT
+		}
+		if ping.RTT > result.MaxRTT {
+			result.MaxRTT = ping.RTT
+		}
+	}
+	if result.PongsReceived > 0 {
+		result.AvgRTT = totalRTT / time.Duration(result.PongsReceived)
+	}
+}
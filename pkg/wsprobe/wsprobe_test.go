@@ -0,0 +1,93 @@
+package wsprobe
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		probe WSProbe
+		valid bool
+	}{
+		{WSProbe{URL: "ws://example.com/socket"}, true},
+		{WSProbe{URL: "wss://example.com:8443/", PingCount: 5}, true},
+		{WSProbe{URL: "https://example.com/"}, false},
+		{WSProbe{URL: "wss:///path"}, false},
+		{WSProbe{URL: "wss://example.com/", PingCount: MaxPingCount + 1}, false},
+		{WSProbe{URL: "wss://example.com/", PingCount: -1}, false},
+	}
+	for _, c := range cases {
+		if err := c.probe.Validate(); (err == nil) != c.valid {
+			t.Errorf("validating %+v, expected valid=%v, got err=%v", c.probe, c.valid, err)
+		}
+	}
+}
+
+func TestValidate_ClampsPingTiming(t *testing.T) {
+	tooShort, tooLong := 1, maxPongTimeoutMs+1
+	probe := WSProbe{URL: "wss://example.com/", PingIntervalMs: &tooShort, PongTimeoutMs: &tooLong}
+	if err := probe.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if *probe.PingIntervalMs != minPingIntervalMs || *probe.PongTimeoutMs != maxPongTimeoutMs {
+		t.Fatalf("expected %d and %d, got %d and %d", minPingIntervalMs, maxPongTimeoutMs, *probe.PingIntervalMs, *probe.PongTimeoutMs)
+	}
+}
+
+func TestDo(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"v2.example", "v1.example"}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// the pong of the second ping carries the payload of the first one, as a late pong would
+		conn.SetPingHandler(func(appData string) error {
+			if appData == "1" {
+				appData = "0"
+			}
+			return conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	interval, pongTimeout := 100, 300
+	probe := WSProbe{
+		URL:            "ws" + strings.TrimPrefix(ts.URL, "http"),
+		Subprotocols:   []string{"v1.example"},
+		PingCount:      3,
+		PingIntervalMs: &interval,
+		PongTimeoutMs:  &pongTimeout,
+	}
+	if err := probe.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	result := probe.Do(context.Background())
+	if !result.Upgraded || result.StatusCode != http.StatusSwitchingProtocols || result.Subprotocol != "v1.example" {
+		t.Fatalf("unexpected handshake: %+v", result)
+	}
+	if len(result.Pings) != 3 || result.PongsReceived != 2 {
+		t.Fatalf("expected 3 pings and 2 pongs, got %+v", result)
+	}
+	for _, ping := range result.Pings {
+		if timeout := ping.Seq == 1; ping.Timeout != timeout || (ping.RTT == 0) != timeout {
+			t.Errorf("unexpected ping: %+v", ping)
+		}
+	}
+	if result.MinRTT <= 0 || result.MinRTT > result.AvgRTT || result.AvgRTT > result.MaxRTT {
+		t.Errorf("unexpected rtt stats: min=%v avg=%v max=%v", result.MinRTT, result.AvgRTT, result.MaxRTT)
+	}
+}
@@ -6,15 +6,68 @@ import {
   FILTERKEY_CORR_ID,
   FILTERKEY_FROM,
   HTTPTarget,
+  HTTPTiming,
+  TLSInspection,
+  HTTPRedirectChain,
+  HTTPProtoComparison,
 } from "./types";
 
+function formatProtoComparison(comparison: HTTPProtoComparison): string {
+  const results = comparison.results
+    .map((result) =>
+      result.ok
+        ? `${result.proto}=${(result.timing.total / 1e6).toFixed(2)}ms`
+        : `${result.proto}=failed(${result.error ?? ""})`,
+    )
+    .join(",");
+  const h3 = comparison.h3_unreachable
+    ? ",h3 advertised but unreachable"
+    : "";
+  return `protocols: ${results},browser=${comparison.browser_proto ?? "none"}${h3}`;
+}
+
+function formatRedirectChain(chain: HTTPRedirectChain): string {
+  const hops = chain.hops
+    .map((hop) => `${hop.status_code} ${hop.url} (${hop.remote_addr ?? ""})`)
+    .join(" -> ");
+  const flags = [
+    chain.loop ? "loop" : "",
+    chain.downgrade ? "https-to-http downgrade" : "",
+    chain.max_redirects_reached ? "max redirects reached" : "",
+  ].filter((flag) => flag !== "");
+  return `redirects: ${hops}${flags.length > 0 ? ` [${flags.join(",")}]` : ""}`;
+}
+
+function formatTLSInspection(tls: TLSInspection): string {
+  const verified = tls.verified ? "verified" : `unverified(${tls.verify_error ?? ""})`;
+  return `tls: ${tls.version},${tls.cipher_suite},alpn=${tls.alpn ?? ""},${verified},expires_in=${tls.days_until_expiry}d,ocsp=${tls.ocsp_status},leaf_sha256=${tls.leaf_sha256 ?? ""}`;
+}
+
+function formatTiming(timing: HTTPTiming): string {
+  const ms = (ns: number | undefined) => `${((ns ?? 0) / 1e6).toFixed(2)}ms`;
+  const phases = timing.phases
+    .map((phase) => `${phase.name}=${ms(phase.duration)}`)
+    .join(",");
+  return `timing: total=${ms(timing.total)},${phases},remote=${timing.remote_addr ?? ""},reused=${timing.conn_reused}`;
+}
+
 function convertRawPingEventToEventObj(
   rawPingEv: RawPingEvent<HTTPProbeEvent> | undefined | null,
   idx: number,
 ): EventObject | undefined {
   const from = rawPingEv?.metadata?.from;
   const corrId = rawPingEv?.data?.correlationId;
-  const date = rawPingEv?.data?.transport?.Date;
+  const timing = rawPingEv?.data?.timing;
+  const tlsInspection = rawPingEv?.data?.tls;
+  const verdict = rawPingEv?.data?.verdict;
+  const redirects = rawPingEv?.data?.redirects;
+  const protoComparison = rawPingEv?.data?.protoComparison;
+  const date =
+    rawPingEv?.data?.transport?.Date ??
+    timing?.started_at ??
+    redirects?.hops[0]?.timing.started_at ??
+    protoComparison?.results[0]?.timing.started_at ??
+    (tlsInspection || verdict ? new Date().toISOString() : undefined);
   const name = rawPingEv?.data?.transport?.Name;
   const ty = rawPingEv?.data?.transport?.Type;
   const val = rawPingEv?.data?.transport?.Value;
@@ -49,6 +102,58 @@ function convertRawPingEventToEventObj(
     };
   }
 
+  if (tlsInspection) {
+    return {
+      id: `${from}:${corrId}:${idx}`,
+      labels,
+      timestamp: tx,
+      annotations: { Type: "tls" },
+      message: formatTLSInspection(tlsInspection),
+    };
+  }
+
+  if (protoComparison) {
+    return {
+      id: `${from}:${corrId}:${idx}`,
+      labels,
+      timestamp: tx,
+      annotations: { Type: "protocols" },
+      message: formatProtoComparison(protoComparison),
+    };
+  }
+
+  if (redirects) {
+    return {
+      id: `${from}:${corrId}:${idx}`,
+      labels,
+      timestamp: tx,
+      annotations: { Type: "redirects" },
+      message: formatRedirectChain(redirects),
+    };
+  }
+
+  if (verdict) {
+    return {
+      id: `${from}:${corrId}:${idx}`,
+      labels,
+      timestamp: tx,
+      annotations: { Type: "verdict" },
+      message: verdict.passed
+        ? "verdict: passed"
+        : `verdict: failed: ${(verdict.reasons ?? []).join("; ")}`,
+    };
+  }
+
+  if (timing) {
+    return {
+      id: `${from}:${corrId}:${idx}`,
+      labels,
+      timestamp: tx + timing.total / 1e6,
+      annotations: { Type: "timing" },
+      message: formatTiming(timing),
+    };
+  }
+
   const evObj: EventObject = {
     id: `${from}:${corrId}:${idx}`,
     labels: labels,
@@ -9,9 +9,37 @@ export type PingTaskType =
   | "route"
   | "ip-query";
 
-export type DNSTransport = "udp" | "tcp" | "tls" | "http/2" | "http/3";
-
-export type DNSQueryType = "a" | "aaaa" | "cname" | "mx" | "ns" | "ptr" | "txt";
+export type DNSTransport =
+  | "udp"
+  | "tcp"
+  | "tls"
+  | "http/2"
+  | "http/3"
+  | "quic";
+
+export type DNSQueryType =
+  | "a"
+  | "aaaa"
+  | "cname"
+  | "mx"
+  | "ns"
+  | "ptr"
+  | "txt"
+  | "soa"
+  | "srv"
+  | "caa"
+  | "ds"
+  | "dnskey"
+  | "rrsig"
+  | "https"
+  | "svcb"
+  | "naptr"
+  | "sshfp"
+  | "tlsa"
+  | "id.server"
+  | "hostname.bind";
+
+export type DoHMethod = "post" | "get" | "json";
 
 export type DNSTarget = {
   corrId: string;
@@ -21,8 +49,19 @@ export type DNSTarget = {
   transport?: DNSTransport;
   queryType: DNSQueryType;
   dotServerName?: string;
+  dohMethod?: DoHMethod;
+  dnssecOk?: boolean;
+  validateDnssec?: boolean;
+  trustAnchors?: string[];
+  trace?: boolean;
+  clientSubnet?: string;
+  requestNsid?: boolean;
+  zoneCheck?: boolean;
+  recordName?: string;
 };
 
+export type DNSSECStatus = "secure" | "insecure" | "bogus" | "indeterminate";
+
 export type DNSResponse = {
   corrId?: string;
   server?: string;
@@ -40,6 +79,126 @@ export type DNSResponse = {
   // in the unit of nanoseconds
   timeout_specified?: number;
   transport_used?: DNSTransport;
+  rcode?: string;
+  flags?: { aa: boolean; tc: boolean; ad: boolean; ra: boolean };
+  edns_bufsize?: number;
+  dnssec?: { status: DNSSECStatus; reason?: string; chain?: string[] };
+  // handshake_time is in the unit of nanoseconds
+  quic?: { handshake_time: number; used_0rtt: boolean };
+  ecs?: { subnet: string; scope_prefix_length: number };
+  nsid?: string;
+  min_ttl?: number;
+  // only available when the server is given by hostname, in the unit of nanoseconds
+  bootstrap_time?: number;
+  bootstrap_addr?: string;
+};
+
+export type DNSDivergenceFlag =
+  | "bogon"
+  | "private"
+  | "different_asn"
+  | "nxdomain"
+  | "low_ttl";
+
+// emitted by the hub at the end of the stream when dnsDivergence is requested
+export type DNSDivergenceReport = {
+  corrId?: string;
+  server: string;
+  target: string;
+  query_type: DNSQueryType;
+  num_agents: number;
+  divergent: boolean;
+  clusters: {
+    rcode: string;
+    answers: string[];
+    asns?: string[];
+    agents: string[];
+  }[];
+  ipinfo?: {
+    ip: string;
+    asn?: string;
+    org?: string;
+    bogon?: boolean;
+    private?: boolean;
+  }[];
+  outliers?: { agent: string; flags: DNSDivergenceFlag[]; reasons: string[] }[];
+};
+
+export type DNSDivergenceSummary = {
+  dnsDivergence: DNSDivergenceReport[];
+};
+
+export type DNSTraceOutcome =
+  | "referral"
+  | "answer"
+  | "cname"
+  | "nxdomain"
+  | "nodata"
+  | "lame"
+  | "error"
+  | "failed";
+
+// emitted for each server queried when the target is in trace mode
+export type DNSTraceStep = {
+  corrId?: string;
+  step: number;
+  target: string;
+  query_type: DNSQueryType;
+  zone: string;
+  server_name?: string;
+  server?: string;
+  glue_used: boolean;
+  outcome: DNSTraceOutcome;
+  rcode?: string;
+  flags?: { aa: boolean; tc: boolean; ad: boolean; ra: boolean };
+  // in the unit of nanoseconds
+  rtt?: number;
+  referral?: { zone: string; name_servers: string[]; glue?: string[] };
+  answer_strings?: string[];
+  reason?: string;
+  err_string?: string;
+  io_timeout?: boolean;
+  started_at: ISO8601Timestamp;
+};
+
+export type ZoneServerStatus = "ok" | "unreachable" | "lame" | "no_address";
+
+export type ZoneServerResult = {
+  server_name: string;
+  server?: string;
+  family: "ip4" | "ip6";
+  status: ZoneServerStatus;
+  reason?: string;
+  rcode?: string;
+  aa: boolean;
+  // in the unit of nanoseconds
+  rtt?: number;
+  serial?: number;
+  edns: boolean;
+  tcp: boolean;
+  record_rcode?: string;
+  answer_strings?: string[];
+};
+
+// emitted once per target when the target is in zone check mode
+export type ZoneCheckReport = {
+  corrId?: string;
+  zone: string;
+  name: string;
+  query_type: DNSQueryType;
+  name_servers: string[];
+  servers: ZoneServerResult[];
+  serials?: number[];
+  serial_mismatch: boolean;
+  answer_mismatch: boolean;
+  unreachable?: string[];
+  lame?: string[];
+  no_edns?: string[];
+  no_tcp?: string[];
+  err_string?: string;
+  started_at: ISO8601Timestamp;
+  // in the unit of nanoseconds
+  elapsed?: number;
 };
 
 // a map of 'from' -> 'corrId' -> 'DNSResponse'
@@ -62,6 +221,7 @@ function stripResolver(resolver: string): string {
   }
 
   striped = striped.replace(/^tls:\/\//i, "");
+  striped = striped.replace(/^quic:\/\//i, "");
   striped = striped.replace(/:\d+$/, "");
   striped = striped.replace(/\]$/, "");
   striped = striped.replace(/^\[/, "");
@@ -102,6 +262,7 @@ export function expandDNSProbePlan(
         queryType: plan.type ?? "a",
         dotServerName:
           plan.transport === "tls" ||
+          plan.transport === "quic" ||
           plan.transport === "http/2" ||
           plan.transport === "http/3"
             ? getServerName(resolver, nameMap)
@@ -126,13 +287,34 @@ export const defaultHTTPProto: HTTPProto = "http/1.1";
 export type IPPref = "ip4" | "ip6" | "ip";
 export const defaultIPPref: IPPref = "ip6";
 
+export type HTTPAssertions = {
+  // e.g. "200", "2xx", "200-299"
+  statusCodes?: string[];
+  headers?: Record<string, string>;
+  bodyContains?: string;
+  bodyRegex?: string;
+  maxTotalTimeMs?: number;
+};
+
 export interface HTTPTarget {
   url: string;
   correlationId: string;
   extraHeaders?: Record<string, string>;
+  // GET, HEAD, POST, PUT, PATCH, DELETE or OPTIONS, default is GET
+  method?: string;
+  // at most one of body and bodyBase64 could be present
+  body?: string;
+  bodyBase64?: string;
   proto?: HTTPProto;
   resolver?: string;
   inetFamilyPreference?: IPPref;
+  assertions?: HTTPAssertions;
+  // default is 10, 0 means not following any redirect
+  maxRedirects?: number;
+  // fetch over each of http/1.1, http/2 and http/3 and compare them
+  compareProtos?: boolean;
+  // emit a content digest at the end of the probe, set by the hub when httpDivergence is requested
+  bodyDigest?: boolean;
 }
 
 export enum RouteQueryType {
@@ -261,9 +443,174 @@ export type HTTPProbeTransportEvent = {
   Date: ISO8601Timestamp;
 };
 
+export type HTTPTimingPhaseName =
+  | "dns-lookup"
+  | "connect"
+  | "tls-handshake"
+  | "request"
+  | "waiting"
+  | "content-transfer";
+
+// durations are in nanoseconds
+export type HTTPTimingPhase = {
+  name: HTTPTimingPhaseName;
+  offset: number;
+  duration: number;
+};
+
+export type HTTPTiming = {
+  started_at: ISO8601Timestamp;
+  dns_lookup?: number;
+  connect?: number;
+  tls_handshake?: number;
+  ttfb?: number;
+  content_transfer?: number;
+  total: number;
+  conn_reused: boolean;
+  conn_was_idle?: boolean;
+  conn_idle_time?: number;
+  remote_addr?: string;
+  local_addr?: string;
+  tls_version?: string;
+  phases: HTTPTimingPhase[];
+};
+
+export type OCSPStatus =
+  | "not_stapled"
+  | "good"
+  | "revoked"
+  | "unknown"
+  | "invalid";
+
+export type TLSCertificate = {
+  subject: string;
+  sans?: string[];
+  issuer: string;
+  serial_number: string;
+  not_before: ISO8601Timestamp;
+  not_after: ISO8601Timestamp;
+  key_type: string;
+  is_ca: boolean;
+  sha256_fingerprint: string;
+};
+
+export type TLSInspection = {
+  server_name?: string;
+  version: string;
+  cipher_suite: string;
+  alpn?: string;
+  resumed: boolean;
+  ocsp_status: OCSPStatus;
+  ocsp_produced_at?: ISO8601Timestamp;
+  verified: boolean;
+  verify_error?: string;
+  days_until_expiry: number;
+  leaf_sha256?: string;
+  peer_certificates: TLSCertificate[];
+};
+
+export type HTTPRedirectHop = {
+  url: string;
+  status_code: number;
+  location?: string;
+  remote_addr?: string;
+  downgrade?: boolean;
+  timing: HTTPTiming;
+};
+
+export type HTTPRedirectChain = {
+  hops: HTTPRedirectHop[];
+  num_redirects: number;
+  final_url: string;
+  loop: boolean;
+  downgrade: boolean;
+  max_redirects_reached: boolean;
+};
+
+export type AltSvcEntry = {
+  protocol_id: string;
+  authority: string;
+};
+
+export type HTTPProtoResult = {
+  proto: HTTPProto;
+  ok: boolean;
+  error?: string;
+  response_proto?: string;
+  alpn?: string;
+  status_code?: number;
+  timing: HTTPTiming;
+};
+
+export type HTTPProtoComparison = {
+  results: HTTPProtoResult[];
+  alt_svc?: AltSvcEntry[];
+  h3_advertised: boolean;
+  h3_authority?: string;
+  h3_unreachable: boolean;
+  browser_proto?: HTTPProto;
+};
+
+export type HTTPVerdict = {
+  passed: boolean;
+  reasons?: string[];
+};
+
+export type HTTPContentDigest = {
+  url: string;
+  status_code?: number;
+  final_url?: string;
+  header?: Record<string, string[]>;
+  body_sha256: string;
+  body_size: number;
+  body_truncated?: boolean;
+  simhash: string;
+  error?: string;
+};
+
+export type HTTPContentCluster = {
+  status_code?: number;
+  final_url?: string;
+  body_sha256?: string;
+  body_size: number;
+  error?: string;
+  agents: string[];
+};
+
+export type HTTPHeaderDifference = {
+  name: string;
+  value?: string[];
+  majority?: string[];
+};
+
+// emitted by the hub at the end of the stream when httpDivergence is requested
+export type HTTPDivergenceReport = {
+  corrId?: string;
+  url: string;
+  num_agents: number;
+  divergent: boolean;
+  clusters: HTTPContentCluster[];
+  outliers?: {
+    agent: string;
+    similarity: number;
+    reasons: string[];
+    differing_headers?: HTTPHeaderDifference[];
+  }[];
+};
+
+export type HTTPDivergenceSummary = {
+  httpDivergence: HTTPDivergenceReport[];
+};
+
 export type HTTPProbeEvent = {
   transport?: HTTPProbeTransportEvent | null;
   error?: string | null;
+  tls?: TLSInspection | null;
+  redirects?: HTTPRedirectChain | null;
+  timing?: HTTPTiming | null;
+  verdict?: HTTPVerdict | null;
+  protoComparison?: HTTPProtoComparison | null;
+  content?: HTTPContentDigest | null;
   correlationId?: string | null;
 };
 
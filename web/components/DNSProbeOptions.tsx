@@ -41,6 +41,7 @@ export function DNSProbeTransportSelect(props: {
         <FormControlLabel control={<Radio />} value="tls" label="TLS" />
         <FormControlLabel control={<Radio />} value="http/2" label="HTTP/2" />
         <FormControlLabel control={<Radio />} value="http/3" label="HTTP/3" />
+        <FormControlLabel control={<Radio />} value="quic" label="QUIC" />
       </RadioGroup>
     </FormControl>
   );
@@ -75,6 +76,19 @@ export function DNSProbeTaskPanel(props: {
           <MenuItem value={"ns"}>NS</MenuItem>
           <MenuItem value={"ptr"}>PTR</MenuItem>
           <MenuItem value={"txt"}>TXT</MenuItem>
+          <MenuItem value={"soa"}>SOA</MenuItem>
+          <MenuItem value={"srv"}>SRV</MenuItem>
+          <MenuItem value={"caa"}>CAA</MenuItem>
+          <MenuItem value={"ds"}>DS</MenuItem>
+          <MenuItem value={"dnskey"}>DNSKEY</MenuItem>
+          <MenuItem value={"rrsig"}>RRSIG</MenuItem>
+          <MenuItem value={"https"}>HTTPS</MenuItem>
+          <MenuItem value={"svcb"}>SVCB</MenuItem>
+          <MenuItem value={"naptr"}>NAPTR</MenuItem>
+          <MenuItem value={"sshfp"}>SSHFP</MenuItem>
+          <MenuItem value={"tlsa"}>TLSA</MenuItem>
+          <MenuItem value={"id.server"}>CHAOS TXT id.server</MenuItem>
+          <MenuItem value={"hostname.bind"}>CHAOS TXT hostname.bind</MenuItem>
         </Select>
       </FormControl>
       <TextField
@@ -95,6 +109,7 @@ export function DNSProbeTaskPanel(props: {
         }
       />
       {(pendingTask.dnsProbePlan?.transport === "tls" ||
+        pendingTask.dnsProbePlan?.transport === "quic" ||
         pendingTask.dnsProbePlan?.transport === "http/2" ||
         pendingTask.dnsProbePlan?.transport === "http/3") && (
         <TextField